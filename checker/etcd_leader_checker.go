@@ -42,10 +42,16 @@ func NewEtcdLeaderChecker(conf *vipconfig.Config) (*EtcdLeaderChecker, error) {
 }
 
 func getTransport(conf *vipconfig.Config) (*tls.Config, error) {
+	return newTLSConfig(conf.EtcdCAFile, conf.EtcdCertFile, conf.EtcdKeyFile)
+}
+
+// newTLSConfig returns the client TLS config for the given files, each of
+// them optional. The client certificate is only used along with a CA file.
+func newTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
 	var caCertPool *x509.CertPool
 	// create valid CertPool only if the ca certificate file exists
-	if conf.EtcdCAFile != "" {
-		caCert, err := os.ReadFile(conf.EtcdCAFile)
+	if caFile != "" {
+		caCert, err := os.ReadFile(caFile)
 		if err != nil {
 			return nil, fmt.Errorf("cannot load CA file: %s", err)
 		}
@@ -55,8 +61,8 @@ func getTransport(conf *vipconfig.Config) (*tls.Config, error) {
 	}
 	var certificates []tls.Certificate
 	// create valid []Certificate only if the client cert and key files exists
-	if conf.EtcdCertFile != "" && conf.EtcdKeyFile != "" {
-		cert, err := tls.LoadX509KeyPair(conf.EtcdCertFile, conf.EtcdKeyFile)
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 		if err != nil {
 			return nil, fmt.Errorf("cannot load client cert or key file: %s", err)
 		}
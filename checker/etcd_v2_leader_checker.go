@@ -0,0 +1,245 @@
+package checker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+	"go.uber.org/zap"
+)
+
+const (
+	// etcdV2WatchTimeout limits a single long poll, it is sent again with
+	// the same waitIndex afterwards. An unreachable etcd is only noticed
+	// then, as nothing is sent over the connection while waiting.
+	etcdV2WatchTimeout = 10 * time.Second
+
+	// error codes of the etcd v2 API
+	etcdV2ErrorKeyNotFound       = 100
+	etcdV2ErrorEventIndexCleared = 401
+)
+
+// errEtcdV2IndexCleared is returned when the waitIndex of a watch is older
+// than the history etcd keeps, the key has to be read again then
+var errEtcdV2IndexCleared = errors.New("the event in the requested index is outdated and cleared")
+
+// errEtcdV2Unavailable is returned when the keys API isn't served at all.
+// It is disabled by default since etcd 3.4 and removed in 3.6, retrying
+// won't help then.
+var errEtcdV2Unavailable = errors.New("the v2 API of etcd is not available, use dcs-type etcd3 if Patroni uses its etcd3 section")
+
+// EtcdV2LeaderChecker is used to check state of the leader key through the
+// v2 keys API of etcd, which Patroni uses with its `etcd:` section. Keys
+// written through it are invisible to the v3 API and vice versa.
+type EtcdV2LeaderChecker struct {
+	*vipconfig.Config
+	*http.Client
+	// endpoint is the index of the endpoint in use, we move on to the next
+	// one after a failure
+	endpoint int
+}
+
+// etcdV2Response is the response of the keys API for reads, watches and
+// errors alike
+type etcdV2Response struct {
+	Action string `json:"action"`
+	Node   *struct {
+		Value         string `json:"value"`
+		ModifiedIndex uint64 `json:"modifiedIndex"`
+	} `json:"node"`
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
+	Index     uint64 `json:"index"`
+}
+
+// NewEtcdV2LeaderChecker returns a new instance
+func NewEtcdV2LeaderChecker(conf *vipconfig.Config) (*EtcdV2LeaderChecker, error) {
+	if len(conf.Endpoints) == 0 {
+		return nil, errors.New("no etcd endpoints given")
+	}
+	tlsConfig, err := getTransport(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TLS transport for etcd: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &EtcdV2LeaderChecker{
+		Config: conf,
+		Client: &http.Client{Transport: transport},
+	}, nil
+}
+
+// request sends a GET for the trigger-key with query to the current
+// endpoint and decodes the response. The X-Etcd-Index header is returned
+// along with it, it is the index to watch from after a read.
+func (e *EtcdV2LeaderChecker) request(ctx context.Context, query url.Values) (*etcdV2Response, uint64, error) {
+	endpoint := strings.TrimRight(e.Endpoints[e.endpoint], "/")
+	key := "/" + strings.TrimLeft(e.TriggerKey, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/v2/keys"+key+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if e.EtcdUser != "" {
+		req.SetBasicAuth(e.EtcdUser, e.EtcdPassword)
+	}
+	resp, err := e.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Etcd-Index"), 10, 64)
+	var r etcdV2Response
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		// etcd ends a watch without an event when it shuts down
+		if errors.Is(err, io.EOF) && resp.StatusCode == http.StatusOK {
+			return nil, index, nil
+		}
+		// errors of the keys API are JSON as well, anything else means
+		// the API doesn't exist
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, index, errEtcdV2Unavailable
+		}
+		return nil, index, fmt.Errorf("failed to decode response with status %d: %w", resp.StatusCode, err)
+	}
+	switch {
+	case r.ErrorCode == etcdV2ErrorEventIndexCleared:
+		return nil, index, errEtcdV2IndexCleared
+	case r.ErrorCode == etcdV2ErrorKeyNotFound && query.Get("wait") == "":
+		return &r, max(index, r.Index), nil
+	case r.ErrorCode != 0 || resp.StatusCode != http.StatusOK:
+		return nil, index, fmt.Errorf("etcd returned status %d: %d %s", resp.StatusCode, r.ErrorCode, r.Message)
+	}
+	return &r, index, nil
+}
+
+// isLeader compares the value after the action of r with the trigger-value
+func (e *EtcdV2LeaderChecker) isLeader(r *etcdV2Response) bool {
+	switch r.Action {
+	case "delete", "expire", "compareAndDelete":
+		e.Logger.Sugar().Info("Key ", e.TriggerKey, " was removed by ", r.Action)
+		return false
+	}
+	if r.Node == nil {
+		e.Logger.Sugar().Info("No value found for key ", e.TriggerKey, " - DCS may not have set it yet")
+		return false
+	}
+	e.Logger.Sugar().Info("Current value from DCS: ", r.Node.Value)
+	return r.Node.Value == e.TriggerValue
+}
+
+// get gets the current value and the index to watch from
+func (e *EtcdV2LeaderChecker) get(ctx context.Context) (bool, uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(max(e.Interval, 1000))*time.Millisecond)
+	defer cancel()
+	// quorum makes sure the value isn't stale, even if this member is
+	// partitioned from the rest of the cluster
+	r, index, err := e.request(ctx, url.Values{"quorum": {"true"}})
+	if err != nil {
+		return false, 0, err
+	}
+	if r.ErrorCode == etcdV2ErrorKeyNotFound {
+		r.Node = nil
+	}
+	return e.isLeader(r), index, nil
+}
+
+// watch waits for the next change of the key at or after waitIndex. It
+// returns nil without an error if there was none within etcdV2WatchTimeout.
+func (e *EtcdV2LeaderChecker) watch(ctx context.Context, waitIndex uint64) (*etcdV2Response, error) {
+	watchCtx, cancel := context.WithTimeout(ctx, etcdV2WatchTimeout)
+	defer cancel()
+	r, _, err := e.request(watchCtx, url.Values{
+		"wait":      {"true"},
+		"waitIndex": {strconv.FormatUint(waitIndex, 10)},
+	})
+	if err != nil && ctx.Err() == nil && watchCtx.Err() != nil {
+		return nil, nil
+	}
+	return r, err
+}
+
+// GetChangeNotificationStream monitors the leader in etcd. The key is read
+// once and then watched with long polls, each one continuing after the
+// index of the last change seen, so no change is missed in between.
+func (e *EtcdV2LeaderChecker) GetChangeNotificationStream(ctx context.Context, out chan<- bool) error {
+	// send guards the channel send with ctx to avoid blocking on shutdown
+	send := func(state bool) bool {
+		select {
+		case out <- state:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	// fail reports the error and moves on to the next endpoint, backing
+	// off briefly to avoid a busy loop when etcd is unreachable
+	fail := func(msg string, err error) bool {
+		e.Logger.Error(msg,
+			zap.String("key", e.TriggerKey),
+			zap.String("endpoint", e.Endpoints[e.endpoint]),
+			zap.Error(err))
+		e.endpoint = (e.endpoint + 1) % len(e.Endpoints)
+		if !send(false) {
+			return false
+		}
+		select {
+		case <-time.After(time.Second):
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	e.Logger.Sugar().Info("Setting WATCH on ", e.TriggerKey)
+	for ctx.Err() == nil {
+		state, index, err := e.get(ctx)
+		if errors.Is(err, errEtcdV2Unavailable) {
+			return fmt.Errorf("%s: %w", e.Endpoints[e.endpoint], err)
+		}
+		if err != nil {
+			if ctx.Err() != nil || !fail("Failed to get value from etcd", err) {
+				break
+			}
+			continue
+		}
+		if !send(state) {
+			break
+		}
+		waitIndex := index + 1
+		for {
+			r, err := e.watch(ctx, waitIndex)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, errEtcdV2IndexCleared) {
+				e.Logger.Sugar().Info("Watch index of ", e.TriggerKey, " was cleared, getting it again")
+				break
+			}
+			if err != nil {
+				// the key is read again afterwards, changes may have been missed
+				if !fail("WATCH on key lost, re-establishing and re-syncing state", err) {
+					return ctx.Err()
+				}
+				break
+			}
+			if r == nil {
+				continue
+			}
+			if r.Node != nil {
+				waitIndex = r.Node.ModifiedIndex + 1
+			}
+			if !send(e.isLeader(r)) {
+				return ctx.Err()
+			}
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,324 @@
+package checker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+	"go.uber.org/zap"
+)
+
+const etcdV2TestKey = "/service/pgcluster/leader"
+
+// etcdV2Event is a change of the key kept in the history of fakeEtcdV2
+type etcdV2Event struct {
+	action string
+	value  *string
+	index  uint64
+}
+
+// fakeEtcdV2 is a stand-in for the v2 keys API of etcd serving a single key
+type fakeEtcdV2 struct {
+	*httptest.Server
+	mu    sync.Mutex
+	index uint64
+	value *string
+	// modified is the index of the last change of value
+	modified uint64
+	history  []etcdV2Event
+	// cleared is the first index still in the history
+	cleared uint64
+	// changed is closed and replaced on every change to wake up watches
+	changed chan struct{}
+	// dropped is closed and replaced to end the watches without an event
+	dropped chan struct{}
+	// paused holds back the answers to watches
+	paused     bool
+	user, pass string
+	gets       int
+}
+
+func newFakeEtcdV2(t *testing.T) *fakeEtcdV2 {
+	t.Helper()
+	e := &fakeEtcdV2{
+		index:   1,
+		cleared: 1,
+		changed: make(chan struct{}),
+		dropped: make(chan struct{}),
+	}
+	e.Server = httptest.NewServer(http.HandlerFunc(e.serve))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func writeEtcdV2Error(w http.ResponseWriter, status, code int, index uint64) {
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(index, 10))
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"errorCode": code, "message": http.StatusText(status), "index": index})
+}
+
+func writeEtcdV2Node(w http.ResponseWriter, action string, value *string, modifiedIndex, index uint64) {
+	node := map[string]any{"key": etcdV2TestKey, "modifiedIndex": modifiedIndex}
+	if value != nil {
+		node["value"] = *value
+	}
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(index, 10))
+	_ = json.NewEncoder(w).Encode(map[string]any{"action": action, "node": node})
+}
+
+func (e *fakeEtcdV2) serve(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	if user, pass, _ := r.BasicAuth(); e.user != "" && (user != e.user || pass != e.pass) {
+		e.mu.Unlock()
+		writeEtcdV2Error(w, http.StatusUnauthorized, 110, 0)
+		return
+	}
+	if r.URL.Path != "/v2/keys"+etcdV2TestKey {
+		e.mu.Unlock()
+		writeEtcdV2Error(w, http.StatusNotFound, 100, e.index)
+		return
+	}
+	if r.URL.Query().Get("wait") != "true" {
+		e.gets++
+		defer e.mu.Unlock()
+		if e.value == nil {
+			writeEtcdV2Error(w, http.StatusNotFound, 100, e.index)
+			return
+		}
+		writeEtcdV2Node(w, "get", e.value, e.modified, e.index)
+		return
+	}
+
+	waitIndex, _ := strconv.ParseUint(r.URL.Query().Get("waitIndex"), 10, 64)
+	for {
+		if !e.paused {
+			if waitIndex < e.cleared {
+				defer e.mu.Unlock()
+				writeEtcdV2Error(w, http.StatusBadRequest, 401, e.index)
+				return
+			}
+			for _, ev := range e.history {
+				if ev.index >= waitIndex {
+					defer e.mu.Unlock()
+					writeEtcdV2Node(w, ev.action, ev.value, ev.index, e.index)
+					return
+				}
+			}
+		}
+		changed, dropped := e.changed, e.dropped
+		e.mu.Unlock()
+		select {
+		case <-changed:
+		case <-dropped:
+			// etcd sends the header right away, the body stays empty
+			w.Header().Set("X-Etcd-Index", strconv.FormatUint(waitIndex-1, 10))
+			w.WriteHeader(http.StatusOK)
+			return
+		case <-r.Context().Done():
+			return
+		}
+		e.mu.Lock()
+	}
+}
+
+// notify wakes up the watches, the caller holds mu
+func (e *fakeEtcdV2) notify() {
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+func (e *fakeEtcdV2) change(action string, value *string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.index++
+	e.value = value
+	e.modified = e.index
+	e.history = append(e.history, etcdV2Event{action: action, value: value, index: e.index})
+	e.notify()
+}
+
+func (e *fakeEtcdV2) set(value string) { e.change("set", &value) }
+func (e *fakeEtcdV2) delete()          { e.change("delete", nil) }
+func (e *fakeEtcdV2) expire()          { e.change("expire", nil) }
+
+// compact clears the history up to the current index
+func (e *fakeEtcdV2) compact() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cleared = e.index + 1
+	e.history = e.history[len(e.history):]
+	e.notify()
+}
+
+func (e *fakeEtcdV2) pause(paused bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.paused = paused
+	e.notify()
+}
+
+// dropWatches ends the open watches without an event
+func (e *fakeEtcdV2) dropWatches() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	close(e.dropped)
+	e.dropped = make(chan struct{})
+}
+
+func (e *fakeEtcdV2) getCount() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.gets
+}
+
+func etcdV2Config(endpoints ...string) *vipconfig.Config {
+	return &vipconfig.Config{
+		EndpointType: "etcd",
+		Endpoints:    endpoints,
+		TriggerKey:   etcdV2TestKey,
+		TriggerValue: "pg1",
+		Interval:     1000,
+		Logger:       zap.NewNop(),
+	}
+}
+
+// ---------------------------------------------------------------------------
+// NewEtcdV2LeaderChecker
+// ---------------------------------------------------------------------------
+
+func TestNewEtcdV2LeaderChecker_TLSError(t *testing.T) {
+	t.Parallel()
+	conf := etcdV2Config("https://127.0.0.1:2379")
+	conf.EtcdCAFile = "/nonexistent/ca.crt"
+	if _, err := NewEtcdV2LeaderChecker(conf); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestNewEtcdV2LeaderChecker_NoEndpoints(t *testing.T) {
+	t.Parallel()
+	if _, err := NewEtcdV2LeaderChecker(etcdV2Config()); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// GetChangeNotificationStream
+// ---------------------------------------------------------------------------
+
+func TestEtcdV2LeaderChecker_FollowsKey(t *testing.T) {
+	t.Parallel()
+	e := newFakeEtcdV2(t)
+	out := startLeaderChecker(t, etcdV2Config(e.URL))
+
+	expectState(t, out, false) // key absent
+	e.set("pg1")
+	expectState(t, out, true)
+	e.set("pg2")
+	expectState(t, out, false)
+	e.set("pg1")
+	expectState(t, out, true)
+	e.delete()
+	expectState(t, out, false)
+	e.set("pg1")
+	expectState(t, out, true)
+	e.expire()
+	expectState(t, out, false)
+
+	if gets := e.getCount(); gets != 1 {
+		t.Errorf("expected the key to be read once, got %d", gets)
+	}
+}
+
+func TestEtcdV2LeaderChecker_ResumesDroppedWatch(t *testing.T) {
+	t.Parallel()
+	e := newFakeEtcdV2(t)
+	e.set("pg1")
+	out := startLeaderChecker(t, etcdV2Config(e.URL))
+
+	expectState(t, out, true)
+	e.dropWatches()
+	e.set("pg2")
+	expectState(t, out, false)
+	e.dropWatches()
+	e.set("pg1")
+	expectState(t, out, true)
+
+	if gets := e.getCount(); gets != 1 {
+		t.Errorf("expected the watch to be resumed without reading the key, got %d reads", gets)
+	}
+}
+
+func TestEtcdV2LeaderChecker_IndexCleared(t *testing.T) {
+	t.Parallel()
+	e := newFakeEtcdV2(t)
+	e.set("pg1")
+	out := startLeaderChecker(t, etcdV2Config(e.URL))
+	expectState(t, out, true)
+
+	// the change happens while the watch is behind, its index is gone
+	e.pause(true)
+	e.set("pg2")
+	e.compact()
+	e.pause(false)
+	expectState(t, out, false)
+
+	if gets := e.getCount(); gets != 2 {
+		t.Errorf("expected the key to be read again, got %d reads", gets)
+	}
+	e.set("pg1")
+	expectState(t, out, true)
+}
+
+func TestEtcdV2LeaderChecker_Failover(t *testing.T) {
+	t.Parallel()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	e := newFakeEtcdV2(t)
+	e.set("pg1")
+	out := startLeaderChecker(t, etcdV2Config(down.URL, e.URL))
+
+	expectState(t, out, false)
+	expectState(t, out, true)
+}
+
+func TestEtcdV2LeaderChecker_BasicAuth(t *testing.T) {
+	t.Parallel()
+	e := newFakeEtcdV2(t)
+	e.user, e.pass = "patroni", "secret"
+	e.set("pg1")
+
+	conf := etcdV2Config(e.URL)
+	conf.EtcdUser, conf.EtcdPassword = "patroni", "secret"
+	expectState(t, startLeaderChecker(t, conf), true)
+
+	conf = etcdV2Config(e.URL)
+	conf.EtcdUser, conf.EtcdPassword = "patroni", "wrong"
+	expectState(t, startLeaderChecker(t, conf), false)
+}
+
+// TestEtcdV2LeaderChecker_Unavailable covers etcd 3.4 and later, which don't
+// serve the v2 API unless enabled and answer with a plain 404
+func TestEtcdV2LeaderChecker_Unavailable(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(srv.Close)
+	elc, err := NewEtcdV2LeaderChecker(etcdV2Config(srv.URL))
+	if err != nil {
+		t.Fatalf("NewEtcdV2LeaderChecker() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = elc.GetChangeNotificationStream(ctx, make(chan bool))
+	if !errors.Is(err, errEtcdV2Unavailable) {
+		t.Errorf("GetChangeNotificationStream() error = %v, want %v", err, errEtcdV2Unavailable)
+	}
+}
@@ -0,0 +1,63 @@
+package checker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// startLeaderChecker runs the checker for conf until the test ends
+func startLeaderChecker(t *testing.T, conf *vipconfig.Config) <-chan bool {
+	t.Helper()
+	lc, err := NewLeaderChecker(conf)
+	if err != nil {
+		t.Fatalf("NewLeaderChecker() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan bool)
+	done := make(chan error, 1)
+	go func() { done <- lc.GetChangeNotificationStream(ctx, out) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return out
+}
+
+// expectState fails unless the next state reported is want
+func expectState(t *testing.T, out <-chan bool, want bool) {
+	t.Helper()
+	select {
+	case got := <-out:
+		if got != want {
+			t.Fatalf("got state %v, want %v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for state %v", want)
+	}
+}
+
+// waitForState skips the states reported until want
+func waitForState(t *testing.T, out <-chan bool, want bool) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case got := <-out:
+			if got == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for state %v", want)
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
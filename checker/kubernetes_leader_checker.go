@@ -0,0 +1,289 @@
+package checker
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/kubernetes"
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+	"go.uber.org/zap"
+)
+
+const (
+	// kubernetesLeaderAnnotation is where Patroni stores the name of the leader
+	kubernetesLeaderAnnotation = "leader"
+	// kubernetesWatchTimeout is how long the API server keeps a watch open,
+	// after which it is resumed from the last resourceVersion
+	kubernetesWatchTimeout = 5 * time.Minute
+	// kubernetesRequestTimeout limits the requests other than the watch
+	kubernetesRequestTimeout = 10 * time.Second
+)
+
+// errKubernetesGone is returned when the resourceVersion to resume the
+// watch from is too old, the object has to be listed again then
+var errKubernetesGone = errors.New("resourceVersion is too old")
+
+// KubernetesLeaderChecker watches the leader annotation Patroni sets on an
+// Endpoints or ConfigMap object when it uses Kubernetes as its DCS.
+// --trigger-key is the object, e.g. configmaps/pgcluster-leader or
+// endpoints/pgcluster.
+type KubernetesLeaderChecker struct {
+	*vipconfig.Config
+	*http.Client
+	kube *kubernetes.Config
+	// path is the collection of the object, restricted to the object
+	path string
+}
+
+// kubernetesObject is the part of Endpoints and ConfigMaps we look at
+type kubernetesObject struct {
+	Metadata struct {
+		ResourceVersion string            `json:"resourceVersion"`
+		Annotations     map[string]string `json:"annotations"`
+	} `json:"metadata"`
+}
+
+type kubernetesList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []kubernetesObject `json:"items"`
+}
+
+// kubernetesWatchEvent is a line of a watch, Object is a Status for ERROR
+type kubernetesWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type kubernetesStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewKubernetesLeaderChecker returns a new instance
+func NewKubernetesLeaderChecker(conf *vipconfig.Config) (*KubernetesLeaderChecker, error) {
+	resource, name, _ := strings.Cut(conf.TriggerKey, "/")
+	switch resource {
+	case "configmaps", "endpoints":
+	default:
+		return nil, fmt.Errorf("trigger-key must be configmaps/<name> or endpoints/<name> for dcs-type kubernetes, got %q", conf.TriggerKey)
+	}
+	if name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid object name in trigger-key %q", conf.TriggerKey)
+	}
+	kube, err := kubernetes.LoadConfig(conf.KubernetesKubeconfig, conf.KubernetesContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the Kubernetes credentials: %w", err)
+	}
+	transport := kube.Transport()
+	// a dead connection would leave the watch silent, ping to notice it
+	transport.HTTP2 = &http.HTTP2Config{
+		SendPingTimeout: 10 * time.Second,
+		PingTimeout:     5 * time.Second,
+	}
+	namespace := cmp.Or(conf.KubernetesNamespace, kube.Namespace, "default")
+	return &KubernetesLeaderChecker{
+		Config: conf,
+		Client: &http.Client{Transport: transport},
+		kube:   kube,
+		path: fmt.Sprintf("/api/v1/namespaces/%s/%s?fieldSelector=%s", url.PathEscape(namespace), resource,
+			url.QueryEscape("metadata.name="+name)),
+	}, nil
+}
+
+// request sends a GET for path to the API server, the caller has to close
+// the body of the response
+func (c *KubernetesLeaderChecker) request(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.kube.Server+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if err = c.kube.Authorize(req); err != nil {
+		return nil, fmt.Errorf("failed to authorize request: %w", err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			return nil, errKubernetesGone
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("API server returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// isLeader compares the leader annotation of obj with the trigger-value
+func (c *KubernetesLeaderChecker) isLeader(obj *kubernetesObject) bool {
+	value := obj.Metadata.Annotations[kubernetesLeaderAnnotation]
+	c.Logger.Sugar().Info("Current value from DCS: ", value)
+	return value == c.TriggerValue
+}
+
+// list gets the current state and the resourceVersion to watch from
+func (c *KubernetesLeaderChecker) list(ctx context.Context) (bool, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, kubernetesRequestTimeout)
+	defer cancel()
+	resp, err := c.request(ctx, c.path)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	var list kubernetesList
+	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return false, "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	if len(list.Items) == 0 {
+		c.Logger.Sugar().Info("No object found for key ", c.TriggerKey, " - DCS may not have set it yet")
+		return false, list.Metadata.ResourceVersion, nil
+	}
+	return c.isLeader(&list.Items[0]), list.Metadata.ResourceVersion, nil
+}
+
+// watch opens a watch for changes after resourceVersion
+func (c *KubernetesLeaderChecker) watch(ctx context.Context, resourceVersion string) (*http.Response, error) {
+	return c.request(ctx, fmt.Sprintf("%s&watch=1&allowWatchBookmarks=true&resourceVersion=%s&timeoutSeconds=%d",
+		c.path, url.QueryEscape(resourceVersion), int(kubernetesWatchTimeout.Seconds())))
+}
+
+// readEvents passes the state of every event of the watch to send and
+// returns the resourceVersion of the last one. The watch only ends with
+// a nil error when the API server closed it after kubernetesWatchTimeout.
+func (c *KubernetesLeaderChecker) readEvents(body io.Reader, resourceVersion string, send func(bool) bool) (string, error) {
+	decoder := json.NewDecoder(body)
+	for {
+		var event kubernetesWatchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				return resourceVersion, nil
+			}
+			return resourceVersion, err
+		}
+		if event.Type == "ERROR" {
+			var status kubernetesStatus
+			_ = json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return resourceVersion, errKubernetesGone
+			}
+			return resourceVersion, fmt.Errorf("watch failed with status %d: %s", status.Code, status.Message)
+		}
+		var obj kubernetesObject
+		if err := json.Unmarshal(event.Object, &obj); err != nil {
+			return resourceVersion, fmt.Errorf("failed to decode %s event: %w", event.Type, err)
+		}
+		resourceVersion = obj.Metadata.ResourceVersion
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			if !send(c.isLeader(&obj)) {
+				return resourceVersion, nil
+			}
+		case "DELETED":
+			c.Logger.Sugar().Info("Object of key ", c.TriggerKey, " was deleted")
+			if !send(false) {
+				return resourceVersion, nil
+			}
+		}
+	}
+}
+
+// GetChangeNotificationStream monitors the leader annotation. The object
+// is listed once and then watched, resuming the watch from the last
+// resourceVersion seen after it was closed or the connection was lost.
+func (c *KubernetesLeaderChecker) GetChangeNotificationStream(ctx context.Context, out chan<- bool) error {
+	// send guards the channel send with ctx to avoid blocking on shutdown
+	send := func(state bool) bool {
+		select {
+		case out <- state:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	// fail reports the error and backs off to avoid a busy loop while the
+	// API server is unreachable
+	fail := func(msg string, err error) bool {
+		c.Logger.Error(msg, zap.String("key", c.TriggerKey), zap.Error(err))
+		if !send(false) {
+			return false
+		}
+		select {
+		case <-time.After(time.Second):
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	var resourceVersion string
+	// leader is the state up to resourceVersion, reported again once the
+	// watch is resumed after a failure was reported
+	var leader, failed bool
+	c.Logger.Sugar().Info("Setting WATCH on ", c.TriggerKey)
+	for ctx.Err() == nil {
+		if resourceVersion == "" {
+			var err error
+			if leader, resourceVersion, err = c.list(ctx); err != nil {
+				if !fail("Failed to get object from Kubernetes", err) {
+					break
+				}
+				continue
+			}
+			failed = false
+			if !send(leader) {
+				break
+			}
+		}
+
+		resp, err := c.watch(ctx, resourceVersion)
+		if errors.Is(err, errKubernetesGone) {
+			c.Logger.Sugar().Info("Resource version of ", c.TriggerKey, " expired, getting it again")
+			resourceVersion = ""
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil && fail("Failed to watch object in Kubernetes", err) {
+				failed = true
+			}
+			continue
+		}
+		if failed {
+			failed = false
+			if !send(leader) {
+				resp.Body.Close()
+				break
+			}
+		}
+		resourceVersion, err = c.readEvents(resp.Body, resourceVersion, func(state bool) bool {
+			leader = state
+			return send(state)
+		})
+		resp.Body.Close()
+		switch {
+		case ctx.Err() != nil:
+		case errors.Is(err, errKubernetesGone):
+			c.Logger.Sugar().Info("Resource version of ", c.TriggerKey, " expired, getting it again")
+			resourceVersion = ""
+		case err != nil:
+			c.Logger.Warn("WATCH on key lost, resuming", zap.String("key", c.TriggerKey), zap.Error(err))
+			// Back off briefly in case the API server is going away
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+		}
+	}
+	return ctx.Err()
+}
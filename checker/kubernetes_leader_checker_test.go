@@ -0,0 +1,353 @@
+package checker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/kubernetes/kubetest"
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+	"go.uber.org/zap"
+)
+
+const (
+	testKubernetesToken      = "test-token"
+	testKubernetesCollection = "/api/v1/namespaces/db/configmaps"
+	testKubernetesName       = "pgcluster-leader"
+)
+
+type fakeKubernetesEvent struct {
+	Type   string `json:"type"`
+	Object any    `json:"object"`
+}
+
+// fakeKubernetes is a stand-in for the API server serving the list and
+// watch of a single ConfigMap, keeping the history of its changes for
+// watches resuming from an older resourceVersion
+type fakeKubernetes struct {
+	*httptest.Server
+	mu      sync.Mutex
+	version int
+	// object is nil as long as the ConfigMap doesn't exist
+	object map[string]any
+	// history holds the events after compacted, by resourceVersion
+	history   map[int]fakeKubernetesEvent
+	compacted int
+	// changed is closed and replaced with every change
+	changed chan struct{}
+	// closeWatches is closed and replaced to end the open watches
+	closeWatches chan struct{}
+	unavailable  bool
+	lists        int
+	watches      []string // resourceVersions of the watch requests
+}
+
+func newFakeKubernetes(t *testing.T) *fakeKubernetes {
+	t.Helper()
+	f := &fakeKubernetes{
+		version:      1,
+		history:      map[int]fakeKubernetesEvent{},
+		changed:      make(chan struct{}),
+		closeWatches: make(chan struct{}),
+	}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(f.handle))
+	t.Cleanup(func() {
+		f.dropWatches()
+		f.Close()
+	})
+	return f
+}
+
+// update records a change, f.mu must be held
+func (f *fakeKubernetes) update(typ string, object map[string]any) {
+	f.version++
+	object["metadata"].(map[string]any)["resourceVersion"] = strconv.Itoa(f.version)
+	f.history[f.version] = fakeKubernetesEvent{typ, object}
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// setLeader sets the leader annotation, creating the ConfigMap if needed
+func (f *fakeKubernetes) setLeader(leader string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	typ := "MODIFIED"
+	if f.object == nil {
+		typ = "ADDED"
+	}
+	f.object = map[string]any{"metadata": map[string]any{
+		"name":        testKubernetesName,
+		"namespace":   "db",
+		"annotations": map[string]any{"leader": leader, "optime": "67108960"},
+	}}
+	f.update(typ, f.object)
+}
+
+func (f *fakeKubernetes) delete() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object := f.object
+	f.object = nil
+	f.update("DELETED", object)
+}
+
+// compact forgets the history, watches from before get 410 Gone
+func (f *fakeKubernetes) compact() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.compacted = f.version
+	f.history = map[int]fakeKubernetesEvent{}
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// dropWatches ends the open watches
+func (f *fakeKubernetes) dropWatches() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	close(f.closeWatches)
+	f.closeWatches = make(chan struct{})
+}
+
+func (f *fakeKubernetes) setUnavailable(unavailable bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unavailable = unavailable
+}
+
+func (f *fakeKubernetes) requests() (int, []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lists, append([]string(nil), f.watches...)
+}
+
+func (f *fakeKubernetes) handle(w http.ResponseWriter, r *http.Request) {
+	status := func(code int) {
+		w.WriteHeader(code)
+		writeJSON(w, map[string]any{"kind": "Status", "code": code})
+	}
+	if r.Header.Get("Authorization") != "Bearer "+testKubernetesToken {
+		status(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != testKubernetesCollection || r.URL.Query().Get("fieldSelector") != "metadata.name="+testKubernetesName {
+		status(http.StatusNotFound)
+		return
+	}
+	f.mu.Lock()
+	if f.unavailable {
+		f.mu.Unlock()
+		status(http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Query().Get("watch") == "" {
+		f.lists++
+		items := []any{}
+		if f.object != nil {
+			items = append(items, f.object)
+		}
+		list := map[string]any{"metadata": map[string]any{"resourceVersion": strconv.Itoa(f.version)}, "items": items}
+		f.mu.Unlock()
+		writeJSON(w, list)
+		return
+	}
+	rv := r.URL.Query().Get("resourceVersion")
+	f.watches = append(f.watches, rv)
+	sent, _ := strconv.Atoi(rv)
+	if sent < f.compacted {
+		f.mu.Unlock()
+		status(http.StatusGone)
+		return
+	}
+	closeWatch := f.closeWatches
+	f.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	for {
+		f.mu.Lock()
+		if sent < f.compacted {
+			f.mu.Unlock()
+			_ = encoder.Encode(fakeKubernetesEvent{"ERROR", map[string]any{"kind": "Status", "code": http.StatusGone}})
+			return
+		}
+		var events []fakeKubernetesEvent
+		for ; sent < f.version; sent++ {
+			events = append(events, f.history[sent+1])
+		}
+		changed := f.changed
+		f.mu.Unlock()
+		for _, event := range events {
+			_ = encoder.Encode(event)
+		}
+		w.(http.Flusher).Flush()
+		select {
+		case <-changed:
+		case <-closeWatch:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func kubernetesConfig(t *testing.T, f *fakeKubernetes) *vipconfig.Config {
+	return &vipconfig.Config{
+		EndpointType:         "kubernetes",
+		TriggerKey:           "configmaps/" + testKubernetesName,
+		TriggerValue:         "pg1",
+		KubernetesKubeconfig: kubetest.WriteKubeconfig(t, f.Server, testKubernetesToken),
+		Logger:               zap.NewNop(),
+	}
+}
+
+// waitForWatch waits until the checker sent n watch requests
+func waitForWatch(t *testing.T, f *fakeKubernetes, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, watches := f.requests(); len(watches) >= n {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for watch request %d", n)
+}
+
+// ---------------------------------------------------------------------------
+// NewKubernetesLeaderChecker
+// ---------------------------------------------------------------------------
+
+func TestNewKubernetesLeaderChecker(t *testing.T) {
+	t.Parallel()
+	f := newFakeKubernetes(t)
+
+	for _, key := range []string{"configmaps/pgcluster-leader", "endpoints/pgcluster"} {
+		conf := kubernetesConfig(t, f)
+		conf.TriggerKey = key
+		if _, err := NewKubernetesLeaderChecker(conf); err != nil {
+			t.Errorf("%s: unexpected error: %v", key, err)
+		}
+	}
+	for _, key := range []string{"/service/pgcluster/leader", "configmaps/", "secrets/pgcluster", "configmaps/a/b"} {
+		conf := kubernetesConfig(t, f)
+		conf.TriggerKey = key
+		if _, err := NewKubernetesLeaderChecker(conf); err == nil {
+			t.Errorf("%s: expected an error", key)
+		}
+	}
+	conf := kubernetesConfig(t, f)
+	conf.KubernetesKubeconfig = filepath.Join(t.TempDir(), "missing")
+	if _, err := NewKubernetesLeaderChecker(conf); err == nil {
+		t.Error("expected an error for a missing kubeconfig")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// GetChangeNotificationStream
+// ---------------------------------------------------------------------------
+
+func TestKubernetesLeaderChecker_FollowsAnnotation(t *testing.T) {
+	t.Parallel()
+	f := newFakeKubernetes(t)
+	out := startLeaderChecker(t, kubernetesConfig(t, f))
+
+	expectState(t, out, false) // object absent
+	f.setLeader("pg1")
+	expectState(t, out, true)
+	f.setLeader("pg2")
+	expectState(t, out, false)
+	f.setLeader("pg1")
+	expectState(t, out, true)
+	f.delete()
+	expectState(t, out, false)
+	f.setLeader("pg1")
+	expectState(t, out, true)
+}
+
+func TestKubernetesLeaderChecker_ResumesWatch(t *testing.T) {
+	t.Parallel()
+	f := newFakeKubernetes(t)
+	f.setLeader("pg1")
+	out := startLeaderChecker(t, kubernetesConfig(t, f))
+	expectState(t, out, true)
+	waitForWatch(t, f, 1)
+
+	f.dropWatches()
+	waitForWatch(t, f, 2)
+	f.setLeader("pg2")
+	expectState(t, out, false)
+
+	// a change while no watch is open is delivered by the resumed watch
+	f.dropWatches()
+	f.setLeader("pg1")
+	expectState(t, out, true)
+
+	lists, watches := f.requests()
+	if lists != 1 {
+		t.Errorf("expected the object to be listed once, got %d lists", lists)
+	}
+	if want := []string{"2", "2", "3"}; len(watches) < 3 || watches[0] != want[0] || watches[1] != want[1] || watches[2] != want[2] {
+		t.Errorf("watches resumed from resourceVersions %v, want %v", watches, want)
+	}
+}
+
+func TestKubernetesLeaderChecker_RelistsWhenGone(t *testing.T) {
+	t.Parallel()
+	f := newFakeKubernetes(t)
+	f.setLeader("pg1")
+	out := startLeaderChecker(t, kubernetesConfig(t, f))
+	expectState(t, out, true)
+	waitForWatch(t, f, 1)
+
+	// the open watch gets an ERROR event
+	f.setLeader("pg2")
+	f.compact()
+	waitForState(t, out, false)
+	f.setLeader("pg1")
+	waitForState(t, out, true)
+
+	// resuming the watch gets 410 Gone
+	f.setUnavailable(true)
+	f.dropWatches()
+	waitForState(t, out, false)
+	f.setLeader("pg2")
+	f.setLeader("pg1")
+	f.compact()
+	f.setUnavailable(false)
+	waitForState(t, out, true)
+
+	if lists, _ := f.requests(); lists != 3 {
+		t.Errorf("expected the object to be listed again after 410 Gone, got %d lists", lists)
+	}
+}
+
+func TestKubernetesLeaderChecker_Unavailable(t *testing.T) {
+	t.Parallel()
+	f := newFakeKubernetes(t)
+	f.setLeader("pg1")
+	out := startLeaderChecker(t, kubernetesConfig(t, f))
+	expectState(t, out, true)
+	waitForWatch(t, f, 1)
+
+	f.setUnavailable(true)
+	f.dropWatches()
+	expectState(t, out, false)
+
+	// the state is reported again once the watch is resumed
+	f.setUnavailable(false)
+	waitForState(t, out, true)
+}
+
+func TestKubernetesLeaderChecker_Unauthorized(t *testing.T) {
+	t.Parallel()
+	f := newFakeKubernetes(t)
+	f.setLeader("pg1")
+	conf := kubernetesConfig(t, f)
+	conf.KubernetesKubeconfig = kubetest.WriteKubeconfig(t, f.Server, "wrong")
+
+	expectState(t, startLeaderChecker(t, conf), false)
+}
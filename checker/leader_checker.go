@@ -23,10 +23,16 @@ func NewLeaderChecker(con *vipconfig.Config) (LeaderChecker, error) {
 	switch con.EndpointType {
 	case "consul":
 		lc, err = NewConsulLeaderChecker(con)
-	case "etcd", "etcd3":
+	case "etcd":
+		lc, err = NewEtcdV2LeaderChecker(con)
+	case "etcd3":
 		lc, err = NewEtcdLeaderChecker(con)
 	case "patroni":
 		lc, err = NewPatroniLeaderChecker(con)
+	case "zookeeper":
+		lc, err = NewZooKeeperLeaderChecker(con)
+	case "kubernetes":
+		lc, err = NewKubernetesLeaderChecker(con)
 	default:
 		err = ErrUnsupportedEndpointType
 	}
@@ -18,7 +18,7 @@ func newLeaderCheckerConfig(endpointType string, endpoints []string) *vipconfig.
 
 func TestNewLeaderChecker_Unsupported(t *testing.T) {
 	t.Parallel()
-	_, err := NewLeaderChecker(newLeaderCheckerConfig("zookeeper", []string{"http://127.0.0.1:2181"}))
+	_, err := NewLeaderChecker(newLeaderCheckerConfig("redis", []string{"http://127.0.0.1:6379"}))
 	if !errors.Is(err, ErrUnsupportedEndpointType) {
 		t.Errorf("expected ErrUnsupportedEndpointType, got %v", err)
 	}
@@ -49,8 +49,8 @@ func TestNewLeaderChecker_Etcd(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if _, ok := lc.(*EtcdLeaderChecker); !ok {
-		t.Errorf("expected *EtcdLeaderChecker, got %T", lc)
+	if _, ok := lc.(*EtcdV2LeaderChecker); !ok {
+		t.Errorf("expected *EtcdV2LeaderChecker, got %T", lc)
 	}
 }
 
@@ -75,3 +75,28 @@ func TestNewLeaderChecker_Patroni(t *testing.T) {
 		t.Errorf("expected *PatroniLeaderChecker, got %T", lc)
 	}
 }
+
+func TestNewLeaderChecker_ZooKeeper(t *testing.T) {
+	t.Parallel()
+	lc, err := NewLeaderChecker(newLeaderCheckerConfig("zookeeper", []string{"127.0.0.1:2181"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	zlc, ok := lc.(*ZooKeeperLeaderChecker)
+	if !ok {
+		t.Fatalf("expected *ZooKeeperLeaderChecker, got %T", lc)
+	}
+	zlc.Close()
+}
+
+func TestNewLeaderChecker_Kubernetes(t *testing.T) {
+	t.Parallel()
+	f := newFakeKubernetes(t)
+	lc, err := NewLeaderChecker(kubernetesConfig(t, f))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := lc.(*KubernetesLeaderChecker); !ok {
+		t.Errorf("expected *KubernetesLeaderChecker, got %T", lc)
+	}
+}
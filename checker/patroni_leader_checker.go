@@ -2,7 +2,13 @@ package checker
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"net/http"
@@ -13,14 +19,50 @@ import (
 // PatroniLeaderChecker will use Patroni REST API to check the trigger value.
 // --trigger-key is used to specify the endpoint to check, e.g. /leader.
 // --trigger-value is used to specify the HTTP code to expect, e.g. 200.
+// With --patroni-json the status document returned for the endpoint, e.g.
+// /patroni, is checked instead and --trigger-value is the member name.
+// With --patroni-cluster the /cluster document of every endpoint is checked
+// and the VIP is held while a majority agrees that the member named in
+// --trigger-value is the leader.
 type PatroniLeaderChecker struct {
 	*vipconfig.Config
 	*http.Client
+	// timeline is the highest timeline reported by this member as leader,
+	// a lower one means the status is outdated
+	timeline int
+}
+
+// patroniStatus is the part of the status document of Patroni we look at
+type patroniStatus struct {
+	State    string `json:"state"`
+	Role     string `json:"role"`
+	Timeline int    `json:"timeline"`
+	Patroni  struct {
+		Name string `json:"name"`
+	} `json:"patroni"`
+}
+
+// patroniCluster is the part of the cluster document of Patroni we look at
+type patroniCluster struct {
+	Members []struct {
+		Name string `json:"name"`
+		Role string `json:"role"`
+	} `json:"members"`
 }
 
 // NewPatroniLeaderChecker returns a new instance
 func NewPatroniLeaderChecker(conf *vipconfig.Config) (*PatroniLeaderChecker, error) {
-	tlsConfig, err := getTransport(conf)
+	if conf.PatroniJSON && conf.PatroniCluster {
+		return nil, errors.New("patroni-json and patroni-cluster can't be used together")
+	}
+	var tlsConfig *tls.Config
+	var err error
+	if conf.PatroniCAFile != "" || conf.PatroniCertFile != "" || conf.PatroniKeyFile != "" {
+		tlsConfig, err = newTLSConfig(conf.PatroniCAFile, conf.PatroniCertFile, conf.PatroniKeyFile)
+	} else {
+		// the etcd settings were used before the patroni ones existed
+		tlsConfig, err = getTransport(conf)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -40,6 +82,135 @@ func NewPatroniLeaderChecker(conf *vipconfig.Config) (*PatroniLeaderChecker, err
 	}, nil
 }
 
+// normalizeRole maps the role names of older Patroni versions to the
+// current ones
+func normalizeRole(role string) string {
+	if role == "master" {
+		return "primary"
+	}
+	return role
+}
+
+// isLeader checks whether the status document describes this member
+// running in the expected role
+func (c *PatroniLeaderChecker) isLeader(status *patroniStatus) bool {
+	c.Logger.Sugar().Infof("Current value from DCS: name=%s role=%s state=%s timeline=%d",
+		status.Patroni.Name, status.Role, status.State, status.Timeline)
+	if status.Patroni.Name != c.TriggerValue || status.State != "running" ||
+		normalizeRole(status.Role) != normalizeRole(c.PatroniRole) {
+		return false
+	}
+	if status.Timeline < c.timeline {
+		c.Logger.Sugar().Warnf("Member %s reports timeline %d, but was leader on timeline %d before", status.Patroni.Name, status.Timeline, c.timeline)
+		return false
+	}
+	c.timeline = status.Timeline
+	return true
+}
+
+// get sends a GET for url to the REST API
+func (c *PatroniLeaderChecker) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.PatroniUser != "" {
+		req.SetBasicAuth(c.PatroniUser, c.PatroniPassword)
+	}
+	return c.Do(req)
+}
+
+// check requests the trigger-key and compares the response
+func (c *PatroniLeaderChecker) check(ctx context.Context) bool {
+	if c.PatroniCluster {
+		return c.checkCluster(ctx)
+	}
+	url := c.Endpoints[0] + c.TriggerKey
+	r, err := c.get(ctx, url)
+	if err != nil {
+		// Signal false on connection error so VIP is removed if endpoint is unreachable
+		c.Logger.Sugar().Errorf("REST API error connecting to %s: %v", url, err)
+		return false
+	}
+	defer r.Body.Close()
+	if !c.PatroniJSON {
+		if r.StatusCode < 200 || r.StatusCode >= 300 {
+			c.Logger.Sugar().Warnf("REST API returned non-success status code %d for %s (expected %s)", r.StatusCode, url, c.TriggerValue)
+		}
+		return strconv.Itoa(r.StatusCode) == c.TriggerValue
+	}
+	// Patroni answers with the status document for most status codes, e.g.
+	// 503 on /primary of a replica, so it is parsed regardless
+	var status patroniStatus
+	if err = json.NewDecoder(r.Body).Decode(&status); err != nil {
+		c.Logger.Sugar().Errorf("REST API returned status code %d and no valid status document for %s: %v", r.StatusCode, url, err)
+		return false
+	}
+	return c.isLeader(&status)
+}
+
+// clusterLeader asks the member at endpoint for the name of the leader, it
+// is empty if the member doesn't know of one
+func (c *PatroniLeaderChecker) clusterLeader(ctx context.Context, endpoint string) (string, error) {
+	leaderRole := "leader"
+	if c.PatroniRole == "standby_leader" {
+		leaderRole = "standby_leader"
+	}
+	r, err := c.get(ctx, strings.TrimSuffix(endpoint, "/")+c.TriggerKey)
+	if err != nil {
+		return "", err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d", r.StatusCode)
+	}
+	var cluster patroniCluster
+	if err = json.NewDecoder(r.Body).Decode(&cluster); err != nil {
+		return "", fmt.Errorf("no valid cluster document: %w", err)
+	}
+	for _, member := range cluster.Members {
+		if member.Role == leaderRole {
+			return member.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// checkCluster asks all endpoints for the leader and compares the one the
+// majority agrees on with the trigger-value
+func (c *PatroniLeaderChecker) checkCluster(ctx context.Context) bool {
+	leaders := make([]string, len(c.Endpoints))
+	var wg sync.WaitGroup
+	for i, endpoint := range c.Endpoints {
+		wg.Go(func() {
+			leader, err := c.clusterLeader(ctx, endpoint)
+			if err != nil {
+				c.Logger.Sugar().Warnf("REST API error getting cluster from %s: %v", endpoint, err)
+				return
+			}
+			leaders[i] = leader
+		})
+	}
+	wg.Wait()
+
+	votes := make(map[string]int)
+	for _, leader := range leaders {
+		if leader != "" {
+			votes[leader]++
+		}
+	}
+	// the majority is counted among all endpoints, not only the reachable
+	// ones, so a partitioned minority can't keep the VIP
+	for leader, n := range votes {
+		if n > len(c.Endpoints)/2 {
+			c.Logger.Sugar().Infof("Current value from DCS: %s (agreed by %d of %d members)", leader, n, len(c.Endpoints))
+			return leader == c.TriggerValue
+		}
+	}
+	c.Logger.Sugar().Warnf("No majority of the %d members agrees on a leader: %v", len(c.Endpoints), leaders)
+	return false
+}
+
 // GetChangeNotificationStream checks the status in the loop
 func (c *PatroniLeaderChecker) GetChangeNotificationStream(ctx context.Context, out chan<- bool) error {
 	for {
@@ -47,25 +218,9 @@ func (c *PatroniLeaderChecker) GetChangeNotificationStream(ctx context.Context,
 		case <-ctx.Done():
 			return nil
 		case <-time.After(time.Duration(c.Interval) * time.Millisecond):
-			url := c.Endpoints[0] + c.TriggerKey
-			r, err := c.Get(url)
-			if err != nil {
-				c.Logger.Sugar().Errorf("REST API error connecting to %s: %v", url, err)
-				// Signal false on connection error so VIP is removed if endpoint is unreachable
-				// Guard the send with ctx to avoid deadlock during shutdown
-				select {
-				case out <- false:
-				case <-ctx.Done():
-					return nil
-				}
-				continue
-			}
-			r.Body.Close() // throw away the body
-			if r.StatusCode < 200 || r.StatusCode >= 300 {
-				c.Logger.Sugar().Warnf("REST API returned non-success status code %d for %s (expected %s)", r.StatusCode, url, c.TriggerValue)
-			}
+			// Guard the send with ctx to avoid deadlock during shutdown
 			select {
-			case out <- strconv.Itoa(r.StatusCode) == c.TriggerValue:
+			case out <- c.check(ctx):
 			case <-ctx.Done():
 				return nil
 			}
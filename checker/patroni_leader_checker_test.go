@@ -1,9 +1,15 @@
 package checker
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -131,3 +137,248 @@ func TestGetChangeNotificationStream_Timeout(t *testing.T) {
 		t.Error("expected false on timeout")
 	}
 }
+
+// ---------------------------------------------------------------------------
+// patroni-json
+// ---------------------------------------------------------------------------
+
+// patroniJSONConfig returns a config checking the status document of member
+// pg1 served by srv
+func patroniJSONConfig(srv *httptest.Server) *vipconfig.Config {
+	conf := patroniConfig(srv.URL, "/patroni", "pg1")
+	conf.PatroniJSON = true
+	conf.PatroniRole = "primary"
+	return conf
+}
+
+// patroniStatusServer answers with the status document returned by status
+func patroniStatusServer(t *testing.T, status func() string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(status()))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGetChangeNotificationStream_JSON(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		name   string
+		status string
+		want   bool
+	}{
+		{"running primary", `{"state":"running","role":"primary","timeline":3,"patroni":{"name":"pg1"}}`, true},
+		{"master of older Patroni", `{"state":"running","role":"master","timeline":3,"patroni":{"name":"pg1"}}`, true},
+		{"demoted during shutdown", `{"state":"stopping","role":"primary","timeline":3,"patroni":{"name":"pg1"}}`, false},
+		{"replica", `{"state":"running","role":"replica","timeline":3,"patroni":{"name":"pg1"}}`, false},
+		{"other member", `{"state":"running","role":"primary","timeline":3,"patroni":{"name":"pg2"}}`, false},
+		{"no status document", `<html>`, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			srv := patroniStatusServer(t, func() string { return tc.status })
+			if got := runStream(t, patroniJSONConfig(srv)); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetChangeNotificationStream_JSONStandbyLeader(t *testing.T) {
+	t.Parallel()
+	srv := patroniStatusServer(t, func() string {
+		return `{"state":"running","role":"standby_leader","timeline":1,"patroni":{"name":"pg1"}}`
+	})
+	conf := patroniJSONConfig(srv)
+	conf.PatroniRole = "standby_leader"
+	if !runStream(t, conf) {
+		t.Error("expected true for the standby leader with patroni-role=standby_leader")
+	}
+}
+
+// TestGetChangeNotificationStream_JSONTimeline verifies that a primary status
+// on an older timeline than seen before is not trusted
+func TestGetChangeNotificationStream_JSONTimeline(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	timeline := 4
+	srv := patroniStatusServer(t, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return fmt.Sprintf(`{"state":"running","role":"primary","timeline":%d,"patroni":{"name":"pg1"}}`, timeline)
+	})
+	checker, err := NewPatroniLeaderChecker(patroniJSONConfig(srv))
+	if err != nil {
+		t.Fatalf("NewPatroniLeaderChecker: %v", err)
+	}
+	out := make(chan bool)
+	go func() { _ = checker.GetChangeNotificationStream(t.Context(), out) }()
+
+	expectState(t, out, true)
+	mu.Lock()
+	timeline = 3
+	mu.Unlock()
+	waitForState(t, out, false)
+	mu.Lock()
+	timeline = 5
+	mu.Unlock()
+	waitForState(t, out, true)
+}
+
+// ---------------------------------------------------------------------------
+// Authentication
+// ---------------------------------------------------------------------------
+
+func TestGetChangeNotificationStream_BasicAuth(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "patroni" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	conf := patroniConfig(srv.URL, "/leader", "200")
+	if runStream(t, conf) {
+		t.Error("expected false without credentials")
+	}
+	conf = patroniConfig(srv.URL, "/leader", "200")
+	conf.PatroniUser, conf.PatroniPassword = "patroni", "secret"
+	if !runStream(t, conf) {
+		t.Error("expected true with credentials")
+	}
+}
+
+func TestGetChangeNotificationStream_ClientTLS(t *testing.T) {
+	t.Parallel()
+	dir := certsDir()
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "etcd_server.crt"), filepath.Join(dir, "etcd_server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := os.ReadFile(filepath.Join(dir, "etcd_server_ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(ca)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	conf := patroniConfig(srv.URL, "/leader", "200")
+	conf.PatroniCAFile = filepath.Join(dir, "etcd_server_ca.crt")
+	if runStream(t, conf) {
+		t.Error("expected false without a client certificate")
+	}
+	conf.PatroniCertFile = filepath.Join(dir, "etcd_client.crt")
+	conf.PatroniKeyFile = filepath.Join(dir, "etcd_client.key")
+	if !runStream(t, conf) {
+		t.Error("expected true with a client certificate")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// patroni-cluster
+// ---------------------------------------------------------------------------
+
+// patroniClusterServer answers with a cluster document in which leader has
+// the role leader. An empty leader stands for an unreachable member.
+func patroniClusterServer(t *testing.T, leader string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cluster" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		role := func(name string) string {
+			if name == leader {
+				return "leader"
+			}
+			return "replica"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"members":[{"name":"pg1","role":%q,"state":"running"},{"name":"pg2","role":%q,"state":"streaming"}],"scope":"pgcluster"}`,
+			role("pg1"), role("pg2"))
+	}))
+	if leader == "" {
+		srv.Close()
+	} else {
+		t.Cleanup(srv.Close)
+	}
+	return srv.URL + "/"
+}
+
+func patroniClusterConfig(endpoints ...string) *vipconfig.Config {
+	conf := patroniConfig("", "/cluster", "pg1")
+	conf.Endpoints = endpoints
+	conf.PatroniCluster = true
+	return conf
+}
+
+func TestNewPatroniLeaderChecker_JSONAndCluster(t *testing.T) {
+	t.Parallel()
+	conf := patroniClusterConfig("http://127.0.0.1:8008")
+	conf.PatroniJSON = true
+	if _, err := NewPatroniLeaderChecker(conf); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestGetChangeNotificationStream_Cluster(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		name    string
+		leaders []string
+		want    bool
+	}{
+		{"all agree", []string{"pg1", "pg1", "pg1"}, true},
+		{"local member unreachable", []string{"", "pg1", "pg1"}, true},
+		{"majority sees another leader", []string{"pg1", "pg2", "pg2"}, false},
+		{"no majority", []string{"", "pg1", "pg2"}, false},
+		{"majority unreachable", []string{"pg1", "", ""}, false},
+		{"no leader", []string{"none", "none", "none"}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var endpoints []string
+			for _, leader := range tc.leaders {
+				endpoints = append(endpoints, patroniClusterServer(t, leader))
+			}
+			if got := runStream(t, patroniClusterConfig(endpoints...)); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetChangeNotificationStream_ClusterStandbyLeader(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"members":[{"name":"pg1","role":"standby_leader"},{"name":"pg2","role":"replica"}]}`))
+	}))
+	defer srv.Close()
+
+	conf := patroniClusterConfig(srv.URL)
+	if runStream(t, conf) {
+		t.Error("expected false for the standby leader with the default patroni-role")
+	}
+	conf = patroniClusterConfig(srv.URL)
+	conf.PatroniRole = "standby_leader"
+	if !runStream(t, conf) {
+		t.Error("expected true for the standby leader with patroni-role=standby_leader")
+	}
+}
@@ -0,0 +1,175 @@
+package checker
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+	"github.com/go-zookeeper/zk"
+	"go.uber.org/zap"
+)
+
+// zookeeperSessionTimeout is the session timeout we ask the ensemble for.
+// Our watch only outlives a lost connection for as long as the session.
+const zookeeperSessionTimeout = 10 * time.Second
+
+// ZooKeeperLeaderChecker is used to check state of the leader key in ZooKeeper
+type ZooKeeperLeaderChecker struct {
+	*vipconfig.Config
+	*zk.Conn
+	authenticated bool
+	// pending receives the result of the call of getW that get started.
+	// A call that timed out is waited for again by the next get, instead
+	// of piling up calls while the client reconnects.
+	pending chan zkResult
+}
+
+// zkResult is the result of getW
+type zkResult struct {
+	state bool
+	watch <-chan zk.Event
+	err   error
+}
+
+// zkLogger passes the messages of the zookeeper client on to our logger
+type zkLogger struct {
+	*zap.SugaredLogger
+}
+
+func (l zkLogger) Printf(format string, args ...any) {
+	l.Infof(format, args...)
+}
+
+// NewZooKeeperLeaderChecker returns a new instance. The connection to the
+// ensemble is established in the background, so an unreachable ensemble
+// is only reported by GetChangeNotificationStream.
+func NewZooKeeperLeaderChecker(conf *vipconfig.Config) (*ZooKeeperLeaderChecker, error) {
+	dial := net.DialTimeout
+	if conf.ZooKeeperCAFile != "" {
+		tlsConfig, err := newTLSConfig(conf.ZooKeeperCAFile, conf.ZooKeeperCertFile, conf.ZooKeeperKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create TLS transport for zookeeper: %w", err)
+		}
+		dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+			return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, network, address, tlsConfig)
+		}
+	}
+	c, _, err := zk.Connect(conf.Endpoints, zookeeperSessionTimeout,
+		zk.WithDialer(dial),
+		zk.WithLogger(zkLogger{conf.Logger.Sugar()}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to zookeeper at endpoints %v: %w", conf.Endpoints, err)
+	}
+	return &ZooKeeperLeaderChecker{Config: conf, Conn: c}, nil
+}
+
+// getW gets the current value from zookeeper and sets a watch on the key.
+// A missing key is watched for creation instead.
+func (zlc *ZooKeeperLeaderChecker) getW() (bool, <-chan zk.Event, error) {
+	// the client re-submits the credentials itself after reconnecting
+	if zlc.ZooKeeperUser != "" && !zlc.authenticated {
+		if err := zlc.AddAuth("digest", []byte(zlc.ZooKeeperUser+":"+zlc.ZooKeeperPassword)); err != nil {
+			return false, nil, fmt.Errorf("failed to authenticate: %w", err)
+		}
+		zlc.authenticated = true
+	}
+	for {
+		value, _, watch, err := zlc.GetW(zlc.TriggerKey)
+		if err == nil {
+			zlc.Logger.Sugar().Info("Current value from DCS: ", string(value))
+			return string(value) == zlc.TriggerValue, watch, nil
+		}
+		if !errors.Is(err, zk.ErrNoNode) {
+			return false, nil, err
+		}
+		exists, _, watch, err := zlc.ExistsW(zlc.TriggerKey)
+		if err != nil {
+			return false, nil, err
+		}
+		// the key was created in between, get it again
+		if exists {
+			continue
+		}
+		zlc.Logger.Sugar().Info("No value found for key ", zlc.TriggerKey, " - DCS may not have set it yet")
+		return false, watch, nil
+	}
+}
+
+// get calls getW but waits at most for the check interval: the zookeeper
+// client queues requests while it is disconnected, so the call could block
+// until it tried every endpoint and wouldn't report the failure meanwhile
+func (zlc *ZooKeeperLeaderChecker) get(ctx context.Context) (bool, <-chan zk.Event, error) {
+	if zlc.pending == nil {
+		done := make(chan zkResult, 1)
+		zlc.pending = done
+		go func() {
+			state, watch, err := zlc.getW()
+			done <- zkResult{state, watch, err}
+		}()
+	}
+	select {
+	case r := <-zlc.pending:
+		zlc.pending = nil
+		return r.state, r.watch, r.err
+	case <-time.After(time.Duration(max(zlc.Interval, 1000)) * time.Millisecond):
+		return false, nil, errors.New("timed out waiting for zookeeper")
+	case <-ctx.Done():
+		return false, nil, ctx.Err()
+	}
+}
+
+// GetChangeNotificationStream monitors the leader in zookeeper. Watches in
+// zookeeper fire only once, so the value is fetched again and the watch
+// re-armed after every event, including the loss of the watch when our
+// session expired.
+func (zlc *ZooKeeperLeaderChecker) GetChangeNotificationStream(ctx context.Context, out chan<- bool) error {
+	defer zlc.Close()
+	// send guards the channel send with ctx to avoid blocking on shutdown
+	send := func(state bool) bool {
+		select {
+		case out <- state:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	zlc.Logger.Sugar().Info("Setting WATCH on ", zlc.TriggerKey)
+	for {
+		state, watch, err := zlc.get(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			zlc.Logger.Error("Failed to get value from zookeeper",
+				zap.String("key", zlc.TriggerKey),
+				zap.Error(err))
+			if !send(false) {
+				return ctx.Err()
+			}
+			// Back off briefly to avoid a busy loop when zookeeper is unreachable
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		if !send(state) {
+			return ctx.Err()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event := <-watch:
+			if event.Type == zk.EventNotWatching {
+				zlc.Logger.Warn("WATCH on key lost, re-establishing and re-syncing state",
+					zap.String("key", zlc.TriggerKey),
+					zap.Error(event.Err))
+			}
+		}
+	}
+}
@@ -0,0 +1,554 @@
+package checker
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+	"go.uber.org/zap"
+)
+
+// ZooKeeper protocol constants used by fakeZooKeeper
+const (
+	zkOpExists     = 3
+	zkOpGetData    = 4
+	zkOpPing       = 11
+	zkOpClose      = -11
+	zkOpSetAuth    = 100
+	zkOpSetWatches = 101
+
+	zkErrUnimplemented = -6
+	zkErrNoNode        = -101
+	zkErrNoAuth        = -102
+
+	zkEventNodeCreated     = 1
+	zkEventNodeDeleted     = 2
+	zkEventNodeDataChanged = 3
+	zkStateSyncConnected   = 3
+)
+
+const zkTestKey = "/service/pgcluster/leader"
+
+// zkEncoder writes the jute encoding used by ZooKeeper
+type zkEncoder struct {
+	bytes.Buffer
+}
+
+func (e *zkEncoder) int32(v int32) { _ = binary.Write(&e.Buffer, binary.BigEndian, v) }
+func (e *zkEncoder) int64(v int64) { _ = binary.Write(&e.Buffer, binary.BigEndian, v) }
+
+func (e *zkEncoder) bytes(v []byte) {
+	e.int32(int32(len(v)))
+	e.Write(v)
+}
+
+// stat writes a Stat of a node with the given data
+func (e *zkEncoder) stat(mzxid int64, data []byte) {
+	e.int64(mzxid) // czxid
+	e.int64(mzxid)
+	e.int64(0) // ctime
+	e.int64(0) // mtime
+	e.int32(0) // version
+	e.int32(0) // cversion
+	e.int32(0) // aversion
+	e.int64(0) // ephemeralOwner
+	e.int32(int32(len(data)))
+	e.int32(0) // numChildren
+	e.int64(mzxid)
+}
+
+// zkDecoder reads the jute encoding used by ZooKeeper
+type zkDecoder struct {
+	*bytes.Reader
+}
+
+func (d zkDecoder) int32() (v int32) { _ = binary.Read(d, binary.BigEndian, &v); return }
+func (d zkDecoder) int64() (v int64) { _ = binary.Read(d, binary.BigEndian, &v); return }
+func (d zkDecoder) bool() bool       { b, _ := d.ReadByte(); return b != 0 }
+
+func (d zkDecoder) bytes() []byte {
+	n := d.int32()
+	if n <= 0 {
+		return nil
+	}
+	b := make([]byte, n)
+	_, _ = io.ReadFull(d, b)
+	return b
+}
+
+func (d zkDecoder) strings() []string {
+	s := make([]string, max(d.int32(), 0))
+	for i := range s {
+		s[i] = string(d.bytes())
+	}
+	return s
+}
+
+type zkFakeNode struct {
+	data  []byte
+	mzxid int64
+	// auth is the digest credential required to read the node, if set
+	auth string
+}
+
+type zkFakeSession struct {
+	conn         *zkFakeConn
+	dataWatches  map[string]bool
+	existWatches map[string]bool
+}
+
+type zkFakeConn struct {
+	net.Conn
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+func (c *zkFakeConn) send(xid int32, zxid int64, code int32, body []byte) {
+	var e zkEncoder
+	e.int32(int32(16 + len(body)))
+	e.int32(xid)
+	e.int64(zxid)
+	e.int32(code)
+	e.Write(body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, _ = c.Write(e.Bytes())
+}
+
+func (c *zkFakeConn) event(zxid int64, typ int32, path string) {
+	var e zkEncoder
+	e.int32(typ)
+	e.int32(zkStateSyncConnected)
+	e.bytes([]byte(path))
+	c.send(-1, zxid, 0, e.Bytes())
+}
+
+// fakeZooKeeper is an in-process ZooKeeper server implementing the requests
+// the ZooKeeperLeaderChecker sends, including sessions, watches and digest
+// authentication
+type fakeZooKeeper struct {
+	addr     string
+	mu       sync.Mutex
+	zxid     int64
+	nodes    map[string]*zkFakeNode
+	sessions map[int64]*zkFakeSession
+	conns    map[*zkFakeConn]bool
+	lastID   int64
+}
+
+func newFakeZooKeeper(t *testing.T, tlsConfig *tls.Config) *fakeZooKeeper {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	z := &fakeZooKeeper{
+		addr:     ln.Addr().String(),
+		nodes:    map[string]*zkFakeNode{},
+		sessions: map[int64]*zkFakeSession{},
+		conns:    map[*zkFakeConn]bool{},
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		z.dropConnections()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go z.serve(&zkFakeConn{Conn: conn, ids: map[string]bool{}})
+		}
+	}()
+	return z
+}
+
+func readZKPacket(r io.Reader) (zkDecoder, error) {
+	var n int32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return zkDecoder{}, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return zkDecoder{}, err
+	}
+	return zkDecoder{bytes.NewReader(b)}, nil
+}
+
+func (z *fakeZooKeeper) serve(c *zkFakeConn) {
+	defer c.Close()
+	d, err := readZKPacket(c)
+	if err != nil {
+		return
+	}
+	d.int32() // protocol version
+	d.int64() // last zxid seen
+	timeout := d.int32()
+	id := d.int64()
+
+	z.mu.Lock()
+	session, ok := z.sessions[id]
+	if !ok && id == 0 {
+		z.lastID++
+		id = z.lastID
+		session = &zkFakeSession{dataWatches: map[string]bool{}, existWatches: map[string]bool{}}
+		z.sessions[id] = session
+	} else if !ok {
+		id, timeout = 0, 0
+	} else if session.conn != nil {
+		session.conn.Close()
+	}
+	if session != nil {
+		session.conn = c
+		z.conns[c] = true
+	}
+	z.mu.Unlock()
+
+	var e zkEncoder
+	e.int32(4 + 4 + 8 + 4 + 16)
+	e.int32(0) // protocol version
+	e.int32(timeout)
+	e.int64(id)
+	e.bytes(make([]byte, 16))
+	if _, err = c.Write(e.Bytes()); err != nil || session == nil {
+		// the session expired
+		return
+	}
+
+	for {
+		d, err := readZKPacket(c)
+		if err != nil {
+			return
+		}
+		xid, opcode := d.int32(), d.int32()
+		switch opcode {
+		case zkOpPing:
+			c.send(-2, z.currentZxid(), 0, nil)
+		case zkOpClose:
+			c.send(xid, z.currentZxid(), 0, nil)
+			return
+		case zkOpSetAuth:
+			d.int32() // type
+			scheme := string(d.bytes())
+			auth := string(d.bytes())
+			if scheme == "digest" {
+				z.mu.Lock()
+				c.ids[auth] = true
+				z.mu.Unlock()
+			}
+			c.send(xid, z.currentZxid(), 0, nil)
+		case zkOpGetData, zkOpExists:
+			path := string(d.bytes())
+			watch := d.bool()
+			zxid, code, body := z.read(session, c, opcode, path, watch)
+			c.send(xid, zxid, code, body)
+		case zkOpSetWatches:
+			z.setWatches(session, xid, d)
+		default:
+			c.send(xid, z.currentZxid(), zkErrUnimplemented, nil)
+		}
+	}
+}
+
+func (z *fakeZooKeeper) currentZxid() int64 {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.zxid
+}
+
+// read answers getData and exists requests
+func (z *fakeZooKeeper) read(session *zkFakeSession, c *zkFakeConn, opcode int32, path string, watch bool) (int64, int32, []byte) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	node := z.nodes[path]
+	if node == nil {
+		if opcode == zkOpExists && watch {
+			session.existWatches[path] = true
+		}
+		return z.zxid, zkErrNoNode, nil
+	}
+	if opcode == zkOpGetData && node.auth != "" && !c.ids[node.auth] {
+		return z.zxid, zkErrNoAuth, nil
+	}
+	if watch {
+		session.dataWatches[path] = true
+	}
+	var e zkEncoder
+	if opcode == zkOpGetData {
+		e.bytes(node.data)
+	}
+	e.stat(node.mzxid, node.data)
+	return z.zxid, 0, e.Bytes()
+}
+
+// setWatches restores the watches of a reconnected client, firing the ones
+// for changes it missed meanwhile
+func (z *fakeZooKeeper) setWatches(session *zkFakeSession, xid int32, d zkDecoder) {
+	relativeZxid := d.int64()
+	dataWatches, existWatches := d.strings(), d.strings()
+	z.mu.Lock()
+	zxid := z.zxid
+	var events []func()
+	for _, path := range dataWatches {
+		switch node := z.nodes[path]; {
+		case node == nil:
+			events = append(events, func() { session.conn.event(zxid, zkEventNodeDeleted, path) })
+		case node.mzxid > relativeZxid:
+			events = append(events, func() { session.conn.event(zxid, zkEventNodeDataChanged, path) })
+		default:
+			session.dataWatches[path] = true
+		}
+	}
+	for _, path := range existWatches {
+		if z.nodes[path] != nil {
+			events = append(events, func() { session.conn.event(zxid, zkEventNodeCreated, path) })
+		} else {
+			session.existWatches[path] = true
+		}
+	}
+	z.mu.Unlock()
+	session.conn.send(xid, zxid, 0, nil)
+	for _, event := range events {
+		event()
+	}
+}
+
+// fire triggers the watches on path, z.mu must be held
+func (z *fakeZooKeeper) fire(path string, typ int32, watches func(*zkFakeSession) map[string]bool) {
+	for _, session := range z.sessions {
+		if w := watches(session); w[path] {
+			delete(w, path)
+			if session.conn != nil {
+				session.conn.event(z.zxid, typ, path)
+			}
+		}
+	}
+}
+
+func dataWatches(s *zkFakeSession) map[string]bool  { return s.dataWatches }
+func existWatches(s *zkFakeSession) map[string]bool { return s.existWatches }
+
+// set creates or updates the node at path, readable only with auth if set
+func (z *fakeZooKeeper) set(path, value, auth string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.zxid++
+	node, ok := z.nodes[path]
+	if !ok {
+		node = &zkFakeNode{}
+		z.nodes[path] = node
+	}
+	node.data, node.mzxid, node.auth = []byte(value), z.zxid, auth
+	if ok {
+		z.fire(path, zkEventNodeDataChanged, dataWatches)
+	} else {
+		z.fire(path, zkEventNodeCreated, existWatches)
+	}
+}
+
+func (z *fakeZooKeeper) delete(path string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.zxid++
+	delete(z.nodes, path)
+	z.fire(path, zkEventNodeDeleted, dataWatches)
+}
+
+// dropConnections closes the connections of all clients, keeping their sessions
+func (z *fakeZooKeeper) dropConnections() {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for c := range z.conns {
+		c.Close()
+	}
+	z.conns = map[*zkFakeConn]bool{}
+}
+
+// expire forgets all sessions along with their watches and drops the
+// connections, like the ensemble does after the session timeout
+func (z *fakeZooKeeper) expire() {
+	z.mu.Lock()
+	z.sessions = map[int64]*zkFakeSession{}
+	z.mu.Unlock()
+	z.dropConnections()
+}
+
+func zookeeperConfig(endpoints ...string) *vipconfig.Config {
+	return &vipconfig.Config{
+		EndpointType: "zookeeper",
+		Endpoints:    endpoints,
+		TriggerKey:   zkTestKey,
+		TriggerValue: "pg1",
+		Interval:     1000,
+		Logger:       zap.NewNop(),
+	}
+}
+
+// ---------------------------------------------------------------------------
+// NewZooKeeperLeaderChecker
+// ---------------------------------------------------------------------------
+
+func TestNewZooKeeperLeaderChecker_TLSError(t *testing.T) {
+	t.Parallel()
+	conf := zookeeperConfig("127.0.0.1:2181")
+	conf.ZooKeeperCAFile = "/nonexistent/ca.crt"
+	if _, err := NewZooKeeperLeaderChecker(conf); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// GetChangeNotificationStream
+// ---------------------------------------------------------------------------
+
+func TestZooKeeperLeaderChecker_FollowsKey(t *testing.T) {
+	t.Parallel()
+	z := newFakeZooKeeper(t, nil)
+	out := startLeaderChecker(t, zookeeperConfig(z.addr))
+
+	expectState(t, out, false) // key absent
+	z.set(zkTestKey, "pg1", "")
+	expectState(t, out, true)
+	z.set(zkTestKey, "pg2", "")
+	expectState(t, out, false)
+	z.set(zkTestKey, "pg1", "")
+	expectState(t, out, true)
+	z.delete(zkTestKey)
+	expectState(t, out, false)
+	z.set(zkTestKey, "pg1", "")
+	expectState(t, out, true)
+}
+
+func TestZooKeeperLeaderChecker_ReconnectKeepsWatch(t *testing.T) {
+	t.Parallel()
+	z := newFakeZooKeeper(t, nil)
+	z.set(zkTestKey, "pg1", "")
+	out := startLeaderChecker(t, zookeeperConfig(z.addr))
+	expectState(t, out, true)
+
+	z.dropConnections()
+	z.set(zkTestKey, "pg2", "")
+	waitForState(t, out, false)
+}
+
+func TestZooKeeperLeaderChecker_RearmsAfterSessionExpiry(t *testing.T) {
+	t.Parallel()
+	z := newFakeZooKeeper(t, nil)
+	z.set(zkTestKey, "pg1", "")
+	out := startLeaderChecker(t, zookeeperConfig(z.addr))
+	expectState(t, out, true)
+
+	// the watch is gone with the session, so noticing the change takes a
+	// new one set by the checker
+	z.expire()
+	waitForState(t, out, true)
+	z.set(zkTestKey, "pg2", "")
+	waitForState(t, out, false)
+}
+
+func TestZooKeeperLeaderChecker_DigestAuth(t *testing.T) {
+	t.Parallel()
+	z := newFakeZooKeeper(t, nil)
+	z.set(zkTestKey, "pg1", "vip:secret")
+
+	conf := zookeeperConfig(z.addr)
+	conf.ZooKeeperUser = "vip"
+	conf.ZooKeeperPassword = "secret"
+	expectState(t, startLeaderChecker(t, conf), true)
+
+	conf = zookeeperConfig(z.addr)
+	conf.ZooKeeperUser = "vip"
+	conf.ZooKeeperPassword = "wrong"
+	expectState(t, startLeaderChecker(t, conf), false)
+
+	expectState(t, startLeaderChecker(t, zookeeperConfig(z.addr)), false)
+}
+
+func TestZooKeeperLeaderChecker_TLS(t *testing.T) {
+	t.Parallel()
+	dir := certsDir()
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "etcd_server.crt"), filepath.Join(dir, "etcd_server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := os.ReadFile(filepath.Join(dir, "etcd_server_ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(ca)
+	z := newFakeZooKeeper(t, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	z.set(zkTestKey, "pg1", "")
+
+	conf := zookeeperConfig(z.addr)
+	conf.ZooKeeperCAFile = filepath.Join(dir, "etcd_server_ca.crt")
+	conf.ZooKeeperCertFile = filepath.Join(dir, "etcd_client.crt")
+	conf.ZooKeeperKeyFile = filepath.Join(dir, "etcd_client.key")
+	expectState(t, startLeaderChecker(t, conf), true)
+}
+
+func TestZooKeeperLeaderChecker_Unreachable(t *testing.T) {
+	t.Parallel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	expectState(t, startLeaderChecker(t, zookeeperConfig(addr)), false)
+}
+
+func TestZooKeeperLeaderChecker_TimeoutReusesRequest(t *testing.T) {
+	t.Parallel()
+	// a server that accepts connections, but never answers the handshake,
+	// keeps the request queued in the client
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	zlc, err := NewZooKeeperLeaderChecker(zookeeperConfig(ln.Addr().String()))
+	if err != nil {
+		t.Fatalf("NewZooKeeperLeaderChecker() error = %v", err)
+	}
+	defer zlc.Close()
+
+	if _, _, err = zlc.get(context.Background()); err == nil {
+		t.Fatal("expected a timeout while zookeeper doesn't answer")
+	}
+	pending := zlc.pending
+	if _, _, err = zlc.get(context.Background()); err == nil {
+		t.Fatal("expected a timeout while zookeeper doesn't answer")
+	}
+	if pending == nil || zlc.pending != pending {
+		t.Error("expected the timed out request to be waited for again instead of starting another one")
+	}
+}
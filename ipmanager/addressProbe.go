@@ -0,0 +1,159 @@
+package ipmanager
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// errProbeUnsupported is returned by probeAddress on platforms that cannot
+// listen for the answers to a probe
+var errProbeUnsupported = errors.New("address probing is not supported on this platform")
+
+// claimAddress makes sure no other host uses the VIP before it is added
+// locally. A conflicting host is probed for again after retry-after
+// milliseconds, doubling the wait every time, up to retry-num times.
+// It returns false if the VIP is still in use after all retries.
+func (c *BasicConfigurer) claimAddress() bool {
+	if c.noAnnouncements {
+		return true
+	}
+	probe := c.probe
+	if probe == nil {
+		probe = c.probeAddress
+	}
+	backoff := time.Duration(c.RetryAfter) * time.Millisecond
+	for attempt := range max(c.RetryNum, 1) {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		mac, err := probe()
+		if err != nil {
+			// a probe that cannot be sent must not block the failover
+			log.Warnf("Failed to probe whether %s is in use, adding it anyway: %v", c.VIP, err)
+			return true
+		}
+		if mac == nil {
+			return true
+		}
+		log.Errorf("Address %s is already in use by %s (attempt %d of %d)", c.VIP, mac, attempt+1, max(c.RetryNum, 1))
+	}
+	log.Errorf("Refusing to configure %s on %s, another host still answers for it", c.VIP, c.Iface.Name)
+	return false
+}
+
+// createProbe prepares the packet that asks whether anybody uses the VIP:
+// an ARP probe for IPv4, a Duplicate Address Detection probe for IPv6
+func (c *BasicConfigurer) createProbe() ([]byte, error) {
+	if c.VIP.Is6() {
+		return c.createDADProbe()
+	}
+	return c.createARPProbe()
+}
+
+// createARPProbe prepares an ARP probe (RFC 5227, section 2.1.1), an ARP
+// request for the VIP with an all-zero sender address, which does not
+// pollute the ARP caches of other hosts
+func (c *BasicConfigurer) createARPProbe() ([]byte, error) {
+	return c.createARP(layers.ARPRequest, net.IPv4zero.To4(), net.HardwareAddr{0, 0, 0, 0, 0, 0})
+}
+
+// createDADProbe prepares a Neighbor Solicitation for the VIP from the
+// unspecified address to its solicited-node multicast group, as used for
+// Duplicate Address Detection (RFC 4862, section 5.4.2)
+func (c *BasicConfigurer) createDADProbe() ([]byte, error) {
+	vip := c.VIP.As16()
+	solicitedNode := net.IP{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0xff, vip[13], vip[14], vip[15]}
+
+	ethLayer := &layers.Ethernet{
+		SrcMAC:       c.Iface.HardwareAddr,
+		DstMAC:       net.HardwareAddr{0x33, 0x33, solicitedNode[12], solicitedNode[13], solicitedNode[14], solicitedNode[15]},
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+
+	ipLayer := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   255, // required for neighbor discovery messages
+		SrcIP:      net.IPv6unspecified,
+		DstIP:      solicitedNode,
+	}
+
+	icmpLayer := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0),
+	}
+	if err := icmpLayer.SetNetworkLayerForChecksum(ipLayer); err != nil {
+		return nil, err
+	}
+
+	// no source link-layer address option, it must not be sent from the unspecified address
+	nsLayer := &layers.ICMPv6NeighborSolicitation{
+		TargetAddress: vip[:],
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+
+	if err := gopacket.SerializeLayers(buffer, opts, ethLayer, ipLayer, icmpLayer, nsLayer); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// conflictingMAC inspects a received frame and returns the hardware address
+// of the sender if it claims the VIP for itself, or probes for it at the
+// same time as we do. Frames sent by this machine are never a conflict.
+func (c *BasicConfigurer) conflictingMAC(frame []byte) net.HardwareAddr {
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.NoCopy)
+	eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok || bytes.Equal(eth.SrcMAC, c.Iface.HardwareAddr) {
+		return nil
+	}
+	vip := c.VIP.AsSlice()
+
+	if arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP); ok {
+		if bytes.Equal(arp.SourceHwAddress, c.Iface.HardwareAddr) {
+			return nil
+		}
+		// somebody uses the VIP as its sender address...
+		if bytes.Equal(arp.SourceProtAddress, vip) {
+			return net.HardwareAddr(arp.SourceHwAddress)
+		}
+		// ...or probes for it right now
+		if arp.Operation == layers.ARPRequest &&
+			bytes.Equal(arp.SourceProtAddress, net.IPv4zero.To4()) &&
+			bytes.Equal(arp.DstProtAddress, vip) {
+			return net.HardwareAddr(arp.SourceHwAddress)
+		}
+		return nil
+	}
+
+	if na, ok := packet.Layer(layers.LayerTypeICMPv6NeighborAdvertisement).(*layers.ICMPv6NeighborAdvertisement); ok {
+		if !na.TargetAddress.Equal(vip) {
+			return nil
+		}
+		for _, opt := range na.Options {
+			if opt.Type == layers.ICMPv6OptTargetAddress && len(opt.Data) == MACAddressSize {
+				return net.HardwareAddr(opt.Data)
+			}
+		}
+		return eth.SrcMAC
+	}
+
+	if ns, ok := packet.Layer(layers.LayerTypeICMPv6NeighborSolicitation).(*layers.ICMPv6NeighborSolicitation); ok {
+		ip, _ := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+		if ip != nil && ip.SrcIP.IsUnspecified() && ns.TargetAddress.Equal(vip) {
+			return eth.SrcMAC
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package ipmanager
+
+import (
+	"cmp"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// probeAddress sends address-probe-count probes for the VIP and listens
+// address-probe-timeout milliseconds after each one for another host that
+// answers for it. It returns the hardware address of that host, or nil.
+func (c *BasicConfigurer) probeAddress() (net.HardwareAddr, error) {
+	proto := uint16(syscall.ETH_P_ARP)
+	if c.VIP.Is6() {
+		proto = syscall.ETH_P_IPV6
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(proto)))
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	sll := syscall.SockaddrLinklayer{
+		Protocol: htons(proto),
+		Ifindex:  c.Iface.Index,
+	}
+	if err = syscall.Bind(fd, &sll); err != nil {
+		return nil, err
+	}
+	// wake up regularly to check the deadline
+	tv := syscall.NsecToTimeval((50 * time.Millisecond).Nanoseconds())
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return nil, err
+	}
+
+	probe, err := c.createProbe()
+	if err != nil {
+		return nil, err
+	}
+	send := c.sendPacket
+	if send == nil {
+		send = sendPacket
+	}
+	timeout := time.Duration(cmp.Or(c.AddressProbeTimeout, 500)) * time.Millisecond
+	buf := make([]byte, max(c.Iface.MTU, 1500)+14)
+	for range cmp.Or(c.AddressProbeCount, 3) {
+		if err = send(c.Iface, probe); err != nil {
+			return nil, err
+		}
+		for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil {
+				if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+					continue
+				}
+				return nil, err
+			}
+			if mac := c.conflictingMAC(buf[:n]); mac != nil {
+				return mac, nil
+			}
+		}
+	}
+	return nil, nil
+}
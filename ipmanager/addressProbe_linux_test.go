@@ -0,0 +1,146 @@
+//go:build linux
+
+package ipmanager
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// setupVethPair creates a veth pair and returns both ends. The kernel answers
+// ARP and neighbor solicitations arriving on one end for addresses of the
+// other, so the pair can stand in for a second host on the same segment.
+func setupVethPair(t *testing.T, name string) (local, peer *net.Interface) {
+	t.Helper()
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "p"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("failed to create veth pair: %v", err)
+	}
+	t.Cleanup(func() { _ = netlink.LinkDel(veth) })
+
+	for _, n := range []string{veth.Name, veth.PeerName} {
+		link, err := netlink.LinkByName(n)
+		if err != nil {
+			t.Fatalf("failed to look up %s: %v", n, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			t.Fatalf("failed to bring up %s: %v", n, err)
+		}
+	}
+
+	var err error
+	if local, err = net.InterfaceByName(veth.Name); err != nil {
+		t.Fatal(err)
+	}
+	if peer, err = net.InterfaceByName(veth.PeerName); err != nil {
+		t.Fatal(err)
+	}
+	return local, peer
+}
+
+func TestBasicConfigurer_probeAddress_Conflict(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("probeAddress tests require root privileges")
+	}
+
+	local, peer := setupVethPair(t, "viptestprb")
+
+	// The "other host" already holds the VIP
+	owner := &BasicConfigurer{
+		IPConfiguration: &IPConfiguration{
+			VIP:     netip.MustParseAddr("192.0.2.200"),
+			Netmask: net.CIDRMask(24, 32),
+			Iface:   *peer,
+		},
+	}
+	if err := owner.addAddress(); err != nil {
+		t.Fatalf("failed to add address to %s: %v", peer.Name, err)
+	}
+
+	c := &BasicConfigurer{
+		IPConfiguration: &IPConfiguration{
+			VIP:                 netip.MustParseAddr("192.0.2.200"),
+			Netmask:             net.CIDRMask(24, 32),
+			Iface:               *local,
+			AddressProbeCount:   2,
+			AddressProbeTimeout: 200,
+		},
+	}
+	mac, err := c.probeAddress()
+	if err != nil {
+		t.Fatalf("probeAddress() error = %v", err)
+	}
+	if mac.String() != peer.HardwareAddr.String() {
+		t.Errorf("probeAddress() = %v, want the peer's address %v", mac, peer.HardwareAddr)
+	}
+}
+
+func TestBasicConfigurer_probeAddress_NoConflict(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("probeAddress tests require root privileges")
+	}
+
+	local, _ := setupVethPair(t, "viptestfre")
+
+	for _, vip := range []string{"192.0.2.201", "2001:db8:ffff::201"} {
+		c := &BasicConfigurer{
+			IPConfiguration: &IPConfiguration{
+				VIP:                 netip.MustParseAddr(vip),
+				Iface:               *local,
+				AddressProbeCount:   1,
+				AddressProbeTimeout: 100,
+			},
+		}
+		mac, err := c.probeAddress()
+		if err != nil {
+			t.Fatalf("probeAddress(%s) error = %v", vip, err)
+		}
+		if mac != nil {
+			t.Errorf("probeAddress(%s) = %v, want no conflict", vip, mac)
+		}
+	}
+}
+
+func TestBasicConfigurer_configureAddress_RefusesConflict(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("configureAddress tests require root privileges")
+	}
+
+	local, peer := setupVethPair(t, "viptestref")
+
+	owner := &BasicConfigurer{
+		IPConfiguration: &IPConfiguration{
+			VIP:     netip.MustParseAddr("192.0.2.202"),
+			Netmask: net.CIDRMask(24, 32),
+			Iface:   *peer,
+		},
+	}
+	if err := owner.addAddress(); err != nil {
+		t.Fatalf("failed to add address to %s: %v", peer.Name, err)
+	}
+
+	c := &BasicConfigurer{
+		IPConfiguration: &IPConfiguration{
+			VIP:                 netip.MustParseAddr("192.0.2.202"),
+			Netmask:             net.CIDRMask(24, 32),
+			Iface:               *local,
+			RetryNum:            2,
+			RetryAfter:          10,
+			AddressProbe:        true,
+			AddressProbeCount:   1,
+			AddressProbeTimeout: 200,
+		},
+	}
+	defer c.deconfigureAddress()
+
+	if c.configureAddress() {
+		t.Error("configureAddress() should refuse an address that is in use by another host")
+	}
+	if c.queryAddress() {
+		t.Error("the address must not be added when another host answers for it")
+	}
+}
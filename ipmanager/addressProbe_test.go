@@ -0,0 +1,256 @@
+package ipmanager
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var otherMAC = net.HardwareAddr{0x02, 0xaa, 0xbb, 0xcc, 0xdd, 0xee}
+
+func serializeTestFrame(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, opts, l...); err != nil {
+		t.Fatalf("failed to serialize test frame: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+func testARPFrame(t *testing.T, src net.HardwareAddr, op uint16, senderIP, targetIP string) []byte {
+	t.Helper()
+	return serializeTestFrame(t,
+		&layers.Ethernet{SrcMAC: src, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     MACAddressSize,
+			ProtAddressSize:   IPv4AddressSize,
+			Operation:         op,
+			SourceHwAddress:   src,
+			SourceProtAddress: net.ParseIP(senderIP).To4(),
+			DstHwAddress:      net.HardwareAddr{0, 0, 0, 0, 0, 0},
+			DstProtAddress:    net.ParseIP(targetIP).To4(),
+		})
+}
+
+func testNDPFrame(t *testing.T, src net.HardwareAddr, srcIP string, msg gopacket.SerializableLayer, typ uint8) []byte {
+	t.Helper()
+	ip := &layers.IPv6{Version: 6, NextHeader: layers.IPProtocolICMPv6, HopLimit: 255, SrcIP: net.ParseIP(srcIP), DstIP: net.ParseIP("ff02::1")}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(typ, 0)}
+	if err := icmp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	return serializeTestFrame(t,
+		&layers.Ethernet{SrcMAC: src, DstMAC: net.HardwareAddr{0x33, 0x33, 0, 0, 0, 1}, EthernetType: layers.EthernetTypeIPv6},
+		ip, icmp, msg)
+}
+
+// ---------------------------------------------------------------------------
+// createProbe
+// ---------------------------------------------------------------------------
+
+func TestBasicConfigurer_createARPProbe(t *testing.T) {
+	t.Parallel()
+
+	c := &BasicConfigurer{IPConfiguration: testIPConfiguration("192.168.1.10")}
+	packet, err := c.createProbe()
+	if err != nil {
+		t.Fatalf("createProbe() error = %v", err)
+	}
+
+	parsed := gopacket.NewPacket(packet, layers.LayerTypeEthernet, gopacket.Default)
+	arp, ok := parsed.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok {
+		t.Fatal("missing ARP layer")
+	}
+	if arp.Operation != layers.ARPRequest {
+		t.Errorf("ARP operation = %d, want request", arp.Operation)
+	}
+	if !bytes.Equal(arp.SourceProtAddress, []byte{0, 0, 0, 0}) {
+		t.Errorf("ARP sender protocol address = %v, want 0.0.0.0", arp.SourceProtAddress)
+	}
+	if !bytes.Equal(arp.DstProtAddress, c.VIP.AsSlice()) {
+		t.Errorf("ARP target protocol address = %v, want %v", arp.DstProtAddress, c.VIP)
+	}
+	if !bytes.Equal(arp.SourceHwAddress, c.Iface.HardwareAddr) {
+		t.Errorf("ARP sender hardware address = %v, want %v", arp.SourceHwAddress, c.Iface.HardwareAddr)
+	}
+}
+
+func TestBasicConfigurer_createDADProbe(t *testing.T) {
+	t.Parallel()
+
+	c := &BasicConfigurer{IPConfiguration: testIPConfiguration("2001:db8::12:3456")}
+	packet, err := c.createProbe()
+	if err != nil {
+		t.Fatalf("createProbe() error = %v", err)
+	}
+
+	parsed := gopacket.NewPacket(packet, layers.LayerTypeEthernet, gopacket.Default)
+	eth := parsed.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	wantMAC := net.HardwareAddr{0x33, 0x33, 0xff, 0x12, 0x34, 0x56}
+	if !bytes.Equal(eth.DstMAC, wantMAC) {
+		t.Errorf("Ethernet destination MAC = %v, want %v", eth.DstMAC, wantMAC)
+	}
+	ip, ok := parsed.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !ok {
+		t.Fatal("missing IPv6 layer")
+	}
+	if !ip.SrcIP.IsUnspecified() {
+		t.Errorf("IPv6 source = %v, want ::", ip.SrcIP)
+	}
+	if !ip.DstIP.Equal(net.ParseIP("ff02::1:ff12:3456")) {
+		t.Errorf("IPv6 destination = %v, want solicited-node multicast ff02::1:ff12:3456", ip.DstIP)
+	}
+	ns, ok := parsed.Layer(layers.LayerTypeICMPv6NeighborSolicitation).(*layers.ICMPv6NeighborSolicitation)
+	if !ok {
+		t.Fatal("missing Neighbor Solicitation layer")
+	}
+	if !ns.TargetAddress.Equal(net.IP(c.VIP.AsSlice())) {
+		t.Errorf("target address = %v, want %v", ns.TargetAddress, c.VIP)
+	}
+	if len(ns.Options) != 0 {
+		t.Errorf("DAD probe must not carry options, got %v", ns.Options)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// conflictingMAC
+// ---------------------------------------------------------------------------
+
+func TestBasicConfigurer_conflictingMAC_IPv4(t *testing.T) {
+	t.Parallel()
+
+	c := &BasicConfigurer{IPConfiguration: testIPConfiguration("192.168.1.10")}
+	own := c.Iface.HardwareAddr
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  net.HardwareAddr
+	}{
+		{"reply from other host", testARPFrame(t, otherMAC, layers.ARPReply, "192.168.1.10", "192.168.1.10"), otherMAC},
+		{"request from other host using the VIP", testARPFrame(t, otherMAC, layers.ARPRequest, "192.168.1.10", "192.168.1.1"), otherMAC},
+		{"probe from other host", testARPFrame(t, otherMAC, layers.ARPRequest, "0.0.0.0", "192.168.1.10"), otherMAC},
+		{"own probe", testARPFrame(t, own, layers.ARPRequest, "0.0.0.0", "192.168.1.10"), nil},
+		{"own announcement", testARPFrame(t, own, layers.ARPReply, "192.168.1.10", "192.168.1.10"), nil},
+		{"unrelated address", testARPFrame(t, otherMAC, layers.ARPReply, "192.168.1.11", "192.168.1.1"), nil},
+		{"request for the VIP from a user", testARPFrame(t, otherMAC, layers.ARPRequest, "192.168.1.1", "192.168.1.10"), nil},
+		{"garbage", []byte{0x01, 0x02, 0x03}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := c.conflictingMAC(tt.frame); !bytes.Equal(got, tt.want) {
+				t.Errorf("conflictingMAC() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBasicConfigurer_conflictingMAC_IPv6(t *testing.T) {
+	t.Parallel()
+
+	c := &BasicConfigurer{IPConfiguration: testIPConfiguration("2001:db8::10")}
+	vip := net.ParseIP("2001:db8::10")
+	tlla := layers.ICMPv6Options{{Type: layers.ICMPv6OptTargetAddress, Data: otherMAC}}
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  net.HardwareAddr
+	}{
+		{"advertisement from other host",
+			testNDPFrame(t, otherMAC, "2001:db8::10", &layers.ICMPv6NeighborAdvertisement{Flags: 0x20, TargetAddress: vip, Options: tlla}, layers.ICMPv6TypeNeighborAdvertisement),
+			otherMAC},
+		{"advertisement without link-layer option",
+			testNDPFrame(t, otherMAC, "2001:db8::10", &layers.ICMPv6NeighborAdvertisement{TargetAddress: vip}, layers.ICMPv6TypeNeighborAdvertisement),
+			otherMAC},
+		{"DAD probe from other host",
+			testNDPFrame(t, otherMAC, "::", &layers.ICMPv6NeighborSolicitation{TargetAddress: vip}, layers.ICMPv6TypeNeighborSolicitation),
+			otherMAC},
+		{"regular solicitation for the VIP",
+			testNDPFrame(t, otherMAC, "2001:db8::1", &layers.ICMPv6NeighborSolicitation{TargetAddress: vip}, layers.ICMPv6TypeNeighborSolicitation),
+			nil},
+		{"advertisement for another address",
+			testNDPFrame(t, otherMAC, "2001:db8::11", &layers.ICMPv6NeighborAdvertisement{TargetAddress: net.ParseIP("2001:db8::11")}, layers.ICMPv6TypeNeighborAdvertisement),
+			nil},
+		{"own advertisement",
+			testNDPFrame(t, c.Iface.HardwareAddr, "2001:db8::10", &layers.ICMPv6NeighborAdvertisement{TargetAddress: vip}, layers.ICMPv6TypeNeighborAdvertisement),
+			nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := c.conflictingMAC(tt.frame); !bytes.Equal(got, tt.want) {
+				t.Errorf("conflictingMAC() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// ---------------------------------------------------------------------------
+// claimAddress
+// ---------------------------------------------------------------------------
+
+// probeResults returns a probe function that yields the given results in order
+func probeResults(calls *int, results ...net.HardwareAddr) func() (net.HardwareAddr, error) {
+	return func() (net.HardwareAddr, error) {
+		*calls++
+		return results[min(*calls, len(results))-1], nil
+	}
+}
+
+func TestBasicConfigurer_claimAddress(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		results   []net.HardwareAddr
+		want      bool
+		wantCalls int
+	}{
+		{"address unused", []net.HardwareAddr{nil}, true, 1},
+		{"conflict resolves after retry", []net.HardwareAddr{otherMAC, nil}, true, 2},
+		{"persistent conflict", []net.HardwareAddr{otherMAC}, false, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cfg := testIPConfiguration("192.168.1.10")
+			cfg.RetryNum = 3
+			cfg.RetryAfter = 1
+			calls := 0
+			c := &BasicConfigurer{IPConfiguration: cfg, probe: probeResults(&calls, tt.results...)}
+			if got := c.claimAddress(); got != tt.want {
+				t.Errorf("claimAddress() = %v, want %v", got, tt.want)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("probe was called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestBasicConfigurer_claimAddress_ProbeError(t *testing.T) {
+	t.Parallel()
+
+	c := &BasicConfigurer{
+		IPConfiguration: testIPConfiguration("192.168.1.10"),
+		probe: func() (net.HardwareAddr, error) {
+			return nil, errors.New("operation not permitted")
+		},
+	}
+	if !c.claimAddress() {
+		t.Error("claimAddress() should not block the failover when probing fails")
+	}
+}
@@ -0,0 +1,97 @@
+package ipmanager
+
+import (
+	"context"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// watchAddress subscribes to RTM_NEWADDR/RTM_DELADDR and link notifications
+// and signals every change of the VIP on our interface as well as the
+// interface going up or down. Unrelated notifications are dropped here, so
+// the apply loop only wakes up when there is something to reconcile.
+func (c *BasicConfigurer) watchAddress(ctx context.Context) (<-chan struct{}, error) {
+	done := make(chan struct{})
+	addrUpdates := make(chan netlink.AddrUpdate)
+	linkUpdates := make(chan netlink.LinkUpdate)
+	onError := func(err error) {
+		// closing done makes the pending receive fail, that is no news
+		select {
+		case <-done:
+			return
+		default:
+		}
+		log.Warnf("Netlink subscription for %s failed: %v", c.Iface.Name, err)
+	}
+
+	if err := netlink.AddrSubscribeWithOptions(addrUpdates, done, netlink.AddrSubscribeOptions{ErrorCallback: onError}); err != nil {
+		close(done)
+		return nil, netlinkError(err)
+	}
+	if err := netlink.LinkSubscribeWithOptions(linkUpdates, done, netlink.LinkSubscribeOptions{ErrorCallback: onError}); err != nil {
+		close(done)
+		for range addrUpdates {
+		}
+		return nil, netlinkError(err)
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
+		defer func() {
+			close(done)
+			// netlink closes the channels once it noticed done, until then
+			// it may still block sending an update
+			for range addrUpdates {
+			}
+			for range linkUpdates {
+			}
+		}()
+		// The interface is matched by name, as it may have been recreated
+		// with a new index since startup, or be recreated while we watch.
+		index, linkUp := c.Iface.Index, c.Iface.Flags&net.FlagUp != 0
+		if link, err := c.link(); err == nil {
+			index, linkUp = link.Attrs().Index, link.Attrs().Flags&net.FlagUp != 0
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case update, ok := <-addrUpdates:
+				if !ok {
+					return
+				}
+				if update.LinkIndex != index || !c.isVIP(update.LinkAddress.IP) {
+					continue
+				}
+				log.Infof("IP address %s was %s on %s", c.getCIDR(),
+					map[bool]string{true: "added", false: "removed"}[update.NewAddr], c.Iface.Name)
+			case update, ok := <-linkUpdates:
+				if !ok {
+					return
+				}
+				if update.Attrs().Name != c.Iface.Name {
+					continue
+				}
+				up := update.Header.Type != unix.RTM_DELLINK && update.Attrs().Flags&net.FlagUp != 0
+				if update.Attrs().Index == index && up == linkUp {
+					continue
+				}
+				if update.Attrs().Index != index {
+					log.Infof("Interface %s was recreated with index %d", c.Iface.Name, update.Attrs().Index)
+					index = update.Attrs().Index
+				}
+				linkUp = up
+				log.Infof("Interface %s went %s", c.Iface.Name, map[bool]string{true: "up", false: "down"}[up])
+			}
+			// coalesce bursts of notifications into a single recheck
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
@@ -0,0 +1,147 @@
+//go:build linux
+
+package ipmanager
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// startWatch watches the address of c until the test ends, and makes sure
+// the subscription is gone by then
+func startWatch(t *testing.T, c *BasicConfigurer) <-chan struct{} {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	changes, err := c.watchAddress(ctx)
+	if err != nil {
+		cancel()
+		t.Fatalf("watchAddress() error = %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		timeout := time.After(2 * time.Second)
+		for {
+			select {
+			case _, ok := <-changes:
+				if !ok {
+					return
+				}
+			case <-timeout:
+				t.Error("subscription did not end after the context was cancelled")
+				return
+			}
+		}
+	})
+	return changes
+}
+
+func expectChange(t *testing.T, changes <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case _, ok := <-changes:
+		if !ok {
+			t.Fatalf("subscription ended while waiting for %s", what)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no notification for %s", what)
+	}
+}
+
+func expectNoChange(t *testing.T, changes <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-changes:
+		t.Fatalf("unexpected notification for %s", what)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestBasicConfigurer_watchAddress(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("watchAddress tests require root privileges")
+	}
+
+	iface, _ := setupVethPair(t, "viptestwat")
+	link, err := netlink.LinkByIndex(iface.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &BasicConfigurer{
+		IPConfiguration: &IPConfiguration{
+			VIP:     netip.MustParseAddr("192.0.2.1"),
+			Netmask: net.CIDRMask(24, 32),
+			Iface:   *iface,
+		},
+	}
+	changes := startWatch(t, c)
+
+	if err := c.addAddress(); err != nil {
+		t.Fatalf("addAddress() error = %v", err)
+	}
+	expectChange(t, changes, "adding the VIP")
+
+	// an address sharing the VIP as a string prefix must not wake us up
+	other, _ := netlink.ParseAddr("192.0.2.11/24")
+	if err := netlink.AddrAdd(link, other); err != nil {
+		t.Fatalf("failed to add unrelated address: %v", err)
+	}
+	expectNoChange(t, changes, "an unrelated address")
+
+	vip, _ := netlink.ParseAddr("192.0.2.1/24")
+	if err := netlink.AddrDel(link, vip); err != nil {
+		t.Fatalf("failed to remove the VIP: %v", err)
+	}
+	expectChange(t, changes, "removing the VIP")
+
+	if err := netlink.LinkSetDown(link); err != nil {
+		t.Fatalf("failed to bring down %s: %v", iface.Name, err)
+	}
+	expectChange(t, changes, "the link going down")
+}
+
+func TestBasicConfigurer_watchAddress_Recreated(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("watchAddress tests require root privileges")
+	}
+
+	iface, _ := setupVethPair(t, "viptestrec")
+	c := &BasicConfigurer{
+		IPConfiguration: &IPConfiguration{
+			VIP:     netip.MustParseAddr("192.0.2.1"),
+			Netmask: net.CIDRMask(24, 32),
+			Iface:   *iface,
+		},
+	}
+	changes := startWatch(t, c)
+
+	// the interface comes back under the same name, but with a new index
+	if err := netlink.LinkDel(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: iface.Name}}); err != nil {
+		t.Fatalf("failed to delete %s: %v", iface.Name, err)
+	}
+	expectChange(t, changes, "the link being deleted")
+	recreated, _ := setupVethPair(t, iface.Name)
+	if recreated.Index == iface.Index {
+		t.Skip("the interface was recreated with the same index")
+	}
+	expectChange(t, changes, "the link being recreated")
+	// let the notifications about the new link settle
+	for settled := false; !settled; {
+		select {
+		case <-changes:
+		case <-time.After(200 * time.Millisecond):
+			settled = true
+		}
+	}
+
+	if err := c.addAddress(); err != nil {
+		t.Fatalf("addAddress() error = %v", err)
+	}
+	expectChange(t, changes, "adding the VIP to the recreated interface")
+}
@@ -0,0 +1,197 @@
+package ipmanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// apiTimeout limits a single request to a provider API, so a hanging
+// endpoint can't block the manager forever
+const apiTimeout = 10 * time.Second
+
+// apiClient is a minimal JSON over HTTP client used by the configurers
+// that manage the VIP through the REST API of a hosting provider
+type apiClient struct {
+	baseURL    string
+	httpClient *http.Client
+	// authorize is called for every request, e.g. to add a bearer token
+	authorize func(req *http.Request) error
+}
+
+// apiError is returned for every response outside of the 2xx range
+type apiError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("API returned status %d: %s", e.StatusCode, e.Body)
+}
+
+func newAPIClient(baseURL string, authorize func(req *http.Request) error) *apiClient {
+	return &apiClient{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: apiTimeout},
+		authorize:  authorize,
+	}
+}
+
+// bearerToken returns an authorize function adding the given token
+func bearerToken(token string) func(req *http.Request) error {
+	return func(req *http.Request) error {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+}
+
+// apiToken caches an access token handed out by an identity service, it is
+// fetched again a minute before it expires, so it can't expire while a
+// request is in flight
+type apiToken struct {
+	fetch  func() (token string, expiry time.Time, err error)
+	token  string
+	expiry time.Time
+}
+
+// get returns the cached token, fetching a new one if needed
+func (t *apiToken) get() (string, error) {
+	if t.token == "" || time.Now().Add(time.Minute).After(t.expiry) {
+		token, expiry, err := t.fetch()
+		if err != nil {
+			return "", err
+		}
+		t.token, t.expiry = token, expiry
+	}
+	return t.token, nil
+}
+
+// bearer is an authorize function adding the token as bearer token
+func (t *apiToken) bearer(req *http.Request) error {
+	token, err := t.get()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// do sends body, if any, JSON encoded to path and decodes the response into
+// result, if any. path is relative to the base URL of the client.
+func (a *apiClient) do(method, path string, body, result any) error {
+	_, err := a.doHeader(method, path, body, result)
+	return err
+}
+
+// doHeader is like do, but also returns the response headers, e.g. for APIs
+// that point to the status of long-running operations in a header
+func (a *apiClient) doHeader(method, path string, body, result any) (http.Header, error) {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode request: %w", err)
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, a.baseURL+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if a.authorize != nil {
+		if err = a.authorize(req); err != nil {
+			return nil, fmt.Errorf("failed to authorize request: %w", err)
+		}
+	}
+	log.Debugf("%s %s", method, req.URL)
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.Header, &apiError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(respBody))}
+	}
+	if result == nil || len(respBody) == 0 {
+		return resp.Header, nil
+	}
+	if err = json.Unmarshal(respBody, result); err != nil {
+		return resp.Header, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return resp.Header, nil
+}
+
+// relativePath returns the path of an absolute URL returned by the API,
+// e.g. the next page of a list. It fails for URLs outside of the base URL,
+// so credentials are never sent anywhere else.
+func (a *apiClient) relativePath(rawURL string) (string, error) {
+	path, ok := strings.CutPrefix(rawURL, a.baseURL)
+	if !ok || (path != "" && !strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "?")) {
+		return "", fmt.Errorf("URL %s is outside of %s", rawURL, a.baseURL)
+	}
+	return path, nil
+}
+
+// getText returns the trimmed plain text body of path, as served by the
+// metadata services of most providers
+func (a *apiClient) getText(path string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, a.baseURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if a.authorize != nil {
+		if err = a.authorize(req); err != nil {
+			return "", fmt.Errorf("failed to authorize request: %w", err)
+		}
+	}
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", &apiError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// readSecret returns value if set, else the content of file if set, else
+// the content of the environment variable env
+func readSecret(value, file, env string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		if secret := strings.TrimSpace(string(b)); secret != "" {
+			return secret, nil
+		}
+		return "", fmt.Errorf("%s is empty", file)
+	}
+	if secret := os.Getenv(env); secret != "" {
+		return secret, nil
+	}
+	return "", errors.New("no credentials configured")
+}
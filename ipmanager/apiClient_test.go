@@ -0,0 +1,145 @@
+package ipmanager
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------
+// apiClient
+// ---------------------------------------------------------------------------
+
+func TestAPIClient_do(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/things" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"name":"thing"}`))
+	}))
+	defer server.Close()
+
+	api := newAPIClient(server.URL+"/v1/", bearerToken("secret"))
+	var result struct {
+		Name string `json:"name"`
+	}
+	if err := api.do(http.MethodPost, "/things", map[string]int{"a": 1}, &result); err != nil {
+		t.Fatalf("do() error = %v", err)
+	}
+	if result.Name != "thing" {
+		t.Errorf("do() decoded %q, want %q", result.Name, "thing")
+	}
+}
+
+func TestAPIClient_do_ErrorStatus(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("forbidden\n"))
+	}))
+	defer server.Close()
+
+	err := newAPIClient(server.URL, nil).do(http.MethodGet, "/", nil, nil)
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("do() error = %v, want an *apiError", err)
+	}
+	if apiErr.StatusCode != http.StatusForbidden || apiErr.Body != "forbidden" {
+		t.Errorf("do() error = %+v, want status 403 and body %q", apiErr, "forbidden")
+	}
+}
+
+func TestAPIClient_getText(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("12345\n"))
+	}))
+	defer server.Close()
+
+	got, err := newAPIClient(server.URL, nil).getText("/instance-id")
+	if err != nil {
+		t.Fatalf("getText() error = %v", err)
+	}
+	if got != "12345" {
+		t.Errorf("getText() = %q, want %q", got, "12345")
+	}
+}
+
+func TestAPIClient_relativePath(t *testing.T) {
+	t.Parallel()
+
+	api := newAPIClient("https://api.example.com/v1", nil)
+	tests := []struct {
+		url     string
+		want    string
+		wantErr bool
+	}{
+		{"https://api.example.com/v1/things?page=2", "/things?page=2", false},
+		{"https://api.example.com/v1?page=2", "?page=2", false},
+		{"https://api.example.com/v10/things", "", true},
+		{"https://evil.example.com/v1/things", "", true},
+	}
+	for _, tt := range tests {
+		got, err := api.relativePath(tt.url)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("relativePath(%s) = %q, %v, want %q", tt.url, got, err, tt.want)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// readSecret
+// ---------------------------------------------------------------------------
+
+func TestReadSecret(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "token")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VIP_MANAGER_TEST_SECRET", "from-env")
+
+	tests := []struct {
+		name    string
+		value   string
+		file    string
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{"value wins", "from-value", file, "VIP_MANAGER_TEST_SECRET", "from-value", false},
+		{"file before env", "", file, "VIP_MANAGER_TEST_SECRET", "from-file", false},
+		{"env", "", "", "VIP_MANAGER_TEST_SECRET", "from-env", false},
+		{"missing file", "", filepath.Join(dir, "missing"), "VIP_MANAGER_TEST_SECRET", "", true},
+		{"empty file", "", empty, "", "", true},
+		{"nothing", "", "", "VIP_MANAGER_TEST_UNSET", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readSecret(tt.value, tt.file, tt.env)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readSecret() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("readSecret() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package ipmanager
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+const (
+	defaultAWSIMDSEndpoint = "http://169.254.169.254"
+	awsEC2APIVersion       = "2016-11-15"
+)
+
+// The AWSConfigurer manages the VIP as secondary private IP of the network
+// interface (ENI) of this EC2 instance, whenever manager-type `aws` is set.
+// The VPC only delivers traffic for addresses owned by the ENI, so the VIP
+// is assigned to our ENI first, taking it away from any other instance.
+// The OS doesn't pick up secondary private IPs of the ENI by itself, so the
+// VIP is then added to the interface as well. Optionally an Elastic IP is
+// associated with the VIP.
+type AWSConfigurer struct {
+	*IPConfiguration
+	local        ipConfigurer
+	imds         *apiClient
+	httpClient   *http.Client
+	ec2Endpoint  string
+	region       string
+	allocationID string
+	eni          string
+	credentials  *awsCredentials
+}
+
+// awsError is the error returned by the EC2 API
+type awsError struct {
+	Code    string `xml:"Errors>Error>Code"`
+	Message string `xml:"Errors>Error>Message"`
+}
+
+func (e *awsError) Error() string {
+	return fmt.Sprintf("EC2 API error %s: %s", e.Code, e.Message)
+}
+
+type awsNetworkInterfaces struct {
+	Interfaces []struct {
+		ID         string `xml:"networkInterfaceId"`
+		PrivateIPs []struct {
+			Address string `xml:"privateIpAddress"`
+		} `xml:"privateIpAddressesSet>item"`
+	} `xml:"networkInterfaceSet>item"`
+}
+
+type awsAddresses struct {
+	Addresses []struct {
+		AllocationID       string `xml:"allocationId"`
+		PublicIP           string `xml:"publicIp"`
+		NetworkInterfaceID string `xml:"networkInterfaceId"`
+		PrivateIP          string `xml:"privateIpAddress"`
+	} `xml:"addressesSet>item"`
+}
+
+func newAWSConfigurer(config *IPConfiguration, conf *vipconfig.Config) (*AWSConfigurer, error) {
+	if !config.VIP.Is4() {
+		return nil, errors.New("manager-type aws only supports IPv4 addresses")
+	}
+	local, err := newBasicConfigurer(config)
+	if err != nil {
+		return nil, err
+	}
+	c := &AWSConfigurer{
+		IPConfiguration: config,
+		local:           local,
+		httpClient:      &http.Client{Timeout: apiTimeout},
+		ec2Endpoint:     strings.TrimRight(conf.AWSEC2Endpoint, "/"),
+		region:          conf.AWSRegion,
+		allocationID:    conf.AWSElasticIPAllocationID,
+	}
+	c.imds = newAPIClient(cmp.Or(conf.AWSIMDSEndpoint, defaultAWSIMDSEndpoint)+"/latest", c.authorizeIMDS)
+	return c, nil
+}
+
+// authorizeIMDS fetches a session token for the instance metadata service,
+// as required by IMDSv2
+func (c *AWSConfigurer) authorizeIMDS(req *http.Request) error {
+	tokenReq, err := http.NewRequest(http.MethodPut, c.imds.baseURL+"/api/token", nil)
+	if err != nil {
+		return err
+	}
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	resp, err := c.imds.httpClient.Do(tokenReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	token, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &apiError{StatusCode: resp.StatusCode, Body: string(token)}
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	return nil
+}
+
+// discover looks up the region and the ENI of our interface, found by its
+// MAC address, from the instance metadata service
+func (c *AWSConfigurer) discover() error {
+	if c.eni != "" {
+		return nil
+	}
+	var err error
+	if c.region == "" {
+		if c.region, err = c.imds.getText("/meta-data/placement/region"); err != nil {
+			return fmt.Errorf("failed to query the region from the metadata service: %w", err)
+		}
+	}
+	if c.ec2Endpoint == "" {
+		c.ec2Endpoint = "https://ec2." + c.region + ".amazonaws.com"
+	}
+	mac := c.Iface.HardwareAddr.String()
+	eni, err := c.imds.getText("/meta-data/network/interfaces/macs/" + mac + "/interface-id")
+	if err != nil {
+		return fmt.Errorf("failed to query the network interface with MAC %s from the metadata service: %w", mac, err)
+	}
+	c.eni = eni
+	log.Infof("Discovered network interface %s of %s in %s", c.eni, c.Iface.Name, c.region)
+	return nil
+}
+
+// getCredentials returns the credentials from the standard AWS environment
+// variables, or else those of the instance profile
+func (c *AWSConfigurer) getCredentials() (*awsCredentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return &awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	if c.credentials != nil && !c.credentials.expired(time.Now()) {
+		return c.credentials, nil
+	}
+
+	roles, err := c.imds.getText("/meta-data/iam/security-credentials/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the instance profile: %w", err)
+	}
+	role, _, _ := strings.Cut(roles, "\n")
+	if role == "" {
+		return nil, errors.New("no AWS credentials in the environment and no instance profile attached")
+	}
+	str, err := c.imds.getText("/meta-data/iam/security-credentials/" + role)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the credentials of role %s: %w", role, err)
+	}
+	var resp struct {
+		Code            string
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err = json.Unmarshal([]byte(str), &resp); err != nil {
+		return nil, fmt.Errorf("failed to decode the credentials of role %s: %w", role, err)
+	}
+	if resp.Code != "Success" {
+		return nil, fmt.Errorf("failed to get the credentials of role %s: %s", role, resp.Code)
+	}
+	c.credentials = &awsCredentials{
+		AccessKeyID:     resp.AccessKeyID,
+		SecretAccessKey: resp.SecretAccessKey,
+		SessionToken:    resp.Token,
+		Expiration:      resp.Expiration,
+	}
+	return c.credentials, nil
+}
+
+// callEC2 calls action of the EC2 query API and decodes the response into
+// result, if given
+func (c *AWSConfigurer) callEC2(action string, params url.Values, result any) error {
+	creds, err := c.getCredentials()
+	if err != nil {
+		return err
+	}
+	params.Set("Action", action)
+	params.Set("Version", awsEC2APIVersion)
+	body := []byte(params.Encode())
+
+	req, err := http.NewRequest(http.MethodPost, c.ec2Endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, body, creds, c.region, "ec2", time.Now())
+	log.Debugf("EC2 %s %s", action, params.Encode())
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		awsErr := &awsError{}
+		if xml.Unmarshal(respBody, awsErr) == nil && awsErr.Code != "" {
+			return awsErr
+		}
+		return &apiError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(respBody))}
+	}
+	if result != nil {
+		if err = xml.Unmarshal(respBody, result); err != nil {
+			return fmt.Errorf("failed to decode %s response: %w", action, err)
+		}
+	}
+	return nil
+}
+
+// isAssigned returns whether the VIP is a private IP of our ENI and, if
+// configured, the Elastic IP is associated with it
+func (c *AWSConfigurer) isAssigned() (bool, error) {
+	var interfaces awsNetworkInterfaces
+	if err := c.callEC2("DescribeNetworkInterfaces", url.Values{"NetworkInterfaceId.1": {c.eni}}, &interfaces); err != nil {
+		return false, err
+	}
+	assigned := false
+	for _, iface := range interfaces.Interfaces {
+		for _, ip := range iface.PrivateIPs {
+			assigned = assigned || (iface.ID == c.eni && ip.Address == c.VIP.String())
+		}
+	}
+	if !assigned || c.allocationID == "" {
+		return assigned, nil
+	}
+
+	var addresses awsAddresses
+	if err := c.callEC2("DescribeAddresses", url.Values{"AllocationId.1": {c.allocationID}}, &addresses); err != nil {
+		return false, err
+	}
+	for _, address := range addresses.Addresses {
+		if address.NetworkInterfaceID == c.eni && address.PrivateIP == c.VIP.String() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *AWSConfigurer) queryAddress() bool {
+	if !c.local.queryAddress() {
+		return false
+	}
+	if err := c.discover(); err != nil {
+		log.Error(err)
+		return false
+	}
+	assigned, err := c.isAssigned()
+	if err != nil {
+		log.Errorf("Failed to query the assignment of %s: %s", c.VIP, err)
+		return false
+	}
+	return assigned
+}
+
+func (c *AWSConfigurer) queryLocalAddress() bool {
+	return c.local.queryAddress()
+}
+
+func (c *AWSConfigurer) configureAddress() bool {
+	if err := c.discover(); err != nil {
+		log.Error(err)
+		return false
+	}
+	err := c.callEC2("AssignPrivateIpAddresses", url.Values{
+		"NetworkInterfaceId": {c.eni},
+		"PrivateIpAddress.1": {c.VIP.String()},
+		"AllowReassignment":  {"true"},
+	}, nil)
+	if err != nil {
+		log.Errorf("Failed to assign %s to %s: %s", c.VIP, c.eni, err)
+		return false
+	}
+	log.Infof("Assigned %s to %s", c.VIP, c.eni)
+
+	if c.allocationID != "" {
+		err = c.callEC2("AssociateAddress", url.Values{
+			"AllocationId":       {c.allocationID},
+			"NetworkInterfaceId": {c.eni},
+			"PrivateIpAddress":   {c.VIP.String()},
+			"AllowReassociation": {"true"},
+		}, nil)
+		if err != nil {
+			log.Errorf("Failed to associate Elastic IP %s with %s: %s", c.allocationID, c.VIP, err)
+			return false
+		}
+		log.Infof("Associated Elastic IP %s with %s", c.allocationID, c.VIP)
+	}
+
+	return c.local.configureAddress()
+}
+
+func (c *AWSConfigurer) deconfigureAddress() bool {
+	// The private IP stays assigned to our ENI, the next leader reassigns
+	// it with AllowReassignment. Unassigning it would leave the VPC without
+	// a target for the VIP until then.
+	return c.local.deconfigureAddress()
+}
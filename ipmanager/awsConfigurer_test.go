@@ -0,0 +1,340 @@
+package ipmanager
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// fakeAWS is a stand-in for the instance metadata service (IMDSv2) and the
+// EC2 query API of a VPC with two instances
+type fakeAWS struct {
+	*fakeAPI
+	privateIPs map[string][]string // by ENI
+	eipENI     string
+	eipIP      string
+	actions    []string
+	failAction string
+}
+
+const fakeIMDSToken = "imds-token"
+
+func newFakeAWS(t *testing.T) *fakeAWS {
+	t.Helper()
+	f := &fakeAWS{privateIPs: map[string][]string{
+		"eni-own":   {"10.0.0.5"},
+		"eni-other": {"10.0.0.6", "192.168.1.10"},
+	}}
+	f.fakeAPI = newFakeAPI(t, f.handle)
+	return f
+}
+
+func (f *fakeAWS) handle(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/latest/") {
+		f.handleIMDS(w, r)
+		return
+	}
+
+	auth := r.Header.Get("Authorization")
+	wantScope := "/eu-central-1/ec2/aws4_request"
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=ASIAROLE/") || !strings.Contains(auth, wantScope) ||
+		r.Header.Get("X-Amz-Security-Token") != "role-session" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `<Response><Errors><Error><Code>AuthFailure</Code><Message>not signed</Message></Error></Errors></Response>`)
+		return
+	}
+	_ = r.ParseForm()
+	action := r.PostForm.Get("Action")
+	f.actions = append(f.actions, action)
+	if action == f.failAction {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `<Response><Errors><Error><Code>InvalidParameterValue</Code><Message>%s failed</Message></Error></Errors></Response>`, action)
+		return
+	}
+
+	switch action {
+	case "DescribeNetworkInterfaces":
+		eni := r.PostForm.Get("NetworkInterfaceId.1")
+		fmt.Fprintf(w, `<DescribeNetworkInterfacesResponse><networkInterfaceSet><item><networkInterfaceId>%s</networkInterfaceId><privateIpAddressesSet>`, eni)
+		for _, ip := range f.privateIPs[eni] {
+			fmt.Fprintf(w, `<item><privateIpAddress>%s</privateIpAddress></item>`, ip)
+		}
+		fmt.Fprint(w, `</privateIpAddressesSet></item></networkInterfaceSet></DescribeNetworkInterfacesResponse>`)
+	case "DescribeAddresses":
+		fmt.Fprintf(w, `<DescribeAddressesResponse><addressesSet><item><allocationId>%s</allocationId><publicIp>203.0.113.1</publicIp><networkInterfaceId>%s</networkInterfaceId><privateIpAddress>%s</privateIpAddress></item></addressesSet></DescribeAddressesResponse>`,
+			r.PostForm.Get("AllocationId.1"), f.eipENI, f.eipIP)
+	case "AssignPrivateIpAddresses":
+		eni, ip := r.PostForm.Get("NetworkInterfaceId"), r.PostForm.Get("PrivateIpAddress.1")
+		for other, ips := range f.privateIPs {
+			if slices.Contains(ips, ip) && r.PostForm.Get("AllowReassignment") != "true" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `<Response><Errors><Error><Code>InvalidParameterValue</Code><Message>in use</Message></Error></Errors></Response>`)
+				return
+			}
+			f.privateIPs[other] = slices.DeleteFunc(ips, func(s string) bool { return s == ip })
+		}
+		f.privateIPs[eni] = append(f.privateIPs[eni], ip)
+		fmt.Fprint(w, `<AssignPrivateIpAddressesResponse><return>true</return></AssignPrivateIpAddressesResponse>`)
+	case "AssociateAddress":
+		f.eipENI, f.eipIP = r.PostForm.Get("NetworkInterfaceId"), r.PostForm.Get("PrivateIpAddress")
+		fmt.Fprint(w, `<AssociateAddressResponse><return>true</return></AssociateAddressResponse>`)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (f *fakeAWS) handleIMDS(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/latest/api/token" {
+		if r.Method != http.MethodPut || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, fakeIMDSToken)
+		return
+	}
+	if r.Header.Get("X-aws-ec2-metadata-token") != fakeIMDSToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/latest/meta-data/placement/region":
+		fmt.Fprint(w, "eu-central-1")
+	case "/latest/meta-data/network/interfaces/macs/00:11:22:33:44:55/interface-id":
+		fmt.Fprint(w, "eni-own")
+	case "/latest/meta-data/iam/security-credentials/":
+		fmt.Fprint(w, "vip-manager-role")
+	case "/latest/meta-data/iam/security-credentials/vip-manager-role":
+		fmt.Fprintf(w, `{"Code":"Success","AccessKeyId":"ASIAROLE","SecretAccessKey":"secret","Token":"role-session","Expiration":%q}`,
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeAWS) assigned(eni, ip string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Contains(f.privateIPs[eni], ip)
+}
+
+// newTestAWSConfigurer returns a configurer talking to f, with a mock for
+// the local address configuration. Credentials are taken from the instance
+// profile, so the tests must not run in parallel with others changing the
+// environment.
+func newTestAWSConfigurer(t *testing.T, f *fakeAWS, allocationID string) (*AWSConfigurer, *mockConfigurer) {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	c := newTestConfigurer(t, newAWSConfigurer, testHetznerIPConfiguration("192.168.1.10"), &vipconfig.Config{
+		AWSElasticIPAllocationID: allocationID,
+		AWSEC2Endpoint:           f.URL,
+		AWSIMDSEndpoint:          f.URL,
+	})
+	return c, mockLocal(&c.local)
+}
+
+// ---------------------------------------------------------------------------
+// newAWSConfigurer
+// ---------------------------------------------------------------------------
+
+func TestNewAWSConfigurer_IPv6(t *testing.T) {
+	t.Parallel()
+
+	if _, err := newAWSConfigurer(testHetznerIPConfiguration("2001:db8::10"), &vipconfig.Config{}); err == nil {
+		t.Error("expected an error for an IPv6 VIP")
+	}
+}
+
+func TestNewAWSConfigurer_Defaults(t *testing.T) {
+	t.Parallel()
+
+	c, err := newAWSConfigurer(testHetznerIPConfiguration("192.168.1.10"), &vipconfig.Config{})
+	if err != nil {
+		t.Fatalf("newAWSConfigurer() error = %v", err)
+	}
+	if c.imds.baseURL != defaultAWSIMDSEndpoint+"/latest" {
+		t.Errorf("unexpected metadata endpoint %s", c.imds.baseURL)
+	}
+	if _, ok := c.local.(*BasicConfigurer); !ok {
+		t.Errorf("the address should be added locally by a BasicConfigurer, got %T", c.local)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// discovery and credentials
+// ---------------------------------------------------------------------------
+
+func TestAWSConfigurer_discover(t *testing.T) {
+	f := newFakeAWS(t)
+	c, _ := newTestAWSConfigurer(t, f, "")
+	c.ec2Endpoint = ""
+
+	if err := c.discover(); err != nil {
+		t.Fatalf("discover() error = %v", err)
+	}
+	if c.region != "eu-central-1" || c.eni != "eni-own" {
+		t.Errorf("discovered region %q and ENI %q", c.region, c.eni)
+	}
+	if c.ec2Endpoint != "https://ec2.eu-central-1.amazonaws.com" {
+		t.Errorf("ec2Endpoint = %q, want the regional endpoint", c.ec2Endpoint)
+	}
+}
+
+func TestAWSConfigurer_discover_UnknownInterface(t *testing.T) {
+	f := newFakeAWS(t)
+	c, _ := newTestAWSConfigurer(t, f, "")
+	c.Iface.HardwareAddr = []byte{0x02, 0, 0, 0, 0, 0x99}
+
+	if err := c.discover(); err == nil {
+		t.Error("expected an error for an interface unknown to the metadata service")
+	}
+}
+
+func TestAWSConfigurer_getCredentials(t *testing.T) {
+	f := newFakeAWS(t)
+	c, _ := newTestAWSConfigurer(t, f, "")
+
+	creds, err := c.getCredentials()
+	if err != nil {
+		t.Fatalf("getCredentials() error = %v", err)
+	}
+	if creds.AccessKeyID != "ASIAROLE" || creds.SessionToken != "role-session" || creds.expired(time.Now()) {
+		t.Errorf("unexpected credentials %+v", creds)
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAENV")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+	if creds, err = c.getCredentials(); err != nil || creds.AccessKeyID != "AKIAENV" {
+		t.Errorf("expected the credentials from the environment, got %+v, %v", creds, err)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// queryAddress / configureAddress / deconfigureAddress
+// ---------------------------------------------------------------------------
+
+func TestAWSConfigurer_configureAddress(t *testing.T) {
+	f := newFakeAWS(t)
+	c, local := newTestAWSConfigurer(t, f, "")
+
+	local.shouldQueryReturn = true
+	if c.queryAddress() {
+		t.Fatal("queryAddress() = true while the VIP belongs to the other instance")
+	}
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if !f.assigned("eni-own", "192.168.1.10") || f.assigned("eni-other", "192.168.1.10") {
+		t.Errorf("the VIP should have moved to our ENI, got %v", f.privateIPs)
+	}
+	if local.configureCount != 1 {
+		t.Errorf("expected the address to be added locally once, got %d", local.configureCount)
+	}
+	if !c.queryAddress() {
+		t.Error("queryAddress() = false after the VIP was assigned")
+	}
+}
+
+func TestAWSConfigurer_queryAddress_NotLocal(t *testing.T) {
+	f := newFakeAWS(t)
+	f.privateIPs["eni-own"] = append(f.privateIPs["eni-own"], "192.168.1.10")
+	c, local := newTestAWSConfigurer(t, f, "")
+	local.shouldQueryReturn = false
+
+	if c.queryAddress() {
+		t.Error("queryAddress() must be false while the address is not configured locally")
+	}
+	if len(f.actions) != 0 {
+		t.Errorf("expected no API calls, got %v", f.actions)
+	}
+}
+
+// TestAWSConfigurer_ReassignedElsewhere covers the old leader after the new
+// one has taken the VIP over with AllowReassignment
+func TestAWSConfigurer_ReassignedElsewhere(t *testing.T) {
+	f := newFakeAWS(t)
+	c, local := newTestAWSConfigurer(t, f, "")
+	local.shouldQueryReturn = true
+
+	if c.queryAddress() {
+		t.Fatal("queryAddress() = true while the VIP belongs to the other instance")
+	}
+	if !c.queryLocalAddress() {
+		t.Fatal("queryLocalAddress() = false while the address is configured locally")
+	}
+
+	runApplyLoop(c, false)
+	if local.deconfigureCount == 0 {
+		t.Error("expected the address to be removed locally")
+	}
+}
+
+func TestAWSConfigurer_ElasticIP(t *testing.T) {
+	f := newFakeAWS(t)
+	f.eipENI, f.eipIP = "eni-other", "192.168.1.10"
+	c, local := newTestAWSConfigurer(t, f, "eipalloc-1234")
+	local.shouldQueryReturn = true
+
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if f.eipENI != "eni-own" || f.eipIP != "192.168.1.10" {
+		t.Errorf("Elastic IP is associated with %s/%s, want eni-own/192.168.1.10", f.eipENI, f.eipIP)
+	}
+	if !c.queryAddress() {
+		t.Error("queryAddress() = false after the Elastic IP was associated")
+	}
+
+	f.eipENI = "eni-other"
+	if c.queryAddress() {
+		t.Error("queryAddress() = true while the Elastic IP points elsewhere")
+	}
+}
+
+func TestAWSConfigurer_configureAddress_APIError(t *testing.T) {
+	f := newFakeAWS(t)
+	f.failAction = "AssignPrivateIpAddresses"
+	c, local := newTestAWSConfigurer(t, f, "")
+
+	if c.configureAddress() {
+		t.Error("configureAddress() should fail when the assignment fails")
+	}
+	if local.configureCount != 0 {
+		t.Error("the address must not be added locally when the assignment failed")
+	}
+}
+
+func TestAWSConfigurer_callEC2_Error(t *testing.T) {
+	f := newFakeAWS(t)
+	f.failAction = "DescribeNetworkInterfaces"
+	c, _ := newTestAWSConfigurer(t, f, "")
+	if err := c.discover(); err != nil {
+		t.Fatalf("discover() error = %v", err)
+	}
+
+	err := c.callEC2("DescribeNetworkInterfaces", map[string][]string{}, nil)
+	awsErr, ok := err.(*awsError)
+	if !ok || awsErr.Code != "InvalidParameterValue" {
+		t.Errorf("callEC2() error = %v, want an InvalidParameterValue *awsError", err)
+	}
+}
+
+func TestAWSConfigurer_deconfigureAddress(t *testing.T) {
+	f := newFakeAWS(t)
+	c, local := newTestAWSConfigurer(t, f, "")
+
+	if !c.deconfigureAddress() {
+		t.Error("deconfigureAddress() = false, want true")
+	}
+	if local.deconfigureCount != 1 {
+		t.Error("expected the address to be removed locally")
+	}
+	if len(f.actions) != 0 {
+		t.Errorf("deconfigureAddress() must leave the assignment to the next leader, got %v", f.actions)
+	}
+}
@@ -0,0 +1,77 @@
+package ipmanager
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The expected signatures are taken from the Signature Version 4 test suite
+// published by AWS, which uses these credentials and this point in time.
+var awsTestCredentials = &awsCredentials{
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+var awsTestTime = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+func TestSignAWSRequest_GetVanilla(t *testing.T) {
+	t.Parallel()
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	signAWSRequest(req, nil, awsTestCredentials, "us-east-1", "service", awsTestTime)
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, " +
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization = %q, want %q", got, want)
+	}
+	if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+		t.Errorf("X-Amz-Date = %q", got)
+	}
+}
+
+func TestSignAWSRequest_GetVanillaQuery(t *testing.T) {
+	t.Parallel()
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/?Param2=value2&Param1=value1", nil)
+	signAWSRequest(req, nil, awsTestCredentials, "us-east-1", "service", awsTestTime)
+
+	want := "Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"
+	if got := req.Header.Get("Authorization"); !strings.HasSuffix(got, want) {
+		t.Errorf("Authorization = %q, want suffix %q", got, want)
+	}
+}
+
+func TestSignAWSRequest_SessionToken(t *testing.T) {
+	t.Parallel()
+
+	creds := *awsTestCredentials
+	creds.SessionToken = "session"
+	req, _ := http.NewRequest(http.MethodPost, "https://ec2.us-east-1.amazonaws.com/", nil)
+	signAWSRequest(req, []byte("Action=DescribeAddresses"), &creds, "us-east-1", "ec2", awsTestTime)
+
+	if got := req.Header.Get("X-Amz-Security-Token"); got != "session" {
+		t.Errorf("X-Amz-Security-Token = %q, want %q", got, "session")
+	}
+	if got := req.Header.Get("Authorization"); !strings.Contains(got, "SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+		t.Errorf("the session token must be signed, Authorization = %q", got)
+	}
+}
+
+func TestAWSCredentials_expired(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	if (&awsCredentials{}).expired(now) {
+		t.Error("static credentials never expire")
+	}
+	if !(&awsCredentials{Expiration: now.Add(time.Minute)}).expired(now) {
+		t.Error("credentials about to expire should be refreshed")
+	}
+	if (&awsCredentials{Expiration: now.Add(time.Hour)}).expired(now) {
+		t.Error("credentials valid for an hour should not be refreshed")
+	}
+}
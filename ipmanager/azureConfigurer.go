@@ -0,0 +1,414 @@
+package ipmanager
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+const (
+	defaultAzureARMEndpoint  = "https://management.azure.com"
+	defaultAzureIMDSEndpoint = "http://169.254.169.254/metadata"
+	// azureARMResource is the audience of the managed identity token
+	azureARMResource = "https://management.azure.com/"
+
+	azureComputeAPIVersion = "2023-03-01"
+	azureNetworkAPIVersion = "2023-05-01"
+	azureIMDSAPIVersion    = "2021-02-01"
+
+	// azureOperationTimeout limits how long we wait for a long-running
+	// operation, e.g. the update of a network interface, to finish
+	azureOperationTimeout = 2 * time.Minute
+)
+
+// The AzureConfigurer manages the VIP as secondary IP configuration of the
+// network interface (NIC) of this VM, whenever manager-type `azure` is set.
+// The VIP is removed from the NIC of any other VM and added to ours through
+// Azure Resource Manager, then added locally like BasicConfigurer does.
+type AzureConfigurer struct {
+	*IPConfiguration
+	local        ipConfigurer
+	arm          *apiClient
+	imds         *apiClient
+	clientID     string
+	ipConfigName string
+
+	subscription string
+	nicID        string
+}
+
+// azureNIC is a network interface resource. Only the fields we need are
+// decoded, everything else is kept as is, as updates replace the whole NIC.
+type azureNIC struct {
+	ID               string
+	MAC              string
+	ipConfigurations []json.RawMessage
+	raw              map[string]json.RawMessage
+	properties       map[string]json.RawMessage
+}
+
+type azureIPConfiguration struct {
+	Name       string `json:"name"`
+	Properties struct {
+		PrivateIPAddress string `json:"privateIPAddress"`
+		Primary          bool   `json:"primary"`
+		Subnet           *struct {
+			ID string `json:"id"`
+		} `json:"subnet"`
+	} `json:"properties"`
+}
+
+func (n *azureNIC) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &n.raw); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(n.raw["properties"], &n.properties); err != nil {
+		return fmt.Errorf("invalid properties: %w", err)
+	}
+	_ = json.Unmarshal(n.raw["id"], &n.ID)
+	_ = json.Unmarshal(n.properties["macAddress"], &n.MAC)
+	if raw, ok := n.properties["ipConfigurations"]; ok {
+		if err := json.Unmarshal(raw, &n.ipConfigurations); err != nil {
+			return fmt.Errorf("invalid ipConfigurations: %w", err)
+		}
+	}
+	return nil
+}
+
+func (n *azureNIC) MarshalJSON() ([]byte, error) {
+	var err error
+	if n.properties["ipConfigurations"], err = json.Marshal(n.ipConfigurations); err != nil {
+		return nil, err
+	}
+	if n.raw["properties"], err = json.Marshal(n.properties); err != nil {
+		return nil, err
+	}
+	return json.Marshal(n.raw)
+}
+
+// findIPConfiguration returns the index of the IP configuration with the
+// given address, or -1
+func (n *azureNIC) findIPConfiguration(ip netip.Addr) int {
+	return slices.IndexFunc(n.ipConfigurations, func(raw json.RawMessage) bool {
+		var ipConfig azureIPConfiguration
+		if json.Unmarshal(raw, &ipConfig) != nil {
+			return false
+		}
+		addr, err := netip.ParseAddr(ipConfig.Properties.PrivateIPAddress)
+		return err == nil && addr == ip
+	})
+}
+
+// primarySubnet returns the ID of the subnet of the primary IP configuration
+func (n *azureNIC) primarySubnet() string {
+	for _, raw := range n.ipConfigurations {
+		var ipConfig azureIPConfiguration
+		if json.Unmarshal(raw, &ipConfig) == nil && ipConfig.Properties.Primary && ipConfig.Properties.Subnet != nil {
+			return ipConfig.Properties.Subnet.ID
+		}
+	}
+	return ""
+}
+
+// normalizeMAC brings the 00-0D-3A-... notation of Azure and the usual
+// 00:0d:3a:... notation into the same form
+func normalizeMAC(mac string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", ":", "").Replace(mac))
+}
+
+func newAzureConfigurer(config *IPConfiguration, conf *vipconfig.Config) (*AzureConfigurer, error) {
+	local, err := newBasicConfigurer(config)
+	if err != nil {
+		return nil, err
+	}
+	c := &AzureConfigurer{
+		IPConfiguration: config,
+		local:           local,
+		clientID:        conf.AzureClientID,
+		ipConfigName:    cmp.Or(conf.AzureIPConfigurationName, "vip-manager"),
+		imds: newAPIClient(cmp.Or(conf.AzureIMDSEndpoint, defaultAzureIMDSEndpoint), func(req *http.Request) error {
+			req.Header.Set("Metadata", "true")
+			return nil
+		}),
+	}
+	token := &apiToken{fetch: c.fetchToken}
+	c.arm = newAPIClient(cmp.Or(conf.AzureARMEndpoint, defaultAzureARMEndpoint), token.bearer)
+	return c, nil
+}
+
+// fetchToken gets an access token of the managed identity of this VM from
+// the instance metadata service
+func (c *AzureConfigurer) fetchToken() (string, time.Time, error) {
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {azureARMResource}}
+	if c.clientID != "" {
+		query.Set("client_id", c.clientID)
+	}
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := c.imds.do(http.MethodGet, "/identity/oauth2/token?"+query.Encode(), nil, &resp); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to get an access token for the managed identity: %w", err)
+	}
+	expiresOn, err := strconv.ParseInt(resp.ExpiresOn, 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("unexpected expires_on %q of the access token: %w", resp.ExpiresOn, err)
+	}
+	return resp.AccessToken, time.Unix(expiresOn, 0), nil
+}
+
+// discover finds the NIC of our interface, by its MAC address, among the
+// NICs of this VM
+func (c *AzureConfigurer) discover() error {
+	if c.nicID != "" {
+		return nil
+	}
+	var instance struct {
+		Compute struct {
+			SubscriptionID    string `json:"subscriptionId"`
+			ResourceGroupName string `json:"resourceGroupName"`
+			Name              string `json:"name"`
+		} `json:"compute"`
+	}
+	if err := c.imds.do(http.MethodGet, "/instance?api-version="+azureIMDSAPIVersion, nil, &instance); err != nil {
+		return fmt.Errorf("failed to query the instance metadata service: %w", err)
+	}
+	c.subscription = instance.Compute.SubscriptionID
+
+	var vm struct {
+		Properties struct {
+			NetworkProfile struct {
+				NetworkInterfaces []struct {
+					ID string `json:"id"`
+				} `json:"networkInterfaces"`
+			} `json:"networkProfile"`
+		} `json:"properties"`
+	}
+	vmPath := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s",
+		instance.Compute.SubscriptionID, instance.Compute.ResourceGroupName, instance.Compute.Name)
+	if err := c.arm.do(http.MethodGet, vmPath+"?api-version="+azureComputeAPIVersion, nil, &vm); err != nil {
+		return fmt.Errorf("failed to query VM %s: %w", instance.Compute.Name, err)
+	}
+	mac := normalizeMAC(c.Iface.HardwareAddr.String())
+	for _, ref := range vm.Properties.NetworkProfile.NetworkInterfaces {
+		nic, err := c.getNIC(ref.ID)
+		if err != nil {
+			return err
+		}
+		if normalizeMAC(nic.MAC) == mac {
+			c.nicID = nic.ID
+			log.Infof("Discovered network interface %s of %s", c.nicID, c.Iface.Name)
+			return nil
+		}
+	}
+	return fmt.Errorf("VM %s has no network interface with MAC %s", instance.Compute.Name, c.Iface.HardwareAddr)
+}
+
+func (c *AzureConfigurer) getNIC(id string) (*azureNIC, error) {
+	var nic azureNIC
+	if err := c.arm.do(http.MethodGet, id+"?api-version="+azureNetworkAPIVersion, nil, &nic); err != nil {
+		return nil, fmt.Errorf("failed to query network interface %s: %w", id, err)
+	}
+	return &nic, nil
+}
+
+// listNICs returns all network interfaces of the subscription
+func (c *AzureConfigurer) listNICs() ([]azureNIC, error) {
+	var all []azureNIC
+	path := fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Network/networkInterfaces?api-version=%s", c.subscription, azureNetworkAPIVersion)
+	for path != "" {
+		var resp struct {
+			Value    []azureNIC `json:"value"`
+			NextLink string     `json:"nextLink"`
+		}
+		if err := c.arm.do(http.MethodGet, path, nil, &resp); err != nil {
+			return nil, err
+		}
+		all = append(all, resp.Value...)
+		path = ""
+		if resp.NextLink != "" {
+			var err error
+			if path, err = c.arm.relativePath(resp.NextLink); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return all, nil
+}
+
+// waitForOperation polls the status of a long-running operation, as given
+// in the Azure-AsyncOperation header, until it is no longer in progress
+func (c *AzureConfigurer) waitForOperation(header http.Header) error {
+	asyncURL := header.Get("Azure-AsyncOperation")
+	if asyncURL == "" {
+		return nil
+	}
+	path, err := c.arm.relativePath(asyncURL)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(azureOperationTimeout)
+	for {
+		var op struct {
+			Status string `json:"status"`
+			Error  *struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err = c.arm.do(http.MethodGet, path, nil, &op); err != nil {
+			return fmt.Errorf("failed to query the operation status: %w", err)
+		}
+		switch op.Status {
+		case "Succeeded":
+			return nil
+		case "Failed", "Canceled":
+			if op.Error != nil {
+				return fmt.Errorf("operation %s: %s: %s", strings.ToLower(op.Status), op.Error.Code, op.Error.Message)
+			}
+			return fmt.Errorf("operation %s", strings.ToLower(op.Status))
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("operation did not finish within %s", azureOperationTimeout)
+		}
+		time.Sleep(time.Duration(max(c.RetryAfter, 1)) * time.Millisecond)
+	}
+}
+
+// putNIC replaces the network interface and waits for the update to finish
+func (c *AzureConfigurer) putNIC(nic *azureNIC) error {
+	header, err := c.arm.doHeader(http.MethodPut, nic.ID+"?api-version="+azureNetworkAPIVersion, nic, nil)
+	if err != nil {
+		return err
+	}
+	return c.waitForOperation(header)
+}
+
+// moveIPConfiguration removes the VIP from the NICs of all other VMs, as an
+// address can only be used once in a virtual network, and adds it to ours
+func (c *AzureConfigurer) moveIPConfiguration() error {
+	nics, err := c.listNICs()
+	if err != nil {
+		return fmt.Errorf("failed to list network interfaces: %w", err)
+	}
+	for i := range nics {
+		nic := &nics[i]
+		if strings.EqualFold(nic.ID, c.nicID) {
+			continue
+		}
+		idx := nic.findIPConfiguration(c.VIP)
+		if idx < 0 {
+			continue
+		}
+		log.Infof("Removing %s from network interface %s", c.VIP, nic.ID)
+		nic.ipConfigurations = slices.Delete(nic.ipConfigurations, idx, idx+1)
+		if err = c.putNIC(nic); err != nil {
+			return fmt.Errorf("failed to remove %s from network interface %s: %w", c.VIP, nic.ID, err)
+		}
+	}
+
+	// query our NIC again, the update must not undo concurrent changes
+	own, err := c.getNIC(c.nicID)
+	if err != nil {
+		return err
+	}
+	if own.findIPConfiguration(c.VIP) >= 0 {
+		return nil
+	}
+	subnet := own.primarySubnet()
+	if subnet == "" {
+		return fmt.Errorf("network interface %s has no primary IP configuration", c.nicID)
+	}
+	version := "IPv4"
+	if c.VIP.Is6() {
+		version = "IPv6"
+	}
+	ipConfig, err := json.Marshal(map[string]any{
+		"name": c.ipConfigName,
+		"properties": map[string]any{
+			"privateIPAddress":          c.VIP.String(),
+			"privateIPAllocationMethod": "Static",
+			"privateIPAddressVersion":   version,
+			"primary":                   false,
+			"subnet":                    map[string]string{"id": subnet},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	own.ipConfigurations = append(own.ipConfigurations, ipConfig)
+	return c.putNIC(own)
+}
+
+func (c *AzureConfigurer) queryAddress() bool {
+	if !c.local.queryAddress() {
+		return false
+	}
+	if err := c.discover(); err != nil {
+		log.Error(err)
+		return false
+	}
+	nic, err := c.getNIC(c.nicID)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	if nic.findIPConfiguration(c.VIP) >= 0 {
+		return true
+	}
+	owner, err := c.findOwner()
+	if err != nil {
+		log.Errorf("Failed to look up the network interface of %s: %s", c.VIP, err)
+	} else {
+		log.Debugf("%s is assigned to network interface %q", c.VIP, owner)
+	}
+	return false
+}
+
+func (c *AzureConfigurer) queryLocalAddress() bool {
+	return c.local.queryAddress()
+}
+
+// findOwner returns the ID of the network interface the VIP is assigned to,
+// it is empty if the VIP isn't assigned at all
+func (c *AzureConfigurer) findOwner() (string, error) {
+	nics, err := c.listNICs()
+	if err != nil {
+		return "", err
+	}
+	for _, nic := range nics {
+		if nic.findIPConfiguration(c.VIP) >= 0 {
+			return nic.ID, nil
+		}
+	}
+	return "", nil
+}
+
+func (c *AzureConfigurer) configureAddress() bool {
+	if err := c.discover(); err != nil {
+		log.Error(err)
+		return false
+	}
+	if err := c.moveIPConfiguration(); err != nil {
+		log.Errorf("Failed to move %s to this VM: %s", c.VIP, err)
+		return false
+	}
+	log.Infof("%s was successfully moved to network interface %s", c.VIP, c.nicID)
+	return c.local.configureAddress()
+}
+
+func (c *AzureConfigurer) deconfigureAddress() bool {
+	// The IP configuration stays on our NIC, the next leader removes it
+	// before adding it to its own. Removing it here would be a second,
+	// conflicting update of our NIC at the same time.
+	return c.local.deconfigureAddress()
+}
@@ -0,0 +1,383 @@
+package ipmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// fakeAzure is a stand-in for Azure Resource Manager and the instance
+// metadata service of a subscription with two VMs. Long-running operations
+// succeed after being polled twice.
+type fakeAzure struct {
+	*fakeAPI
+	nics       map[string]json.RawMessage // by ID
+	operations map[string]int
+	failOps    bool
+	tokens     int
+	puts       []string
+}
+
+const (
+	azureSubnet  = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet/subnets/default"
+	azureNIC1    = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/networkInterfaces/db1-nic"
+	azureNIC2    = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/networkInterfaces/db2-nic"
+	azureNICData = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/networkInterfaces/db1-data"
+)
+
+func newFakeAzure(t *testing.T) *fakeAzure {
+	t.Helper()
+	f := &fakeAzure{
+		nics: map[string]json.RawMessage{
+			azureNIC1:    testAzureNIC(azureNIC1, "02-00-00-00-00-01", "10.0.0.4"),
+			azureNICData: testAzureNIC(azureNICData, "00-11-22-33-44-55", "10.0.0.5"),
+			azureNIC2:    testAzureNIC(azureNIC2, "02-00-00-00-00-02", "10.0.0.6"),
+		},
+		operations: map[string]int{},
+	}
+	f.fakeAPI = newFakeAPI(t, f.handle)
+	return f
+}
+
+// testAzureNIC returns a NIC with a primary IP configuration for primaryIP
+// and secondary ones for secondaryIPs
+func testAzureNIC(id, mac, primaryIP string, secondaryIPs ...string) json.RawMessage {
+	ipConfig := func(name, ip string, primary bool) map[string]any {
+		return map[string]any{
+			"id":   id + "/ipConfigurations/" + name,
+			"name": name,
+			"properties": map[string]any{
+				"privateIPAddress":          ip,
+				"privateIPAllocationMethod": "Static",
+				"primary":                   primary,
+				"subnet":                    map[string]string{"id": azureSubnet},
+				"provisioningState":         "Succeeded",
+			},
+		}
+	}
+	ipConfigs := []any{ipConfig("ipconfig1", primaryIP, true)}
+	for i, ip := range secondaryIPs {
+		ipConfigs = append(ipConfigs, ipConfig(fmt.Sprintf("secondary%d", i), ip, false))
+	}
+	nic, _ := json.Marshal(map[string]any{
+		"id":       id,
+		"name":     id[strings.LastIndex(id, "/")+1:],
+		"location": "westeurope",
+		"tags":     map[string]string{"team": "dba"},
+		"properties": map[string]any{
+			"macAddress":                  mac,
+			"enableAcceleratedNetworking": true,
+			"ipConfigurations":            ipConfigs,
+		},
+	})
+	return nic
+}
+
+func (f *fakeAzure) handle(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/metadata/") {
+		f.handleIMDS(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer arm-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Query().Get("api-version") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch path := r.URL.Path; {
+	case path == "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/db1":
+		fmt.Fprintf(w, `{"properties":{"networkProfile":{"networkInterfaces":[{"id":%q},{"id":%q}]}}}`, azureNIC1, azureNICData)
+	case path == "/subscriptions/sub/providers/Microsoft.Network/networkInterfaces":
+		// one NIC per page, to exercise nextLink
+		ids := []string{azureNIC1, azureNICData, azureNIC2}
+		page := 0
+		fmt.Sscanf(r.URL.Query().Get("page"), "%d", &page)
+		resp := map[string]any{"value": []json.RawMessage{f.nics[ids[page]]}}
+		if page+1 < len(ids) {
+			resp["nextLink"] = fmt.Sprintf("%s%s?api-version=2023-05-01&page=%d", f.URL, path, page+1)
+		}
+		writeJSON(w, resp)
+	case strings.HasPrefix(path, "/operations/"):
+		name := strings.TrimPrefix(path, "/operations/")
+		f.operations[name]++
+		switch {
+		case f.operations[name] < 2:
+			fmt.Fprint(w, `{"status":"InProgress"}`)
+		case f.failOps:
+			fmt.Fprint(w, `{"status":"Failed","error":{"code":"PrivateIPAddressInUse","message":"address in use"}}`)
+		default:
+			fmt.Fprint(w, `{"status":"Succeeded"}`)
+		}
+	case f.nics[path] != nil && r.Method == http.MethodGet:
+		_, _ = w.Write(f.nics[path])
+	case f.nics[path] != nil && r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		f.nics[path] = body
+		f.puts = append(f.puts, path)
+		name := fmt.Sprintf("op%d", len(f.operations)+1)
+		f.operations[name] = 0
+		w.Header().Set("Azure-AsyncOperation", f.URL+"/operations/"+name+"?api-version=2023-05-01")
+		_, _ = w.Write(body)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeAzure) handleIMDS(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Metadata") != "true" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch r.URL.Path {
+	case "/metadata/instance":
+		fmt.Fprint(w, `{"compute":{"subscriptionId":"sub","resourceGroupName":"rg","name":"db1"}}`)
+	case "/metadata/identity/oauth2/token":
+		if r.URL.Query().Get("resource") != "https://management.azure.com/" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.tokens++
+		fmt.Fprintf(w, `{"access_token":"arm-token","expires_on":"%d","token_type":"Bearer"}`, time.Now().Add(time.Hour).Unix())
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// ipConfigurations returns the addresses of the IP configurations of a NIC
+func (f *fakeAzure) ipConfigurations(t *testing.T, id string) []string {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var nic azureNIC
+	if err := json.Unmarshal(f.nics[id], &nic); err != nil {
+		t.Fatalf("invalid NIC %s: %v", id, err)
+	}
+	var ips []string
+	for _, raw := range nic.ipConfigurations {
+		var ipConfig azureIPConfiguration
+		_ = json.Unmarshal(raw, &ipConfig)
+		ips = append(ips, ipConfig.Properties.PrivateIPAddress)
+	}
+	return ips
+}
+
+func newTestAzureConfigurer(t *testing.T, f *fakeAzure) (*AzureConfigurer, *mockConfigurer) {
+	t.Helper()
+	c := newTestConfigurer(t, newAzureConfigurer, testHetznerIPConfiguration("10.0.0.10"), &vipconfig.Config{
+		AzureARMEndpoint:  f.URL,
+		AzureIMDSEndpoint: f.URL + "/metadata",
+	})
+	return c, mockLocal(&c.local)
+}
+
+// ---------------------------------------------------------------------------
+// azureNIC
+// ---------------------------------------------------------------------------
+
+func TestAzureNIC_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	var nic azureNIC
+	if err := json.Unmarshal(testAzureNIC(azureNIC1, "02-00-00-00-00-01", "10.0.0.4", "10.0.0.10"), &nic); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if nic.ID != azureNIC1 || nic.MAC != "02-00-00-00-00-01" || nic.primarySubnet() != azureSubnet {
+		t.Errorf("unexpected NIC %+v", nic)
+	}
+	nic.ipConfigurations = nic.ipConfigurations[:1]
+
+	b, err := json.Marshal(&nic)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	var got map[string]any
+	_ = json.Unmarshal(b, &got)
+	properties := got["properties"].(map[string]any)
+	if got["location"] != "westeurope" || properties["enableAcceleratedNetworking"] != true {
+		t.Errorf("unknown fields were not preserved: %s", b)
+	}
+	if n := len(properties["ipConfigurations"].([]any)); n != 1 {
+		t.Errorf("expected 1 IP configuration, got %d", n)
+	}
+}
+
+func TestNormalizeMAC(t *testing.T) {
+	t.Parallel()
+
+	if normalizeMAC("00-0D-3A-12-34-ab") != normalizeMAC("00:0d:3a:12:34:ab") {
+		t.Error("MAC addresses in Azure and Linux notation should match")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// queryAddress / configureAddress / deconfigureAddress
+// ---------------------------------------------------------------------------
+
+func TestAzureConfigurer_discover(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeAzure(t)
+	c, _ := newTestAzureConfigurer(t, f)
+
+	if err := c.discover(); err != nil {
+		t.Fatalf("discover() error = %v", err)
+	}
+	if c.nicID != azureNICData {
+		t.Errorf("nicID = %s, want the NIC with the MAC of the interface", c.nicID)
+	}
+}
+
+func TestAzureConfigurer_discover_UnknownInterface(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeAzure(t)
+	c, _ := newTestAzureConfigurer(t, f)
+	c.Iface.HardwareAddr = []byte{0x02, 0, 0, 0, 0, 0x99}
+
+	if err := c.discover(); err == nil {
+		t.Error("expected an error for an interface the VM does not have")
+	}
+}
+
+func TestAzureConfigurer_configureAddress(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeAzure(t)
+	f.nics[azureNIC2] = testAzureNIC(azureNIC2, "02-00-00-00-00-02", "10.0.0.6", "10.0.0.10", "10.0.0.11")
+	c, local := newTestAzureConfigurer(t, f)
+
+	if c.queryAddress() {
+		t.Fatal("queryAddress() = true while the VIP belongs to the other VM")
+	}
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if got := f.ipConfigurations(t, azureNIC2); strings.Join(got, ",") != "10.0.0.6,10.0.0.11" {
+		t.Errorf("IP configurations of the other NIC = %v", got)
+	}
+	if got := f.ipConfigurations(t, azureNICData); strings.Join(got, ",") != "10.0.0.5,10.0.0.10" {
+		t.Errorf("IP configurations of our NIC = %v", got)
+	}
+	for name, polls := range f.operations {
+		if polls != 2 {
+			t.Errorf("operation %s was polled %d times, want until it succeeded", name, polls)
+		}
+	}
+	if local.configureCount != 1 {
+		t.Errorf("expected the address to be added locally once, got %d", local.configureCount)
+	}
+	if !c.queryAddress() {
+		t.Error("queryAddress() = false after the VIP was moved")
+	}
+	if f.tokens != 1 {
+		t.Errorf("expected the access token to be fetched once, got %d", f.tokens)
+	}
+}
+
+func TestAzureConfigurer_configureAddress_AlreadyAssigned(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeAzure(t)
+	f.nics[azureNICData] = testAzureNIC(azureNICData, "00-11-22-33-44-55", "10.0.0.5", "10.0.0.10")
+	c, _ := newTestAzureConfigurer(t, f)
+
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if len(f.puts) != 0 {
+		t.Errorf("expected no updates, got %v", f.puts)
+	}
+}
+
+func TestAzureConfigurer_configureAddress_OperationFails(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeAzure(t)
+	f.failOps = true
+	c, local := newTestAzureConfigurer(t, f)
+
+	if c.configureAddress() {
+		t.Error("configureAddress() should fail when the operation fails")
+	}
+	if local.configureCount != 0 {
+		t.Error("the address must not be added locally when the operation failed")
+	}
+}
+
+func TestAzureConfigurer_queryAddress_NotLocal(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeAzure(t)
+	f.nics[azureNICData] = testAzureNIC(azureNICData, "00-11-22-33-44-55", "10.0.0.5", "10.0.0.10")
+	c, local := newTestAzureConfigurer(t, f)
+	local.shouldQueryReturn = false
+
+	if c.queryAddress() {
+		t.Error("queryAddress() must be false while the address is not configured locally")
+	}
+}
+
+// TestAzureConfigurer_MovedElsewhere covers the old leader after the new one
+// has taken the IP configuration over
+func TestAzureConfigurer_MovedElsewhere(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeAzure(t)
+	f.nics[azureNIC2] = testAzureNIC(azureNIC2, "02-00-00-00-00-02", "10.0.0.6", "10.0.0.10")
+	c, local := newTestAzureConfigurer(t, f)
+
+	if c.queryAddress() {
+		t.Fatal("queryAddress() = true while the IP configuration belongs to the other VM")
+	}
+	if owner, err := c.findOwner(); err != nil || owner != azureNIC2 {
+		t.Errorf("findOwner() = %q, %v, want %q", owner, err, azureNIC2)
+	}
+	if !c.queryLocalAddress() {
+		t.Fatal("queryLocalAddress() = false while the address is configured locally")
+	}
+	runApplyLoop(c, false)
+	if local.deconfigureCount == 0 {
+		t.Error("expected the address to be removed locally")
+	}
+	if len(f.puts) != 0 {
+		t.Errorf("the IP configuration of the other VM must be left alone, got %v", f.puts)
+	}
+}
+
+func TestAzureConfigurer_waitForOperation_ForeignURL(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeAzure(t)
+	c, _ := newTestAzureConfigurer(t, f)
+
+	header := http.Header{"Azure-Asyncoperation": {"https://attacker.example.com/operations/1"}}
+	if err := c.waitForOperation(header); err == nil {
+		t.Error("expected an error for an operation URL outside of the ARM endpoint")
+	}
+}
+
+func TestAzureConfigurer_deconfigureAddress(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeAzure(t)
+	c, local := newTestAzureConfigurer(t, f)
+
+	if !c.deconfigureAddress() {
+		t.Error("deconfigureAddress() = false, want true")
+	}
+	if local.deconfigureCount != 1 {
+		t.Error("expected the address to be removed locally")
+	}
+	if len(f.puts) != 0 {
+		t.Errorf("deconfigureAddress() must leave the VIP to the next leader, got %v", f.puts)
+	}
+}
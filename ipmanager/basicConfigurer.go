@@ -2,50 +2,157 @@ package ipmanager
 
 import (
 	"errors"
+	"fmt"
 	"net"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
+// Errors reported when adding, removing or querying the virtual ip locally
+var (
+	ErrAddressExists    = errors.New("address already exists")
+	ErrAddressNotFound  = errors.New("address not assigned")
+	ErrNoSuchDevice     = errors.New("no such device")
+	ErrPermissionDenied = errors.New("operation not permitted")
+)
+
 // BasicConfigurer can be used to enable vip-management on nodes
 // that handle their own network connection, in setups where it is
-// sufficient to add the virtual ip using `ip addr add ...` .
+// sufficient to add the virtual ip to a local interface
+// (through rtnetlink on Linux, the IP Helper API on Windows).
 // After adding the virtual ip to the specified interface,
-// a gratuitous ARP package is sent out to update the tables of
-// nearby routers and other devices.
+// a gratuitous ARP package (or an unsolicited Neighbor Advertisement
+// for IPv6) is sent out to update the tables of nearby routers and
+// other devices.
 type BasicConfigurer struct {
 	*IPConfiguration
 	ntecontext uint32 //used by Windows to delete IP address
+
+	// sendPacket puts a frame on the wire, defaults to the platform's raw socket implementation
+	sendPacket func(iface net.Interface, packetData []byte) error
+	// probe looks for other hosts using the VIP, defaults to probeAddress
+	probe func() (net.HardwareAddr, error)
+	// noAnnouncements is set by withoutAnnouncements
+	noAnnouncements bool
+
+	announceMutex sync.Mutex
+	announceStop  chan struct{}
+	announceDone  chan struct{}
+}
+
+// basicConfigurerOption changes the behaviour of a BasicConfigurer created
+// by newBasicConfigurer
+type basicConfigurerOption func(*BasicConfigurer)
+
+// withoutAnnouncements is for interfaces nobody listens on for
+// announcements, like a dummy or the loopback. Neither announcements nor
+// probes are sent, so the interface doesn't need a hardware address.
+func withoutAnnouncements() basicConfigurerOption {
+	return func(c *BasicConfigurer) {
+		c.noAnnouncements = true
+	}
 }
 
-func newBasicConfigurer(config *IPConfiguration) (*BasicConfigurer, error) {
+func newBasicConfigurer(config *IPConfiguration, opts ...basicConfigurerOption) (*BasicConfigurer, error) {
 	c := &BasicConfigurer{IPConfiguration: config, ntecontext: 0}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.noAnnouncements {
+		return c, nil
+	}
 	if c.Iface.HardwareAddr == nil || c.Iface.HardwareAddr.String() == "00:00:00:00:00:00" {
 		return nil, errors.New(`cannot run vip-manager on the loopback device
 as its hardware address is the local address (00:00:00:00:00:00),
 which prohibits sending of gratuitous ARP messages`)
 	}
+	switch c.ARPMode {
+	case "", arpModeRequest, arpModeReply, arpModeBoth:
+	default:
+		return nil, fmt.Errorf("unsupported arp-mode %q, supported values: request, reply, both", c.ARPMode)
+	}
 	return c, nil
 }
 
-// queryAddress returns if the address is assigned
-func (c *BasicConfigurer) queryAddress() bool {
-	iface, err := net.InterfaceByName(c.Iface.Name)
-	if err != nil {
-		return false
+// Supported values for arp-mode
+const (
+	arpModeRequest = "request"
+	arpModeReply   = "reply"
+	arpModeBoth    = "both"
+)
+
+// startAnnouncing sends the configured burst of announcements for the VIP
+// in the background and keeps repeating it every arp-refresh-interval
+// until stopAnnouncing is called
+func (c *BasicConfigurer) startAnnouncing() {
+	c.stopAnnouncing()
+	if c.noAnnouncements {
+		return
+	}
+
+	c.announceMutex.Lock()
+	defer c.announceMutex.Unlock()
+	c.announceStop = make(chan struct{})
+	c.announceDone = make(chan struct{})
+	go c.announceLoop(c.announceStop, c.announceDone)
+}
+
+// stopAnnouncing stops a running announcement loop and waits for it to exit
+func (c *BasicConfigurer) stopAnnouncing() {
+	c.announceMutex.Lock()
+	stop, done := c.announceStop, c.announceDone
+	c.announceStop, c.announceDone = nil, nil
+	c.announceMutex.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (c *BasicConfigurer) announceLoop(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	for {
+		c.announce(stop)
+		if c.ARPRefreshInterval <= 0 {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Duration(c.ARPRefreshInterval) * time.Millisecond):
+		}
 	}
-	addresses, err := iface.Addrs()
+}
+
+// announce sends arp-count rounds of announcements, arp-interval apart
+func (c *BasicConfigurer) announce(stop <-chan struct{}) {
+	packets, err := c.createAnnouncements()
 	if err != nil {
-		return false
+		log.Warn("Failed to compose address announcement: ", err)
+		return
+	}
+	send := c.sendPacket
+	if send == nil {
+		send = sendPacket
 	}
-	for _, address := range addresses {
-		if strings.Contains(address.String(), c.getCIDR()) {
-			return true
+	for i := range max(c.ARPCount, 1) {
+		if i > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Duration(c.ARPInterval) * time.Millisecond):
+			}
+		}
+		for _, packet := range packets {
+			if err := send(c.Iface, packet); err != nil {
+				log.Warnf("Failed to send address announcement for %s on %s: %v", c.VIP, c.Iface.Name, err)
+			}
 		}
 	}
-	return false
 }
 
 const (
@@ -53,8 +160,46 @@ const (
 	IPv4AddressSize = 4
 )
 
-// createGratuitousARP prepares a packet with a gratuitous ARP request
+// createAnnouncements prepares the packets that tell the neighbours about the
+// new owner of the VIP: gratuitous ARP requests and/or replies (depending on
+// arp-mode) for IPv4, an unsolicited Neighbor Advertisement for IPv6
+func (c *BasicConfigurer) createAnnouncements() ([][]byte, error) {
+	var creators []func() ([]byte, error)
+	switch {
+	case c.VIP.Is6():
+		creators = append(creators, c.createUnsolicitedNA)
+	case c.ARPMode == arpModeRequest:
+		creators = append(creators, c.createGratuitousARPRequest)
+	case c.ARPMode == arpModeBoth:
+		creators = append(creators, c.createGratuitousARPRequest, c.createGratuitousARP)
+	default:
+		creators = append(creators, c.createGratuitousARP)
+	}
+	packets := make([][]byte, 0, len(creators))
+	for _, create := range creators {
+		packet, err := create()
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, packet)
+	}
+	return packets, nil
+}
+
+// createGratuitousARP prepares a packet with a gratuitous ARP reply
 func (c *BasicConfigurer) createGratuitousARP() ([]byte, error) {
+	// Gratuitous ARP replies target the sender itself
+	return c.createARP(layers.ARPReply, c.VIP.AsSlice(), c.Iface.HardwareAddr)
+}
+
+// createGratuitousARPRequest prepares a packet with a gratuitous ARP request,
+// which some devices only accept instead of a reply (RFC 5227, section 3)
+func (c *BasicConfigurer) createGratuitousARPRequest() ([]byte, error) {
+	return c.createARP(layers.ARPRequest, c.VIP.AsSlice(), net.HardwareAddr{0, 0, 0, 0, 0, 0})
+}
+
+// createARP prepares a broadcast ARP packet asking for or announcing the VIP
+func (c *BasicConfigurer) createARP(operation uint16, sourceProtAddress []byte, dstHwAddress net.HardwareAddr) ([]byte, error) {
 	// Create the Ethernet layer
 	ethLayer := &layers.Ethernet{
 		SrcMAC:       c.Iface.HardwareAddr,
@@ -68,10 +213,10 @@ func (c *BasicConfigurer) createGratuitousARP() ([]byte, error) {
 		Protocol:          layers.EthernetTypeIPv4,
 		HwAddressSize:     MACAddressSize,
 		ProtAddressSize:   IPv4AddressSize,
-		Operation:         layers.ARPReply, // Gratuitous ARP is sent as a reply
+		Operation:         operation,
 		SourceHwAddress:   c.Iface.HardwareAddr,
-		SourceProtAddress: c.VIP.AsSlice(),
-		DstHwAddress:      c.Iface.HardwareAddr, // Gratuitous ARP targets itself
+		SourceProtAddress: sourceProtAddress,
+		DstHwAddress:      dstHwAddress,
 		DstProtAddress:    c.VIP.AsSlice(),
 	}
 
@@ -88,3 +233,52 @@ func (c *BasicConfigurer) createGratuitousARP() ([]byte, error) {
 
 	return buffer.Bytes(), nil
 }
+
+// createUnsolicitedNA prepares a packet with an unsolicited ICMPv6 Neighbor
+// Advertisement (RFC 4861, section 7.2.6) sent to all nodes, with the
+// override flag set so that existing cache entries are replaced
+func (c *BasicConfigurer) createUnsolicitedNA() ([]byte, error) {
+	allNodes := net.ParseIP("ff02::1")
+
+	ethLayer := &layers.Ethernet{
+		SrcMAC:       c.Iface.HardwareAddr,
+		DstMAC:       net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}, // all-nodes multicast
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+
+	ipLayer := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   255, // required for neighbor discovery messages
+		SrcIP:      c.VIP.AsSlice(),
+		DstIP:      allNodes,
+	}
+
+	icmpLayer := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0),
+	}
+	if err := icmpLayer.SetNetworkLayerForChecksum(ipLayer); err != nil {
+		return nil, err
+	}
+
+	naLayer := &layers.ICMPv6NeighborAdvertisement{
+		Flags:         0x20, // override, not solicited, not a router
+		TargetAddress: c.VIP.AsSlice(),
+		Options: layers.ICMPv6Options{{
+			Type: layers.ICMPv6OptTargetAddress,
+			Data: c.Iface.HardwareAddr,
+		}},
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+
+	if err := gopacket.SerializeLayers(buffer, opts, ethLayer, ipLayer, icmpLayer, naLayer); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
@@ -1,9 +1,13 @@
 package ipmanager
 
 import (
+	"errors"
+	"fmt"
 	"net"
-	"os/exec"
 	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 // htons converts uint16 to network byte order
@@ -11,6 +15,8 @@ func htons(i uint16) uint16 {
 	return (i<<8)&0xff00 | i>>8
 }
 
+var sendPacket = sendPacketLinux
+
 func sendPacketLinux(iface net.Interface, packetData []byte) error {
 	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
 	if err != nil {
@@ -20,6 +26,10 @@ func sendPacketLinux(iface net.Interface, packetData []byte) error {
 
 	var sll syscall.SockaddrLinklayer
 	sll.Protocol = htons(syscall.ETH_P_ARP)
+	if len(packetData) >= 14 {
+		// use the EtherType of the frame, which is already in network byte order
+		sll.Protocol = uint16(packetData[13])<<8 | uint16(packetData[12])
+	}
 	sll.Ifindex = iface.Index
 	sll.Hatype = syscall.ARPHRD_ETHER
 	sll.Pkttype = syscall.PACKET_BROADCAST
@@ -34,42 +44,123 @@ func sendPacketLinux(iface net.Interface, packetData []byte) error {
 // configureAddress assigns virtual IP address
 func (c *BasicConfigurer) configureAddress() bool {
 	log.Infof("Configuring address %s on %s", c.getCIDR(), c.Iface.Name)
-	result := c.runAddressConfiguration("add")
-	if result {
-		if buff, err := c.createGratuitousARP(); err != nil {
-			log.Warn("Failed to compose gratuitous ARP request: ", err)
-		} else {
-			if err := sendPacketLinux(c.Iface, buff); err != nil {
-				log.Warn("Failed to send gratuitous ARP request: ", err)
-			}
-		}
+	if c.AddressProbe && !c.claimAddress() {
+		return false
+	}
+	err := c.addAddress()
+	switch {
+	case errors.Is(err, ErrAddressExists):
+		log.Infof("Address %s is already present on %s", c.getCIDR(), c.Iface.Name)
+	case err != nil:
+		log.Errorf("Failed to add address %s on %s: %v", c.getCIDR(), c.Iface.Name, err)
+		return false
 	}
 
-	return result
+	c.startAnnouncing()
+	return true
 }
 
 // deconfigureAddress drops virtual IP address
 func (c *BasicConfigurer) deconfigureAddress() bool {
 	log.Infof("Removing address %s on %s", c.getCIDR(), c.Iface.Name)
-	return c.runAddressConfiguration("delete")
+	c.stopAnnouncing()
+	err := c.deleteAddress()
+	switch {
+	case errors.Is(err, ErrAddressNotFound):
+		log.Infof("Address %s is not present on %s", c.getCIDR(), c.Iface.Name)
+	case err != nil:
+		log.Errorf("Failed to remove address %s on %s: %v", c.getCIDR(), c.Iface.Name, err)
+		return false
+	}
+	return true
 }
 
-func (c *BasicConfigurer) runAddressConfiguration(action string) bool {
-	cmd := exec.Command("ip", "addr", action,
-		c.getCIDR(),
-		"dev", c.Iface.Name)
-	output, err := cmd.CombinedOutput()
-
-	switch err.(type) {
-	case *exec.ExitError:
-		log.Infof("Got error %s", output)
-
+// queryAddress returns if the address is assigned
+func (c *BasicConfigurer) queryAddress() bool {
+	link, err := c.link()
+	if err != nil {
 		return false
 	}
+	addrs, err := netlink.AddrList(link, c.family())
 	if err != nil {
-		log.Infof("Error running ip address %s %s on %s: %s",
-			action, c.VIP, c.Iface.Name, err)
+		log.Warnf("Failed to list addresses on %s: %v", c.Iface.Name, netlinkError(err))
 		return false
 	}
-	return true
+	want := c.netlinkAddr()
+	for _, addr := range addrs {
+		if addr.Equal(*want) {
+			return true
+		}
+	}
+	return false
+}
+
+// addAddress adds the VIP to the interface through rtnetlink
+func (c *BasicConfigurer) addAddress() error {
+	link, err := c.link()
+	if err != nil {
+		return err
+	}
+	return netlinkError(netlink.AddrAdd(link, c.netlinkAddr()))
+}
+
+// deleteAddress removes the VIP from the interface through rtnetlink
+func (c *BasicConfigurer) deleteAddress() error {
+	link, err := c.link()
+	if err != nil {
+		return err
+	}
+	return netlinkError(netlink.AddrDel(link, c.netlinkAddr()))
+}
+
+// link looks up the configured interface by name, so that an interface
+// that was recreated since startup is still found
+func (c *BasicConfigurer) link() (netlink.Link, error) {
+	link, err := netlink.LinkByName(c.Iface.Name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil, fmt.Errorf("%w: %s", ErrNoSuchDevice, c.Iface.Name)
+		}
+		return nil, netlinkError(err)
+	}
+	return link, nil
+}
+
+func (c *BasicConfigurer) family() int {
+	if c.VIP.Is6() {
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_V4
+}
+
+func (c *BasicConfigurer) netlinkAddr() *netlink.Addr {
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: c.VIP.AsSlice(), Mask: c.Netmask}}
+	if c.VIP.Is6() {
+		// Skip Duplicate Address Detection, otherwise the VIP stays
+		// "tentative" and unusable for a while after every failover, or
+		// for good if the old owner still answers for it
+		addr.Flags = unix.IFA_F_NODAD
+	}
+	return addr
+}
+
+// netlinkError translates the errno returned by the kernel into one of the
+// typed address errors, keeping the original error in the chain
+func netlinkError(err error) error {
+	var errno unix.Errno
+	if !errors.As(err, &errno) {
+		return err
+	}
+	switch errno {
+	case unix.EEXIST:
+		return fmt.Errorf("%w: %w", ErrAddressExists, err)
+	case unix.EADDRNOTAVAIL:
+		return fmt.Errorf("%w: %w", ErrAddressNotFound, err)
+	case unix.ENODEV:
+		return fmt.Errorf("%w: %w", ErrNoSuchDevice, err)
+	case unix.EPERM, unix.EACCES:
+		return fmt.Errorf("%w: %w", ErrPermissionDenied, err)
+	}
+	return err
 }
@@ -2,9 +2,12 @@ package ipmanager
 
 import (
 	"bytes"
+	"errors"
 	"net"
 	"net/netip"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -46,6 +49,33 @@ func TestNewBasicConfigurer_LoopbackMAC(t *testing.T) {
 	}
 }
 
+func TestNewBasicConfigurer_WithoutAnnouncements(t *testing.T) {
+	t.Parallel()
+
+	cfg := testIPConfiguration("192.168.1.10")
+	cfg.Iface.HardwareAddr = net.HardwareAddr{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	cfg.AddressProbe = true
+	c, err := newBasicConfigurer(cfg, withoutAnnouncements())
+	if err != nil {
+		t.Fatalf("expected the loopback to be accepted without announcements, got: %v", err)
+	}
+	recorder := &packetRecorder{}
+	c.sendPacket = recorder.send
+	c.probe = func() (net.HardwareAddr, error) {
+		t.Error("the address must not be probed for")
+		return nil, nil
+	}
+
+	if !c.claimAddress() {
+		t.Error("claimAddress() = false, want true")
+	}
+	c.startAnnouncing()
+	c.stopAnnouncing()
+	if got := recorder.count(); got != 0 {
+		t.Errorf("expected no announcements, got %d", got)
+	}
+}
+
 func TestNewBasicConfigurer_NilHardwareAddr(t *testing.T) {
 	t.Parallel()
 
@@ -249,3 +279,295 @@ func TestBasicConfigurer_createGratuitousARP(t *testing.T) {
 		t.Errorf("ARP destination protocol address = %v, want %v", arp.DstProtAddress, c.VIP.AsSlice())
 	}
 }
+
+// ---------------------------------------------------------------------------
+// createUnsolicitedNA
+// ---------------------------------------------------------------------------
+
+func TestBasicConfigurer_createUnsolicitedNA(t *testing.T) {
+	t.Parallel()
+
+	cfg := testIPConfiguration("2001:db8::10")
+	cfg.Netmask = net.CIDRMask(64, 128)
+	c := &BasicConfigurer{IPConfiguration: cfg}
+
+	packet, err := c.createUnsolicitedNA()
+	if err != nil {
+		t.Fatalf("createUnsolicitedNA() error = %v", err)
+	}
+
+	parsed := gopacket.NewPacket(packet, layers.LayerTypeEthernet, gopacket.Default)
+
+	eth, ok := parsed.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok {
+		t.Fatal("missing Ethernet layer")
+	}
+	if !bytes.Equal(eth.SrcMAC, c.Iface.HardwareAddr) {
+		t.Errorf("Ethernet source MAC = %v, want %v", eth.SrcMAC, c.Iface.HardwareAddr)
+	}
+	wantMulticast := net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}
+	if !bytes.Equal(eth.DstMAC, wantMulticast) {
+		t.Errorf("Ethernet destination MAC = %v, want all-nodes multicast", eth.DstMAC)
+	}
+	if eth.EthernetType != layers.EthernetTypeIPv6 {
+		t.Errorf("Ethernet type = %v, want IPv6", eth.EthernetType)
+	}
+
+	ip, ok := parsed.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !ok {
+		t.Fatal("missing IPv6 layer")
+	}
+	if ip.HopLimit != 255 {
+		t.Errorf("IPv6 hop limit = %d, want 255", ip.HopLimit)
+	}
+	if !ip.SrcIP.Equal(net.IP(c.VIP.AsSlice())) {
+		t.Errorf("IPv6 source = %v, want %v", ip.SrcIP, c.VIP)
+	}
+	if !ip.DstIP.Equal(net.ParseIP("ff02::1")) {
+		t.Errorf("IPv6 destination = %v, want ff02::1", ip.DstIP)
+	}
+
+	icmp, ok := parsed.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+	if !ok {
+		t.Fatal("missing ICMPv6 layer")
+	}
+	if icmp.TypeCode.Type() != layers.ICMPv6TypeNeighborAdvertisement {
+		t.Errorf("ICMPv6 type = %v, want neighbor advertisement", icmp.TypeCode)
+	}
+	if err := icmp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatalf("SetNetworkLayerForChecksum() error = %v", err)
+	}
+
+	na, ok := parsed.Layer(layers.LayerTypeICMPv6NeighborAdvertisement).(*layers.ICMPv6NeighborAdvertisement)
+	if !ok {
+		t.Fatal("missing Neighbor Advertisement layer")
+	}
+	if !na.Override() {
+		t.Error("Neighbor Advertisement should have the override flag set")
+	}
+	if na.Solicited() || na.Router() {
+		t.Error("Neighbor Advertisement should be neither solicited nor from a router")
+	}
+	if !na.TargetAddress.Equal(net.IP(c.VIP.AsSlice())) {
+		t.Errorf("target address = %v, want %v", na.TargetAddress, c.VIP)
+	}
+	if len(na.Options) != 1 || na.Options[0].Type != layers.ICMPv6OptTargetAddress {
+		t.Fatalf("options = %v, want a single target link-layer address", na.Options)
+	}
+	if !bytes.Equal(na.Options[0].Data, c.Iface.HardwareAddr) {
+		t.Errorf("target link-layer address = %v, want %v", na.Options[0].Data, c.Iface.HardwareAddr)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// createAnnouncements
+// ---------------------------------------------------------------------------
+
+func TestBasicConfigurer_createAnnouncements(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		vip  string
+		mode string
+		want []uint16 // ARP operations, 0 for a neighbor advertisement
+	}{
+		{"IPv4 default mode", "192.168.1.10", "", []uint16{layers.ARPReply}},
+		{"IPv4 reply", "192.168.1.10", "reply", []uint16{layers.ARPReply}},
+		{"IPv4 request", "192.168.1.10", "request", []uint16{layers.ARPRequest}},
+		{"IPv4 both", "192.168.1.10", "both", []uint16{layers.ARPRequest, layers.ARPReply}},
+		{"IPv6 ignores mode", "2001:db8::10", "both", []uint16{0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cfg := testIPConfiguration(tt.vip)
+			cfg.ARPMode = tt.mode
+			c := &BasicConfigurer{IPConfiguration: cfg}
+			packets, err := c.createAnnouncements()
+			if err != nil {
+				t.Fatalf("createAnnouncements() error = %v", err)
+			}
+			if len(packets) != len(tt.want) {
+				t.Fatalf("createAnnouncements() returned %d packets, want %d", len(packets), len(tt.want))
+			}
+			for i, packet := range packets {
+				parsed := gopacket.NewPacket(packet, layers.LayerTypeEthernet, gopacket.Default)
+				if tt.want[i] == 0 {
+					if parsed.Layer(layers.LayerTypeICMPv6NeighborAdvertisement) == nil {
+						t.Errorf("packet %d is not a neighbor advertisement", i)
+					}
+					continue
+				}
+				arp, ok := parsed.Layer(layers.LayerTypeARP).(*layers.ARP)
+				if !ok {
+					t.Fatalf("packet %d is not an ARP packet", i)
+				}
+				if arp.Operation != tt.want[i] {
+					t.Errorf("packet %d has ARP operation %d, want %d", i, arp.Operation, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBasicConfigurer_createGratuitousARPRequest(t *testing.T) {
+	t.Parallel()
+
+	c := &BasicConfigurer{
+		IPConfiguration: testIPConfiguration("192.168.1.10"),
+	}
+
+	packet, err := c.createGratuitousARPRequest()
+	if err != nil {
+		t.Fatalf("createGratuitousARPRequest() error = %v", err)
+	}
+
+	parsed := gopacket.NewPacket(packet, layers.LayerTypeEthernet, gopacket.Default)
+	arp, ok := parsed.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok {
+		t.Fatal("missing ARP layer")
+	}
+	if arp.Operation != layers.ARPRequest {
+		t.Errorf("ARP operation = %d, want request", arp.Operation)
+	}
+	if !bytes.Equal(arp.SourceProtAddress, c.VIP.AsSlice()) || !bytes.Equal(arp.DstProtAddress, c.VIP.AsSlice()) {
+		t.Errorf("ARP protocol addresses = %v -> %v, want the VIP for both", arp.SourceProtAddress, arp.DstProtAddress)
+	}
+	if !bytes.Equal(arp.DstHwAddress, make([]byte, MACAddressSize)) {
+		t.Errorf("ARP destination hardware address = %v, want zero", arp.DstHwAddress)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// announcements
+// ---------------------------------------------------------------------------
+
+// packetRecorder collects the frames passed to BasicConfigurer.sendPacket
+type packetRecorder struct {
+	mu      sync.Mutex
+	packets [][]byte
+	err     error
+}
+
+func (r *packetRecorder) send(_ net.Interface, packetData []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.packets = append(r.packets, packetData)
+	return r.err
+}
+
+func (r *packetRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.packets)
+}
+
+func TestNewBasicConfigurer_InvalidARPMode(t *testing.T) {
+	t.Parallel()
+
+	cfg := testIPConfiguration("192.168.1.10")
+	cfg.ARPMode = "broadcast"
+	if _, err := newBasicConfigurer(cfg); err == nil {
+		t.Error("expected error for unsupported arp-mode, got nil")
+	}
+}
+
+func TestBasicConfigurer_announce_Burst(t *testing.T) {
+	t.Parallel()
+
+	cfg := testIPConfiguration("192.168.1.10")
+	cfg.ARPCount = 3
+	cfg.ARPInterval = 1
+	cfg.ARPMode = "both"
+	recorder := &packetRecorder{}
+	c := &BasicConfigurer{IPConfiguration: cfg, sendPacket: recorder.send}
+
+	c.announce(make(chan struct{}))
+
+	if got := recorder.count(); got != 6 {
+		t.Errorf("announce() sent %d packets, want 6 (3 rounds of request and reply)", got)
+	}
+}
+
+func TestBasicConfigurer_announce_SendErrorsAreNotFatal(t *testing.T) {
+	t.Parallel()
+
+	cfg := testIPConfiguration("192.168.1.10")
+	cfg.ARPCount = 2
+	recorder := &packetRecorder{err: errors.New("network is down")}
+	c := &BasicConfigurer{IPConfiguration: cfg, sendPacket: recorder.send}
+
+	c.announce(make(chan struct{}))
+
+	if got := recorder.count(); got != 2 {
+		t.Errorf("announce() sent %d packets, want 2 even though sending fails", got)
+	}
+}
+
+func TestBasicConfigurer_announce_Stopped(t *testing.T) {
+	t.Parallel()
+
+	cfg := testIPConfiguration("192.168.1.10")
+	cfg.ARPCount = 5
+	cfg.ARPInterval = 60000
+	recorder := &packetRecorder{}
+	c := &BasicConfigurer{IPConfiguration: cfg, sendPacket: recorder.send}
+
+	stop := make(chan struct{})
+	close(stop)
+	c.announce(stop)
+
+	if got := recorder.count(); got != 1 {
+		t.Errorf("announce() sent %d packets after being stopped, want only the first one", got)
+	}
+}
+
+func TestBasicConfigurer_startAnnouncing_Refresh(t *testing.T) {
+	t.Parallel()
+
+	cfg := testIPConfiguration("192.168.1.10")
+	cfg.ARPRefreshInterval = 5
+	recorder := &packetRecorder{}
+	c := &BasicConfigurer{IPConfiguration: cfg, sendPacket: recorder.send}
+
+	c.startAnnouncing()
+	deadline := time.Now().Add(2 * time.Second)
+	for recorder.count() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.stopAnnouncing()
+
+	sent := recorder.count()
+	if sent < 3 {
+		t.Fatalf("expected the announcement to be refreshed, only %d packets were sent", sent)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := recorder.count(); got != sent {
+		t.Errorf("announcements continued after stopAnnouncing: %d -> %d packets", sent, got)
+	}
+}
+
+func TestBasicConfigurer_startAnnouncing_NoRefresh(t *testing.T) {
+	t.Parallel()
+
+	recorder := &packetRecorder{}
+	c := &BasicConfigurer{IPConfiguration: testIPConfiguration("192.168.1.10"), sendPacket: recorder.send}
+
+	c.startAnnouncing()
+	c.announceMutex.Lock()
+	done := c.announceDone
+	c.announceMutex.Unlock()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("announcement loop should exit after a single burst without arp-refresh-interval")
+	}
+	if got := recorder.count(); got != 1 {
+		t.Errorf("expected a single announcement, got %d", got)
+	}
+	// stopping an already finished loop must not block
+	c.stopAnnouncing()
+	c.stopAnnouncing()
+}
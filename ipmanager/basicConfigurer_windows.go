@@ -7,6 +7,8 @@ import (
 	"github.com/cybertec-postgresql/vip-manager/iphlpapi"
 )
 
+var sendPacket = sendPacketWindows
+
 func sendPacketWindows(iface net.Interface, packetData []byte) error {
 	// Open a raw socket using Winsock
 	conn, err := net.Dial("ip4:ethernet", iface.HardwareAddr.String())
@@ -22,6 +24,13 @@ func sendPacketWindows(iface net.Interface, packetData []byte) error {
 // configureAddress assigns virtual IP address
 func (c *BasicConfigurer) configureAddress() bool {
 	log.Infof("Configuring address %s on %s", c.getCIDR(), c.Iface.Name)
+	if !c.VIP.Is4() {
+		log.Errorf("Failed to add address %s: only IPv4 addresses are supported on Windows", c.getCIDR())
+		return false
+	}
+	if c.AddressProbe && !c.claimAddress() {
+		return false
+	}
 	var (
 		ip          = binary.LittleEndian.Uint32(c.VIP.AsSlice())
 		mask        = binary.LittleEndian.Uint32(c.Netmask)
@@ -38,19 +47,14 @@ func (c *BasicConfigurer) configureAddress() bool {
 		return false
 	}
 
-	if buff, err := c.createGratuitousARP(); err != nil {
-		log.Warn("Failed to compose gratuitous ARP request: ", err)
-	} else {
-		if err := sendPacketWindows(c.Iface, buff); err != nil {
-			log.Warn("Failed to send gratuitous ARP request: ", err)
-		}
-	}
+	c.startAnnouncing()
 	return true
 }
 
 // deconfigureAddress drops virtual IP address
 func (c *BasicConfigurer) deconfigureAddress() bool {
 	log.Infof("Removing address %s on %s", c.getCIDR(), c.Iface.Name)
+	c.stopAnnouncing()
 	err := iphlpapi.DeleteIPAddress(c.ntecontext)
 	if err != nil {
 		log.Errorf("Failed to remove address %s: %v", c.getCIDR(), err)
@@ -58,3 +62,27 @@ func (c *BasicConfigurer) deconfigureAddress() bool {
 	}
 	return true
 }
+
+// queryAddress returns if the address is assigned
+func (c *BasicConfigurer) queryAddress() bool {
+	iface, err := net.InterfaceByName(c.Iface.Name)
+	if err != nil {
+		return false
+	}
+	addresses, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, address := range addresses {
+		if ipNet, ok := address.(*net.IPNet); ok && c.isVIP(ipNet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// probeAddress is not implemented on Windows, as there is no raw socket to
+// listen for the answers to a probe
+func (c *BasicConfigurer) probeAddress() (net.HardwareAddr, error) {
+	return nil, errProbeUnsupported
+}
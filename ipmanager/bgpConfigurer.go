@@ -0,0 +1,158 @@
+package ipmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// well-known communities, RFC 1997
+var bgpWellKnownCommunities = map[string]uint32{
+	"no-export":           0xffffff01,
+	"no-advertise":        0xffffff02,
+	"no-export-subconfed": 0xffffff03,
+}
+
+// The BGPConfigurer announces the vip as /32 or /128 route to the BGP
+// neighbors, whenever manager-type `bgp` is set. It is meant for routed
+// fabrics, where gratuitous ARP doesn't reach the routers that matter.
+// The vip is added as host address on a dummy or loopback interface, so
+// this machine accepts the traffic routed to it, and the route is only
+// considered in place while at least one session has it announced.
+type BGPConfigurer struct {
+	*IPConfiguration
+	settings bgpSettings
+	speaker  *bgpSpeaker
+	prefix   netip.Prefix
+	local    ipConfigurer
+}
+
+func newBGPConfigurer(config *IPConfiguration, conf *vipconfig.Config) (*BGPConfigurer, error) {
+	settings, err := newBGPSettings(conf)
+	if err != nil {
+		return nil, err
+	}
+	c := &BGPConfigurer{
+		IPConfiguration: config,
+		settings:        settings,
+		prefix:          netip.PrefixFrom(config.VIP, config.VIP.BitLen()),
+	}
+	// The interface is a dummy or the loopback, nobody is listening for
+	// announcements there and the routers learn about the vip through BGP
+	localConf := *config
+	localConf.Netmask = net.CIDRMask(config.VIP.BitLen(), config.VIP.BitLen())
+	if c.local, err = newBasicConfigurer(&localConf, withoutAnnouncements()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newBGPSettings validates the bgp-* settings
+func newBGPSettings(conf *vipconfig.Config) (settings bgpSettings, err error) {
+	if conf.BGPLocalAS <= 0 || conf.BGPLocalAS > 0xffffffff {
+		return settings, fmt.Errorf("bgp-local-as must be set to an AS number, got %d", conf.BGPLocalAS)
+	}
+	if conf.BGPPeerAS < 0 || conf.BGPPeerAS > 0xffffffff {
+		return settings, fmt.Errorf("invalid bgp-peer-as %d", conf.BGPPeerAS)
+	}
+	if conf.BGPMED < 0 || conf.BGPMED > 0xffffffff {
+		return settings, fmt.Errorf("invalid bgp-med %d", conf.BGPMED)
+	}
+	if conf.BGPHoldTime < 0 || conf.BGPHoldTime > 0xffff || (conf.BGPHoldTime > 0 && conf.BGPHoldTime < 3) {
+		return settings, fmt.Errorf("bgp-hold-time must be 0 or between 3 and 65535 seconds, got %d", conf.BGPHoldTime)
+	}
+	settings = bgpSettings{
+		LocalAS:      uint32(conf.BGPLocalAS),
+		PeerAS:       uint32(conf.BGPPeerAS),
+		HoldTime:     time.Duration(conf.BGPHoldTime) * time.Second,
+		MED:          uint32(conf.BGPMED),
+		ConnectRetry: time.Duration(max(conf.RetryAfter, 1)) * time.Millisecond,
+	}
+	if settings.PeerAS == 0 {
+		settings.PeerAS = settings.LocalAS
+	}
+	if conf.BGPRouterID != "" {
+		if settings.RouterID, err = netip.ParseAddr(conf.BGPRouterID); err != nil || !settings.RouterID.Is4() {
+			return settings, fmt.Errorf("bgp-router-id must be an IPv4 address, got %q", conf.BGPRouterID)
+		}
+	}
+	if conf.BGPNextHop != "" {
+		if settings.NextHop, err = netip.ParseAddr(conf.BGPNextHop); err != nil {
+			return settings, fmt.Errorf("invalid bgp-next-hop: %w", err)
+		}
+	}
+	for _, community := range conf.BGPCommunities {
+		value, err := parseBGPCommunity(community)
+		if err != nil {
+			return settings, err
+		}
+		settings.Communities = append(settings.Communities, value)
+	}
+	for _, neighbor := range conf.BGPNeighbors {
+		neighbor = strings.TrimSpace(neighbor)
+		if neighbor == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(neighbor); err != nil {
+			neighbor = net.JoinHostPort(neighbor, bgpPort)
+		}
+		settings.Neighbors = append(settings.Neighbors, neighbor)
+	}
+	if len(settings.Neighbors) == 0 {
+		return settings, errors.New("bgp-neighbors must list at least one neighbor")
+	}
+	return settings, nil
+}
+
+// parseBGPCommunity parses a community as AS:value or its well-known name
+func parseBGPCommunity(community string) (uint32, error) {
+	community = strings.ToLower(strings.TrimSpace(community))
+	if value, ok := bgpWellKnownCommunities[community]; ok {
+		return value, nil
+	}
+	as, value, ok := strings.Cut(community, ":")
+	high, err1 := strconv.ParseUint(as, 10, 16)
+	low, err2 := strconv.ParseUint(value, 10, 16)
+	if !ok || err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("invalid bgp-communities entry %q, expected AS:value or no-export, no-advertise, no-export-subconfed", community)
+	}
+	return uint32(high<<16 | low), nil
+}
+
+// start joins the speaker with our settings, the sessions run until the
+// last VIP using them is stopped
+func (c *BGPConfigurer) start(ctx context.Context) func() {
+	c.speaker = acquireBGPSpeaker(ctx, c.settings)
+	return c.speaker.release
+}
+
+func (c *BGPConfigurer) queryAddress() bool {
+	return c.local.queryAddress() && c.speaker.isAdvertised(c.prefix)
+}
+
+func (c *BGPConfigurer) configureAddress() bool {
+	// the address goes first, so the traffic attracted by the route is accepted
+	if !c.local.configureAddress() {
+		return false
+	}
+	c.speaker.announce(c.prefix)
+	return true
+}
+
+func (c *BGPConfigurer) deconfigureAddress() bool {
+	c.speaker.withdraw(c.prefix)
+	return c.local.deconfigureAddress()
+}
+
+// watchAddress signals changes of the BGP sessions, so a lost or regained
+// announcement is noticed right away
+func (c *BGPConfigurer) watchAddress(ctx context.Context) (<-chan struct{}, error) {
+	return c.speaker.subscribe(ctx), nil
+}
@@ -0,0 +1,654 @@
+package ipmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// fakeBGPRoute is a route as received by fakeBGPPeer
+type fakeBGPRoute struct {
+	nextHop     netip.Addr
+	asPath      []byte
+	med         uint32
+	localPref   bool
+	communities []uint32
+}
+
+// fakeBGPPeer is a BGP neighbor in the same process. It accepts sessions
+// and keeps the routes announced to it.
+type fakeBGPPeer struct {
+	net.Listener
+	as          uint32
+	holdTime    uint16
+	fourOctetAS bool
+	families    []bgpFamily
+
+	mu            sync.Mutex
+	conns         []net.Conn
+	opens         []*bgpOpen
+	routes        map[netip.Prefix]fakeBGPRoute
+	notifications []bgpNotification
+	keepalives    int
+}
+
+func newFakeBGPPeer(t *testing.T, as uint32) *fakeBGPPeer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeBGPPeer{Listener: l, as: as, fourOctetAS: true, families: []bgpFamily{bgpIPv4Unicast, bgpIPv6Unicast},
+		routes: map[netip.Prefix]fakeBGPRoute{}}
+	t.Cleanup(func() {
+		l.Close()
+		f.dropSessions()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+			go f.handle(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeBGPPeer) handle(conn net.Conn) {
+	defer conn.Close()
+	msgType, body, err := readBGPMessage(conn)
+	if err != nil || msgType != bgpMsgOpen {
+		return
+	}
+	open, err := parseBGPOpen(body)
+	if err != nil {
+		return
+	}
+	f.mu.Lock()
+	f.opens = append(f.opens, open)
+	f.mu.Unlock()
+
+	reply := (&bgpOpen{AS: f.as, HoldTime: f.holdTime, RouterID: netip.MustParseAddr("192.0.2.254"),
+		Families: f.families}).marshal()
+	if !f.fourOctetAS {
+		// an old speaker without any capabilities
+		reply = append([]byte{bgpVersion}, binary.BigEndian.AppendUint16(nil, uint16(f.as))...)
+		reply = binary.BigEndian.AppendUint16(reply, f.holdTime)
+		reply = append(reply, 192, 0, 2, 254, 0)
+	}
+	if writeBGPMessage(conn, bgpMsgOpen, reply) != nil || writeBGPMessage(conn, bgpMsgKeepalive, nil) != nil {
+		return
+	}
+	for {
+		msgType, body, err := readBGPMessage(conn)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		switch msgType {
+		case bgpMsgKeepalive:
+			f.keepalives++
+		case bgpMsgNotification:
+			f.notifications = append(f.notifications, bgpNotification{Code: body[0], Subcode: body[1]})
+		case bgpMsgUpdate:
+			f.update(body)
+		}
+		f.mu.Unlock()
+	}
+}
+
+// update applies an UPDATE message to the routes
+func (f *fakeBGPPeer) update(body []byte) {
+	withdrawnLen := int(binary.BigEndian.Uint16(body))
+	for _, prefix := range parseTestBGPPrefixes(body[2:2+withdrawnLen], 4) {
+		delete(f.routes, prefix)
+	}
+	body = body[2+withdrawnLen:]
+	attrsLen := int(binary.BigEndian.Uint16(body))
+	attrs, nlri := body[2:2+attrsLen], body[2+attrsLen:]
+
+	var route fakeBGPRoute
+	announced := parseTestBGPPrefixes(nlri, 4)
+	for len(attrs) > 0 {
+		flags, attrType := attrs[0], attrs[1]
+		length, offset := int(attrs[2]), 3
+		if flags&bgpAttrFlagExtended != 0 {
+			length, offset = int(binary.BigEndian.Uint16(attrs[2:])), 4
+		}
+		value := attrs[offset : offset+length]
+		attrs = attrs[offset+length:]
+		switch attrType {
+		case bgpAttrASPath:
+			route.asPath = value
+		case bgpAttrNextHop:
+			route.nextHop = netip.AddrFrom4([4]byte(value))
+		case bgpAttrMED:
+			route.med = binary.BigEndian.Uint32(value)
+		case bgpAttrLocalPref:
+			route.localPref = true
+		case bgpAttrCommunities:
+			for i := 0; i < len(value); i += 4 {
+				route.communities = append(route.communities, binary.BigEndian.Uint32(value[i:]))
+			}
+		case bgpAttrMPReachNLRI:
+			nextHopLen := int(value[3])
+			route.nextHop, _ = netip.AddrFromSlice(value[4 : 4+nextHopLen])
+			announced = append(announced, parseTestBGPPrefixes(value[5+nextHopLen:], 16)...)
+		case bgpAttrMPUnreachNLRI:
+			for _, prefix := range parseTestBGPPrefixes(value[3:], 16) {
+				delete(f.routes, prefix)
+			}
+		}
+	}
+	for _, prefix := range announced {
+		f.routes[prefix] = route
+	}
+}
+
+func parseTestBGPPrefixes(b []byte, addrLen int) (prefixes []netip.Prefix) {
+	for len(b) > 0 {
+		bits := int(b[0])
+		addr := make([]byte, addrLen)
+		copy(addr, b[1:1+(bits+7)/8])
+		b = b[1+(bits+7)/8:]
+		ip, _ := netip.AddrFromSlice(addr)
+		prefixes = append(prefixes, netip.PrefixFrom(ip, bits))
+	}
+	return prefixes
+}
+
+func (f *fakeBGPPeer) route(prefix string) (fakeBGPRoute, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	route, ok := f.routes[netip.MustParsePrefix(prefix)]
+	return route, ok
+}
+
+// dropSessions closes all connections, like a peer being restarted
+func (f *fakeBGPPeer) dropSessions() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+	f.routes = map[netip.Prefix]fakeBGPRoute{}
+}
+
+func newTestBGPConfigurer(t *testing.T, vip string, conf *vipconfig.Config) (*BGPConfigurer, *mockConfigurer) {
+	t.Helper()
+	conf.RetryAfter = 10
+	c := newTestConfigurer(t, newBGPConfigurer, testHetznerIPConfiguration(vip), conf)
+	t.Cleanup(c.start(context.Background()))
+	return c, mockLocal(&c.local)
+}
+
+// ---------------------------------------------------------------------------
+// newBGPConfigurer
+// ---------------------------------------------------------------------------
+
+func TestNewBGPSettings(t *testing.T) {
+	t.Parallel()
+
+	settings, err := newBGPSettings(&vipconfig.Config{
+		BGPLocalAS:     4200000001,
+		BGPNeighbors:   []string{"10.0.0.254", " 2001:db8::1 ", "[2001:db8::2]:1179", ""},
+		BGPHoldTime:    30,
+		BGPRouterID:    "10.0.0.1",
+		BGPNextHop:     "2001:db8::10",
+		BGPMED:         50,
+		BGPCommunities: []string{"65000:100", "no-export"},
+		RetryAfter:     250,
+	})
+	if err != nil {
+		t.Fatalf("newBGPSettings() error = %v", err)
+	}
+	if settings.PeerAS != 4200000001 {
+		t.Errorf("PeerAS = %d, want bgp-local-as for iBGP", settings.PeerAS)
+	}
+	if want := []string{"10.0.0.254:179", "[2001:db8::1]:179", "[2001:db8::2]:1179"}; !slices.Equal(settings.Neighbors, want) {
+		t.Errorf("Neighbors = %v, want %v", settings.Neighbors, want)
+	}
+	if want := []uint32{65000<<16 | 100, 0xffffff01}; !slices.Equal(settings.Communities, want) {
+		t.Errorf("Communities = %x, want %x", settings.Communities, want)
+	}
+	if settings.HoldTime != 30*time.Second || settings.MED != 50 || settings.ConnectRetry != 250*time.Millisecond {
+		t.Errorf("unexpected settings %+v", settings)
+	}
+
+	for _, conf := range []vipconfig.Config{
+		{BGPNeighbors: []string{"10.0.0.254"}},
+		{BGPLocalAS: 65001},
+		{BGPLocalAS: 65001, BGPNeighbors: []string{"10.0.0.254"}, BGPHoldTime: 2},
+		{BGPLocalAS: 65001, BGPNeighbors: []string{"10.0.0.254"}, BGPRouterID: "2001:db8::1"},
+		{BGPLocalAS: 65001, BGPNeighbors: []string{"10.0.0.254"}, BGPNextHop: "invalid"},
+		{BGPLocalAS: 65001, BGPNeighbors: []string{"10.0.0.254"}, BGPCommunities: []string{"65536:1"}},
+		{BGPLocalAS: 65001, BGPNeighbors: []string{"10.0.0.254"}, BGPMED: -1},
+	} {
+		if _, err := newBGPSettings(&conf); err == nil {
+			t.Errorf("expected an error for %+v", conf)
+		}
+	}
+}
+
+func TestBGPOpen_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for _, as := range []uint32{65001, 4200000001} {
+		open := &bgpOpen{AS: as, HoldTime: 90, RouterID: netip.MustParseAddr("10.0.0.1"),
+			Families: []bgpFamily{bgpIPv4Unicast, bgpIPv6Unicast}, FourOctetAS: true}
+		got, err := parseBGPOpen(open.marshal())
+		if err != nil {
+			t.Fatalf("parseBGPOpen() error = %v", err)
+		}
+		if got.AS != open.AS || got.HoldTime != open.HoldTime || got.RouterID != open.RouterID ||
+			!got.FourOctetAS || !slices.Equal(got.Families, open.Families) {
+			t.Errorf("parseBGPOpen() = %+v, want %+v", got, open)
+		}
+	}
+	if _, err := parseBGPOpen([]byte{3, 0, 1, 0, 90, 10, 0, 0, 1, 0}); err == nil {
+		t.Error("expected an error for BGP version 3")
+	}
+}
+
+func TestBGPOpen_Supports(t *testing.T) {
+	t.Parallel()
+
+	if o := (&bgpOpen{}); !o.supports(bgpIPv4Unicast) || o.supports(bgpIPv6Unicast) {
+		t.Error("expected only IPv4 unicast without multiprotocol capabilities")
+	}
+	if o := (&bgpOpen{Families: []bgpFamily{bgpIPv6Unicast}}); o.supports(bgpIPv4Unicast) || !o.supports(bgpIPv6Unicast) {
+		t.Error("expected only the negotiated IPv6 unicast")
+	}
+}
+
+func TestAcquireBGPSpeaker_Shared(t *testing.T) {
+	t.Parallel()
+
+	settings := bgpSettings{LocalAS: 65001, PeerAS: 65000, Neighbors: []string{"127.0.0.1:1"}, ConnectRetry: time.Hour}
+	s := acquireBGPSpeaker(context.Background(), settings)
+	if acquireBGPSpeaker(context.Background(), settings) != s {
+		t.Error("expected speakers with the same settings to be shared")
+	}
+	other := settings
+	other.MED = 10
+	o := acquireBGPSpeaker(context.Background(), other)
+	defer o.release()
+	if o == s {
+		t.Error("expected speakers with different settings to be separate")
+	}
+
+	running := func() bool {
+		bgpSpeakersMutex.Lock()
+		defer bgpSpeakersMutex.Unlock()
+		return bgpSpeakers[settings.key()] == s
+	}
+	s.release()
+	if !running() {
+		t.Error("the speaker must keep running while it is still used")
+	}
+	s.release()
+	if running() {
+		t.Error("the speaker must be stopped after the last release")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// queryAddress / configureAddress / deconfigureAddress
+// ---------------------------------------------------------------------------
+
+func TestBGPConfigurer_AnnounceWithdraw(t *testing.T) {
+	t.Parallel()
+
+	peer := newFakeBGPPeer(t, 65000)
+	c, local := newTestBGPConfigurer(t, "192.0.2.10", &vipconfig.Config{
+		BGPLocalAS:     4200000001,
+		BGPPeerAS:      65000,
+		BGPNeighbors:   []string{peer.Addr().String()},
+		BGPMED:         50,
+		BGPCommunities: []string{"65000:100", "no-export"},
+	})
+	waitUntil(t, "the session is established", func() bool {
+		peer.mu.Lock()
+		defer peer.mu.Unlock()
+		return len(peer.opens) == 1
+	})
+	if c.queryAddress() {
+		t.Error("queryAddress() = true before the VIP was announced")
+	}
+
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	waitUntil(t, "the VIP is announced", c.queryAddress)
+	route, ok := peer.route("192.0.2.10/32")
+	if !ok {
+		t.Fatal("peer did not receive the route")
+	}
+	wantPath := binary.BigEndian.AppendUint32([]byte{2, 1}, 4200000001)
+	if route.nextHop != netip.MustParseAddr("127.0.0.1") || !slices.Equal(route.asPath, wantPath) ||
+		route.med != 50 || route.localPref || !slices.Equal(route.communities, []uint32{65000<<16 | 100, 0xffffff01}) {
+		t.Errorf("unexpected route %+v", route)
+	}
+	if local.configureCount != 1 {
+		t.Errorf("expected the VIP to be added locally, got %d calls", local.configureCount)
+	}
+	if open := peer.opens[0]; open.AS != 4200000001 || open.RouterID != netip.MustParseAddr("127.0.0.1") {
+		t.Errorf("unexpected OPEN %+v", open)
+	}
+
+	if !c.deconfigureAddress() {
+		t.Fatal("deconfigureAddress() = false, want true")
+	}
+	waitUntil(t, "the VIP is withdrawn", func() bool {
+		_, ok := peer.route("192.0.2.10/32")
+		return !ok
+	})
+	if c.queryAddress() || local.deconfigureCount != 1 {
+		t.Error("expected the VIP to be withdrawn and removed locally")
+	}
+}
+
+func TestBGPConfigurer_IPv6(t *testing.T) {
+	t.Parallel()
+
+	peer := newFakeBGPPeer(t, 65001)
+	c, _ := newTestBGPConfigurer(t, "2001:db8:1::10", &vipconfig.Config{
+		BGPLocalAS:   65001,
+		BGPNeighbors: []string{peer.Addr().String()},
+		BGPNextHop:   "2001:db8::1",
+	})
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	waitUntil(t, "the VIP is announced", c.queryAddress)
+	route, ok := peer.route("2001:db8:1::10/128")
+	if !ok {
+		t.Fatal("peer did not receive the route")
+	}
+	if route.nextHop != netip.MustParseAddr("2001:db8::1") || len(route.asPath) != 0 || !route.localPref {
+		t.Errorf("unexpected iBGP route %+v", route)
+	}
+
+	c.deconfigureAddress()
+	waitUntil(t, "the VIP is withdrawn", func() bool {
+		_, ok := peer.route("2001:db8:1::10/128")
+		return !ok
+	})
+}
+
+func TestBGPConfigurer_IPv6_NoNextHop(t *testing.T) {
+	t.Parallel()
+
+	peer := newFakeBGPPeer(t, 65001)
+	c, _ := newTestBGPConfigurer(t, "2001:db8:1::10", &vipconfig.Config{
+		BGPLocalAS:   65001,
+		BGPNeighbors: []string{peer.Addr().String()},
+	})
+	c.configureAddress()
+	time.Sleep(100 * time.Millisecond)
+	if c.queryAddress() {
+		t.Error("queryAddress() = true without an IPv6 next hop for an IPv4 session")
+	}
+}
+
+func TestBGPConfigurer_IPv6_NotNegotiated(t *testing.T) {
+	t.Parallel()
+
+	peer := newFakeBGPPeer(t, 65001)
+	peer.families = []bgpFamily{bgpIPv4Unicast}
+	c, _ := newTestBGPConfigurer(t, "2001:db8:1::10", &vipconfig.Config{
+		BGPLocalAS:   65001,
+		BGPNeighbors: []string{peer.Addr().String()},
+		BGPNextHop:   "2001:db8::1",
+	})
+	c.configureAddress()
+	time.Sleep(100 * time.Millisecond)
+	if c.queryAddress() {
+		t.Error("queryAddress() = true for a peer without IPv6 unicast")
+	}
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if len(peer.routes) != 0 || len(peer.notifications) != 0 {
+		t.Errorf("expected neither routes nor notifications, got %v and %+v", peer.routes, peer.notifications)
+	}
+}
+
+func TestBGPConfigurer_SessionLost(t *testing.T) {
+	t.Parallel()
+
+	peer := newFakeBGPPeer(t, 65000)
+	c, _ := newTestBGPConfigurer(t, "192.0.2.11", &vipconfig.Config{
+		BGPLocalAS:   65001,
+		BGPPeerAS:    65000,
+		BGPNeighbors: []string{peer.Addr().String()},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, err := c.watchAddress(ctx)
+	if err != nil {
+		t.Fatalf("watchAddress() error = %v", err)
+	}
+	c.configureAddress()
+	waitUntil(t, "the VIP is announced", c.queryAddress)
+
+	for len(changes) > 0 {
+		<-changes
+	}
+	peer.dropSessions()
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a change to be signalled when the session was lost")
+	}
+	waitUntil(t, "the VIP is announced again", func() bool {
+		_, ok := peer.route("192.0.2.11/32")
+		return ok && c.queryAddress()
+	})
+	peer.mu.Lock()
+	sessions := len(peer.opens)
+	peer.mu.Unlock()
+	if sessions != 2 {
+		t.Errorf("expected the session to be reestablished once, got %d sessions", sessions)
+	}
+}
+
+func TestBGPConfigurer_QueryWithoutSession(t *testing.T) {
+	t.Parallel()
+
+	peer := newFakeBGPPeer(t, 65000)
+	addr := peer.Addr().String()
+	peer.Close() // nobody is listening
+	c, local := newTestBGPConfigurer(t, "192.0.2.12", &vipconfig.Config{
+		BGPLocalAS:   65001,
+		BGPPeerAS:    65000,
+		BGPNeighbors: []string{addr},
+	})
+	if !c.configureAddress() {
+		t.Error("configureAddress() = false, want true while the neighbor is down")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if c.queryAddress() {
+		t.Error("queryAddress() = true without any established session")
+	}
+	if local.configureCount != 1 {
+		t.Error("expected the VIP to be added locally anyway")
+	}
+}
+
+func TestBGPConfigurer_LocalFails(t *testing.T) {
+	t.Parallel()
+
+	peer := newFakeBGPPeer(t, 65000)
+	c, local := newTestBGPConfigurer(t, "192.0.2.13", &vipconfig.Config{
+		BGPLocalAS:   65001,
+		BGPPeerAS:    65000,
+		BGPNeighbors: []string{peer.Addr().String()},
+	})
+	local.shouldConfigureFail = true
+	if c.configureAddress() {
+		t.Error("configureAddress() should fail when the VIP can't be added locally")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := peer.route("192.0.2.13/32"); ok {
+		t.Error("the VIP must not be announced without the local address")
+	}
+}
+
+func TestBGPConfigurer_BadPeerAS(t *testing.T) {
+	t.Parallel()
+
+	peer := newFakeBGPPeer(t, 65002)
+	c, _ := newTestBGPConfigurer(t, "192.0.2.14", &vipconfig.Config{
+		BGPLocalAS:   65001,
+		BGPPeerAS:    65000,
+		BGPNeighbors: []string{peer.Addr().String()},
+	})
+	c.configureAddress()
+	waitUntil(t, "the session is refused", func() bool {
+		peer.mu.Lock()
+		defer peer.mu.Unlock()
+		return len(peer.notifications) > 0
+	})
+	if n := peer.notifications[0]; n.Code != bgpErrOpen || n.Subcode != bgpErrOpenBadPeerAS {
+		t.Errorf("unexpected notification %+v", n)
+	}
+	if c.queryAddress() {
+		t.Error("queryAddress() = true without an established session")
+	}
+}
+
+func TestBGPConfigurer_TwoOctetASPeer(t *testing.T) {
+	t.Parallel()
+
+	peer := newFakeBGPPeer(t, 65000)
+	peer.fourOctetAS = false
+	c, _ := newTestBGPConfigurer(t, "192.0.2.15", &vipconfig.Config{
+		BGPLocalAS:   65001,
+		BGPPeerAS:    65000,
+		BGPNeighbors: []string{peer.Addr().String()},
+	})
+	c.configureAddress()
+	waitUntil(t, "the VIP is announced", c.queryAddress)
+	if route, _ := peer.route("192.0.2.15/32"); !slices.Equal(route.asPath, []byte{2, 1, 0xfd, 0xe9}) {
+		t.Errorf("AS_PATH = %x, want AS 65001 as two octets", route.asPath)
+	}
+
+	peer4 := newFakeBGPPeer(t, 65000)
+	peer4.fourOctetAS = false
+	c4, _ := newTestBGPConfigurer(t, "192.0.2.15", &vipconfig.Config{
+		BGPLocalAS:   4200000001,
+		BGPPeerAS:    65000,
+		BGPNeighbors: []string{peer4.Addr().String()},
+	})
+	c4.configureAddress()
+	waitUntil(t, "the session is refused", func() bool {
+		peer4.mu.Lock()
+		defer peer4.mu.Unlock()
+		return len(peer4.notifications) > 0
+	})
+	if peer4.notifications[0].Code != bgpErrCease || c4.queryAddress() {
+		t.Errorf("expected the session to be closed, got %+v", peer4.notifications[0])
+	}
+}
+
+func TestBGPConfigurer_Keepalive(t *testing.T) {
+	t.Parallel()
+
+	peer := newFakeBGPPeer(t, 65000)
+	peer.holdTime = 3
+	s := acquireBGPSpeaker(context.Background(), bgpSettings{
+		LocalAS:      65001,
+		PeerAS:       65000,
+		Neighbors:    []string{peer.Addr().String()},
+		HoldTime:     90 * time.Second,
+		ConnectRetry: 10 * time.Millisecond,
+	})
+	waitUntil(t, "a keepalive was sent", func() bool {
+		peer.mu.Lock()
+		defer peer.mu.Unlock()
+		return peer.keepalives >= 2 // the first one confirms the OPEN
+	})
+	s.release()
+	waitUntil(t, "the session is closed", func() bool {
+		peer.mu.Lock()
+		defer peer.mu.Unlock()
+		return len(peer.notifications) == 1 && peer.notifications[0].Code == bgpErrCease
+	})
+}
+
+// TestBGPConfigurer_SyncStates covers the lifetime of the speaker, which
+// runs from the start of the manager until the final withdrawal
+func TestBGPConfigurer_SyncStates(t *testing.T) {
+	t.Parallel()
+	peer := newFakeBGPPeer(t, 65000)
+	c := newTestConfigurer(t, newBGPConfigurer, testHetznerIPConfiguration("192.0.2.17"), &vipconfig.Config{
+		BGPLocalAS:   65001,
+		BGPPeerAS:    65000,
+		BGPNeighbors: []string{peer.Addr().String()},
+		RetryAfter:   10,
+	})
+	mockLocal(&c.local)
+	prefix := netip.MustParsePrefix("192.0.2.17/32")
+
+	m := &IPManager{configurer: c, recheckChan: make(chan struct{})}
+	states := make(chan bool)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.SyncStates(ctx, states)
+		close(done)
+	}()
+	states <- true
+	waitUntil(t, "the route is announced", func() bool {
+		peer.mu.Lock()
+		defer peer.mu.Unlock()
+		_, ok := peer.routes[prefix]
+		return ok
+	})
+
+	cancel()
+	<-done
+	waitUntil(t, "the session is closed", func() bool {
+		peer.mu.Lock()
+		defer peer.mu.Unlock()
+		return len(peer.notifications) == 1 && peer.notifications[0].Code == bgpErrCease
+	})
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if _, ok := peer.routes[prefix]; ok {
+		t.Error("expected the route to be withdrawn before the session was closed")
+	}
+}
+
+func TestReadBGPMessage_Invalid(t *testing.T) {
+	t.Parallel()
+
+	header := func(marker byte, length uint16) []byte {
+		b := make([]byte, bgpHeaderLen)
+		for i := range 16 {
+			b[i] = marker
+		}
+		binary.BigEndian.PutUint16(b[16:], length)
+		b[18] = bgpMsgKeepalive
+		return b
+	}
+	for _, msg := range [][]byte{header(0, bgpHeaderLen), header(0xff, 5), header(0xff, bgpMaxMessageLen+1), header(0xff, 30)} {
+		if _, _, err := readBGPMessage(bytes.NewReader(msg)); err == nil {
+			t.Errorf("expected an error for %x", msg)
+		}
+	}
+}
@@ -0,0 +1,784 @@
+package ipmanager
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Message types, path attributes and error codes of BGP-4, see RFC 4271
+const (
+	bgpMsgOpen         = 1
+	bgpMsgUpdate       = 2
+	bgpMsgNotification = 3
+	bgpMsgKeepalive    = 4
+
+	bgpAttrOrigin        = 1
+	bgpAttrASPath        = 2
+	bgpAttrNextHop       = 3
+	bgpAttrMED           = 4
+	bgpAttrLocalPref     = 5
+	bgpAttrCommunities   = 8  // RFC 1997
+	bgpAttrMPReachNLRI   = 14 // RFC 4760
+	bgpAttrMPUnreachNLRI = 15 // RFC 4760
+
+	bgpAttrFlagOptional   = 0x80
+	bgpAttrFlagTransitive = 0x40
+	bgpAttrFlagExtended   = 0x10
+
+	bgpCapMultiprotocol = 1  // RFC 4760
+	bgpCapFourOctetAS   = 65 // RFC 6793
+
+	bgpErrOpen      = 2
+	bgpErrHoldTimer = 4
+	bgpErrCease     = 6
+
+	bgpErrOpenBadPeerAS   = 2
+	bgpErrOpenBadHoldTime = 6
+
+	bgpVersion       = 4
+	bgpPort          = "179"
+	bgpASTrans       = 23456
+	bgpHeaderLen     = 19
+	bgpMaxMessageLen = 4096
+	bgpLocalPref     = 100
+
+	// bgpOpenHoldTime is the hold time until the peer answered our OPEN,
+	// the large value suggested by RFC 4271, section 8
+	bgpOpenHoldTime   = 4 * time.Minute
+	bgpConnectTimeout = 5 * time.Second
+	bgpWriteTimeout   = 5 * time.Second
+)
+
+// bgpFamily is an address family identifier with its subsequent address
+// family identifier, as used by the multiprotocol extensions
+type bgpFamily struct {
+	AFI  uint16
+	SAFI uint8
+}
+
+var (
+	bgpIPv4Unicast = bgpFamily{AFI: 1, SAFI: 1}
+	bgpIPv6Unicast = bgpFamily{AFI: 2, SAFI: 1}
+)
+
+func bgpFamilyOf(addr netip.Addr) bgpFamily {
+	if addr.Is4() {
+		return bgpIPv4Unicast
+	}
+	return bgpIPv6Unicast
+}
+
+func (f bgpFamily) String() string {
+	switch f {
+	case bgpIPv4Unicast:
+		return "IPv4 unicast"
+	case bgpIPv6Unicast:
+		return "IPv6 unicast"
+	}
+	return fmt.Sprintf("AFI %d SAFI %d", f.AFI, f.SAFI)
+}
+
+// bgpSettings are the parameters of a speaker, shared by all its sessions
+type bgpSettings struct {
+	LocalAS      uint32
+	PeerAS       uint32
+	RouterID     netip.Addr // defaults to the local address of the session
+	HoldTime     time.Duration
+	NextHop      netip.Addr // defaults to the local address of the session
+	MED          uint32
+	Communities  []uint32
+	Neighbors    []string // host:port
+	ConnectRetry time.Duration
+}
+
+// key identifies speakers with the same settings, which are shared
+func (s bgpSettings) key() string {
+	return fmt.Sprintf("%+v", s)
+}
+
+// bgpNotification is an error sent by us or the peer before closing the
+// session
+type bgpNotification struct {
+	Code, Subcode uint8
+	Data          []byte
+}
+
+func (n *bgpNotification) Error() string {
+	return fmt.Sprintf("BGP notification code %d, subcode %d", n.Code, n.Subcode)
+}
+
+// writeBGPMessage sends a single message with the common header
+func writeBGPMessage(w io.Writer, msgType uint8, body []byte) error {
+	msg := make([]byte, bgpHeaderLen, bgpHeaderLen+len(body))
+	for i := range 16 {
+		msg[i] = 0xff // marker
+	}
+	binary.BigEndian.PutUint16(msg[16:], uint16(bgpHeaderLen+len(body)))
+	msg[18] = msgType
+	_, err := w.Write(append(msg, body...))
+	return err
+}
+
+// readBGPMessage reads a single message and returns its type and body
+func readBGPMessage(r io.Reader) (uint8, []byte, error) {
+	header := make([]byte, bgpHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	for _, b := range header[:16] {
+		if b != 0xff {
+			return 0, nil, errors.New("invalid BGP message marker")
+		}
+	}
+	length := int(binary.BigEndian.Uint16(header[16:]))
+	if length < bgpHeaderLen || length > bgpMaxMessageLen {
+		return 0, nil, fmt.Errorf("invalid BGP message length %d", length)
+	}
+	body := make([]byte, length-bgpHeaderLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[18], body, nil
+}
+
+// bgpOpen is the content of an OPEN message, limited to the capabilities
+// we care about
+type bgpOpen struct {
+	AS          uint32
+	HoldTime    uint16 // seconds
+	RouterID    netip.Addr
+	Families    []bgpFamily
+	FourOctetAS bool
+}
+
+func (o *bgpOpen) marshal() []byte {
+	var caps []byte
+	for _, f := range o.Families {
+		caps = append(caps, bgpCapMultiprotocol, 4)
+		caps = binary.BigEndian.AppendUint16(caps, f.AFI)
+		caps = append(caps, 0, f.SAFI)
+	}
+	caps = append(caps, bgpCapFourOctetAS, 4)
+	caps = binary.BigEndian.AppendUint32(caps, o.AS)
+
+	as := uint16(bgpASTrans)
+	if o.AS <= 0xffff {
+		as = uint16(o.AS)
+	}
+	body := []byte{bgpVersion}
+	body = binary.BigEndian.AppendUint16(body, as)
+	body = binary.BigEndian.AppendUint16(body, o.HoldTime)
+	body = append(body, o.RouterID.AsSlice()...)
+	// a single optional parameter of type capabilities
+	body = append(body, uint8(len(caps)+2), 2, uint8(len(caps)))
+	return append(body, caps...)
+}
+
+// supports reports whether routes of family may be sent to the speaker of
+// the OPEN. Without multiprotocol capabilities that is only IPv4 unicast,
+// see RFC 4760, section 8.
+func (o *bgpOpen) supports(family bgpFamily) bool {
+	if len(o.Families) == 0 {
+		return family == bgpIPv4Unicast
+	}
+	return slices.Contains(o.Families, family)
+}
+
+func parseBGPOpen(body []byte) (*bgpOpen, error) {
+	if len(body) < 10 {
+		return nil, errors.New("OPEN message too short")
+	}
+	if body[0] != bgpVersion {
+		return nil, fmt.Errorf("unsupported BGP version %d", body[0])
+	}
+	o := &bgpOpen{
+		AS:       uint32(binary.BigEndian.Uint16(body[1:])),
+		HoldTime: binary.BigEndian.Uint16(body[3:]),
+		RouterID: netip.AddrFrom4([4]byte(body[5:9])),
+	}
+	params := body[10:]
+	if len(params) != int(body[9]) {
+		return nil, errors.New("invalid length of the OPEN optional parameters")
+	}
+	for len(params) >= 2 {
+		paramType, paramLen := params[0], int(params[1])
+		if len(params) < 2+paramLen {
+			return nil, errors.New("truncated OPEN optional parameter")
+		}
+		caps := params[2 : 2+paramLen]
+		params = params[2+paramLen:]
+		if paramType != 2 {
+			continue
+		}
+		for len(caps) >= 2 {
+			code, capLen := caps[0], int(caps[1])
+			if len(caps) < 2+capLen {
+				return nil, errors.New("truncated capability")
+			}
+			value := caps[2 : 2+capLen]
+			caps = caps[2+capLen:]
+			switch {
+			case code == bgpCapMultiprotocol && capLen == 4:
+				o.Families = append(o.Families, bgpFamily{AFI: binary.BigEndian.Uint16(value), SAFI: value[3]})
+			case code == bgpCapFourOctetAS && capLen == 4:
+				o.AS = binary.BigEndian.Uint32(value)
+				o.FourOctetAS = true
+			}
+		}
+	}
+	return o, nil
+}
+
+// appendBGPPrefix encodes a prefix as length in bits followed by as few
+// octets as needed
+func appendBGPPrefix(b []byte, prefix netip.Prefix) []byte {
+	b = append(b, uint8(prefix.Bits()))
+	return append(b, prefix.Addr().AsSlice()[:(prefix.Bits()+7)/8]...)
+}
+
+func appendBGPAttr(b []byte, flags, attrType uint8, value []byte) []byte {
+	if len(value) > 0xff {
+		b = append(b, flags|bgpAttrFlagExtended, attrType)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	} else {
+		b = append(b, flags, attrType, uint8(len(value)))
+	}
+	return append(b, value...)
+}
+
+// bgpUpdateOptions tell how to encode an UPDATE for a particular session
+type bgpUpdateOptions struct {
+	LocalAS     uint32
+	EBGP        bool
+	FourOctetAS bool
+	NextHop     netip.Addr
+	MED         uint32
+	Communities []uint32
+}
+
+// marshalBGPUpdate returns the body of an UPDATE announcing or withdrawing
+// the prefix. IPv4 uses the classic NLRI fields, IPv6 the multiprotocol
+// attributes.
+func marshalBGPUpdate(prefix netip.Prefix, announce bool, opts bgpUpdateOptions) []byte {
+	family := bgpFamilyOf(prefix.Addr())
+	var withdrawn, attrs, nlri []byte
+	switch {
+	case !announce && family == bgpIPv4Unicast:
+		withdrawn = appendBGPPrefix(nil, prefix)
+	case !announce:
+		value := binary.BigEndian.AppendUint16(nil, family.AFI)
+		value = appendBGPPrefix(append(value, family.SAFI), prefix)
+		attrs = appendBGPAttr(attrs, bgpAttrFlagOptional, bgpAttrMPUnreachNLRI, value)
+	default:
+		attrs = appendBGPAttr(attrs, bgpAttrFlagTransitive, bgpAttrOrigin, []byte{0}) // IGP
+
+		var asPath []byte
+		if opts.EBGP {
+			asPath = []byte{2, 1} // AS_SEQUENCE of one AS
+			if opts.FourOctetAS {
+				asPath = binary.BigEndian.AppendUint32(asPath, opts.LocalAS)
+			} else {
+				asPath = binary.BigEndian.AppendUint16(asPath, uint16(opts.LocalAS))
+			}
+		}
+		attrs = appendBGPAttr(attrs, bgpAttrFlagTransitive, bgpAttrASPath, asPath)
+		if family == bgpIPv4Unicast {
+			attrs = appendBGPAttr(attrs, bgpAttrFlagTransitive, bgpAttrNextHop, opts.NextHop.AsSlice())
+		}
+		attrs = appendBGPAttr(attrs, bgpAttrFlagOptional, bgpAttrMED, binary.BigEndian.AppendUint32(nil, opts.MED))
+		if !opts.EBGP {
+			attrs = appendBGPAttr(attrs, bgpAttrFlagTransitive, bgpAttrLocalPref, binary.BigEndian.AppendUint32(nil, bgpLocalPref))
+		}
+		if len(opts.Communities) > 0 {
+			var value []byte
+			for _, community := range opts.Communities {
+				value = binary.BigEndian.AppendUint32(value, community)
+			}
+			attrs = appendBGPAttr(attrs, bgpAttrFlagOptional|bgpAttrFlagTransitive, bgpAttrCommunities, value)
+		}
+		if family == bgpIPv4Unicast {
+			nlri = appendBGPPrefix(nil, prefix)
+		} else {
+			value := binary.BigEndian.AppendUint16(nil, family.AFI)
+			value = append(value, family.SAFI, uint8(opts.NextHop.BitLen()/8))
+			value = append(value, opts.NextHop.AsSlice()...)
+			value = appendBGPPrefix(append(value, 0), prefix)
+			attrs = appendBGPAttr(attrs, bgpAttrFlagOptional, bgpAttrMPReachNLRI, value)
+		}
+	}
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(withdrawn)))
+	body = append(body, withdrawn...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(attrs)))
+	body = append(body, attrs...)
+	return append(body, nlri...)
+}
+
+// The bgpSpeaker keeps a session to every neighbor and announces the
+// prefixes of all BGPConfigurers sharing its settings over them. Sessions
+// are initiated by us only, the neighbors may be configured as passive.
+type bgpSpeaker struct {
+	settings  bgpSettings
+	neighbors []*bgpNeighbor
+	cancel    context.CancelFunc
+	done      sync.WaitGroup
+	// refs counts the configurers using the speaker, guarded by
+	// bgpSpeakersMutex
+	refs int
+
+	mu          sync.Mutex
+	routes      map[netip.Prefix]bool
+	subscribers map[chan struct{}]struct{}
+}
+
+var (
+	bgpSpeakersMutex sync.Mutex
+	bgpSpeakers      = map[string]*bgpSpeaker{}
+)
+
+// acquireBGPSpeaker returns the running speaker with these settings,
+// starting one if there is none yet. Several VIPs are announced over the
+// same sessions, as the neighbors would reject a second session from us.
+// Every call has to be paired with a call of release.
+func acquireBGPSpeaker(ctx context.Context, settings bgpSettings) *bgpSpeaker {
+	bgpSpeakersMutex.Lock()
+	defer bgpSpeakersMutex.Unlock()
+	key := settings.key()
+	s, ok := bgpSpeakers[key]
+	if !ok {
+		s = newBGPSpeaker(settings)
+		bgpSpeakers[key] = s
+		s.start(ctx)
+	}
+	s.refs++
+	return s
+}
+
+func newBGPSpeaker(settings bgpSettings) *bgpSpeaker {
+	s := &bgpSpeaker{
+		settings:    settings,
+		routes:      map[netip.Prefix]bool{},
+		subscribers: map[chan struct{}]struct{}{},
+	}
+	for _, addr := range settings.Neighbors {
+		s.neighbors = append(s.neighbors, &bgpNeighbor{
+			speaker: s,
+			addr:    addr,
+			sync:    make(chan struct{}, 1),
+		})
+	}
+	return s
+}
+
+func (s *bgpSpeaker) start(ctx context.Context) {
+	// The sessions are closed by release once the final withdrawals were
+	// made, not as soon as ctx is done, which may be before.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	s.cancel = cancel
+	for _, n := range s.neighbors {
+		s.done.Add(1)
+		go func() {
+			defer s.done.Done()
+			n.run(ctx)
+		}()
+	}
+}
+
+// release gives up a reference taken by acquireBGPSpeaker. The last one
+// closes all sessions, withdrawing everything we announced, and waits for
+// them to end.
+func (s *bgpSpeaker) release() {
+	bgpSpeakersMutex.Lock()
+	s.refs--
+	last := s.refs == 0
+	if last {
+		delete(bgpSpeakers, s.settings.key())
+	}
+	bgpSpeakersMutex.Unlock()
+	if last {
+		s.cancel()
+		s.done.Wait()
+	}
+}
+
+// announce adds the prefix to the routes advertised to all neighbors
+func (s *bgpSpeaker) announce(prefix netip.Prefix) {
+	s.setRoute(prefix, true)
+}
+
+// withdraw removes the prefix from the routes advertised to all neighbors
+func (s *bgpSpeaker) withdraw(prefix netip.Prefix) {
+	s.setRoute(prefix, false)
+}
+
+func (s *bgpSpeaker) setRoute(prefix netip.Prefix, announce bool) {
+	s.mu.Lock()
+	if announce {
+		s.routes[prefix] = true
+	} else {
+		delete(s.routes, prefix)
+	}
+	s.mu.Unlock()
+	for _, n := range s.neighbors {
+		select {
+		case n.sync <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// isAdvertised returns whether at least one established session has
+// advertised the prefix
+func (s *bgpSpeaker) isAdvertised(prefix netip.Prefix) bool {
+	for _, n := range s.neighbors {
+		if n.isAdvertised(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribe returns a channel signalled whenever a session went up or down
+// or the advertised routes changed, until ctx is done
+func (s *bgpSpeaker) subscribe(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		s.mu.Unlock()
+		close(ch)
+	}()
+	return ch
+}
+
+func (s *bgpSpeaker) notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wantedRoutes returns a copy of the prefixes to announce
+func (s *bgpSpeaker) wantedRoutes() map[netip.Prefix]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	routes := make(map[netip.Prefix]bool, len(s.routes))
+	for prefix := range s.routes {
+		routes[prefix] = true
+	}
+	return routes
+}
+
+// bgpNeighbor is the session to a single peer, kept up by its own goroutine
+type bgpNeighbor struct {
+	speaker *bgpSpeaker
+	addr    string
+	// sync is signalled when the routes to announce changed
+	sync chan struct{}
+
+	mu          sync.Mutex
+	established bool
+	advertised  map[netip.Prefix]bool
+}
+
+func (n *bgpNeighbor) isAdvertised(prefix netip.Prefix) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.established && n.advertised[prefix]
+}
+
+func (n *bgpNeighbor) setState(established bool, advertised map[netip.Prefix]bool) {
+	n.mu.Lock()
+	n.established = established
+	n.advertised = advertised
+	n.mu.Unlock()
+	n.speaker.notify()
+}
+
+// run keeps the session up until ctx is done, reconnecting every
+// connect-retry after a failure
+func (n *bgpNeighbor) run(ctx context.Context) {
+	var lastErr string
+	for {
+		err := n.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		// only log changes, a neighbor that is down would flood the log
+		if err.Error() != lastErr {
+			log.Warnf("BGP session to %s failed: %v", n.addr, err)
+			lastErr = err.Error()
+		} else {
+			log.Debugf("BGP session to %s failed: %v", n.addr, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(n.speaker.settings.ConnectRetry):
+		}
+	}
+}
+
+// session connects to the neighbor and runs the session until it fails
+func (n *bgpNeighbor) session(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: bgpConnectTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	s := &bgpSession{neighbor: n, settings: &n.speaker.settings, conn: conn}
+
+	// the handshake may take long, don't let it delay a shutdown
+	stopHandshake := context.AfterFunc(ctx, func() { conn.Close() })
+	err = s.open()
+	stopHandshake()
+	if err != nil {
+		return err
+	}
+	log.Infof("BGP session to %s (AS %d, router ID %s) established", n.addr, s.peer.AS, s.peer.RouterID)
+	defer n.setState(false, nil)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.receive()
+	}()
+
+	var keepalive <-chan time.Time
+	if s.holdTime > 0 {
+		ticker := time.NewTicker(s.holdTime / 3)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+	n.setState(true, map[netip.Prefix]bool{})
+	advertised := map[netip.Prefix]bool{}
+	for {
+		if advertised, err = s.syncRoutes(advertised); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			// withdrawals made right before the shutdown are sent first
+			_, _ = s.syncRoutes(advertised)
+			_ = s.notify(&bgpNotification{Code: bgpErrCease, Subcode: 2}) // administrative shutdown
+			return ctx.Err()
+		case err = <-errs:
+			return err
+		case <-keepalive:
+			if err = s.write(bgpMsgKeepalive, nil); err != nil {
+				return err
+			}
+		case <-n.sync:
+		}
+	}
+}
+
+// bgpSession is a single connection to a neighbor
+type bgpSession struct {
+	neighbor *bgpNeighbor
+	settings *bgpSettings
+	conn     net.Conn
+	peer     *bgpOpen
+	holdTime time.Duration
+	localIP  netip.Addr
+	// unsupported holds the wanted routes of a family the peer didn't
+	// negotiate, so skipping them is only logged once
+	unsupported map[netip.Prefix]bool
+	// writeMutex keeps the receiving goroutine from interleaving a
+	// NOTIFICATION with our messages
+	writeMutex sync.Mutex
+}
+
+func (s *bgpSession) write(msgType uint8, body []byte) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	if err := s.conn.SetWriteDeadline(time.Now().Add(bgpWriteTimeout)); err != nil {
+		return err
+	}
+	return writeBGPMessage(s.conn, msgType, body)
+}
+
+func (s *bgpSession) read(timeout time.Duration) (uint8, []byte, error) {
+	deadline := time.Time{}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if err := s.conn.SetReadDeadline(deadline); err != nil {
+		return 0, nil, err
+	}
+	msgType, body, err := readBGPMessage(s.conn)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		_ = s.notify(&bgpNotification{Code: bgpErrHoldTimer})
+		return 0, nil, errors.New("hold timer expired")
+	}
+	if err == nil && msgType == bgpMsgNotification {
+		notification := &bgpNotification{}
+		if len(body) >= 2 {
+			notification.Code, notification.Subcode, notification.Data = body[0], body[1], body[2:]
+		}
+		return 0, nil, fmt.Errorf("peer closed the session: %w", notification)
+	}
+	return msgType, body, err
+}
+
+// notify sends a NOTIFICATION, the session must be closed afterwards
+func (s *bgpSession) notify(notification *bgpNotification) error {
+	return s.write(bgpMsgNotification, append([]byte{notification.Code, notification.Subcode}, notification.Data...))
+}
+
+// open exchanges OPEN and KEEPALIVE messages with the peer
+func (s *bgpSession) open() error {
+	localAddr, _ := s.conn.LocalAddr().(*net.TCPAddr)
+	if localAddr != nil {
+		s.localIP, _ = netip.AddrFromSlice(localAddr.IP)
+		s.localIP = s.localIP.Unmap()
+	}
+	routerID := s.settings.RouterID
+	if !routerID.IsValid() {
+		routerID = s.localIP
+	}
+	if !routerID.Is4() {
+		return errors.New("bgp-router-id must be set for sessions over IPv6")
+	}
+	families := []bgpFamily{bgpIPv4Unicast, bgpIPv6Unicast}
+	err := s.write(bgpMsgOpen, (&bgpOpen{
+		AS:       s.settings.LocalAS,
+		HoldTime: uint16(s.settings.HoldTime / time.Second),
+		RouterID: routerID,
+		Families: families,
+	}).marshal())
+	if err != nil {
+		return err
+	}
+
+	msgType, body, err := s.read(bgpOpenHoldTime)
+	if err != nil {
+		return err
+	}
+	if msgType != bgpMsgOpen {
+		return fmt.Errorf("expected OPEN, got message type %d", msgType)
+	}
+	if s.peer, err = parseBGPOpen(body); err != nil {
+		return err
+	}
+	if s.peer.AS != s.settings.PeerAS {
+		_ = s.notify(&bgpNotification{Code: bgpErrOpen, Subcode: bgpErrOpenBadPeerAS})
+		return fmt.Errorf("peer is AS %d, expected AS %d", s.peer.AS, s.settings.PeerAS)
+	}
+	if !s.peer.FourOctetAS && s.settings.LocalAS > 0xffff {
+		_ = s.notify(&bgpNotification{Code: bgpErrCease})
+		return fmt.Errorf("peer does not support the four-octet AS %d", s.settings.LocalAS)
+	}
+	s.holdTime = min(s.settings.HoldTime, time.Duration(s.peer.HoldTime)*time.Second)
+	if s.holdTime > 0 && s.holdTime < 3*time.Second {
+		_ = s.notify(&bgpNotification{Code: bgpErrOpen, Subcode: bgpErrOpenBadHoldTime})
+		return fmt.Errorf("unacceptable hold time %s", s.holdTime)
+	}
+	if err = s.write(bgpMsgKeepalive, nil); err != nil {
+		return err
+	}
+
+	msgType, _, err = s.read(s.holdTime)
+	if err != nil {
+		return err
+	}
+	if msgType != bgpMsgKeepalive {
+		return fmt.Errorf("expected KEEPALIVE, got message type %d", msgType)
+	}
+	return nil
+}
+
+// receive reads messages until the session fails. Routes of the peer are
+// of no interest to us, so everything but NOTIFICATIONs is ignored.
+func (s *bgpSession) receive() error {
+	for {
+		if _, _, err := s.read(s.holdTime); err != nil {
+			return err
+		}
+	}
+}
+
+// syncRoutes sends UPDATEs for the difference between the wanted routes
+// and those advertised over this session so far
+func (s *bgpSession) syncRoutes(advertised map[netip.Prefix]bool) (map[netip.Prefix]bool, error) {
+	wanted := s.neighbor.speaker.wantedRoutes()
+	changed := false
+	for prefix := range wanted {
+		if advertised[prefix] || s.unsupported[prefix] {
+			continue
+		}
+		// sending a family the peer didn't negotiate may reset the session
+		if family := bgpFamilyOf(prefix.Addr()); !s.peer.supports(family) {
+			log.Warnf("Not announcing %s to %s, which didn't negotiate %s", prefix, s.neighbor.addr, family)
+			if s.unsupported == nil {
+				s.unsupported = map[netip.Prefix]bool{}
+			}
+			s.unsupported[prefix] = true
+			continue
+		}
+		opts, err := s.updateOptions(prefix)
+		if err != nil {
+			log.Errorf("Can't announce %s to %s: %v", prefix, s.neighbor.addr, err)
+			continue
+		}
+		if err = s.write(bgpMsgUpdate, marshalBGPUpdate(prefix, true, opts)); err != nil {
+			return advertised, err
+		}
+		log.Infof("Announced %s to %s", prefix, s.neighbor.addr)
+		advertised[prefix] = true
+		changed = true
+	}
+	for prefix := range advertised {
+		if wanted[prefix] {
+			continue
+		}
+		if err := s.write(bgpMsgUpdate, marshalBGPUpdate(prefix, false, bgpUpdateOptions{})); err != nil {
+			return advertised, err
+		}
+		log.Infof("Withdrew %s from %s", prefix, s.neighbor.addr)
+		delete(advertised, prefix)
+		changed = true
+	}
+	if changed {
+		copied := make(map[netip.Prefix]bool, len(advertised))
+		for prefix := range advertised {
+			copied[prefix] = true
+		}
+		s.neighbor.setState(true, copied)
+	}
+	return advertised, nil
+}
+
+func (s *bgpSession) updateOptions(prefix netip.Prefix) (bgpUpdateOptions, error) {
+	nextHop := s.settings.NextHop
+	if !nextHop.IsValid() || nextHop.Is4() != prefix.Addr().Is4() {
+		nextHop = s.localIP
+	}
+	if nextHop.Is4() != prefix.Addr().Is4() {
+		return bgpUpdateOptions{}, errors.New("no next hop of the same address family, set bgp-next-hop")
+	}
+	return bgpUpdateOptions{
+		LocalAS:     s.settings.LocalAS,
+		EBGP:        s.settings.PeerAS != s.settings.LocalAS,
+		FourOctetAS: s.peer.FourOctetAS,
+		NextHop:     nextHop,
+		MED:         s.settings.MED,
+		Communities: s.settings.Communities,
+	}, nil
+}
@@ -0,0 +1,78 @@
+package ipmanager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// commandWaitDelay is how long we wait for the output of a command after it
+// was killed, e.g. when it left a child behind that holds on to it
+const commandWaitDelay = time.Second
+
+// commandEnv describes the VIP to user supplied commands, using the names
+// of the environment variables vip-manager itself is configured with
+func commandEnv(config *IPConfiguration, conf *vipconfig.Config) []string {
+	return []string{
+		"VIP_IP=" + config.VIP.String(),
+		fmt.Sprintf("VIP_NETMASK=%d", netmaskSize(config.Netmask)),
+		"VIP_CIDR=" + config.getCIDR(),
+		"VIP_INTERFACE=" + config.Iface.Name,
+		"VIP_MANAGER_TYPE=" + conf.HostingType,
+		"VIP_TRIGGER_KEY=" + conf.TriggerKey,
+		"VIP_TRIGGER_VALUE=" + conf.TriggerValue,
+		"VIP_DCS_TYPE=" + conf.EndpointType,
+		"VIP_DCS_ENDPOINTS=" + strings.Join(conf.Endpoints, ","),
+	}
+}
+
+// runCommand runs line with the shell of the platform, the environment of
+// vip-manager extended by env, and returns its exit code. The output is
+// logged line by line with logf, prefixed by name. An error is returned if
+// the command couldn't be run or was killed after timeout.
+func runCommand(name, line string, env []string, timeout time.Duration, logf func(string, ...any)) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd.exe", "/C", line)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", line)
+	}
+	cmd.Env = append(os.Environ(), env...)
+	cmd.WaitDelay = commandWaitDelay
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	start := time.Now()
+	err := cmd.Run()
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		if text := strings.TrimSpace(scanner.Text()); text != "" {
+			logf("%s: %s", name, text)
+		}
+	}
+	if ctx.Err() != nil {
+		return -1, fmt.Errorf("%s was killed after %s", name, timeout)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, fmt.Errorf("failed to run %s: %w", name, err)
+	}
+	log.Debugf("%s finished in %s", name, time.Since(start))
+	return 0, nil
+}
@@ -0,0 +1,166 @@
+package ipmanager
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+const (
+	defaultDigitalOceanEndpoint         = "https://api.digitalocean.com/v2"
+	defaultDigitalOceanMetadataEndpoint = "http://169.254.169.254/metadata/v1"
+
+	// digitalOceanActionTimeout limits how long we wait for the assignment
+	// of the reserved IP to finish
+	digitalOceanActionTimeout = time.Minute
+)
+
+// The DigitalOceanConfigurer assigns a reserved IP to this droplet through
+// the DigitalOcean API, whenever manager-type `digitalocean` is set. The
+// reserved IP is mapped to the anchor IP of the droplet, so it doesn't need
+// to be configured on any interface.
+// Unlike HetznerConfigurer, the assignment is queried from the API on every
+// check, so a reserved IP moved by someone else is noticed right away.
+type DigitalOceanConfigurer struct {
+	*IPConfiguration
+	api       *apiClient
+	metadata  *apiClient
+	dropletID int64
+	// assignee is only kept to log changes of the assignment
+	assignee int64
+}
+
+type digitalOceanAction struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+}
+
+type digitalOceanReservedIP struct {
+	IP      string `json:"ip"`
+	Droplet *struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	} `json:"droplet"`
+}
+
+func newDigitalOceanConfigurer(config *IPConfiguration, conf *vipconfig.Config) (*DigitalOceanConfigurer, error) {
+	token, err := readSecret("", conf.DigitalOceanTokenFile, "DIGITALOCEAN_TOKEN")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DigitalOcean API token: %w", err)
+	}
+	return &DigitalOceanConfigurer{
+		IPConfiguration: config,
+		api:             newAPIClient(cmp.Or(conf.DigitalOceanEndpoint, defaultDigitalOceanEndpoint), bearerToken(token)),
+		metadata:        newAPIClient(cmp.Or(conf.DigitalOceanMetadataEndpoint, defaultDigitalOceanMetadataEndpoint), nil),
+	}, nil
+}
+
+// getDropletID returns the ID of this droplet, as told by the metadata service
+func (c *DigitalOceanConfigurer) getDropletID() (int64, error) {
+	if c.dropletID != 0 {
+		return c.dropletID, nil
+	}
+	str, err := c.metadata.getText("/id")
+	if err != nil {
+		return 0, fmt.Errorf("failed to query the metadata service: %w", err)
+	}
+	if c.dropletID, err = strconv.ParseInt(str, 10, 64); err != nil {
+		return 0, fmt.Errorf("unexpected droplet id %q from the metadata service: %w", str, err)
+	}
+	log.Infof("Discovered droplet ID %d", c.dropletID)
+	return c.dropletID, nil
+}
+
+// getAssignee returns the ID of the droplet the reserved IP is assigned to,
+// 0 if it is unassigned
+func (c *DigitalOceanConfigurer) getAssignee() (int64, error) {
+	var resp struct {
+		ReservedIP digitalOceanReservedIP `json:"reserved_ip"`
+	}
+	if err := c.api.do(http.MethodGet, "/reserved_ips/"+c.VIP.String(), nil, &resp); err != nil {
+		return 0, fmt.Errorf("failed to query reserved IP %s: %w", c.VIP, err)
+	}
+	var assignee int64
+	if droplet := resp.ReservedIP.Droplet; droplet != nil {
+		assignee = droplet.ID
+	}
+	if assignee != c.assignee {
+		if assignee == 0 {
+			log.Infof("Reserved IP %s is unassigned", c.VIP)
+		} else {
+			log.Infof("Reserved IP %s is assigned to droplet %d (%s)", c.VIP, assignee, resp.ReservedIP.Droplet.Name)
+		}
+		c.assignee = assignee
+	}
+	return assignee, nil
+}
+
+// waitForAction polls the action until it is no longer in progress
+func (c *DigitalOceanConfigurer) waitForAction(action digitalOceanAction) error {
+	deadline := time.Now().Add(digitalOceanActionTimeout)
+	for action.Status == "in-progress" {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("action %d did not finish within %s", action.ID, digitalOceanActionTimeout)
+		}
+		time.Sleep(time.Duration(max(c.RetryAfter, 1)) * time.Millisecond)
+		var resp struct {
+			Action digitalOceanAction `json:"action"`
+		}
+		if err := c.api.do(http.MethodGet, fmt.Sprintf("/reserved_ips/%s/actions/%d", c.VIP, action.ID), nil, &resp); err != nil {
+			return fmt.Errorf("failed to query action %d: %w", action.ID, err)
+		}
+		action = resp.Action
+	}
+	if action.Status != "completed" {
+		return fmt.Errorf("action %d finished with status %q", action.ID, action.Status)
+	}
+	return nil
+}
+
+func (c *DigitalOceanConfigurer) queryAddress() bool {
+	dropletID, err := c.getDropletID()
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	assignee, err := c.getAssignee()
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	return assignee == dropletID
+}
+
+func (c *DigitalOceanConfigurer) configureAddress() bool {
+	dropletID, err := c.getDropletID()
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	var resp struct {
+		Action digitalOceanAction `json:"action"`
+	}
+	err = c.api.do(http.MethodPost, "/reserved_ips/"+c.VIP.String()+"/actions", map[string]any{
+		"type":       "assign",
+		"droplet_id": dropletID,
+	}, &resp)
+	if err == nil {
+		err = c.waitForAction(resp.Action)
+	}
+	if err != nil {
+		log.Errorf("Failed to assign reserved IP %s to droplet %d: %s", c.VIP, dropletID, err)
+		return false
+	}
+	log.Infof("Reserved IP %s was successfully assigned to droplet %d", c.VIP, dropletID)
+	return true
+}
+
+func (c *DigitalOceanConfigurer) deconfigureAddress() bool {
+	// The assign action of the next leader takes the reserved IP from our
+	// droplet. Unassigning it here would only leave it unreachable until then.
+	return true
+}
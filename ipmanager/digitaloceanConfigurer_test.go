@@ -0,0 +1,211 @@
+package ipmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// fakeDigitalOcean is a stand-in for the DigitalOcean API and the droplet
+// metadata service. Actions complete after being polled once.
+type fakeDigitalOcean struct {
+	*fakeAPI
+	dropletID int64
+	assignee  int64
+	actions   map[int64]string
+	failWith  string
+	gets      int
+}
+
+func newFakeDigitalOcean(t *testing.T) *fakeDigitalOcean {
+	t.Helper()
+	f := &fakeDigitalOcean{dropletID: 3164444, actions: map[int64]string{}}
+	f.fakeAPI = newFakeAPI(t, f.handle)
+	return f
+}
+
+func (f *fakeDigitalOcean) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/metadata/v1/id" {
+		fmt.Fprintf(w, "%d", f.dropletID)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer do-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"id":"Unauthorized","message":"Unable to authenticate you."}`))
+		return
+	}
+
+	actionID, _ := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/v2/reserved_ips/203.0.113.10/actions/"), 10, 64)
+	switch {
+	case r.URL.Path == "/v2/reserved_ips/203.0.113.10" && r.Method == http.MethodGet:
+		f.gets++
+		ip := map[string]any{"ip": "203.0.113.10", "droplet": nil}
+		if f.assignee != 0 {
+			ip["droplet"] = map[string]any{"id": f.assignee, "name": fmt.Sprintf("db-%d", f.assignee)}
+		}
+		writeJSON(w, map[string]any{"reserved_ip": ip})
+	case r.URL.Path == "/v2/reserved_ips/203.0.113.10/actions" && r.Method == http.MethodPost:
+		var body struct {
+			Type      string `json:"type"`
+			DropletID int64  `json:"droplet_id"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if body.Type != "assign" || body.DropletID == 0 {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		id := int64(len(f.actions) + 1)
+		f.actions[id] = "in-progress"
+		if f.failWith == "" {
+			f.assignee = body.DropletID
+		}
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, map[string]any{"action": map[string]any{"id": id, "status": "in-progress", "type": "assign_ip"}})
+	case actionID != 0 && r.Method == http.MethodGet:
+		status := "completed"
+		if f.failWith != "" {
+			status = f.failWith
+		}
+		f.actions[actionID] = status
+		writeJSON(w, map[string]any{"action": map[string]any{"id": actionID, "status": status}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestDigitalOceanConfigurer(t *testing.T, f *fakeDigitalOcean) *DigitalOceanConfigurer {
+	t.Helper()
+	tokenFile := filepath.Join(t.TempDir(), "do-token")
+	if err := os.WriteFile(tokenFile, []byte("do-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return newTestConfigurer(t, newDigitalOceanConfigurer, testHetznerIPConfiguration("203.0.113.10"), &vipconfig.Config{
+		DigitalOceanTokenFile:        tokenFile,
+		DigitalOceanEndpoint:         f.URL + "/v2",
+		DigitalOceanMetadataEndpoint: f.URL + "/metadata/v1",
+	})
+}
+
+// ---------------------------------------------------------------------------
+// newDigitalOceanConfigurer
+// ---------------------------------------------------------------------------
+
+func TestNewDigitalOceanConfigurer_NoToken(t *testing.T) {
+	t.Setenv("DIGITALOCEAN_TOKEN", "")
+
+	if _, err := newDigitalOceanConfigurer(testHetznerIPConfiguration("203.0.113.10"), &vipconfig.Config{}); err == nil {
+		t.Error("expected an error without API token")
+	}
+}
+
+func TestNewDigitalOceanConfigurer_Defaults(t *testing.T) {
+	t.Setenv("DIGITALOCEAN_TOKEN", "env-token")
+
+	c, err := newDigitalOceanConfigurer(testHetznerIPConfiguration("203.0.113.10"), &vipconfig.Config{})
+	if err != nil {
+		t.Fatalf("newDigitalOceanConfigurer() error = %v", err)
+	}
+	if c.api.baseURL != defaultDigitalOceanEndpoint || c.metadata.baseURL != defaultDigitalOceanMetadataEndpoint {
+		t.Errorf("unexpected endpoints %s and %s", c.api.baseURL, c.metadata.baseURL)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// queryAddress / configureAddress / deconfigureAddress
+// ---------------------------------------------------------------------------
+
+func TestDigitalOceanConfigurer_queryAddress(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeDigitalOcean(t)
+	c := newTestDigitalOceanConfigurer(t, f)
+
+	tests := []struct {
+		name     string
+		assignee int64
+		want     bool
+	}{
+		{"unassigned", 0, false},
+		{"assigned to us", 3164444, true},
+		{"moved to another droplet", 3164445, false},
+		{"moved back", 3164444, true},
+	}
+	for _, tt := range tests {
+		f.mu.Lock()
+		f.assignee = tt.assignee
+		f.mu.Unlock()
+		if got := c.queryAddress(); got != tt.want {
+			t.Errorf("%s: queryAddress() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if f.gets != len(tests) {
+		t.Errorf("expected the API to be queried on every check, got %d queries for %d checks", f.gets, len(tests))
+	}
+}
+
+func TestDigitalOceanConfigurer_configureAddress(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeDigitalOcean(t)
+	f.assignee = 3164445
+	c := newTestDigitalOceanConfigurer(t, f)
+
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if f.assignee != f.dropletID {
+		t.Errorf("reserved IP is assigned to %d, want %d", f.assignee, f.dropletID)
+	}
+	if f.actions[1] != "completed" {
+		t.Errorf("expected the action to be polled until completed, got %q", f.actions[1])
+	}
+	if !c.queryAddress() {
+		t.Error("queryAddress() = false after the assignment")
+	}
+}
+
+func TestDigitalOceanConfigurer_configureAddress_ActionErrored(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeDigitalOcean(t)
+	f.failWith = "errored"
+	c := newTestDigitalOceanConfigurer(t, f)
+
+	if c.configureAddress() {
+		t.Error("configureAddress() should fail when the action errored")
+	}
+}
+
+func TestDigitalOceanConfigurer_Unauthorized(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeDigitalOcean(t)
+	c := newTestDigitalOceanConfigurer(t, f)
+	c.api.authorize = bearerToken("wrong")
+
+	if c.queryAddress() || c.configureAddress() {
+		t.Error("expected failures with a wrong token")
+	}
+}
+
+func TestDigitalOceanConfigurer_deconfigureAddress(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeDigitalOcean(t)
+	f.assignee = 3164444
+	c := newTestDigitalOceanConfigurer(t, f)
+
+	if !c.deconfigureAddress() {
+		t.Error("deconfigureAddress() = false, want true")
+	}
+	if f.assignee != 3164444 || len(f.actions) != 0 {
+		t.Error("deconfigureAddress() must leave the reserved IP to the next leader")
+	}
+}
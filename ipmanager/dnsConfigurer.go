@@ -0,0 +1,204 @@
+package ipmanager
+
+import (
+	"cmp"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+	"github.com/miekg/dns"
+)
+
+// dnsTSIGFudge is the allowed clock difference for signed messages
+const dnsTSIGFudge = 300
+
+// TSIG algorithms supported for dns-tsig-algorithm
+var dnsTSIGAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// The DNSConfigurer points a name to this node through dynamic DNS updates
+// (RFC 2136), whenever manager-type `dns` is set. Instead of a virtual ip,
+// `ip` is the address of this node, which replaces the A or AAAA record of
+// the name when this node becomes the leader. The updates are signed with
+// TSIG (RFC 8945) if a key is configured.
+type DNSConfigurer struct {
+	*IPConfiguration
+	client   *dns.Client
+	server   string
+	zone     string
+	name     string
+	ttl      uint32
+	tsigKey  string
+	tsigAlgo string
+	rrType   uint16
+}
+
+func newDNSConfigurer(config *IPConfiguration, conf *vipconfig.Config) (*DNSConfigurer, error) {
+	if conf.DNSServer == "" || conf.DNSName == "" {
+		return nil, errors.New("dns-server and dns-name must be set for manager-type dns")
+	}
+	server := conf.DNSServer
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	name := dns.CanonicalName(conf.DNSName)
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("invalid dns-name %q", conf.DNSName)
+	}
+	zone := dns.CanonicalName(conf.DNSZone)
+	if conf.DNSZone == "" {
+		// the parent of the name, e.g. example.com. for db.example.com.
+		labels := dns.SplitDomainName(name)
+		if len(labels) < 2 {
+			return nil, fmt.Errorf("can't derive the zone of %s, set dns-zone", name)
+		}
+		zone = dns.Fqdn(strings.Join(labels[1:], "."))
+	}
+	if !dns.IsSubDomain(zone, name) {
+		return nil, fmt.Errorf("dns-name %s is not in dns-zone %s", name, zone)
+	}
+	if conf.DNSTTL < 0 {
+		return nil, fmt.Errorf("invalid dns-ttl %d", conf.DNSTTL)
+	}
+
+	c := &DNSConfigurer{
+		IPConfiguration: config,
+		client:          &dns.Client{Timeout: apiTimeout},
+		server:          server,
+		zone:            zone,
+		name:            name,
+		ttl:             uint32(conf.DNSTTL),
+		rrType:          dns.TypeAAAA,
+	}
+	if config.VIP.Is4() {
+		c.rrType = dns.TypeA
+	}
+	if conf.DNSTSIGKeyName != "" {
+		algorithm, ok := dnsTSIGAlgorithms[strings.ToLower(cmp.Or(conf.DNSTSIGAlgorithm, "hmac-sha256"))]
+		if !ok {
+			return nil, fmt.Errorf("unsupported dns-tsig-algorithm %q, supported values: hmac-sha1, hmac-sha224, hmac-sha256, hmac-sha384, hmac-sha512", conf.DNSTSIGAlgorithm)
+		}
+		secret, err := readSecret(conf.DNSTSIGSecret, conf.DNSTSIGSecretFile, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the TSIG secret: %w", err)
+		}
+		if _, err = base64.StdEncoding.DecodeString(secret); err != nil {
+			return nil, fmt.Errorf("the TSIG secret must be base64 encoded: %w", err)
+		}
+		c.tsigKey = dns.Fqdn(conf.DNSTSIGKeyName)
+		c.tsigAlgo = algorithm
+		c.client.TsigSecret = map[string]string{c.tsigKey: secret}
+	}
+	return c, nil
+}
+
+// record returns the A or AAAA record pointing the name to this node
+func (c *DNSConfigurer) record() dns.RR {
+	header := dns.RR_Header{Name: c.name, Rrtype: c.rrType, Class: dns.ClassINET, Ttl: c.ttl}
+	if c.rrType == dns.TypeA {
+		return &dns.A{Hdr: header, A: c.VIP.AsSlice()}
+	}
+	return &dns.AAAA{Hdr: header, AAAA: c.VIP.AsSlice()}
+}
+
+// dnsRcodeError is returned by exchange for answers other than NOERROR
+type dnsRcodeError struct {
+	server string
+	rcode  int
+}
+
+func (e *dnsRcodeError) Error() string {
+	return fmt.Sprintf("%s answered %s", e.server, dns.RcodeToString[e.rcode])
+}
+
+// exchange sends the message to the server, signed if a key is configured,
+// and fails unless the server answers with NOERROR
+func (c *DNSConfigurer) exchange(m *dns.Msg) (*dns.Msg, error) {
+	if c.tsigKey != "" {
+		m.SetTsig(c.tsigKey, c.tsigAlgo, dnsTSIGFudge, time.Now().Unix())
+	}
+	resp, _, err := c.client.Exchange(m, c.server)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, &dnsRcodeError{server: c.server, rcode: resp.Rcode}
+	}
+	return resp, nil
+}
+
+// getAddresses asks the server for the addresses the name points to. A
+// name that doesn't exist (NXDOMAIN) or has no such records (NODATA, an
+// empty answer) points nowhere, it is gone once the last record was removed.
+func (c *DNSConfigurer) getAddresses() ([]net.IP, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(c.name, c.rrType)
+	m.RecursionDesired = false
+	resp, err := c.exchange(m)
+	var rcodeErr *dnsRcodeError
+	if errors.As(err, &rcodeErr) && rcodeErr.rcode == dns.RcodeNameError {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %w", c.name, err)
+	}
+	var addrs []net.IP
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, rr.A)
+		case *dns.AAAA:
+			addrs = append(addrs, rr.AAAA)
+		}
+	}
+	return addrs, nil
+}
+
+func (c *DNSConfigurer) queryAddress() bool {
+	addrs, err := c.getAddresses()
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	log.Debugf("%s points to %v", c.name, addrs)
+	// other addresses would still get a share of the clients
+	return len(addrs) == 1 && c.isVIP(addrs[0])
+}
+
+func (c *DNSConfigurer) configureAddress() bool {
+	record := c.record()
+	m := new(dns.Msg)
+	m.SetUpdate(c.zone)
+	// both happen atomically, there is no moment without a record
+	m.RemoveRRset([]dns.RR{record})
+	m.Insert([]dns.RR{record})
+	if _, err := c.exchange(m); err != nil {
+		log.Errorf("Failed to point %s to %s: %s", c.name, c.VIP, err)
+		return false
+	}
+	log.Infof("%s was successfully pointed to %s", c.name, c.VIP)
+	return true
+}
+
+func (c *DNSConfigurer) deconfigureAddress() bool {
+	// Only our own address is removed, should the next leader have
+	// replaced it already, the update changes nothing.
+	m := new(dns.Msg)
+	m.SetUpdate(c.zone)
+	m.Remove([]dns.RR{c.record()})
+	if _, err := c.exchange(m); err != nil {
+		log.Errorf("Failed to remove %s from %s: %s", c.VIP, c.name, err)
+		return false
+	}
+	log.Infof("%s was removed from %s", c.VIP, c.name)
+	return true
+}
@@ -0,0 +1,391 @@
+package ipmanager
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+	"github.com/miekg/dns"
+)
+
+const (
+	testDNSKey    = "vip-manager."
+	testDNSSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+)
+
+// fakeDNS is a stand-in for an authoritative server of example.com.,
+// accepting only updates signed with testDNSKey
+type fakeDNS struct {
+	server  *dns.Server
+	addr    string
+	mu      sync.Mutex
+	records map[string][]dns.RR // by name and type
+	updates int
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeDNS{addr: pc.LocalAddr().String(), records: map[string][]dns.RR{}}
+	started := make(chan struct{})
+	f.server = &dns.Server{
+		PacketConn:        pc,
+		TsigSecret:        map[string]string{testDNSKey: testDNSSecret},
+		Handler:           dns.HandlerFunc(f.handle),
+		MsgAcceptFunc:     acceptDNSUpdates,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go func() { _ = f.server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = f.server.Shutdown() })
+	return f
+}
+
+// acceptDNSUpdates extends the default, which answers updates with NOTIMP
+func acceptDNSUpdates(h dns.Header) dns.MsgAcceptAction {
+	if opcode := int(h.Bits>>11) & 0xF; opcode == dns.OpcodeUpdate {
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(h)
+}
+
+func fakeDNSKey(name string, rrtype uint16) string {
+	return dns.CanonicalName(name) + "/" + dns.TypeToString[rrtype]
+}
+
+func (f *fakeDNS) set(name string, rrtype uint16, addrs ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var rrs []dns.RR
+	for _, addr := range addrs {
+		rr, _ := dns.NewRR(name + " 30 IN " + dns.TypeToString[rrtype] + " " + addr)
+		rrs = append(rrs, rr)
+	}
+	f.records[fakeDNSKey(name, rrtype)] = rrs
+}
+
+func (f *fakeDNS) get(name string, rrtype uint16) (addrs []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, rr := range f.records[fakeDNSKey(name, rrtype)] {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, rr.A.String())
+		case *dns.AAAA:
+			addrs = append(addrs, rr.AAAA.String())
+		}
+	}
+	return addrs
+}
+
+func (f *fakeDNS) handle(w dns.ResponseWriter, req *dns.Msg) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	tsig := req.IsTsig()
+	switch {
+	case tsig != nil && w.TsigStatus() != nil:
+		resp.Rcode = dns.RcodeNotAuth
+	case len(req.Question) != 1 || !dns.IsSubDomain("example.com.", req.Question[0].Name):
+		resp.Rcode = dns.RcodeRefused
+	case req.Opcode == dns.OpcodeQuery:
+		q := req.Question[0]
+		resp.Answer = f.records[fakeDNSKey(q.Name, q.Qtype)]
+		if !f.exists(q.Name) {
+			resp.Rcode = dns.RcodeNameError
+		}
+	case req.Opcode == dns.OpcodeUpdate && tsig == nil:
+		resp.Rcode = dns.RcodeRefused
+	case req.Opcode == dns.OpcodeUpdate:
+		f.update(req.Ns)
+	default:
+		resp.Rcode = dns.RcodeNotImplemented
+	}
+	if tsig != nil && w.TsigStatus() == nil {
+		resp.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+	_ = w.WriteMsg(resp)
+}
+
+// exists returns whether there are any records for the name
+func (f *fakeDNS) exists(name string) bool {
+	for key, rrs := range f.records {
+		if strings.HasPrefix(key, dns.CanonicalName(name)+"/") && len(rrs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// update applies the update section, RFC 2136 section 3.4.2
+func (f *fakeDNS) update(rrs []dns.RR) {
+	f.updates++
+	for _, rr := range rrs {
+		h := rr.Header()
+		key := fakeDNSKey(h.Name, h.Rrtype)
+		switch h.Class {
+		case dns.ClassANY:
+			delete(f.records, key)
+		case dns.ClassNONE:
+			rr = dns.Copy(rr)
+			rr.Header().Class = dns.ClassINET
+			var kept []dns.RR
+			for _, existing := range f.records[key] {
+				if !dns.IsDuplicate(existing, rr) {
+					kept = append(kept, existing)
+				}
+			}
+			f.records[key] = kept
+		default:
+			f.records[key] = append(f.records[key], dns.Copy(rr))
+		}
+	}
+}
+
+func testDNSConfig(server string) *vipconfig.Config {
+	return &vipconfig.Config{
+		DNSServer:        server,
+		DNSName:          "db.example.com",
+		DNSTTL:           30,
+		DNSTSIGKeyName:   "vip-manager",
+		DNSTSIGAlgorithm: "hmac-sha256",
+		DNSTSIGSecret:    testDNSSecret,
+	}
+}
+
+func newTestDNSConfigurer(t *testing.T, f *fakeDNS, ip string) *DNSConfigurer {
+	t.Helper()
+	c := newTestConfigurer(t, newDNSConfigurer, testHetznerIPConfiguration(ip), testDNSConfig(f.addr))
+	c.client.Timeout = time.Second
+	return c
+}
+
+// ---------------------------------------------------------------------------
+// newDNSConfigurer
+// ---------------------------------------------------------------------------
+
+func TestNewDNSConfigurer(t *testing.T) {
+	t.Parallel()
+
+	secretFile := filepath.Join(t.TempDir(), "tsig.key")
+	if err := os.WriteFile(secretFile, []byte(testDNSSecret+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		modify     func(*vipconfig.Config)
+		wantServer string
+		wantZone   string
+		wantErr    bool
+	}{
+		{"defaults", func(*vipconfig.Config) {}, "192.0.2.53:53", "example.com.", false},
+		{"port and zone", func(c *vipconfig.Config) {
+			c.DNSServer = "192.0.2.53:5353"
+			c.DNSName = "db.eu.example.com."
+			c.DNSZone = "example.com"
+		}, "192.0.2.53:5353", "example.com.", false},
+		{"secret file", func(c *vipconfig.Config) {
+			c.DNSTSIGSecret = ""
+			c.DNSTSIGSecretFile = secretFile
+		}, "192.0.2.53:53", "example.com.", false},
+		{"without key", func(c *vipconfig.Config) {
+			c.DNSTSIGKeyName = ""
+			c.DNSTSIGSecret = ""
+		}, "192.0.2.53:53", "example.com.", false},
+		{"no server", func(c *vipconfig.Config) { c.DNSServer = "" }, "", "", true},
+		{"no name", func(c *vipconfig.Config) { c.DNSName = "" }, "", "", true},
+		{"top level name", func(c *vipconfig.Config) { c.DNSName = "db" }, "", "", true},
+		{"name outside zone", func(c *vipconfig.Config) { c.DNSZone = "example.org" }, "", "", true},
+		{"negative ttl", func(c *vipconfig.Config) { c.DNSTTL = -1 }, "", "", true},
+		{"unknown algorithm", func(c *vipconfig.Config) { c.DNSTSIGAlgorithm = "hmac-md4" }, "", "", true},
+		{"missing secret", func(c *vipconfig.Config) { c.DNSTSIGSecret = "" }, "", "", true},
+		{"secret not base64", func(c *vipconfig.Config) { c.DNSTSIGSecret = "not base64!" }, "", "", true},
+	}
+	for _, tt := range tests {
+		conf := testDNSConfig("192.0.2.53")
+		tt.modify(conf)
+		c, err := newDNSConfigurer(testHetznerIPConfiguration("192.0.2.10"), conf)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: newDNSConfigurer() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if c.server != tt.wantServer || c.zone != tt.wantZone {
+			t.Errorf("%s: server, zone = %s, %s, want %s, %s", tt.name, c.server, c.zone, tt.wantServer, tt.wantZone)
+		}
+		if c.rrType != dns.TypeA {
+			t.Errorf("%s: record type = %s, want A", tt.name, dns.TypeToString[c.rrType])
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// queryAddress / configureAddress / deconfigureAddress
+// ---------------------------------------------------------------------------
+
+func TestDNSConfigurer_configureAddress(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeDNS(t)
+	f.set("db.example.com.", dns.TypeA, "192.0.2.20")
+	c := newTestDNSConfigurer(t, f, "192.0.2.10")
+
+	if c.queryAddress() {
+		t.Error("queryAddress() = true while the name points to another node")
+	}
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if got := f.get("db.example.com.", dns.TypeA); len(got) != 1 || got[0] != "192.0.2.10" {
+		t.Errorf("db.example.com. points to %v, want [192.0.2.10]", got)
+	}
+	if f.updates != 1 {
+		t.Errorf("expected the record to be replaced in a single update, got %d", f.updates)
+	}
+	if !c.queryAddress() {
+		t.Error("queryAddress() = false after the update")
+	}
+}
+
+func TestDNSConfigurer_queryAddress_MoreAddresses(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeDNS(t)
+	f.set("db.example.com.", dns.TypeA, "192.0.2.10", "192.0.2.20")
+	c := newTestDNSConfigurer(t, f, "192.0.2.10")
+
+	if c.queryAddress() {
+		t.Error("queryAddress() = true while the name points to other nodes, too")
+	}
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if !c.queryAddress() {
+		t.Error("queryAddress() = false after the update")
+	}
+}
+
+func TestDNSConfigurer_queryAddress_NoRecords(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeDNS(t)
+	c := newTestDNSConfigurer(t, f, "192.0.2.10")
+
+	// NXDOMAIN, the name doesn't exist at all
+	if addrs, err := c.getAddresses(); err != nil || len(addrs) != 0 {
+		t.Errorf("getAddresses() = %v, %v, want no addresses for a name that doesn't exist", addrs, err)
+	}
+	// NODATA, the name exists with an AAAA record only
+	f.set("db.example.com.", dns.TypeAAAA, "2001:db8::20")
+	if addrs, err := c.getAddresses(); err != nil || len(addrs) != 0 {
+		t.Errorf("getAddresses() = %v, %v, want no addresses for a name without A records", addrs, err)
+	}
+	if c.queryAddress() {
+		t.Error("queryAddress() = true without any A record")
+	}
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if !c.queryAddress() {
+		t.Error("queryAddress() = false after the update")
+	}
+}
+
+func TestDNSConfigurer_AAAA(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeDNS(t)
+	f.set("db.example.com.", dns.TypeA, "192.0.2.20")
+	c := newTestDNSConfigurer(t, f, "2001:db8::10")
+
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if got := f.get("db.example.com.", dns.TypeAAAA); len(got) != 1 || got[0] != "2001:db8::10" {
+		t.Errorf("db.example.com. AAAA = %v, want [2001:db8::10]", got)
+	}
+	if got := f.get("db.example.com.", dns.TypeA); len(got) != 1 {
+		t.Errorf("the A record must be left alone, got %v", got)
+	}
+	if !c.queryAddress() {
+		t.Error("queryAddress() = false after the update")
+	}
+}
+
+func TestDNSConfigurer_WrongSecret(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeDNS(t)
+	f.set("db.example.com.", dns.TypeA, "192.0.2.20")
+	c := newTestDNSConfigurer(t, f, "192.0.2.10")
+	c.client.TsigSecret[c.tsigKey] = "d3Jvbmctc2VjcmV0"
+
+	if c.configureAddress() {
+		t.Error("configureAddress() should fail with a wrong secret")
+	}
+	if got := f.get("db.example.com.", dns.TypeA); len(got) != 1 || got[0] != "192.0.2.20" {
+		t.Errorf("db.example.com. must be unchanged, got %v", got)
+	}
+}
+
+func TestDNSConfigurer_Unsigned(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeDNS(t)
+	conf := testDNSConfig(f.addr)
+	conf.DNSTSIGKeyName = ""
+	c, err := newDNSConfigurer(testHetznerIPConfiguration("192.0.2.10"), conf)
+	if err != nil {
+		t.Fatalf("newDNSConfigurer() error = %v", err)
+	}
+
+	if c.configureAddress() {
+		t.Error("configureAddress() should fail when the server refuses unsigned updates")
+	}
+}
+
+func TestDNSConfigurer_deconfigureAddress(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeDNS(t)
+	f.set("db.example.com.", dns.TypeA, "192.0.2.10")
+	c := newTestDNSConfigurer(t, f, "192.0.2.10")
+
+	if !c.deconfigureAddress() {
+		t.Fatal("deconfigureAddress() = false, want true")
+	}
+	if got := f.get("db.example.com.", dns.TypeA); len(got) != 0 {
+		t.Errorf("db.example.com. still points to %v", got)
+	}
+	if c.queryAddress() {
+		t.Error("queryAddress() = true after the removal")
+	}
+}
+
+func TestDNSConfigurer_deconfigureAddress_NewLeader(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeDNS(t)
+	f.set("db.example.com.", dns.TypeA, "192.0.2.20")
+	c := newTestDNSConfigurer(t, f, "192.0.2.10")
+
+	if !c.deconfigureAddress() {
+		t.Fatal("deconfigureAddress() = false, want true")
+	}
+	if got := f.get("db.example.com.", dns.TypeA); len(got) != 1 || got[0] != "192.0.2.20" {
+		t.Errorf("the record of the new leader must be kept, got %v", got)
+	}
+}
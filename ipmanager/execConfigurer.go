@@ -0,0 +1,112 @@
+package ipmanager
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// Exit codes of exec-status
+const (
+	execStatusUp   = 0
+	execStatusDown = 1
+)
+
+// The ExecConfigurer leaves managing the VIP to user supplied commands,
+// whenever manager-type `exec` is set, e.g. to drive a load balancer or an
+// SDN vip-manager has no support for. The commands learn about the VIP from
+// environment variables, see commandEnv.
+// exec-up and exec-down succeed with exit code 0 and are retried like
+// the other configurers do. exec-status tells with exit code 0 that the
+// VIP is up and with 1 that it is down. Without exec-status, the VIP is
+// taken to be in the state the last successful command left it in.
+type ExecConfigurer struct {
+	*IPConfiguration
+	up      string
+	down    string
+	status  string
+	timeout time.Duration
+	env     []string
+	// isUp is the state left by the last successful exec-up or exec-down
+	isUp bool
+}
+
+func newExecConfigurer(config *IPConfiguration, conf *vipconfig.Config) (*ExecConfigurer, error) {
+	if conf.ExecUp == "" || conf.ExecDown == "" {
+		return nil, errors.New("exec-up and exec-down must be set for manager-type exec")
+	}
+	if conf.ExecTimeout <= 0 {
+		return nil, errors.New("exec-timeout must be positive")
+	}
+	return &ExecConfigurer{
+		IPConfiguration: config,
+		up:              conf.ExecUp,
+		down:            conf.ExecDown,
+		status:          conf.ExecStatus,
+		timeout:         time.Duration(conf.ExecTimeout) * time.Millisecond,
+		env:             commandEnv(config, conf),
+	}, nil
+}
+
+// run runs the command for action, passing the action in VIP_ACTION
+func (c *ExecConfigurer) run(name, line, action string, logf func(string, ...any)) (int, error) {
+	return runCommand(name, line, slices.Concat(c.env, []string{"VIP_ACTION=" + action}), c.timeout, logf)
+}
+
+// runWithRetries runs the command until it succeeds, at most retry-num times
+func (c *ExecConfigurer) runWithRetries(name, line, action string) bool {
+	attempts := max(c.RetryNum, 1)
+	for attempt := range attempts {
+		code, err := c.run(name, line, action, log.Infof)
+		if err == nil && code == 0 {
+			return true
+		}
+		if err == nil {
+			log.Errorf("%s exited with code %d (attempt %d of %d)", name, code, attempt+1, attempts)
+		} else {
+			log.Errorf("%s (attempt %d of %d)", err, attempt+1, attempts)
+		}
+		if attempt+1 < attempts {
+			time.Sleep(time.Duration(max(c.RetryAfter, 1)) * time.Millisecond)
+		}
+	}
+	return false
+}
+
+func (c *ExecConfigurer) queryAddress() bool {
+	if c.status == "" {
+		return c.isUp
+	}
+	// it runs on every check, so its output is only of interest when debugging
+	code, err := c.run("exec-status", c.status, "status", log.Debugf)
+	switch {
+	case err != nil:
+		log.Error(err)
+		return false
+	case code == execStatusUp:
+		return true
+	case code != execStatusDown:
+		log.Errorf("exec-status exited with code %d, expected %d (up) or %d (down)", code, execStatusUp, execStatusDown)
+	}
+	return false
+}
+
+func (c *ExecConfigurer) configureAddress() bool {
+	if !c.runWithRetries("exec-up", c.up, "up") {
+		return false
+	}
+	c.isUp = true
+	log.Infof("exec-up successfully configured %s", c.getCIDR())
+	return true
+}
+
+func (c *ExecConfigurer) deconfigureAddress() bool {
+	if !c.runWithRetries("exec-down", c.down, "down") {
+		return false
+	}
+	c.isUp = false
+	log.Infof("exec-down successfully deconfigured %s", c.getCIDR())
+	return true
+}
@@ -0,0 +1,203 @@
+package ipmanager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// skipWithoutShell skips tests whose commands are written for /bin/sh
+func skipWithoutShell(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the test commands need /bin/sh")
+	}
+}
+
+// testExecConfig returns commands that keep the state in a file in dir
+func testExecConfig(dir string) *vipconfig.Config {
+	state := filepath.Join(dir, "state")
+	return &vipconfig.Config{
+		HostingType:  "exec",
+		TriggerKey:   "/service/pgcluster/leader",
+		TriggerValue: "pg1",
+		EndpointType: "etcd",
+		Endpoints:    []string{"http://10.0.0.1:2379", "http://10.0.0.2:2379"},
+		ExecUp:       fmt.Sprintf(`echo "$VIP_ACTION $VIP_CIDR $VIP_INTERFACE $VIP_TRIGGER_VALUE $VIP_DCS_ENDPOINTS" > %q`, state),
+		ExecDown:     fmt.Sprintf(`rm -f %q`, state),
+		ExecStatus:   fmt.Sprintf(`test -f %q`, state),
+		ExecTimeout:  5000,
+	}
+}
+
+func newTestExecConfigurer(t *testing.T, conf *vipconfig.Config) *ExecConfigurer {
+	t.Helper()
+	config := testHetznerIPConfiguration("10.0.0.100")
+	config.Iface.Name = "eth0"
+	config.RetryAfter = 10
+	return newTestConfigurer(t, newExecConfigurer, config, conf)
+}
+
+// ---------------------------------------------------------------------------
+// runCommand
+// ---------------------------------------------------------------------------
+
+func TestRunCommand(t *testing.T) {
+	t.Parallel()
+	skipWithoutShell(t)
+
+	var mu sync.Mutex
+	var lines []string
+	logf := func(template string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(template, args...))
+	}
+
+	code, err := runCommand("test", `echo "$VIP_IP"; echo oops >&2; exit 3`, []string{"VIP_IP=10.0.0.100"}, 5*time.Second, logf)
+	if err != nil || code != 3 {
+		t.Errorf("runCommand() = %d, %v, want 3, nil", code, err)
+	}
+	if want := []string{"test: 10.0.0.100", "test: oops"}; strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("logged %q, want %q", lines, want)
+	}
+
+	start := time.Now()
+	if _, err = runCommand("test", "sleep 10", nil, 100*time.Millisecond, logf); err == nil {
+		t.Error("runCommand() should fail after the timeout")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("runCommand() returned after %s, expected it to be killed", d)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// newExecConfigurer
+// ---------------------------------------------------------------------------
+
+func TestNewExecConfigurer(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name   string
+		modify func(*vipconfig.Config)
+	}{
+		{"no up", func(c *vipconfig.Config) { c.ExecUp = "" }},
+		{"no down", func(c *vipconfig.Config) { c.ExecDown = "" }},
+		{"no timeout", func(c *vipconfig.Config) { c.ExecTimeout = 0 }},
+	} {
+		conf := testExecConfig(t.TempDir())
+		tt.modify(conf)
+		if _, err := newExecConfigurer(testHetznerIPConfiguration("10.0.0.100"), conf); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// queryAddress / configureAddress / deconfigureAddress
+// ---------------------------------------------------------------------------
+
+func TestExecConfigurer(t *testing.T) {
+	t.Parallel()
+	skipWithoutShell(t)
+
+	dir := t.TempDir()
+	c := newTestExecConfigurer(t, testExecConfig(dir))
+
+	if c.queryAddress() {
+		t.Error("queryAddress() = true before exec-up")
+	}
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "up 10.0.0.100/24 eth0 pg1 http://10.0.0.1:2379,http://10.0.0.2:2379\n"; string(b) != want {
+		t.Errorf("exec-up saw %q, want %q", b, want)
+	}
+	if !c.queryAddress() {
+		t.Error("queryAddress() = false after exec-up")
+	}
+	if !c.deconfigureAddress() {
+		t.Fatal("deconfigureAddress() = false, want true")
+	}
+	if c.queryAddress() {
+		t.Error("queryAddress() = true after exec-down")
+	}
+}
+
+func TestExecConfigurer_Retries(t *testing.T) {
+	t.Parallel()
+	skipWithoutShell(t)
+
+	dir := t.TempDir()
+	conf := testExecConfig(dir)
+	// fails until it was run three times
+	conf.ExecUp = fmt.Sprintf(`echo x >> %q; test $(wc -l < %q) -ge 3`, filepath.Join(dir, "runs"), filepath.Join(dir, "runs"))
+	c := newTestExecConfigurer(t, conf)
+
+	c.RetryNum = 2
+	if c.configureAddress() {
+		t.Error("configureAddress() should fail after retry-num attempts")
+	}
+	c.RetryNum = 3
+	if !c.configureAddress() {
+		t.Error("configureAddress() should succeed within retry-num attempts")
+	}
+}
+
+func TestExecConfigurer_StatusError(t *testing.T) {
+	t.Parallel()
+	skipWithoutShell(t)
+
+	conf := testExecConfig(t.TempDir())
+	conf.ExecStatus = "exit 2"
+	c := newTestExecConfigurer(t, conf)
+
+	if c.queryAddress() {
+		t.Error("queryAddress() = true for an unexpected exit code")
+	}
+
+	conf.ExecStatus = "sleep 10"
+	conf.ExecTimeout = 100
+	c = newTestExecConfigurer(t, conf)
+	if c.queryAddress() {
+		t.Error("queryAddress() = true for a command that timed out")
+	}
+}
+
+func TestExecConfigurer_WithoutStatus(t *testing.T) {
+	t.Parallel()
+	skipWithoutShell(t)
+
+	conf := testExecConfig(t.TempDir())
+	conf.ExecStatus = ""
+	c := newTestExecConfigurer(t, conf)
+
+	if c.queryAddress() {
+		t.Error("queryAddress() = true before exec-up")
+	}
+	if !c.configureAddress() || !c.queryAddress() {
+		t.Error("expected the state of exec-up to be remembered")
+	}
+	if !c.deconfigureAddress() || c.queryAddress() {
+		t.Error("expected the state of exec-down to be remembered")
+	}
+
+	conf.ExecUp = "exit 1"
+	c = newTestExecConfigurer(t, conf)
+	c.RetryNum = 1
+	if c.configureAddress() || c.queryAddress() {
+		t.Error("a failed exec-up must not change the state")
+	}
+}
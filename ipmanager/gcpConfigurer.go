@@ -0,0 +1,431 @@
+package ipmanager
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+const (
+	defaultGCPComputeEndpoint  = "https://compute.googleapis.com/compute/v1"
+	defaultGCPMetadataEndpoint = "http://metadata.google.internal/computeMetadata/v1"
+
+	// gcpOperationTimeout limits how long we wait for an operation, e.g.
+	// the update of a network interface, to finish
+	gcpOperationTimeout = 2 * time.Minute
+)
+
+// Supported values for gcp-mode
+const (
+	gcpModeAlias = "alias"
+	gcpModeRoute = "route"
+)
+
+// The GCPConfigurer manages the VIP through the Compute Engine API, whenever
+// manager-type `gcp` is set. Depending on gcp-mode the VIP is either an alias
+// IP range of the network interface of this instance, or the destination of
+// a static route with this instance as next hop. Either way the network
+// only delivers the packets to the instance, which accepts them once the
+// VIP is on its interface, so the VIP is added there afterwards.
+type GCPConfigurer struct {
+	*IPConfiguration
+	local     ipConfigurer
+	compute   *apiClient
+	metadata  *apiClient
+	mode      string
+	nic       string
+	routeName string
+
+	project  string
+	zone     string
+	instance string
+}
+
+type gcpOperation struct {
+	Name   string `json:"name"`
+	Zone   string `json:"zone"`
+	Status string `json:"status"`
+	Error  *struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"error"`
+}
+
+type gcpAliasIPRange struct {
+	IPCIDRRange         string `json:"ipCidrRange"`
+	SubnetworkRangeName string `json:"subnetworkRangeName,omitempty"`
+}
+
+type gcpNetworkInterface struct {
+	Name          string            `json:"name"`
+	Network       string            `json:"network"`
+	Fingerprint   string            `json:"fingerprint"`
+	AliasIPRanges []gcpAliasIPRange `json:"aliasIpRanges"`
+}
+
+type gcpInstance struct {
+	Name              string                `json:"name"`
+	Zone              string                `json:"zone"`
+	SelfLink          string                `json:"selfLink"`
+	NetworkInterfaces []gcpNetworkInterface `json:"networkInterfaces"`
+}
+
+type gcpRoute struct {
+	Name            string `json:"name"`
+	Network         string `json:"network"`
+	DestRange       string `json:"destRange"`
+	NextHopInstance string `json:"nextHopInstance"`
+	Priority        int    `json:"priority"`
+	Description     string `json:"description,omitempty"`
+}
+
+func newGCPConfigurer(config *IPConfiguration, conf *vipconfig.Config) (*GCPConfigurer, error) {
+	mode := cmp.Or(conf.GCPMode, gcpModeAlias)
+	switch mode {
+	case gcpModeAlias:
+		if !config.VIP.Is4() {
+			return nil, errors.New("gcp-mode alias only supports IPv4 addresses")
+		}
+	case gcpModeRoute:
+	default:
+		return nil, fmt.Errorf("unsupported gcp-mode %q, supported values: alias, route", mode)
+	}
+	local, err := newBasicConfigurer(config)
+	if err != nil {
+		return nil, err
+	}
+	c := &GCPConfigurer{
+		IPConfiguration: config,
+		local:           local,
+		mode:            mode,
+		nic:             cmp.Or(conf.GCPNetworkInterface, "nic0"),
+		// route names must match [a-z]([-a-z0-9]*[a-z0-9])?
+		routeName: cmp.Or(conf.GCPRouteName, "vip-manager-"+strings.NewReplacer(".", "-", ":", "-").Replace(config.VIP.String())),
+		metadata: newAPIClient(cmp.Or(conf.GCPMetadataEndpoint, defaultGCPMetadataEndpoint), func(req *http.Request) error {
+			req.Header.Set("Metadata-Flavor", "Google")
+			return nil
+		}),
+	}
+	token := &apiToken{fetch: c.fetchToken}
+	c.compute = newAPIClient(cmp.Or(conf.GCPComputeEndpoint, defaultGCPComputeEndpoint), token.bearer)
+	return c, nil
+}
+
+// fetchToken gets an access token of the service account of this instance
+// from the metadata server
+func (c *GCPConfigurer) fetchToken() (string, time.Time, error) {
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := c.metadata.do(http.MethodGet, "/instance/service-accounts/default/token", nil, &resp); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to get an access token from the metadata server: %w", err)
+	}
+	return resp.AccessToken, time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second), nil
+}
+
+// discover looks up the project, zone and name of this instance from the
+// metadata server
+func (c *GCPConfigurer) discover() error {
+	if c.instance != "" {
+		return nil
+	}
+	project, err := c.metadata.getText("/project/project-id")
+	if err != nil {
+		return fmt.Errorf("failed to query the project from the metadata server: %w", err)
+	}
+	// the zone is given as projects/<number>/zones/<zone>
+	zone, err := c.metadata.getText("/instance/zone")
+	if err != nil {
+		return fmt.Errorf("failed to query the zone from the metadata server: %w", err)
+	}
+	instance, err := c.metadata.getText("/instance/name")
+	if err != nil {
+		return fmt.Errorf("failed to query the instance name from the metadata server: %w", err)
+	}
+	c.project, c.zone, c.instance = project, path.Base(zone), instance
+	log.Infof("Discovered instance %s in %s of project %s", c.instance, c.zone, c.project)
+	return nil
+}
+
+func (c *GCPConfigurer) instancePath(zone, instance string) string {
+	return fmt.Sprintf("/projects/%s/zones/%s/instances/%s", c.project, zone, instance)
+}
+
+// destRange returns the VIP as single address range
+func (c *GCPConfigurer) destRange() string {
+	return netip.PrefixFrom(c.VIP, c.VIP.BitLen()).String()
+}
+
+// hasVIP returns whether one of the alias IP ranges is exactly the VIP.
+// Ranges are returned as CIDR, but may be given as plain address.
+func (c *GCPConfigurer) hasVIP(ranges []gcpAliasIPRange) bool {
+	return slices.ContainsFunc(ranges, func(r gcpAliasIPRange) bool {
+		if prefix, err := netip.ParsePrefix(r.IPCIDRRange); err == nil {
+			return prefix.Addr() == c.VIP && prefix.IsSingleIP()
+		}
+		addr, err := netip.ParseAddr(r.IPCIDRRange)
+		return err == nil && addr == c.VIP
+	})
+}
+
+// waitForOperation polls the operation until it is done
+func (c *GCPConfigurer) waitForOperation(op gcpOperation) error {
+	opPath := fmt.Sprintf("/projects/%s/global/operations/%s", c.project, op.Name)
+	if op.Zone != "" {
+		opPath = fmt.Sprintf("/projects/%s/zones/%s/operations/%s", c.project, path.Base(op.Zone), op.Name)
+	}
+	deadline := time.Now().Add(gcpOperationTimeout)
+	for op.Status != "DONE" {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("operation %s did not finish within %s", op.Name, gcpOperationTimeout)
+		}
+		time.Sleep(time.Duration(max(c.RetryAfter, 1)) * time.Millisecond)
+		if err := c.compute.do(http.MethodGet, opPath, nil, &op); err != nil {
+			return fmt.Errorf("failed to query operation %s: %w", op.Name, err)
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return fmt.Errorf("operation %s failed: %s: %s", op.Name, op.Error.Errors[0].Code, op.Error.Errors[0].Message)
+	}
+	return nil
+}
+
+// runOperation sends a request that starts an operation and waits for the
+// operation to finish
+func (c *GCPConfigurer) runOperation(method, path string, body any) error {
+	var op gcpOperation
+	if err := c.compute.do(method, path, body, &op); err != nil {
+		return err
+	}
+	return c.waitForOperation(op)
+}
+
+func (c *GCPConfigurer) getInstance() (*gcpInstance, error) {
+	var instance gcpInstance
+	if err := c.compute.do(http.MethodGet, c.instancePath(c.zone, c.instance), nil, &instance); err != nil {
+		return nil, fmt.Errorf("failed to query instance %s: %w", c.instance, err)
+	}
+	return &instance, nil
+}
+
+func (c *GCPConfigurer) networkInterface(instance *gcpInstance) (*gcpNetworkInterface, error) {
+	for i := range instance.NetworkInterfaces {
+		if instance.NetworkInterfaces[i].Name == c.nic {
+			return &instance.NetworkInterfaces[i], nil
+		}
+	}
+	return nil, fmt.Errorf("instance %s has no network interface %s", instance.Name, c.nic)
+}
+
+// listInstances returns the instances of all zones of the project
+func (c *GCPConfigurer) listInstances() ([]gcpInstance, error) {
+	var all []gcpInstance
+	for pageToken := ""; ; {
+		var resp struct {
+			Items map[string]struct {
+				Instances []gcpInstance `json:"instances"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		query := url.Values{}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		if err := c.compute.do(http.MethodGet, fmt.Sprintf("/projects/%s/aggregated/instances?%s", c.project, query.Encode()), nil, &resp); err != nil {
+			return nil, err
+		}
+		for _, scope := range resp.Items {
+			all = append(all, scope.Instances...)
+		}
+		if pageToken = resp.NextPageToken; pageToken == "" {
+			return all, nil
+		}
+	}
+}
+
+func (c *GCPConfigurer) setAliasIPRanges(instance *gcpInstance, nic *gcpNetworkInterface, ranges []gcpAliasIPRange) error {
+	// an empty list removes all ranges, null would be ignored
+	if ranges == nil {
+		ranges = []gcpAliasIPRange{}
+	}
+	return c.runOperation(http.MethodPatch,
+		fmt.Sprintf("%s/updateNetworkInterface?networkInterface=%s", c.instancePath(path.Base(instance.Zone), instance.Name), url.QueryEscape(nic.Name)),
+		map[string]any{
+			"aliasIpRanges": ranges,
+			"fingerprint":   nic.Fingerprint,
+		})
+}
+
+// moveAliasIP removes the VIP from the alias IP ranges of any other instance,
+// as a range can only be used once in a network, and adds it to ours
+func (c *GCPConfigurer) moveAliasIP() error {
+	instances, err := c.listInstances()
+	if err != nil {
+		return fmt.Errorf("failed to list instances: %w", err)
+	}
+	for i := range instances {
+		instance := &instances[i]
+		if instance.Name == c.instance && path.Base(instance.Zone) == c.zone {
+			continue
+		}
+		for j := range instance.NetworkInterfaces {
+			nic := &instance.NetworkInterfaces[j]
+			if !c.hasVIP(nic.AliasIPRanges) {
+				continue
+			}
+			log.Infof("Removing alias IP range %s from instance %s", c.VIP, instance.Name)
+			ranges := slices.DeleteFunc(slices.Clone(nic.AliasIPRanges), func(r gcpAliasIPRange) bool {
+				return c.hasVIP([]gcpAliasIPRange{r})
+			})
+			if err = c.setAliasIPRanges(instance, nic, ranges); err != nil {
+				return fmt.Errorf("failed to remove alias IP range from instance %s: %w", instance.Name, err)
+			}
+		}
+	}
+
+	// query our instance again, the fingerprint must be current
+	own, err := c.getInstance()
+	if err != nil {
+		return err
+	}
+	nic, err := c.networkInterface(own)
+	if err != nil {
+		return err
+	}
+	if c.hasVIP(nic.AliasIPRanges) {
+		return nil
+	}
+	return c.setAliasIPRanges(own, nic, append(slices.Clone(nic.AliasIPRanges), gcpAliasIPRange{IPCIDRRange: c.destRange()}))
+}
+
+// getRoute returns the route to the VIP, or nil if there is none
+func (c *GCPConfigurer) getRoute() (*gcpRoute, error) {
+	var route gcpRoute
+	err := c.compute.do(http.MethodGet, fmt.Sprintf("/projects/%s/global/routes/%s", c.project, c.routeName), nil, &route)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query route %s: %w", c.routeName, err)
+	}
+	return &route, nil
+}
+
+// isOwnRoute returns whether route leads to the VIP through this instance
+func (c *GCPConfigurer) isOwnRoute(route *gcpRoute) bool {
+	return route.DestRange == c.destRange() &&
+		strings.HasSuffix(route.NextHopInstance, c.instancePath(c.zone, c.instance))
+}
+
+// moveRoute replaces the route to the VIP with one through this instance.
+// Routes can't be changed, so any existing route is deleted first.
+func (c *GCPConfigurer) moveRoute() error {
+	route, err := c.getRoute()
+	if err != nil {
+		return err
+	}
+	if route != nil && c.isOwnRoute(route) {
+		return nil
+	}
+	if route != nil {
+		log.Infof("Deleting route %s via %s", c.routeName, route.NextHopInstance)
+		if err = c.runOperation(http.MethodDelete, fmt.Sprintf("/projects/%s/global/routes/%s", c.project, c.routeName), nil); err != nil {
+			return fmt.Errorf("failed to delete route %s: %w", c.routeName, err)
+		}
+	}
+
+	own, err := c.getInstance()
+	if err != nil {
+		return err
+	}
+	nic, err := c.networkInterface(own)
+	if err != nil {
+		return err
+	}
+	err = c.runOperation(http.MethodPost, fmt.Sprintf("/projects/%s/global/routes", c.project), gcpRoute{
+		Name:            c.routeName,
+		Network:         nic.Network,
+		DestRange:       c.destRange(),
+		NextHopInstance: cmp.Or(own.SelfLink, strings.TrimPrefix(c.instancePath(c.zone, c.instance), "/")),
+		Priority:        1000,
+		Description:     "managed by vip-manager",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create route %s: %w", c.routeName, err)
+	}
+	return nil
+}
+
+func (c *GCPConfigurer) queryAddress() bool {
+	if !c.local.queryAddress() {
+		return false
+	}
+	if err := c.discover(); err != nil {
+		log.Error(err)
+		return false
+	}
+	if c.mode == gcpModeRoute {
+		route, err := c.getRoute()
+		if err != nil {
+			log.Error(err)
+			return false
+		}
+		return route != nil && c.isOwnRoute(route)
+	}
+
+	instance, err := c.getInstance()
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	nic, err := c.networkInterface(instance)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	return c.hasVIP(nic.AliasIPRanges)
+}
+
+func (c *GCPConfigurer) queryLocalAddress() bool {
+	return c.local.queryAddress()
+}
+
+func (c *GCPConfigurer) configureAddress() bool {
+	if err := c.discover(); err != nil {
+		log.Error(err)
+		return false
+	}
+	var err error
+	if c.mode == gcpModeRoute {
+		err = c.moveRoute()
+	} else {
+		err = c.moveAliasIP()
+	}
+	if err != nil {
+		log.Errorf("Failed to move %s to this instance: %s", c.VIP, err)
+		return false
+	}
+	log.Infof("%s was successfully moved to instance %s", c.VIP, c.instance)
+	return c.local.configureAddress()
+}
+
+func (c *GCPConfigurer) deconfigureAddress() bool {
+	// The alias IP range stays on our network interface and the route keeps
+	// pointing to us, the next leader removes the range from us or replaces
+	// the route. The fingerprint of our network interface would change
+	// under its update otherwise.
+	return c.local.deconfigureAddress()
+}
@@ -0,0 +1,459 @@
+package ipmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// fakeGCP is a stand-in for the Compute Engine API and the metadata server
+// of a project with two instances. Operations are done after being polled
+// once.
+type fakeGCP struct {
+	*fakeAPI
+	instances  []*gcpInstance
+	routes     map[string]gcpRoute
+	operations map[string]string
+	failOps    bool
+	tokens     int
+	mutations  []string
+}
+
+const gcpNetwork = "https://www.googleapis.com/compute/v1/projects/test-project/global/networks/default"
+
+func newFakeGCP(t *testing.T) *fakeGCP {
+	t.Helper()
+	f := &fakeGCP{
+		instances: []*gcpInstance{
+			testGCPInstance("db1", "europe-west1-b"),
+			testGCPInstance("db2", "europe-west1-c"),
+		},
+		routes:     map[string]gcpRoute{},
+		operations: map[string]string{},
+	}
+	f.fakeAPI = newFakeAPI(t, f.handle)
+	return f
+}
+
+func testGCPInstance(name, zone string, aliasIPs ...string) *gcpInstance {
+	instance := &gcpInstance{
+		Name:     name,
+		Zone:     "https://www.googleapis.com/compute/v1/projects/test-project/zones/" + zone,
+		SelfLink: "https://www.googleapis.com/compute/v1/projects/test-project/zones/" + zone + "/instances/" + name,
+		NetworkInterfaces: []gcpNetworkInterface{{
+			Name:        "nic0",
+			Network:     gcpNetwork,
+			Fingerprint: "fp-" + name,
+		}},
+	}
+	for _, ip := range aliasIPs {
+		instance.NetworkInterfaces[0].AliasIPRanges = append(instance.NetworkInterfaces[0].AliasIPRanges, gcpAliasIPRange{IPCIDRRange: ip})
+	}
+	return instance
+}
+
+var (
+	gcpInstancePath  = regexp.MustCompile(`^/compute/v1/projects/test-project/zones/([^/]+)/instances/([^/]+)$`)
+	gcpUpdateNICPath = regexp.MustCompile(`^/compute/v1/projects/test-project/zones/([^/]+)/instances/([^/]+)/updateNetworkInterface$`)
+	gcpRoutePath     = regexp.MustCompile(`^/compute/v1/projects/test-project/global/routes/([^/]+)$`)
+	gcpOperationPath = regexp.MustCompile(`^/compute/v1/projects/test-project/(?:zones/[^/]+|global)/operations/([^/]+)$`)
+)
+
+func (f *fakeGCP) handle(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/computeMetadata/v1/") {
+		f.handleMetadata(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer access-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		f.mutations = append(f.mutations, r.Method+" "+r.URL.Path)
+	}
+
+	switch {
+	case r.URL.Path == "/compute/v1/projects/test-project/aggregated/instances":
+		items := map[string]map[string][]*gcpInstance{}
+		for _, instance := range f.instances {
+			zone := "zones/" + instance.Zone[strings.LastIndex(instance.Zone, "/")+1:]
+			items[zone] = map[string][]*gcpInstance{"instances": append(items[zone]["instances"], instance)}
+		}
+		writeJSON(w, map[string]any{"items": items})
+	case gcpInstancePath.MatchString(r.URL.Path):
+		m := gcpInstancePath.FindStringSubmatch(r.URL.Path)
+		if instance := f.find(m[1], m[2]); instance != nil {
+			writeJSON(w, instance)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case gcpUpdateNICPath.MatchString(r.URL.Path) && r.Method == http.MethodPatch:
+		m := gcpUpdateNICPath.FindStringSubmatch(r.URL.Path)
+		instance := f.find(m[1], m[2])
+		var body struct {
+			AliasIPRanges []gcpAliasIPRange `json:"aliasIpRanges"`
+			Fingerprint   string            `json:"fingerprint"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		nic := &instance.NetworkInterfaces[0]
+		if r.URL.Query().Get("networkInterface") != nic.Name || body.Fingerprint != nic.Fingerprint || body.AliasIPRanges == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		nic.AliasIPRanges = body.AliasIPRanges
+		nic.Fingerprint += "+"
+		f.startOperation(w, m[1])
+	case r.URL.Path == "/compute/v1/projects/test-project/global/routes" && r.Method == http.MethodPost:
+		var route gcpRoute
+		_ = json.NewDecoder(r.Body).Decode(&route)
+		if _, ok := f.routes[route.Name]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.routes[route.Name] = route
+		f.startOperation(w, "")
+	case gcpRoutePath.MatchString(r.URL.Path):
+		name := gcpRoutePath.FindStringSubmatch(r.URL.Path)[1]
+		route, ok := f.routes[name]
+		switch {
+		case !ok:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodDelete:
+			delete(f.routes, name)
+			f.startOperation(w, "")
+		default:
+			writeJSON(w, route)
+		}
+	case gcpOperationPath.MatchString(r.URL.Path):
+		name := gcpOperationPath.FindStringSubmatch(r.URL.Path)[1]
+		op := map[string]any{"name": name, "status": "DONE"}
+		if f.operations[name] == "error" {
+			op["error"] = map[string]any{"errors": []map[string]string{{"code": "RESOURCE_NOT_READY", "message": "try again"}}}
+		}
+		writeJSON(w, op)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeGCP) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Metadata-Flavor") != "Google" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, "/computeMetadata/v1") {
+	case "/project/project-id":
+		fmt.Fprint(w, "test-project")
+	case "/instance/zone":
+		fmt.Fprint(w, "projects/123456789/zones/europe-west1-b")
+	case "/instance/name":
+		fmt.Fprint(w, "db1")
+	case "/instance/service-accounts/default/token":
+		f.tokens++
+		writeJSON(w, map[string]any{"access_token": "access-token", "expires_in": 3599, "token_type": "Bearer"})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeGCP) find(zone, name string) *gcpInstance {
+	for _, instance := range f.instances {
+		if instance.Name == name && strings.HasSuffix(instance.Zone, "/"+zone) {
+			return instance
+		}
+	}
+	return nil
+}
+
+func (f *fakeGCP) startOperation(w http.ResponseWriter, zone string) {
+	name := fmt.Sprintf("operation-%d", len(f.operations)+1)
+	f.operations[name] = "running"
+	if f.failOps {
+		f.operations[name] = "error"
+	}
+	op := map[string]any{"name": name, "status": "RUNNING"}
+	if zone != "" {
+		op["zone"] = "https://www.googleapis.com/compute/v1/projects/test-project/zones/" + zone
+	}
+	writeJSON(w, op)
+}
+
+func (f *fakeGCP) aliasIPs(name string) []gcpAliasIPRange {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, instance := range f.instances {
+		if instance.Name == name {
+			return instance.NetworkInterfaces[0].AliasIPRanges
+		}
+	}
+	return nil
+}
+
+func newTestGCPConfigurer(t *testing.T, f *fakeGCP, vip, mode string) (*GCPConfigurer, *mockConfigurer) {
+	t.Helper()
+	c := newTestConfigurer(t, newGCPConfigurer, testHetznerIPConfiguration(vip), &vipconfig.Config{
+		GCPMode:             mode,
+		GCPComputeEndpoint:  f.URL + "/compute/v1",
+		GCPMetadataEndpoint: f.URL + "/computeMetadata/v1",
+	})
+	return c, mockLocal(&c.local)
+}
+
+// ---------------------------------------------------------------------------
+// newGCPConfigurer
+// ---------------------------------------------------------------------------
+
+func TestNewGCPConfigurer(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		vip     string
+		mode    string
+		wantErr bool
+	}{
+		{"alias by default", "10.0.0.10", "", false},
+		{"route", "10.0.0.10", "route", false},
+		{"IPv6 route", "2001:db8::10", "route", false},
+		{"IPv6 alias", "2001:db8::10", "alias", true},
+		{"unknown mode", "10.0.0.10", "forwarding-rule", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			c, err := newGCPConfigurer(testHetznerIPConfiguration(tt.vip), &vipconfig.Config{GCPMode: tt.mode})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newGCPConfigurer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && c.nic != "nic0" {
+				t.Errorf("nic = %q, want nic0", c.nic)
+			}
+		})
+	}
+}
+
+func TestNewGCPConfigurer_RouteName(t *testing.T) {
+	t.Parallel()
+
+	c, err := newGCPConfigurer(testHetznerIPConfiguration("2001:db8::10"), &vipconfig.Config{GCPMode: "route"})
+	if err != nil {
+		t.Fatalf("newGCPConfigurer() error = %v", err)
+	}
+	if c.routeName != "vip-manager-2001-db8--10" {
+		t.Errorf("routeName = %q", c.routeName)
+	}
+	if c.destRange() != "2001:db8::10/128" {
+		t.Errorf("destRange() = %q", c.destRange())
+	}
+}
+
+// ---------------------------------------------------------------------------
+// alias IP ranges
+// ---------------------------------------------------------------------------
+
+func TestGCPConfigurer_hasVIP(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newGCPConfigurer(testHetznerIPConfiguration("10.0.0.10"), &vipconfig.Config{})
+	tests := []struct {
+		ipCIDRRange string
+		want        bool
+	}{
+		{"10.0.0.10/32", true},
+		{"10.0.0.10", true},
+		{"10.0.0.0/24", false},
+		{"10.0.0.11/32", false},
+		{"invalid", false},
+	}
+	for _, tt := range tests {
+		if got := c.hasVIP([]gcpAliasIPRange{{IPCIDRRange: tt.ipCIDRRange}}); got != tt.want {
+			t.Errorf("hasVIP(%s) = %v, want %v", tt.ipCIDRRange, got, tt.want)
+		}
+	}
+}
+
+func TestGCPConfigurer_AliasIP(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeGCP(t)
+	f.instances[1] = testGCPInstance("db2", "europe-west1-c", "10.0.0.10/32", "10.0.1.0/28")
+	c, local := newTestGCPConfigurer(t, f, "10.0.0.10", "")
+
+	if c.queryAddress() {
+		t.Fatal("queryAddress() = true while the alias IP belongs to the other instance")
+	}
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if got := f.aliasIPs("db2"); len(got) != 1 || got[0].IPCIDRRange != "10.0.1.0/28" {
+		t.Errorf("alias IP ranges of db2 = %v, want only 10.0.1.0/28", got)
+	}
+	if got := f.aliasIPs("db1"); len(got) != 1 || got[0].IPCIDRRange != "10.0.0.10/32" {
+		t.Errorf("alias IP ranges of db1 = %v, want 10.0.0.10/32", got)
+	}
+	if local.configureCount != 1 {
+		t.Errorf("expected the address to be added locally once, got %d", local.configureCount)
+	}
+	if !c.queryAddress() {
+		t.Error("queryAddress() = false after the alias IP was moved")
+	}
+	if f.tokens != 1 {
+		t.Errorf("expected the access token to be fetched once, got %d", f.tokens)
+	}
+}
+
+// TestGCPConfigurer_MovedElsewhere covers the old leader after the new one
+// has taken the alias IP range over
+func TestGCPConfigurer_MovedElsewhere(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeGCP(t)
+	f.instances[1] = testGCPInstance("db2", "europe-west1-c", "10.0.0.10/32")
+	c, local := newTestGCPConfigurer(t, f, "10.0.0.10", "")
+
+	if c.queryAddress() {
+		t.Fatal("queryAddress() = true while the alias IP belongs to the other instance")
+	}
+	if !c.queryLocalAddress() {
+		t.Fatal("queryLocalAddress() = false while the address is configured locally")
+	}
+	runApplyLoop(c, false)
+	if local.deconfigureCount == 0 {
+		t.Error("expected the address to be removed locally")
+	}
+}
+
+func TestGCPConfigurer_AliasIP_RemoveLast(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeGCP(t)
+	f.instances[1] = testGCPInstance("db2", "europe-west1-c", "10.0.0.10")
+	c, _ := newTestGCPConfigurer(t, f, "10.0.0.10", "")
+
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if got := f.aliasIPs("db2"); len(got) != 0 {
+		t.Errorf("alias IP ranges of db2 = %v, want none", got)
+	}
+}
+
+func TestGCPConfigurer_AliasIP_AlreadyAssigned(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeGCP(t)
+	f.instances[0] = testGCPInstance("db1", "europe-west1-b", "10.0.0.10/32")
+	c, _ := newTestGCPConfigurer(t, f, "10.0.0.10", "")
+
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if len(f.mutations) != 0 {
+		t.Errorf("expected no changes, got %v", f.mutations)
+	}
+}
+
+func TestGCPConfigurer_OperationFails(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeGCP(t)
+	f.failOps = true
+	c, local := newTestGCPConfigurer(t, f, "10.0.0.10", "")
+
+	if c.configureAddress() {
+		t.Error("configureAddress() should fail when the operation fails")
+	}
+	if local.configureCount != 0 {
+		t.Error("the address must not be added locally when the operation failed")
+	}
+}
+
+func TestGCPConfigurer_queryAddress_NotLocal(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeGCP(t)
+	f.instances[0] = testGCPInstance("db1", "europe-west1-b", "10.0.0.10/32")
+	c, local := newTestGCPConfigurer(t, f, "10.0.0.10", "")
+	local.shouldQueryReturn = false
+
+	if c.queryAddress() {
+		t.Error("queryAddress() must be false while the address is not configured locally")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// routes
+// ---------------------------------------------------------------------------
+
+func TestGCPConfigurer_Route(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeGCP(t)
+	f.routes["vip-manager-10-0-0-10"] = gcpRoute{
+		Name:            "vip-manager-10-0-0-10",
+		Network:         gcpNetwork,
+		DestRange:       "10.0.0.10/32",
+		NextHopInstance: f.instances[1].SelfLink,
+	}
+	c, _ := newTestGCPConfigurer(t, f, "10.0.0.10", "route")
+
+	if c.queryAddress() {
+		t.Fatal("queryAddress() = true while the route leads to the other instance")
+	}
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	route := f.routes["vip-manager-10-0-0-10"]
+	if route.NextHopInstance != f.instances[0].SelfLink || route.Network != gcpNetwork || route.DestRange != "10.0.0.10/32" {
+		t.Errorf("unexpected route %+v", route)
+	}
+	want := []string{
+		"DELETE /compute/v1/projects/test-project/global/routes/vip-manager-10-0-0-10",
+		"POST /compute/v1/projects/test-project/global/routes",
+	}
+	if strings.Join(f.mutations, "\n") != strings.Join(want, "\n") {
+		t.Errorf("mutations = %v, want %v", f.mutations, want)
+	}
+	if !c.queryAddress() {
+		t.Error("queryAddress() = false after the route was replaced")
+	}
+}
+
+func TestGCPConfigurer_Route_Missing(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeGCP(t)
+	c, _ := newTestGCPConfigurer(t, f, "10.0.0.10", "route")
+
+	if c.queryAddress() {
+		t.Fatal("queryAddress() = true without a route")
+	}
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if _, ok := f.routes["vip-manager-10-0-0-10"]; !ok {
+		t.Error("expected the route to be created")
+	}
+}
+
+func TestGCPConfigurer_deconfigureAddress(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeGCP(t)
+	c, local := newTestGCPConfigurer(t, f, "10.0.0.10", "route")
+
+	if !c.deconfigureAddress() {
+		t.Error("deconfigureAddress() = false, want true")
+	}
+	if local.deconfigureCount != 1 {
+		t.Error("expected the address to be removed locally")
+	}
+	if len(f.mutations) != 0 {
+		t.Errorf("deconfigureAddress() must leave the route to the next leader, got %v", f.mutations)
+	}
+}
@@ -0,0 +1,151 @@
+package ipmanager
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	// the tests share the package logger with the goroutines they start
+	log = zap.NewNop().Sugar()
+	os.Exit(m.Run())
+}
+
+// ---------------------------------------------------------------------------
+// Mock configurer for testing applyLoop and SyncStates
+// ---------------------------------------------------------------------------
+
+type mockConfigurer struct {
+	queryAddressCount     int
+	configureCount        int
+	deconfigureCount      int
+	shouldQueryFail       bool
+	shouldConfigureFail   bool
+	shouldDeconfigureFail bool
+	shouldQueryReturn     bool
+}
+
+func (m *mockConfigurer) queryAddress() bool {
+	m.queryAddressCount++
+	if m.shouldQueryFail {
+		return false
+	}
+	return m.shouldQueryReturn
+}
+
+func (m *mockConfigurer) configureAddress() bool {
+	m.configureCount++
+	return !m.shouldConfigureFail
+}
+
+func (m *mockConfigurer) deconfigureAddress() bool {
+	m.deconfigureCount++
+	return !m.shouldDeconfigureFail
+}
+
+func (m *mockConfigurer) getCIDR() string {
+	return "192.168.1.100/24"
+}
+
+// localConfigurer additionally reports the local address separately, like
+// the configurers of the cloud providers do
+type localConfigurer struct {
+	mockConfigurer
+	local bool
+}
+
+func (m *localConfigurer) queryLocalAddress() bool {
+	return m.local
+}
+
+// mockLocal replaces the local address configuration of a configurer with
+// a mock, on which the VIP is present
+func mockLocal(local *ipConfigurer) *mockConfigurer {
+	m := &mockConfigurer{shouldQueryReturn: true}
+	*local = m
+	return m
+}
+
+// runApplyLoop runs applyLoop with c for a short while
+func runApplyLoop(c ipConfigurer, shouldSetIPUp bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	m := &IPManager{configurer: c, recheckChan: make(chan struct{}, 1)}
+	m.shouldSetIPUp.Store(shouldSetIPUp)
+	m.applyLoop(ctx)
+}
+
+// ---------------------------------------------------------------------------
+// Stand-ins for the APIs of the providers
+// ---------------------------------------------------------------------------
+
+// fakeAPI is embedded by the stand-ins for HTTP APIs. Requests are served
+// one at a time, so handlers use the state of the stand-in without locking,
+// tests lock mu to read it.
+type fakeAPI struct {
+	*httptest.Server
+	mu sync.Mutex
+}
+
+// newFakeAPI serves handle until the test ends
+func newFakeAPI(t *testing.T, handle http.HandlerFunc) *fakeAPI {
+	t.Helper()
+	f := &fakeAPI{}
+	f.Server = httptest.NewServer(f.serialize(handle))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// newFakeTLSAPI is like newFakeAPI, but serves HTTPS
+func newFakeTLSAPI(t *testing.T, handle http.HandlerFunc) *fakeAPI {
+	t.Helper()
+	f := &fakeAPI{}
+	f.Server = httptest.NewTLSServer(f.serialize(handle))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeAPI) serialize(handle http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		handle(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// newTestConfigurer calls newConfigurer with config and conf
+func newTestConfigurer[C any](t *testing.T, newConfigurer func(*IPConfiguration, *vipconfig.Config) (C, error),
+	config *IPConfiguration, conf *vipconfig.Config) C {
+	t.Helper()
+
+	c, err := newConfigurer(config, conf)
+	if err != nil {
+		t.Fatalf("creating the configurer: %v", err)
+	}
+	return c
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
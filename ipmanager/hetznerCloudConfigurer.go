@@ -0,0 +1,311 @@
+package ipmanager
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+const (
+	defaultHetznerCloudEndpoint         = "https://api.hetzner.cloud/v1"
+	defaultHetznerCloudMetadataEndpoint = "http://169.254.169.254/hetzner/v1/metadata"
+
+	// hetznerCloudActionTimeout limits how long we wait for an action,
+	// e.g. the assignment of a Floating IP, to finish
+	hetznerCloudActionTimeout = time.Minute
+)
+
+// The HetznerCloudConfigurer manages the VIP through the Hetzner Cloud API,
+// whenever manager-type `hetzner-cloud` is set. The VIP is either a Floating
+// IP that gets assigned to this server, or, if hetzner-cloud-network is set,
+// an alias IP of this server in that private network.
+// A Floating IP is routed to the server it is assigned to, an alias IP is
+// delivered by the private network to the server it is an alias of. The
+// interface isn't touched in either case, so the VIP has to be configured on
+// every server, e.g. in the network configuration of the OS.
+type HetznerCloudConfigurer struct {
+	*IPConfiguration
+	api      *apiClient
+	metadata *apiClient
+	network  int64
+	serverID int64
+}
+
+type hetznerCloudAction struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+	Error  *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type hetznerCloudFloatingIP struct {
+	ID     int64  `json:"id"`
+	IP     string `json:"ip"`
+	Server *int64 `json:"server"`
+}
+
+type hetznerCloudServer struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	PrivateNet []struct {
+		Network  int64    `json:"network"`
+		IP       string   `json:"ip"`
+		AliasIPs []string `json:"alias_ips"`
+	} `json:"private_net"`
+}
+
+func newHetznerCloudConfigurer(config *IPConfiguration, conf *vipconfig.Config) (*HetznerCloudConfigurer, error) {
+	token, err := readSecret(conf.HetznerCloudToken, conf.HetznerCloudTokenFile, "HCLOUD_TOKEN")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Hetzner Cloud API token: %w", err)
+	}
+	c := &HetznerCloudConfigurer{
+		IPConfiguration: config,
+		api:             newAPIClient(cmp.Or(conf.HetznerCloudEndpoint, defaultHetznerCloudEndpoint), bearerToken(token)),
+		metadata:        newAPIClient(cmp.Or(conf.HetznerCloudMetadataEndpoint, defaultHetznerCloudMetadataEndpoint), nil),
+		network:         int64(conf.HetznerCloudNetwork),
+	}
+	return c, nil
+}
+
+// getServerID returns the ID of this server, as told by the metadata service
+func (c *HetznerCloudConfigurer) getServerID() (int64, error) {
+	if c.serverID != 0 {
+		return c.serverID, nil
+	}
+	str, err := c.metadata.getText("/instance-id")
+	if err != nil {
+		return 0, fmt.Errorf("failed to query the metadata service: %w", err)
+	}
+	if c.serverID, err = strconv.ParseInt(str, 10, 64); err != nil {
+		return 0, fmt.Errorf("unexpected instance-id %q from the metadata service: %w", str, err)
+	}
+	log.Infof("Discovered Hetzner Cloud server ID %d", c.serverID)
+	return c.serverID, nil
+}
+
+// hetznerCloudList collects all pages of a list endpoint, key is the name
+// of the list in the response, e.g. "servers"
+func hetznerCloudList[T any](api *apiClient, path, key string) ([]T, error) {
+	var all []T
+	for page := 1; page != 0; {
+		var resp map[string]json.RawMessage
+		if err := api.do(http.MethodGet, fmt.Sprintf("%s?page=%d&per_page=50", path, page), nil, &resp); err != nil {
+			return nil, err
+		}
+		var items []T
+		if err := json.Unmarshal(resp[key], &items); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", key, err)
+		}
+		all = append(all, items...)
+
+		var meta struct {
+			Pagination struct {
+				NextPage *int `json:"next_page"`
+			} `json:"pagination"`
+		}
+		page = 0
+		if raw, ok := resp["meta"]; ok && json.Unmarshal(raw, &meta) == nil && meta.Pagination.NextPage != nil {
+			page = *meta.Pagination.NextPage
+		}
+	}
+	return all, nil
+}
+
+// matches returns whether the Floating IP is our VIP. IPv6 Floating IPs
+// are whole /64 networks, any address of them can be used as VIP.
+func (f *hetznerCloudFloatingIP) matches(vip netip.Addr) bool {
+	if strings.Contains(f.IP, "/") {
+		prefix, err := netip.ParsePrefix(f.IP)
+		return err == nil && prefix.Contains(vip)
+	}
+	addr, err := netip.ParseAddr(f.IP)
+	return err == nil && addr == vip
+}
+
+func (c *HetznerCloudConfigurer) findFloatingIP() (*hetznerCloudFloatingIP, error) {
+	floatingIPs, err := hetznerCloudList[hetznerCloudFloatingIP](c.api, "/floating_ips", "floating_ips")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Floating IPs: %w", err)
+	}
+	for i := range floatingIPs {
+		if floatingIPs[i].matches(c.VIP) {
+			return &floatingIPs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("there is no Floating IP %s in this project", c.VIP)
+}
+
+// aliasIPs returns the alias IPs of server in our network and whether the
+// server is attached to the network at all
+func (c *HetznerCloudConfigurer) aliasIPs(server *hetznerCloudServer) ([]string, bool) {
+	for _, privateNet := range server.PrivateNet {
+		if privateNet.Network == c.network {
+			return privateNet.AliasIPs, true
+		}
+	}
+	return nil, false
+}
+
+func (c *HetznerCloudConfigurer) hasAliasIP(server *hetznerCloudServer) bool {
+	aliasIPs, _ := c.aliasIPs(server)
+	return slices.ContainsFunc(aliasIPs, func(ip string) bool {
+		addr, err := netip.ParseAddr(ip)
+		return err == nil && addr == c.VIP
+	})
+}
+
+// waitForAction polls the action until it is no longer running
+func (c *HetznerCloudConfigurer) waitForAction(action hetznerCloudAction) error {
+	deadline := time.Now().Add(hetznerCloudActionTimeout)
+	for action.Status == "running" {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("action %d did not finish within %s", action.ID, hetznerCloudActionTimeout)
+		}
+		time.Sleep(time.Duration(max(c.RetryAfter, 1)) * time.Millisecond)
+		var resp struct {
+			Action hetznerCloudAction `json:"action"`
+		}
+		if err := c.api.do(http.MethodGet, fmt.Sprintf("/actions/%d", action.ID), nil, &resp); err != nil {
+			return fmt.Errorf("failed to query action %d: %w", action.ID, err)
+		}
+		action = resp.Action
+	}
+	if action.Status != "success" {
+		if action.Error != nil {
+			return fmt.Errorf("action %d failed: %s: %s", action.ID, action.Error.Code, action.Error.Message)
+		}
+		return fmt.Errorf("action %d finished with status %q", action.ID, action.Status)
+	}
+	return nil
+}
+
+// runAction posts to an action endpoint and waits for the action to finish
+func (c *HetznerCloudConfigurer) runAction(path string, body any) error {
+	var resp struct {
+		Action hetznerCloudAction `json:"action"`
+	}
+	if err := c.api.do(http.MethodPost, path, body, &resp); err != nil {
+		return err
+	}
+	return c.waitForAction(resp.Action)
+}
+
+func (c *HetznerCloudConfigurer) setAliasIPs(serverID int64, aliasIPs []string) error {
+	return c.runAction(fmt.Sprintf("/servers/%d/actions/change_alias_ips", serverID), map[string]any{
+		"network":   c.network,
+		"alias_ips": aliasIPs,
+	})
+}
+
+func (c *HetznerCloudConfigurer) queryAddress() bool {
+	serverID, err := c.getServerID()
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	if c.network == 0 {
+		floatingIP, err := c.findFloatingIP()
+		if err != nil {
+			log.Error(err)
+			return false
+		}
+		return floatingIP.Server != nil && *floatingIP.Server == serverID
+	}
+
+	var resp struct {
+		Server hetznerCloudServer `json:"server"`
+	}
+	if err = c.api.do(http.MethodGet, fmt.Sprintf("/servers/%d", serverID), nil, &resp); err != nil {
+		log.Errorf("Failed to query server %d: %s", serverID, err)
+		return false
+	}
+	return c.hasAliasIP(&resp.Server)
+}
+
+func (c *HetznerCloudConfigurer) configureAddress() bool {
+	serverID, err := c.getServerID()
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	if c.network == 0 {
+		err = c.assignFloatingIP(serverID)
+	} else {
+		err = c.moveAliasIP(serverID)
+	}
+	if err != nil {
+		log.Errorf("Failed to move %s to this server: %s", c.VIP, err)
+		return false
+	}
+	log.Infof("%s was successfully moved to server %d", c.VIP, serverID)
+	return true
+}
+
+func (c *HetznerCloudConfigurer) assignFloatingIP(serverID int64) error {
+	floatingIP, err := c.findFloatingIP()
+	if err != nil {
+		return err
+	}
+	if floatingIP.Server != nil && *floatingIP.Server == serverID {
+		return nil
+	}
+	return c.runAction(fmt.Sprintf("/floating_ips/%d/actions/assign", floatingIP.ID), map[string]int64{"server": serverID})
+}
+
+// moveAliasIP removes the VIP from the alias IPs of any other server in the
+// network, as an address can only be used once, and adds it to ours
+func (c *HetznerCloudConfigurer) moveAliasIP(serverID int64) error {
+	servers, err := hetznerCloudList[hetznerCloudServer](c.api, "/servers", "servers")
+	if err != nil {
+		return fmt.Errorf("failed to list servers: %w", err)
+	}
+	var own *hetznerCloudServer
+	for i := range servers {
+		server := &servers[i]
+		if server.ID == serverID {
+			own = server
+			continue
+		}
+		if !c.hasAliasIP(server) {
+			continue
+		}
+		log.Infof("Removing alias IP %s from server %s", c.VIP, server.Name)
+		aliasIPs, _ := c.aliasIPs(server)
+		aliasIPs = slices.DeleteFunc(slices.Clone(aliasIPs), func(ip string) bool {
+			addr, err := netip.ParseAddr(ip)
+			return err == nil && addr == c.VIP
+		})
+		if err = c.setAliasIPs(server.ID, aliasIPs); err != nil {
+			return fmt.Errorf("failed to remove alias IP from server %s: %w", server.Name, err)
+		}
+	}
+	if own == nil {
+		return errors.New("this server is not in the list of servers")
+	}
+	aliasIPs, ok := c.aliasIPs(own)
+	if !ok {
+		return fmt.Errorf("this server is not attached to network %d", c.network)
+	}
+	if c.hasAliasIP(own) {
+		return nil
+	}
+	return c.setAliasIPs(serverID, append(slices.Clone(aliasIPs), c.VIP.String()))
+}
+
+func (c *HetznerCloudConfigurer) deconfigureAddress() bool {
+	// Assigning a Floating IP replaces the previous assignment, and
+	// moveAliasIP of the next leader removes the alias IP from our server.
+	return true
+}
@@ -0,0 +1,382 @@
+package ipmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// fakeHetznerCloud is a stand-in for the Hetzner Cloud API and the metadata
+// service. Actions finish after being polled once.
+type fakeHetznerCloud struct {
+	*fakeAPI
+	serverID    int64
+	floatingIPs []hetznerCloudFloatingIP
+	servers     []hetznerCloudServer
+	actions     map[int64]string
+	failActions bool
+	posts       []string
+}
+
+func newFakeHetznerCloud(t *testing.T) *fakeHetznerCloud {
+	t.Helper()
+	f := &fakeHetznerCloud{serverID: 42, actions: map[int64]string{}}
+	f.fakeAPI = newFakeAPI(t, f.handle)
+	return f
+}
+
+var (
+	hcloudAssignPath = regexp.MustCompile(`^/v1/floating_ips/(\d+)/actions/assign$`)
+	hcloudAliasPath  = regexp.MustCompile(`^/v1/servers/(\d+)/actions/change_alias_ips$`)
+	hcloudServerPath = regexp.MustCompile(`^/v1/servers/(\d+)$`)
+	hcloudActionPath = regexp.MustCompile(`^/v1/actions/(\d+)$`)
+)
+
+// hcloudPageSize is small, to exercise pagination
+const hcloudPageSize = 1
+
+func (f *fakeHetznerCloud) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/metadata/instance-id" {
+		fmt.Fprintf(w, "%d", f.serverID)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":{"code":"unauthorized","message":"unable to authenticate"}}`))
+		return
+	}
+	if r.Method == http.MethodPost {
+		f.posts = append(f.posts, r.URL.Path)
+	}
+
+	switch {
+	case r.URL.Path == "/v1/floating_ips":
+		writePage(w, r, "floating_ips", f.floatingIPs)
+	case r.URL.Path == "/v1/servers":
+		writePage(w, r, "servers", f.servers)
+	case hcloudServerPath.MatchString(r.URL.Path):
+		id, _ := strconv.ParseInt(hcloudServerPath.FindStringSubmatch(r.URL.Path)[1], 10, 64)
+		for _, s := range f.servers {
+			if s.ID == id {
+				writeJSON(w, map[string]any{"server": s})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case hcloudAssignPath.MatchString(r.URL.Path):
+		id, _ := strconv.ParseInt(hcloudAssignPath.FindStringSubmatch(r.URL.Path)[1], 10, 64)
+		var body struct {
+			Server int64 `json:"server"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		for i := range f.floatingIPs {
+			if f.floatingIPs[i].ID == id && !f.failActions {
+				f.floatingIPs[i].Server = &body.Server
+			}
+		}
+		f.startAction(w)
+	case hcloudAliasPath.MatchString(r.URL.Path):
+		id, _ := strconv.ParseInt(hcloudAliasPath.FindStringSubmatch(r.URL.Path)[1], 10, 64)
+		var body struct {
+			Network  int64    `json:"network"`
+			AliasIPs []string `json:"alias_ips"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		for i := range f.servers {
+			if f.servers[i].ID != id {
+				continue
+			}
+			for j := range f.servers[i].PrivateNet {
+				if f.servers[i].PrivateNet[j].Network == body.Network && !f.failActions {
+					f.servers[i].PrivateNet[j].AliasIPs = body.AliasIPs
+				}
+			}
+		}
+		f.startAction(w)
+	case hcloudActionPath.MatchString(r.URL.Path):
+		id, _ := strconv.ParseInt(hcloudActionPath.FindStringSubmatch(r.URL.Path)[1], 10, 64)
+		action := map[string]any{"id": id, "status": f.actions[id]}
+		if f.actions[id] == "error" {
+			action["error"] = map[string]string{"code": "server_error", "message": "something went wrong"}
+		}
+		writeJSON(w, map[string]any{"action": action})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// startAction answers with a running action, that finishes when polled
+func (f *fakeHetznerCloud) startAction(w http.ResponseWriter) {
+	id := int64(len(f.actions) + 1)
+	f.actions[id] = map[bool]string{false: "success", true: "error"}[f.failActions]
+	writeJSON(w, map[string]any{"action": map[string]any{"id": id, "status": "running"}})
+}
+
+// writePage serves items in pages of hcloudPageSize like the list endpoints
+func writePage[T any](w http.ResponseWriter, r *http.Request, key string, items []T) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	page = max(page, 1)
+	start := min((page-1)*hcloudPageSize, len(items))
+	end := min(start+hcloudPageSize, len(items))
+	var next any
+	if end < len(items) {
+		next = page + 1
+	}
+	writeJSON(w, map[string]any{
+		key:    items[start:end],
+		"meta": map[string]any{"pagination": map[string]any{"page": page, "next_page": next}},
+	})
+}
+
+func newTestHetznerCloudConfigurer(t *testing.T, f *fakeHetznerCloud, vip string, network int) *HetznerCloudConfigurer {
+	t.Helper()
+	return newTestConfigurer(t, newHetznerCloudConfigurer, testHetznerIPConfiguration(vip), &vipconfig.Config{
+		HetznerCloudToken:            "test-token",
+		HetznerCloudNetwork:          network,
+		HetznerCloudEndpoint:         f.URL + "/v1",
+		HetznerCloudMetadataEndpoint: f.URL + "/metadata",
+	})
+}
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+// ---------------------------------------------------------------------------
+// newHetznerCloudConfigurer
+// ---------------------------------------------------------------------------
+
+func TestNewHetznerCloudConfigurer_TokenFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "hcloud-token")
+	if err := os.WriteFile(path, []byte("test-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f := newFakeHetznerCloud(t)
+	f.floatingIPs = []hetznerCloudFloatingIP{{ID: 1, IP: "192.168.1.10", Server: int64Ptr(42)}}
+
+	c, err := newHetznerCloudConfigurer(testHetznerIPConfiguration("192.168.1.10"), &vipconfig.Config{
+		HetznerCloudTokenFile:        path,
+		HetznerCloudEndpoint:         f.URL + "/v1",
+		HetznerCloudMetadataEndpoint: f.URL + "/metadata",
+	})
+	if err != nil {
+		t.Fatalf("newHetznerCloudConfigurer() error = %v", err)
+	}
+	if !c.queryAddress() {
+		t.Error("expected the token from the file to be used")
+	}
+}
+
+func TestNewHetznerCloudConfigurer_NoToken(t *testing.T) {
+	t.Setenv("HCLOUD_TOKEN", "")
+
+	_, err := newHetznerCloudConfigurer(testHetznerIPConfiguration("192.168.1.10"), &vipconfig.Config{})
+	if err == nil {
+		t.Error("expected an error without API token")
+	}
+}
+
+func TestNewHetznerCloudConfigurer_Defaults(t *testing.T) {
+	t.Setenv("HCLOUD_TOKEN", "env-token")
+
+	c, err := newHetznerCloudConfigurer(testHetznerIPConfiguration("192.168.1.10"), &vipconfig.Config{})
+	if err != nil {
+		t.Fatalf("newHetznerCloudConfigurer() error = %v", err)
+	}
+	if c.api.baseURL != defaultHetznerCloudEndpoint || c.metadata.baseURL != defaultHetznerCloudMetadataEndpoint {
+		t.Errorf("unexpected endpoints %s and %s", c.api.baseURL, c.metadata.baseURL)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Floating IPs
+// ---------------------------------------------------------------------------
+
+func TestHetznerCloudConfigurer_queryAddress_FloatingIP(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		vip    string
+		server *int64
+		want   bool
+	}{
+		{"assigned to us", "192.168.1.10", int64Ptr(42), true},
+		{"assigned to other server", "192.168.1.10", int64Ptr(7), false},
+		{"unassigned", "192.168.1.10", nil, false},
+		{"address in IPv6 network assigned to us", "2001:db8:1:2::10", int64Ptr(42), true},
+		{"unknown address", "192.168.1.99", int64Ptr(42), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			f := newFakeHetznerCloud(t)
+			f.floatingIPs = []hetznerCloudFloatingIP{
+				{ID: 1, IP: "10.0.0.1", Server: int64Ptr(42)},
+				{ID: 2, IP: "192.168.1.10", Server: tt.server},
+				{ID: 3, IP: "2001:db8:1:2::/64", Server: tt.server},
+			}
+			c := newTestHetznerCloudConfigurer(t, f, tt.vip, 0)
+			if got := c.queryAddress(); got != tt.want {
+				t.Errorf("queryAddress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHetznerCloudConfigurer_queryAddress_Unauthorized(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeHetznerCloud(t)
+	f.floatingIPs = []hetznerCloudFloatingIP{{ID: 1, IP: "192.168.1.10", Server: int64Ptr(42)}}
+	c := newTestHetznerCloudConfigurer(t, f, "192.168.1.10", 0)
+	c.api.authorize = bearerToken("wrong")
+
+	if c.queryAddress() {
+		t.Error("queryAddress() should fail when the API rejects the token")
+	}
+}
+
+func TestHetznerCloudConfigurer_getServerID_Invalid(t *testing.T) {
+	t.Parallel()
+
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("not-a-number"))
+	}))
+	defer metadata.Close()
+
+	f := newFakeHetznerCloud(t)
+	c := newTestHetznerCloudConfigurer(t, f, "192.168.1.10", 0)
+	c.metadata = newAPIClient(metadata.URL, nil)
+
+	if _, err := c.getServerID(); err == nil {
+		t.Error("expected an error for an invalid instance-id")
+	}
+	if c.configureAddress() {
+		t.Error("configureAddress() should fail without server ID")
+	}
+}
+
+func TestHetznerCloudConfigurer_configureAddress_FloatingIP(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeHetznerCloud(t)
+	f.floatingIPs = []hetznerCloudFloatingIP{
+		{ID: 1, IP: "10.0.0.1"},
+		{ID: 2, IP: "192.168.1.10", Server: int64Ptr(7)},
+	}
+	c := newTestHetznerCloudConfigurer(t, f, "192.168.1.10", 0)
+
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if !c.queryAddress() {
+		t.Error("the Floating IP should be assigned to this server")
+	}
+	if !slices.Equal(f.posts, []string{"/v1/floating_ips/2/actions/assign"}) {
+		t.Errorf("unexpected API calls %v", f.posts)
+	}
+
+	// a second call must not reassign
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if len(f.posts) != 1 {
+		t.Errorf("expected no further assignment, got %v", f.posts)
+	}
+}
+
+func TestHetznerCloudConfigurer_configureAddress_ActionFails(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeHetznerCloud(t)
+	f.failActions = true
+	f.floatingIPs = []hetznerCloudFloatingIP{{ID: 2, IP: "192.168.1.10", Server: int64Ptr(7)}}
+	c := newTestHetznerCloudConfigurer(t, f, "192.168.1.10", 0)
+
+	if c.configureAddress() {
+		t.Error("configureAddress() should fail when the action fails")
+	}
+}
+
+func TestHetznerCloudConfigurer_deconfigureAddress(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeHetznerCloud(t)
+	f.floatingIPs = []hetznerCloudFloatingIP{{ID: 2, IP: "192.168.1.10", Server: int64Ptr(42)}}
+	c := newTestHetznerCloudConfigurer(t, f, "192.168.1.10", 0)
+
+	if !c.deconfigureAddress() {
+		t.Error("deconfigureAddress() = false, want true")
+	}
+	if len(f.posts) != 0 {
+		t.Errorf("deconfigureAddress() must leave the assignment to the next leader, got %v", f.posts)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Alias IPs
+// ---------------------------------------------------------------------------
+
+func testHetznerCloudServer(id, network int64, aliasIPs ...string) hetznerCloudServer {
+	s := hetznerCloudServer{ID: id, Name: fmt.Sprintf("server%d", id)}
+	s.PrivateNet = append(s.PrivateNet, struct {
+		Network  int64    `json:"network"`
+		IP       string   `json:"ip"`
+		AliasIPs []string `json:"alias_ips"`
+	}{Network: network, IP: fmt.Sprintf("10.0.0.%d", id), AliasIPs: aliasIPs})
+	return s
+}
+
+func TestHetznerCloudConfigurer_AliasIP(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeHetznerCloud(t)
+	f.servers = []hetznerCloudServer{
+		testHetznerCloudServer(7, 100, "10.0.0.100", "10.0.0.50"),
+		testHetznerCloudServer(42, 100, "10.0.0.60"),
+		testHetznerCloudServer(8, 200, "10.0.0.100"),
+	}
+	c := newTestHetznerCloudConfigurer(t, f, "10.0.0.100", 100)
+
+	if c.queryAddress() {
+		t.Fatal("queryAddress() = true before the alias IP was moved")
+	}
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if !c.queryAddress() {
+		t.Error("queryAddress() = false after the alias IP was moved")
+	}
+
+	want := [][]string{{"10.0.0.50"}, {"10.0.0.60", "10.0.0.100"}, {"10.0.0.100"}}
+	for i, s := range f.servers {
+		if got := s.PrivateNet[0].AliasIPs; !slices.Equal(got, want[i]) {
+			t.Errorf("alias IPs of %s = %v, want %v", s.Name, got, want[i])
+		}
+	}
+}
+
+func TestHetznerCloudConfigurer_AliasIP_NotAttached(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeHetznerCloud(t)
+	f.servers = []hetznerCloudServer{testHetznerCloudServer(42, 200)}
+	c := newTestHetznerCloudConfigurer(t, f, "10.0.0.100", 100)
+
+	if c.configureAddress() {
+		t.Error("configureAddress() should fail when the server is not in the network")
+	}
+}
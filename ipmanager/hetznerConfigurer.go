@@ -2,13 +2,22 @@ package ipmanager
 
 import (
 	"bufio"
+	"cmp"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
-	"os/exec"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
 )
 
 const (
@@ -17,35 +26,118 @@ const (
 	released   = iota // c2 == 2
 )
 
+const defaultHetznerRobotEndpoint = "https://robot-ws.your-server.de"
+
 // The HetznerConfigurer can be used to enable vip-management on nodes
 // rented in a Hetzner Datacenter.
 // Since Hetzner provides an API that handles failover-ip routing,
 // this API is used to manage the vip, whenever hostintype `hetzner` is set.
+// Besides single failover IPs, failover nets (e.g. an IPv6 /64) containing
+// the vip are routed. With a vSwitch interface set, the vip is additionally
+// added on that VLAN interface like BasicConfigurer does, once it is routed.
 type HetznerConfigurer struct {
 	*IPConfiguration
 	cachedState     int
 	lastAPICheck    time.Time
 	verbose         bool
 	credentialsFile string
-	runCommand      func(name string, arg ...string) ([]byte, error)
+	baseURL         string
+	httpClient      *http.Client
 	getOutboundIP   func() (net.IP, error)
+	getLocalAddrs   func() ([]net.Addr, error)
+	failoverNet     netip.Prefix
+	// local manages the vip on the vSwitch interface, nil if there is none
+	local ipConfigurer
+}
+
+// hetznerFailover is the failover object of the Robot webservice
+type hetznerFailover struct {
+	IP             string  `json:"ip"`
+	Netmask        string  `json:"netmask"`
+	ServerIP       string  `json:"server_ip"`
+	ServerIPv6Net  string  `json:"server_ipv6_net"`
+	ServerNumber   int     `json:"server_number"`
+	ActiveServerIP *string `json:"active_server_ip"`
+}
+
+// hetznerError is the error object of the Robot webservice
+type hetznerError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
-func newHetznerConfigurer(config *IPConfiguration, verbose bool) (*HetznerConfigurer, error) {
+func (e *hetznerError) Error() string {
+	return fmt.Sprintf("Hetzner API error %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+type hetznerResponse struct {
+	Failover *hetznerFailover `json:"failover"`
+	Error    *hetznerError    `json:"error"`
+}
+
+func newHetznerConfigurer(config *IPConfiguration, conf *vipconfig.Config) (*HetznerConfigurer, error) {
+	failoverNet, err := hetznerFailoverNet(config.VIP, conf.HetznerFailoverNet)
+	if err != nil {
+		return nil, err
+	}
 	c := &HetznerConfigurer{
 		IPConfiguration: config,
 		cachedState:     unknown,
 		lastAPICheck:    time.Unix(0, 0),
-		verbose:         verbose,
+		verbose:         conf.Verbose,
 		credentialsFile: "/etc/hetzner",
-		runCommand: func(name string, arg ...string) ([]byte, error) {
-			return exec.Command(name, arg...).Output()
-		},
-		getOutboundIP: getOutboundIP,
+		baseURL:         strings.TrimRight(cmp.Or(conf.HetznerRobotEndpoint, defaultHetznerRobotEndpoint), "/"),
+		httpClient:      newIPv4HTTPClient(),
+		getOutboundIP:   getOutboundIP,
+		getLocalAddrs:   net.InterfaceAddrs,
+		failoverNet:     failoverNet,
+	}
+	if conf.HetznerVSwitchInterface != "" {
+		iface, err := getNetIface(conf.HetznerVSwitchInterface)
+		if err != nil {
+			return nil, err
+		}
+		vswitchConf := *config
+		vswitchConf.Iface = *iface
+		if c.local, err = newBasicConfigurer(&vswitchConf); err != nil {
+			return nil, err
+		}
 	}
 	return c, nil
 }
 
+// hetznerFailoverNet returns the failover net the vip belongs to. Without
+// hetzner-failover-net, that is the vip itself for IPv4 and the /64 around
+// it for IPv6, as Hetzner only offers IPv6 failover nets of that size.
+func hetznerFailoverNet(vip netip.Addr, failoverNet string) (netip.Prefix, error) {
+	if failoverNet == "" {
+		if vip.Is4() {
+			return netip.PrefixFrom(vip, 32), nil
+		}
+		return netip.PrefixFrom(vip, 64).Masked(), nil
+	}
+	prefix, err := netip.ParsePrefix(failoverNet)
+	if err != nil {
+		return prefix, fmt.Errorf("invalid hetzner-failover-net: %w", err)
+	}
+	if !prefix.Contains(vip) {
+		return prefix, fmt.Errorf("hetzner-failover-net %s does not contain %s", prefix, vip)
+	}
+	return prefix.Masked(), nil
+}
+
+// newIPv4HTTPClient returns a client that only connects through IPv4, as
+// the Hetzner Robot webservice is not reachable over IPv6
+func newIPv4HTTPClient() *http.Client {
+	dialer := &net.Dialer{Timeout: apiTimeout}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "tcp4", addr)
+	}
+	return &http.Client{Timeout: apiTimeout, Transport: transport}
+}
+
 /**
  * In order to tell the Hetzner API to route the failover-ip to
  * this machine, we must attach our own IP address to the API request.
@@ -62,154 +154,222 @@ func getOutboundIP() (net.IP, error) {
 	return localAddr.IP, nil
 }
 
-func (c *HetznerConfigurer) curlQueryFailover(post bool) (string, error) {
-	/**
-	 * The credentials for the API are loaded from a file stored in /etc/hetzner .
-	 */
-	f, err := os.Open(c.credentialsFile)
+// readHetznerCredentials reads the user and password for the Robot webservice
+// from a file with lines like
+//
+//	user="myUsername"
+//	pass="myPassword"
+//
+// Whitespace around keys and values, quotes and comment lines are ignored.
+func readHetznerCredentials(path string) (user, password string, err error) {
+	f, err := os.Open(path)
 	if err != nil {
-		log.Error("can't open passwordfile", err)
-		return "", err
+		return "", "", fmt.Errorf("can't open credentials file: %w", err)
 	}
 	defer f.Close()
 
-	/**
-	 * The retrieval of username and password from the file is rather static,
-	 * so the credentials file must conform to the offsets down below perfectly.
-	 */
-	var user string
-	var password string
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) < 4 {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
 			continue
 		}
-		switch line[:4] {
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `"'`)
+		}
+		switch strings.TrimSpace(key) {
 		case "user":
-			if len(line) > 6 {
-				user = line[6 : len(line)-1]
-			}
+			user = value
 		case "pass":
-			if len(line) > 6 {
-				password = line[6 : len(line)-1]
-			}
+			password = value
 		}
 	}
 	if err := scanner.Err(); err != nil {
-		log.Error("error reading credentials file", err)
-		return "", fmt.Errorf("error reading credentials file: %w", err)
+		return "", "", fmt.Errorf("error reading credentials file: %w", err)
 	}
 	if user == "" || password == "" {
-		log.Infoln("Couldn't retrieve username or password from file", c.credentialsFile)
-		return "", errors.New("couldn't retrieve username or password from file")
+		return "", "", fmt.Errorf("couldn't retrieve username or password from file %s", path)
 	}
+	return user, password, nil
+}
 
+// queryFailover asks the Robot webservice where the failover-ip is routed
+// to. If post is set to true, a failover to this machine is triggered first.
+// Responses signalling a rate limit or a switch in progress are retried
+// retry-num times, waiting retry-after ms doubled with every attempt or as
+// long as the API asks us to.
+func (c *HetznerConfigurer) queryFailover(post bool) (net.IP, error) {
 	/**
-	 * As Hetzner API only allows IPv4 connections, we rely on curl
-	 * instead of GO's own http package,
-	 * as selecting IPv4 transport there doesn't seem trivial.
-	 *
-	 * If post is set to true, a failover will be triggered.
-	 * If it is set to false, the current state (i.e. route)
-	 * for the failover-ip will be retrieved.
+	 * The credentials for the API are loaded from a file stored in /etc/hetzner .
 	 */
-	var args []string
+	user, password, err := readHetznerCredentials(c.credentialsFile)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	form := url.Values{}
 	if post {
 		myOwnIP, err := c.getOutboundIP()
 		if err != nil {
 			log.Error("Error determining this machine's IP address.", err)
-			return "", fmt.Errorf("error determining this machine's IP address: %w", err)
+			return nil, fmt.Errorf("error determining this machine's IP address: %w", err)
 		}
-		log.Infof("my_own_ip: %s\n", myOwnIP.String())
-
-		args = []string{
-			"--ipv4",
-			"-u", user + ":" + password,
-			"https://robot-ws.your-server.de/failover/" + c.VIP.String(),
-			"-d", "active_server_ip=" + myOwnIP.String()}
-
-		log.Debugf("%s %s %s '%s' %s %s %s",
-			"curl",
-			"--ipv4",
-			"-u", user+":XXXXXX",
-			"https://robot-ws.your-server.de/failover/"+c.VIP.String(),
-			"-d", "active_server_ip="+myOwnIP.String())
-	} else {
-		args = []string{
-			"--ipv4",
-			"-u", user + ":" + password,
-			"https://robot-ws.your-server.de/failover/" + c.VIP.String()}
-
-		log.Debugf("%s %s %s %s %s",
-			"curl",
-			"--ipv4",
-			"-u", user+":XXXXXX",
-			"https://robot-ws.your-server.de/failover/"+c.VIP.String())
+		log.Infof("my_own_ip: %s", myOwnIP.String())
+		form.Set("active_server_ip", myOwnIP.String())
 	}
 
-	out, err := c.runCommand("curl", args...)
+	for attempt := 0; ; attempt++ {
+		resp, body, err := c.request(form, user, password)
+		if err != nil {
+			return nil, err
+		}
+		ip, err := c.getActiveIPFromJSON(body)
+		var apiErr *hetznerError
+		isAPIErr := errors.As(err, &apiErr)
+		if post && isAPIErr && apiErr.Code == "FAILOVER_ALREADY_ROUTED" {
+			// this is what we wanted in the first place
+			log.Info("Failover-ip is already routed to the requested server")
+			return c.queryFailover(false)
+		}
+		if !isAPIErr && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+			err = &apiError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+		}
+		// the status alone counts as well, the body of a rate limit or a
+		// conflict isn't always a Robot error
+		retry := resp.StatusCode == http.StatusTooManyRequests ||
+			(resp.StatusCode == http.StatusConflict && !isAPIErr) ||
+			(isAPIErr && (apiErr.Code == "RATE_LIMIT_EXCEEDED" || apiErr.Code == "FAILOVER_LOCKED"))
+		if retry && attempt+1 < max(c.RetryNum, 1) {
+			wait := c.backoff(resp, attempt)
+			log.Warnf("%s, retrying in %s", err, wait)
+			time.Sleep(wait)
+			continue
+		}
+		return ip, err
+	}
+}
 
+// request sends a single request for the failover-ip to the Robot
+// webservice, a POST if form is not empty
+func (c *HetznerConfigurer) request(form url.Values, user, password string) (*http.Response, []byte, error) {
+	method := http.MethodGet
+	if len(form) > 0 {
+		method = http.MethodPost
+	}
+	reqURL := c.baseURL + "/failover/" + c.failoverNet.Addr().String()
+	req, err := http.NewRequest(method, reqURL, strings.NewReader(form.Encode()))
 	if err != nil {
-		return "", err
+		return nil, nil, err
+	}
+	req.SetBasicAuth(user, password)
+	req.Header.Set("Accept", "application/json")
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	}
+	log.Debugf("%s %s %s", method, reqURL, form.Encode())
 
-	retStr := string(out[:])
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	return resp, body, nil
+}
 
-	return retStr, nil
+// backoff returns how long to wait before the next attempt, as told by the
+// Retry-After header, or else retry-after doubled with every attempt
+func (c *HetznerConfigurer) backoff(resp *http.Response, attempt int) time.Duration {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Duration(max(c.RetryAfter, 1)) * time.Millisecond << attempt
 }
 
 /**
  * This function is used to parse the response which comes from the
- * curlQueryFailover function and in turn from the curl calls to the API.
+ * Robot webservice. Errors reported by the API are returned as *hetznerError.
  */
-func (c *HetznerConfigurer) getActiveIPFromJSON(str string) (net.IP, error) {
-	var f map[string]interface{}
-
-	log.Debugf("JSON response: %s\n", str)
+func (c *HetznerConfigurer) getActiveIPFromJSON(body []byte) (net.IP, error) {
+	log.Debugf("JSON response: %s\n", body)
 
-	err := json.Unmarshal([]byte(str), &f)
-	if err != nil {
+	var resp hetznerResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
 		log.Errorln(err)
-		return nil, err
+		return nil, fmt.Errorf("failed to decode response from Hetzner API: %w", err)
 	}
 
-	if f["error"] != nil {
-		errormap := f["error"].(map[string]interface{})
-
+	if resp.Error != nil {
 		log.Errorf("There was an error accessing the Hetzner API!\n"+
-			" status: %f\n code: %s\n message: %s\n",
-			errormap["status"].(float64),
-			errormap["code"].(string),
-			errormap["message"].(string))
-		return nil, errors.New("error response from Hetzner API returned")
+			" status: %d\n code: %s\n message: %s\n",
+			resp.Error.Status,
+			resp.Error.Code,
+			resp.Error.Message)
+		return nil, resp.Error
 	}
 
-	if f["failover"] != nil {
-		failovermap := f["failover"].(map[string]interface{})
-
-		ip := failovermap["ip"].(string)
-		netmask := failovermap["netmask"].(string)
-		serverIP := failovermap["server_ip"].(string)
-		serverNumber := failovermap["server_number"].(float64)
-		activeServerIP := failovermap["active_server_ip"].(string)
-
-		log.Infoln("Result of the failover query was: ",
-			"failover-ip=", ip,
-			"netmask=", netmask,
-			"server_ip=", serverIP,
-			"server_number=", serverNumber,
-			"active_server_ip=", activeServerIP,
-		)
-
-		return net.ParseIP(activeServerIP), nil
-
+	if resp.Failover == nil {
+		return nil, errors.New("response from Hetzner API contains no failover object")
+	}
+	failover := resp.Failover
+	activeServerIP := ""
+	if failover.ActiveServerIP != nil {
+		activeServerIP = *failover.ActiveServerIP
+	}
+	log.Infoln("Result of the failover query was: ",
+		"failover-ip=", failover.IP,
+		"netmask=", failover.Netmask,
+		"server_ip=", failover.ServerIP,
+		"server_ipv6_net=", failover.ServerIPv6Net,
+		"server_number=", failover.ServerNumber,
+		"active_server_ip=", activeServerIP,
+	)
+
+	ip := net.ParseIP(activeServerIP)
+	if ip == nil {
+		return nil, fmt.Errorf("failover-ip is not routed to a valid address: %q", activeServerIP)
 	}
+	return ip, nil
+}
 
-	return nil, errors.New("why did we end up here?")
+// isOwnServer tells whether the failover is routed to this machine. For
+// IPv6 failover nets, the Robot webservice reports the IPv6 net of the
+// active server instead of its main IP.
+func (c *HetznerConfigurer) isOwnServer(activeServerIP, myOwnIP net.IP) (bool, error) {
+	if activeServerIP.Equal(myOwnIP) {
+		return true, nil
+	}
+	if activeServerIP.To4() != nil {
+		return false, nil
+	}
+	activeNet := &net.IPNet{IP: activeServerIP, Mask: net.CIDRMask(64, 128)}
+	addrs, err := c.getLocalAddrs()
+	if err != nil {
+		return false, fmt.Errorf("failed to list local addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && activeNet.Contains(ipNet.IP) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func (c *HetznerConfigurer) queryAddress() bool {
+	if c.local != nil && !c.local.queryAddress() {
+		return false
+	}
 	if (time.Since(c.lastAPICheck) / time.Hour) > 1 {
 		/**We need to recheck the status!
 		 * Don't check too often because of stupid API rate limits
@@ -228,27 +388,27 @@ func (c *HetznerConfigurer) queryAddress() bool {
 		}
 	}
 
-	str, err := c.curlQueryFailover(false)
+	currentFailoverDestinationIP, err := c.queryFailover(false)
 	if err != nil {
 		c.cachedState = unknown
 		return false
 	}
 	c.lastAPICheck = time.Now()
 
-	currentFailoverDestinationIP, err := c.getActiveIPFromJSON(str)
+	myOwnIP, err := c.getOutboundIP()
 	if err != nil {
+		log.Error("Error determining this machine's IP address.", err)
 		c.cachedState = unknown
 		return false
 	}
 
-	myOwnIP, err := c.getOutboundIP()
+	isOwn, err := c.isOwnServer(currentFailoverDestinationIP, myOwnIP)
 	if err != nil {
-		log.Error("Error determining this machine's IP address.", err)
+		log.Error(err)
 		c.cachedState = unknown
 		return false
 	}
-
-	if currentFailoverDestinationIP.Equal(myOwnIP) {
+	if isOwn {
 		//We "are" the current failover destination.
 		c.cachedState = configured
 		return true
@@ -258,6 +418,10 @@ func (c *HetznerConfigurer) queryAddress() bool {
 	return false
 }
 
+func (c *HetznerConfigurer) queryLocalAddress() bool {
+	return c.local != nil && c.local.queryAddress()
+}
+
 func (c *HetznerConfigurer) configureAddress() bool {
 	//log.Printf("Configuring address %s on %s", m.GetCIDR(), m.iface.Name)
 
@@ -265,24 +429,22 @@ func (c *HetznerConfigurer) configureAddress() bool {
 }
 
 func (c *HetznerConfigurer) deconfigureAddress() bool {
-	//The address doesn't need deconfiguring since Hetzner API
+	//The routing doesn't need deconfiguring since Hetzner API
 	// is used to point the VIP address somewhere else.
 	c.cachedState = released
+	if c.local != nil {
+		return c.local.deconfigureAddress()
+	}
 	return true
 }
 
 func (c *HetznerConfigurer) runAddressConfiguration() bool {
-	str, err := c.curlQueryFailover(true)
+	currentFailoverDestinationIP, err := c.queryFailover(true)
 	if err != nil {
 		log.Infof("Error while configuring Hetzner failover-ip! Error message: %s", err)
 		c.cachedState = unknown
 		return false
 	}
-	currentFailoverDestinationIP, err := c.getActiveIPFromJSON(str)
-	if err != nil {
-		c.cachedState = unknown
-		return false
-	}
 
 	c.lastAPICheck = time.Now()
 
@@ -293,10 +455,19 @@ func (c *HetznerConfigurer) runAddressConfiguration() bool {
 		return false
 	}
 
-	if currentFailoverDestinationIP.Equal(myOwnIP) {
+	isOwn, err := c.isOwnServer(currentFailoverDestinationIP, myOwnIP)
+	if err != nil {
+		log.Error(err)
+		c.cachedState = unknown
+		return false
+	}
+	if isOwn {
 		//We "are" the current failover destination.
 		log.Info("Failover was successfully executed!")
 		c.cachedState = configured
+		if c.local != nil {
+			return c.local.configureAddress()
+		}
 		return true
 	}
 
@@ -4,20 +4,19 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/netip"
 	"os"
 	"path/filepath"
-	"slices"
 	"testing"
 	"time"
 
-	"go.uber.org/zap"
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
 )
 
 func setupHetznerTest(t *testing.T) {
 	t.Helper()
-	conf := zap.NewNop()
-	log = conf.Sugar()
 }
 
 func testHetznerIPConfiguration(vip string) *IPConfiguration {
@@ -28,6 +27,8 @@ func testHetznerIPConfiguration(vip string) *IPConfiguration {
 			Name:         "test0",
 			HardwareAddr: net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
 		},
+		RetryNum:   3,
+		RetryAfter: 1,
 	}
 }
 
@@ -44,13 +45,129 @@ func writeHetznerCredentialsFile(t *testing.T, dir, user, pass string) string {
 func newTestHetznerConfigurer(t *testing.T) *HetznerConfigurer {
 	t.Helper()
 	cfg := testHetznerIPConfiguration("192.168.1.10")
-	c, err := newHetznerConfigurer(cfg, false)
+	c, err := newHetznerConfigurer(cfg, &vipconfig.Config{})
 	if err != nil {
 		t.Fatalf("unexpected error creating HetznerConfigurer: %v", err)
 	}
 	return c
 }
 
+// fakeRobotResponse is served instead of the regular answer of fakeRobot
+type fakeRobotResponse struct {
+	status int
+	header http.Header
+	body   string
+}
+
+type fakeRobotRequest struct {
+	method         string
+	path           string
+	user, password string
+	activeServerIP string
+}
+
+// fakeRobot is a stand-in for the failover endpoint of the Hetzner Robot
+// webservice. Queued responses are served first, after that POST requests
+// route the failover-ip to the requested server.
+type fakeRobot struct {
+	*fakeAPI
+	failoverIP     string
+	activeServerIP string
+	ipv6Nets       map[string]string // main IP to IPv6 net of the servers
+	queued         []fakeRobotResponse
+	requests       []fakeRobotRequest
+}
+
+// newHetznerTestSetup returns a configurer talking to a fakeRobot, with valid
+// credentials and 10.0.0.5 as outbound IP
+func newHetznerTestSetup(t *testing.T) (*HetznerConfigurer, *fakeRobot) {
+	t.Helper()
+	setupHetznerTest(t)
+
+	robot := &fakeRobot{failoverIP: "192.168.1.10", activeServerIP: "10.0.0.1"}
+	robot.fakeAPI = newFakeAPI(t, robot.handle)
+
+	c := newTestHetznerConfigurer(t)
+	c.baseURL = robot.URL
+	c.credentialsFile = writeHetznerCredentialsFile(t, t.TempDir(), "testuser", "testpass")
+	c.getOutboundIP = func() (net.IP, error) {
+		return net.ParseIP("10.0.0.5"), nil
+	}
+	c.getLocalAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(26, 32)},
+			&net.IPNet{IP: net.ParseIP("2001:db8:5::2"), Mask: net.CIDRMask(64, 128)},
+		}, nil
+	}
+	return c, robot
+}
+
+func (f *fakeRobot) handle(w http.ResponseWriter, r *http.Request) {
+	user, password, _ := r.BasicAuth()
+	_ = r.ParseForm()
+	f.requests = append(f.requests, fakeRobotRequest{
+		method:         r.Method,
+		path:           r.URL.Path,
+		user:           user,
+		password:       password,
+		activeServerIP: r.PostForm.Get("active_server_ip"),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if user != "testuser" || password != "testpass" {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":{"status":401,"code":"UNAUTHORIZED","message":"Unauthorized"}}`))
+		return
+	}
+	if len(f.queued) > 0 {
+		resp := f.queued[0]
+		f.queued = f.queued[1:]
+		for k, v := range resp.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.status)
+		_, _ = w.Write([]byte(resp.body))
+		return
+	}
+	if r.URL.Path != "/failover/"+f.failoverIP {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":{"status":404,"code":"NOT_FOUND","message":"Not found"}}`))
+		return
+	}
+	if r.Method == http.MethodPost {
+		f.activeServerIP = r.PostForm.Get("active_server_ip")
+		if ipv6Net, ok := f.ipv6Nets[f.activeServerIP]; ok {
+			f.activeServerIP = ipv6Net
+		}
+	}
+	fmt.Fprint(w, robotFailoverJSON(f.activeServerIP))
+}
+
+// useFailoverNet switches the configurer and the fake to the IPv6 failover
+// net 2001:db8:1::/64, the fake reports the IPv6 net of the active server
+func (f *fakeRobot) useFailoverNet(t *testing.T, c *HetznerConfigurer) {
+	t.Helper()
+	c.IPConfiguration = testHetznerIPConfiguration("2001:db8:1::10")
+	c.failoverNet = netip.MustParsePrefix("2001:db8:1::/64")
+	f.failoverIP = "2001:db8:1::"
+	f.ipv6Nets = map[string]string{"10.0.0.1": "2001:db8:ff::", "10.0.0.5": "2001:db8:5::"}
+	f.activeServerIP = "2001:db8:ff::"
+}
+
+func (f *fakeRobot) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+func robotFailoverJSON(activeServerIP string) string {
+	return fmt.Sprintf(`{"failover":{"ip":"192.168.1.10","netmask":"255.255.255.255","server_ip":"10.0.0.1","server_number":12345,"active_server_ip":%q}}`, activeServerIP)
+}
+
+func robotErrorJSON(status int, code string) string {
+	return fmt.Sprintf(`{"error":{"status":%d,"code":%q,"message":"%s"}}`, status, code, code)
+}
+
 // ---------------------------------------------------------------------------
 // newHetznerConfigurer
 // ---------------------------------------------------------------------------
@@ -60,7 +177,7 @@ func TestNewHetznerConfigurer_Success(t *testing.T) {
 	setupHetznerTest(t)
 
 	cfg := testHetznerIPConfiguration("10.20.30.40")
-	c, err := newHetznerConfigurer(cfg, true)
+	c, err := newHetznerConfigurer(cfg, &vipconfig.Config{Verbose: true})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -82,14 +199,74 @@ func TestNewHetznerConfigurer_Success(t *testing.T) {
 	if c.credentialsFile != "/etc/hetzner" {
 		t.Errorf("expected default credentials file path, got %q", c.credentialsFile)
 	}
-	if c.runCommand == nil {
-		t.Error("expected runCommand to be initialized")
+	if c.baseURL != defaultHetznerRobotEndpoint {
+		t.Errorf("expected default Robot endpoint, got %q", c.baseURL)
+	}
+	if c.httpClient == nil {
+		t.Error("expected httpClient to be initialized")
 	}
 	if c.getOutboundIP == nil {
 		t.Error("expected getOutboundIP to be initialized")
 	}
 }
 
+func TestNewHetznerConfigurer_Endpoint(t *testing.T) {
+	t.Parallel()
+	setupHetznerTest(t)
+
+	c, err := newHetznerConfigurer(testHetznerIPConfiguration("10.20.30.40"),
+		&vipconfig.Config{HetznerRobotEndpoint: "http://127.0.0.1:8080/"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.baseURL != "http://127.0.0.1:8080" {
+		t.Errorf("baseURL = %q, want the configured endpoint without trailing slash", c.baseURL)
+	}
+}
+
+func TestHetznerFailoverNet(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		vip         string
+		failoverNet string
+		want        string
+		wantErr     bool
+	}{
+		{"192.0.2.10", "", "192.0.2.10/32", false},
+		{"2001:db8:1::10", "", "2001:db8:1::/64", false},
+		{"192.0.2.10", "192.0.2.8/29", "192.0.2.8/29", false},
+		{"192.0.2.10", "192.0.2.10/29", "192.0.2.8/29", false},
+		{"2001:db8:1::10", "2001:db8:1::/56", "2001:db8:1::/56", false},
+		{"192.0.2.10", "198.51.100.0/29", "", true},
+		{"192.0.2.10", "192.0.2.10", "", true},
+	}
+	for _, tt := range tests {
+		got, err := hetznerFailoverNet(netip.MustParseAddr(tt.vip), tt.failoverNet)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("hetznerFailoverNet(%s, %q) error = %v, wantErr %v", tt.vip, tt.failoverNet, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("hetznerFailoverNet(%s, %q) = %s, want %s", tt.vip, tt.failoverNet, got, tt.want)
+		}
+	}
+}
+
+func TestNewHetznerConfigurer_InvalidFailoverNet(t *testing.T) {
+	t.Parallel()
+	setupHetznerTest(t)
+
+	if _, err := newHetznerConfigurer(testHetznerIPConfiguration("192.0.2.10"),
+		&vipconfig.Config{HetznerFailoverNet: "198.51.100.0/29"}); err == nil {
+		t.Error("expected an error for a failover net not containing the VIP")
+	}
+	if _, err := newHetznerConfigurer(testHetznerIPConfiguration("192.0.2.10"),
+		&vipconfig.Config{HetznerVSwitchInterface: "does-not-exist0"}); err == nil {
+		t.Error("expected an error for a missing vSwitch interface")
+	}
+}
+
 // ---------------------------------------------------------------------------
 // getActiveIPFromJSON
 // ---------------------------------------------------------------------------
@@ -109,7 +286,7 @@ func TestHetznerConfigurer_getActiveIPFromJSON_Success(t *testing.T) {
 		}
 	}`
 
-	ip, err := c.getActiveIPFromJSON(response)
+	ip, err := c.getActiveIPFromJSON([]byte(response))
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -132,10 +309,14 @@ func TestHetznerConfigurer_getActiveIPFromJSON_ErrorResponse(t *testing.T) {
 		}
 	}`
 
-	ip, err := c.getActiveIPFromJSON(response)
+	ip, err := c.getActiveIPFromJSON([]byte(response))
 	if err == nil {
 		t.Fatal("expected error for API error response, got nil")
 	}
+	var apiErr *hetznerError
+	if !errors.As(err, &apiErr) || apiErr.Code != "UNAUTHORIZED" || apiErr.Status != 401 {
+		t.Errorf("expected a *hetznerError with code UNAUTHORIZED, got %v", err)
+	}
 	if ip != nil {
 		t.Errorf("expected nil IP, got %v", ip)
 	}
@@ -146,7 +327,7 @@ func TestHetznerConfigurer_getActiveIPFromJSON_InvalidJSON(t *testing.T) {
 	setupHetznerTest(t)
 
 	c := newTestHetznerConfigurer(t)
-	ip, err := c.getActiveIPFromJSON("not-json")
+	ip, err := c.getActiveIPFromJSON([]byte("not-json"))
 	if err == nil {
 		t.Fatal("expected error for invalid JSON, got nil")
 	}
@@ -160,7 +341,7 @@ func TestHetznerConfigurer_getActiveIPFromJSON_UnexpectedStructure(t *testing.T)
 	setupHetznerTest(t)
 
 	c := newTestHetznerConfigurer(t)
-	ip, err := c.getActiveIPFromJSON(`{"unknown": "value"}`)
+	ip, err := c.getActiveIPFromJSON([]byte(`{"unknown": "value"}`))
 	if err == nil {
 		t.Fatal("expected error for unexpected JSON structure, got nil")
 	}
@@ -169,157 +350,337 @@ func TestHetznerConfigurer_getActiveIPFromJSON_UnexpectedStructure(t *testing.T)
 	}
 }
 
+func TestHetznerConfigurer_getActiveIPFromJSON_MissingFields(t *testing.T) {
+	t.Parallel()
+	setupHetznerTest(t)
+
+	c := newTestHetznerConfigurer(t)
+
+	tests := []struct {
+		name     string
+		response string
+	}{
+		{
+			name: "missing active_server_ip",
+			response: `{
+				"failover": {
+					"ip": "192.168.1.10",
+					"netmask": "255.255.255.255",
+					"server_ip": "10.0.0.1",
+					"server_number": 12345
+				}
+			}`,
+		},
+		{
+			name: "active_server_ip is null",
+			response: `{
+				"failover": {
+					"ip": "192.168.1.10",
+					"active_server_ip": null
+				}
+			}`,
+		},
+		{
+			name: "active_server_ip is not a string",
+			response: `{
+				"failover": {
+					"ip": "192.168.1.10",
+					"netmask": "255.255.255.255",
+					"server_ip": "10.0.0.1",
+					"server_number": 12345,
+					"active_server_ip": 12345
+				}
+			}`,
+		},
+		{
+			name: "active_server_ip is not an address",
+			response: `{
+				"failover": {
+					"ip": "192.168.1.10",
+					"active_server_ip": "somewhere"
+				}
+			}`,
+		},
+		{
+			name: "failover is not an object",
+			response: `{
+				"failover": "not an object"
+			}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, err := c.getActiveIPFromJSON([]byte(tt.response))
+			if err == nil {
+				t.Errorf("expected an error, got %v", ip)
+			}
+		})
+	}
+}
+
 // ---------------------------------------------------------------------------
-// curlQueryFailover
+// readHetznerCredentials
 // ---------------------------------------------------------------------------
 
-type recordedCommand struct {
-	name string
-	args []string
+func TestReadHetznerCredentials(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		content  string
+		user     string
+		password string
+		wantErr  bool
+	}{
+		{"quoted", "user=\"testuser\"\npass=\"testpass\"\n", "testuser", "testpass", false},
+		{"unquoted", "user=testuser\npass=testpass", "testuser", "testpass", false},
+		{"single quotes and spaces", "  user = 'testuser'\n\tpass= 'test pass'  \n", "testuser", "test pass", false},
+		{"escaped quote", "user=\"testuser\"\npass=\"te\\\"st\"\n", "testuser", "te\"st", false},
+		{"equals sign in password", "user=\"testuser\"\npass=\"a=b\"\n", "testuser", "a=b", false},
+		{"comments and short lines", "# robot credentials\nusr\n\nuser=\"testuser\"\npass=\"testpass\"\n", "testuser", "testpass", false},
+		{"missing password", "user=\"onlyuser\"\n", "", "", true},
+		{"only short lines", "usr\nps\n", "", "", true},
+		{"empty values", "user=\"\"\npass=\"\"\n", "", "", true},
+		{"malformed", "user=\"\npass=\"\n", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "hetzner")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatalf("failed to write credentials file: %v", err)
+			}
+			user, password, err := readHetznerCredentials(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readHetznerCredentials() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if user != tt.user || password != tt.password {
+				t.Errorf("readHetznerCredentials() = %q, %q, want %q, %q", user, password, tt.user, tt.password)
+			}
+		})
+	}
 }
 
-func TestHetznerConfigurer_curlQueryFailover_GET(t *testing.T) {
+func TestReadHetznerCredentials_MissingFile(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
 
-	dir := t.TempDir()
-	credPath := writeHetznerCredentialsFile(t, dir, "testuser", "testpass")
+	if _, _, err := readHetznerCredentials(filepath.Join(t.TempDir(), "does-not-exist")); err == nil {
+		t.Fatal("expected error for missing credentials file, got nil")
+	}
+}
 
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = credPath
+// ---------------------------------------------------------------------------
+// queryFailover
+// ---------------------------------------------------------------------------
 
-	var recorded recordedCommand
-	c.runCommand = func(name string, arg ...string) ([]byte, error) {
-		recorded = recordedCommand{name: name, args: arg}
-		return []byte(`{"failover":{"ip":"192.168.1.10","netmask":"255.255.255.255","server_ip":"10.0.0.1","server_number":12345,"active_server_ip":"10.0.0.1"}}`), nil
-	}
+func TestHetznerConfigurer_queryFailover_GET(t *testing.T) {
+	t.Parallel()
+	c, robot := newHetznerTestSetup(t)
 
-	resp, err := c.curlQueryFailover(false)
+	ip, err := c.queryFailover(false)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if resp == "" {
-		t.Error("expected non-empty response")
+	if !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("queryFailover() = %v, want 10.0.0.1", ip)
 	}
 
-	if recorded.name != "curl" {
-		t.Errorf("expected command curl, got %q", recorded.name)
-	}
-	wantArgs := []string{
-		"--ipv4",
-		"-u", "testuser:testpass",
-		"https://robot-ws.your-server.de/failover/192.168.1.10",
-	}
-	if !slices.Equal(recorded.args, wantArgs) {
-		t.Errorf("curl args = %v, want %v", recorded.args, wantArgs)
+	want := fakeRobotRequest{method: http.MethodGet, path: "/failover/192.168.1.10", user: "testuser", password: "testpass"}
+	if len(robot.requests) != 1 || robot.requests[0] != want {
+		t.Errorf("requests = %+v, want [%+v]", robot.requests, want)
 	}
 }
 
-func TestHetznerConfigurer_curlQueryFailover_POST(t *testing.T) {
+func TestHetznerConfigurer_queryFailover_POST(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
-
-	dir := t.TempDir()
-	credPath := writeHetznerCredentialsFile(t, dir, "testuser", "testpass")
+	c, robot := newHetznerTestSetup(t)
 
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = credPath
-	c.getOutboundIP = func() (net.IP, error) {
-		return net.ParseIP("10.0.0.5"), nil
+	ip, err := c.queryFailover(true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("queryFailover() = %v, want 10.0.0.5", ip)
 	}
 
-	var recorded recordedCommand
-	c.runCommand = func(name string, arg ...string) ([]byte, error) {
-		recorded = recordedCommand{name: name, args: arg}
-		return []byte(`{"failover":{"ip":"192.168.1.10","netmask":"255.255.255.255","server_ip":"10.0.0.1","server_number":12345,"active_server_ip":"10.0.0.5"}}`), nil
+	want := fakeRobotRequest{method: http.MethodPost, path: "/failover/192.168.1.10", user: "testuser", password: "testpass", activeServerIP: "10.0.0.5"}
+	if len(robot.requests) != 1 || robot.requests[0] != want {
+		t.Errorf("requests = %+v, want [%+v]", robot.requests, want)
 	}
+}
 
-	resp, err := c.curlQueryFailover(true)
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+func TestHetznerConfigurer_queryFailover_MissingCredentialsFile(t *testing.T) {
+	t.Parallel()
+	c, robot := newHetznerTestSetup(t)
+	c.credentialsFile = filepath.Join(t.TempDir(), "does-not-exist")
+
+	if _, err := c.queryFailover(false); err == nil {
+		t.Fatal("expected error for missing credentials file, got nil")
 	}
-	if resp == "" {
-		t.Error("expected non-empty response")
+	if robot.requestCount() != 0 {
+		t.Error("expected no request without credentials")
 	}
+}
 
-	wantArgs := []string{
-		"--ipv4",
-		"-u", "testuser:testpass",
-		"https://robot-ws.your-server.de/failover/192.168.1.10",
-		"-d", "active_server_ip=10.0.0.5",
+func TestHetznerConfigurer_queryFailover_OutboundIPError(t *testing.T) {
+	t.Parallel()
+	c, _ := newHetznerTestSetup(t)
+	c.getOutboundIP = func() (net.IP, error) {
+		return nil, errors.New("no outbound IP")
 	}
-	if !slices.Equal(recorded.args, wantArgs) {
-		t.Errorf("curl args = %v, want %v", recorded.args, wantArgs)
+
+	if _, err := c.queryFailover(true); err == nil {
+		t.Fatal("expected error when outbound IP lookup fails, got nil")
 	}
 }
 
-func TestHetznerConfigurer_curlQueryFailover_MissingCredentialsFile(t *testing.T) {
+func TestHetznerConfigurer_queryFailover_Unauthorized(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
+	c, _ := newHetznerTestSetup(t)
+	c.credentialsFile = writeHetznerCredentialsFile(t, t.TempDir(), "testuser", "wrong")
 
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = filepath.Join(t.TempDir(), "does-not-exist")
+	_, err := c.queryFailover(false)
+	var apiErr *hetznerError
+	if !errors.As(err, &apiErr) || apiErr.Code != "UNAUTHORIZED" {
+		t.Fatalf("expected UNAUTHORIZED error, got %v", err)
+	}
+}
 
-	_, err := c.curlQueryFailover(false)
-	if err == nil {
-		t.Fatal("expected error for missing credentials file, got nil")
+func TestHetznerConfigurer_queryFailover_ServerError(t *testing.T) {
+	t.Parallel()
+	c, robot := newHetznerTestSetup(t)
+	robot.queued = []fakeRobotResponse{{status: http.StatusBadGateway, body: "<html>bad gateway</html>"}}
+
+	if _, err := c.queryFailover(false); err == nil {
+		t.Fatal("expected error for a non-JSON error page, got nil")
 	}
 }
 
-func TestHetznerConfigurer_curlQueryFailover_MissingUserOrPass(t *testing.T) {
+func TestHetznerConfigurer_queryFailover_Unreachable(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
+	c, robot := newHetznerTestSetup(t)
+	robot.Close()
 
-	dir := t.TempDir()
-	path := filepath.Join(dir, "hetzner")
-	if err := os.WriteFile(path, []byte("user=\"onlyuser\"\n"), 0o600); err != nil {
-		t.Fatalf("failed to write credentials file: %v", err)
+	if _, err := c.queryFailover(false); err == nil {
+		t.Fatal("expected error when the API is unreachable, got nil")
 	}
+}
 
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = path
+func TestHetznerConfigurer_queryFailover_RateLimited(t *testing.T) {
+	t.Parallel()
+	c, robot := newHetznerTestSetup(t)
+	robot.queued = []fakeRobotResponse{
+		{status: http.StatusTooManyRequests, body: robotErrorJSON(429, "RATE_LIMIT_EXCEEDED")},
+		{status: http.StatusConflict, body: robotErrorJSON(409, "FAILOVER_LOCKED")},
+	}
 
-	_, err := c.curlQueryFailover(false)
-	if err == nil {
-		t.Fatal("expected error when password is missing, got nil")
+	ip, err := c.queryFailover(true)
+	if err != nil {
+		t.Fatalf("expected the request to succeed after backing off, got %v", err)
+	}
+	if !ip.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("queryFailover() = %v, want 10.0.0.5", ip)
+	}
+	if robot.requestCount() != 3 {
+		t.Errorf("expected 3 requests, got %d", robot.requestCount())
 	}
 }
 
-func TestHetznerConfigurer_curlQueryFailover_OutboundIPError(t *testing.T) {
+// TestHetznerConfigurer_queryFailover_RetryWithoutRobotError covers a rate
+// limit and a conflict answered without a Robot error, e.g. by a proxy
+func TestHetznerConfigurer_queryFailover_RetryWithoutRobotError(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
+	c, robot := newHetznerTestSetup(t)
+	robot.queued = []fakeRobotResponse{
+		{status: http.StatusTooManyRequests, body: "Too Many Requests"},
+		{status: http.StatusConflict, body: "<html>Conflict</html>"},
+	}
 
-	dir := t.TempDir()
-	credPath := writeHetznerCredentialsFile(t, dir, "testuser", "testpass")
+	ip, err := c.queryFailover(true)
+	if err != nil {
+		t.Fatalf("expected the request to succeed after backing off, got %v", err)
+	}
+	if !ip.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("queryFailover() = %v, want 10.0.0.5", ip)
+	}
+	if robot.requestCount() != 3 {
+		t.Errorf("expected 3 requests, got %d", robot.requestCount())
+	}
+}
 
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = credPath
-	c.getOutboundIP = func() (net.IP, error) {
-		return nil, errors.New("no outbound IP")
+func TestHetznerConfigurer_queryFailover_RateLimitExhausted(t *testing.T) {
+	t.Parallel()
+	c, robot := newHetznerTestSetup(t)
+	for range 5 {
+		robot.queued = append(robot.queued, fakeRobotResponse{status: http.StatusTooManyRequests, body: robotErrorJSON(429, "RATE_LIMIT_EXCEEDED")})
 	}
 
-	_, err := c.curlQueryFailover(true)
-	if err == nil {
-		t.Fatal("expected error when outbound IP lookup fails, got nil")
+	if _, err := c.queryFailover(false); err == nil {
+		t.Fatal("expected error after retry-num rate limited responses, got nil")
+	}
+	if robot.requestCount() != c.RetryNum {
+		t.Errorf("expected %d requests, got %d", c.RetryNum, robot.requestCount())
 	}
 }
 
-func TestHetznerConfigurer_curlQueryFailover_CommandError(t *testing.T) {
+func TestHetznerConfigurer_queryFailover_AlreadyRouted(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
+	c, robot := newHetznerTestSetup(t)
+	robot.activeServerIP = "10.0.0.5"
+	robot.queued = []fakeRobotResponse{{status: http.StatusConflict, body: robotErrorJSON(409, "FAILOVER_ALREADY_ROUTED")}}
 
-	dir := t.TempDir()
-	credPath := writeHetznerCredentialsFile(t, dir, "testuser", "testpass")
+	ip, err := c.queryFailover(true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("queryFailover() = %v, want 10.0.0.5", ip)
+	}
+	if len(robot.requests) != 2 || robot.requests[1].method != http.MethodGet {
+		t.Errorf("expected the routing to be queried after FAILOVER_ALREADY_ROUTED, got %+v", robot.requests)
+	}
+}
+
+func TestHetznerConfigurer_backoff(t *testing.T) {
+	t.Parallel()
 
 	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = credPath
-	c.runCommand = func(string, ...string) ([]byte, error) {
-		return nil, errors.New("curl failed")
+	c.RetryAfter = 250
+
+	resp := &http.Response{Header: http.Header{}}
+	for attempt, want := range []time.Duration{250 * time.Millisecond, 500 * time.Millisecond, time.Second} {
+		if got := c.backoff(resp, attempt); got != want {
+			t.Errorf("backoff(attempt %d) = %s, want %s", attempt, got, want)
+		}
 	}
+	resp.Header.Set("Retry-After", "7")
+	if got := c.backoff(resp, 0); got != 7*time.Second {
+		t.Errorf("backoff() = %s, want the Retry-After header of 7s", got)
+	}
+}
 
-	_, err := c.curlQueryFailover(false)
-	if err == nil {
-		t.Fatal("expected error when curl fails, got nil")
+func TestNewIPv4HTTPClient_RefusesIPv6(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.Listener = l
+	server.Start()
+	defer server.Close()
+
+	if resp, err := http.Get(server.URL); err == nil {
+		resp.Body.Close()
+	} else {
+		t.Skipf("IPv6 loopback not usable: %v", err)
+	}
+	if resp, err := newIPv4HTTPClient().Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Error("expected the IPv4 only client to refuse an IPv6 address")
 	}
 }
 
@@ -329,66 +690,38 @@ func TestHetznerConfigurer_curlQueryFailover_CommandError(t *testing.T) {
 
 func TestHetznerConfigurer_queryAddress_CachedConfigured(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
-
-	c := newTestHetznerConfigurer(t)
+	c, robot := newHetznerTestSetup(t)
 	c.cachedState = configured
 	c.lastAPICheck = time.Now()
 
-	called := false
-	c.runCommand = func(string, ...string) ([]byte, error) {
-		called = true
-		return nil, nil
-	}
-
 	if got := c.queryAddress(); !got {
 		t.Errorf("queryAddress() = %v, want true for cached configured state", got)
 	}
-	if called {
-		t.Error("expected queryAddress to use cached state without calling curl")
+	if robot.requestCount() != 0 {
+		t.Error("expected queryAddress to use cached state without calling the API")
 	}
 }
 
 func TestHetznerConfigurer_queryAddress_CachedReleased(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
-
-	c := newTestHetznerConfigurer(t)
+	c, robot := newHetznerTestSetup(t)
 	c.cachedState = released
 	c.lastAPICheck = time.Now()
 
-	called := false
-	c.runCommand = func(string, ...string) ([]byte, error) {
-		called = true
-		return nil, nil
-	}
-
 	if got := c.queryAddress(); got {
 		t.Errorf("queryAddress() = %v, want false for cached released state", got)
 	}
-	if called {
-		t.Error("expected queryAddress to use cached state without calling curl")
+	if robot.requestCount() != 0 {
+		t.Error("expected queryAddress to use cached state without calling the API")
 	}
 }
 
 func TestHetznerConfigurer_queryAddress_ExpiredCache_MatchesOwnIP(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
-
-	dir := t.TempDir()
-	credPath := writeHetznerCredentialsFile(t, dir, "testuser", "testpass")
-
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = credPath
+	c, robot := newHetznerTestSetup(t)
 	c.lastAPICheck = time.Now().Add(-2 * time.Hour)
 	c.cachedState = unknown
-
-	c.getOutboundIP = func() (net.IP, error) {
-		return net.ParseIP("10.0.0.5"), nil
-	}
-	c.runCommand = func(string, ...string) ([]byte, error) {
-		return []byte(`{"failover":{"ip":"192.168.1.10","netmask":"255.255.255.255","server_ip":"10.0.0.1","server_number":12345,"active_server_ip":"10.0.0.5"}}`), nil
-	}
+	robot.activeServerIP = "10.0.0.5"
 
 	if got := c.queryAddress(); !got {
 		t.Errorf("queryAddress() = %v, want true when failover points to this machine", got)
@@ -400,22 +733,10 @@ func TestHetznerConfigurer_queryAddress_ExpiredCache_MatchesOwnIP(t *testing.T)
 
 func TestHetznerConfigurer_queryAddress_ExpiredCache_DifferentIP(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
-
-	dir := t.TempDir()
-	credPath := writeHetznerCredentialsFile(t, dir, "testuser", "testpass")
-
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = credPath
+	c, robot := newHetznerTestSetup(t)
 	c.lastAPICheck = time.Now().Add(-2 * time.Hour)
 	c.cachedState = unknown
-
-	c.getOutboundIP = func() (net.IP, error) {
-		return net.ParseIP("10.0.0.5"), nil
-	}
-	c.runCommand = func(string, ...string) ([]byte, error) {
-		return []byte(`{"failover":{"ip":"192.168.1.10","netmask":"255.255.255.255","server_ip":"10.0.0.1","server_number":12345,"active_server_ip":"10.0.0.9"}}`), nil
-	}
+	robot.activeServerIP = "10.0.0.9"
 
 	if got := c.queryAddress(); got {
 		t.Errorf("queryAddress() = %v, want false when failover points elsewhere", got)
@@ -425,385 +746,282 @@ func TestHetznerConfigurer_queryAddress_ExpiredCache_DifferentIP(t *testing.T) {
 	}
 }
 
-func TestHetznerConfigurer_queryAddress_CurlError(t *testing.T) {
+func TestHetznerConfigurer_queryAddress_APIError(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
-
-	dir := t.TempDir()
-	credPath := writeHetznerCredentialsFile(t, dir, "testuser", "testpass")
-
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = credPath
+	c, robot := newHetznerTestSetup(t)
 	c.lastAPICheck = time.Now().Add(-2 * time.Hour)
-
-	c.getOutboundIP = func() (net.IP, error) {
-		return net.ParseIP("10.0.0.5"), nil
-	}
-	c.runCommand = func(string, ...string) ([]byte, error) {
-		return nil, errors.New("curl failed")
-	}
+	robot.queued = []fakeRobotResponse{{status: http.StatusInternalServerError, body: robotErrorJSON(500, "INTERNAL_ERROR")}}
 
 	if got := c.queryAddress(); got {
-		t.Errorf("queryAddress() = %v, want false when curl fails", got)
+		t.Errorf("queryAddress() = %v, want false when the API fails", got)
+	}
+	if c.cachedState != unknown {
+		t.Errorf("cachedState = %d, want unknown", c.cachedState)
 	}
 }
 
 func TestHetznerConfigurer_queryAddress_OutboundIPError(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
-
-	dir := t.TempDir()
-	credPath := writeHetznerCredentialsFile(t, dir, "testuser", "testpass")
-
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = credPath
+	c, robot := newHetznerTestSetup(t)
 	c.lastAPICheck = time.Now().Add(-2 * time.Hour)
-
+	robot.activeServerIP = "10.0.0.5"
 	c.getOutboundIP = func() (net.IP, error) {
 		return nil, errors.New("no outbound IP")
 	}
-	c.runCommand = func(string, ...string) ([]byte, error) {
-		return []byte(`{"failover":{"ip":"192.168.1.10","netmask":"255.255.255.255","server_ip":"10.0.0.1","server_number":12345,"active_server_ip":"10.0.0.5"}}`), nil
-	}
 
 	if got := c.queryAddress(); got {
 		t.Errorf("queryAddress() = %v, want false when outbound IP lookup fails", got)
 	}
 }
 
-// ---------------------------------------------------------------------------
-// configureAddress / runAddressConfiguration
-// ---------------------------------------------------------------------------
-
-func TestHetznerConfigurer_configureAddress_Success(t *testing.T) {
+func TestHetznerConfigurer_queryAddress_ParseJSONError(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
-
-	dir := t.TempDir()
-	credPath := writeHetznerCredentialsFile(t, dir, "testuser", "testpass")
-
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = credPath
+	c, robot := newHetznerTestSetup(t)
+	c.lastAPICheck = time.Now().Add(-2 * time.Hour)
+	robot.queued = []fakeRobotResponse{{status: http.StatusOK, body: "invalid json"}}
 
-	c.getOutboundIP = func() (net.IP, error) {
-		return net.ParseIP("10.0.0.5"), nil
+	if got := c.queryAddress(); got {
+		t.Errorf("queryAddress() = %v, want false when JSON parsing fails", got)
 	}
-	c.runCommand = func(string, ...string) ([]byte, error) {
-		return []byte(`{"failover":{"ip":"192.168.1.10","netmask":"255.255.255.255","server_ip":"10.0.0.1","server_number":12345,"active_server_ip":"10.0.0.5"}}`), nil
+	if c.cachedState != unknown {
+		t.Errorf("cachedState = %d, want unknown after JSON parse error", c.cachedState)
 	}
+}
 
-	if got := c.configureAddress(); !got {
-		t.Errorf("configureAddress() = %v, want true on successful failover", got)
-	}
-	if c.cachedState != configured {
-		t.Errorf("cachedState = %d, want configured", c.cachedState)
+func TestHetznerConfigurer_queryAddress_UnexpectedStructure(t *testing.T) {
+	t.Parallel()
+	c, robot := newHetznerTestSetup(t)
+	c.lastAPICheck = time.Now().Add(-2 * time.Hour)
+	robot.queued = []fakeRobotResponse{{status: http.StatusOK, body: `{"unexpected": "structure"}`}}
+
+	if got := c.queryAddress(); got {
+		t.Errorf("queryAddress() = %v, want false when JSON structure is unexpected", got)
 	}
 }
 
-func TestHetznerConfigurer_configureAddress_CurlError(t *testing.T) {
+func TestHetznerConfigurer_queryAddress_FailoverNet(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
-
-	dir := t.TempDir()
-	credPath := writeHetznerCredentialsFile(t, dir, "testuser", "testpass")
+	c, robot := newHetznerTestSetup(t)
+	robot.useFailoverNet(t, c)
 
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = credPath
-	c.runCommand = func(string, ...string) ([]byte, error) {
-		return nil, errors.New("curl failed")
+	if got := c.queryAddress(); got {
+		t.Errorf("queryAddress() = %v, want false when the net is routed to another server", got)
 	}
-
-	if got := c.configureAddress(); got {
-		t.Errorf("configureAddress() = %v, want false when curl fails", got)
+	if len(robot.requests) != 1 || robot.requests[0].path != "/failover/2001:db8:1::" {
+		t.Errorf("expected the failover net to be queried, got %+v", robot.requests)
 	}
-	if c.cachedState != unknown {
-		t.Errorf("cachedState = %d, want unknown", c.cachedState)
+
+	robot.activeServerIP = "2001:db8:5::"
+	c.cachedState = unknown
+	if got := c.queryAddress(); !got {
+		t.Errorf("queryAddress() = %v, want true when the net is routed to our IPv6 net", got)
 	}
 }
 
-func TestHetznerConfigurer_configureAddress_DifferentIP(t *testing.T) {
+func TestHetznerConfigurer_isOwnServer_LocalAddrsError(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
-
-	dir := t.TempDir()
-	credPath := writeHetznerCredentialsFile(t, dir, "testuser", "testpass")
-
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = credPath
-	c.getOutboundIP = func() (net.IP, error) {
-		return net.ParseIP("10.0.0.5"), nil
-	}
-	c.runCommand = func(string, ...string) ([]byte, error) {
-		return []byte(`{"failover":{"ip":"192.168.1.10","netmask":"255.255.255.255","server_ip":"10.0.0.1","server_number":12345,"active_server_ip":"10.0.0.9"}}`), nil
+	c, _ := newHetznerTestSetup(t)
+	c.getLocalAddrs = func() ([]net.Addr, error) {
+		return nil, errors.New("no addresses")
 	}
 
-	if got := c.configureAddress(); got {
-		t.Errorf("configureAddress() = %v, want false when API reports different active IP", got)
+	if _, err := c.isOwnServer(net.ParseIP("2001:db8:5::"), net.ParseIP("10.0.0.5")); err == nil {
+		t.Error("expected an error when the local addresses can't be listed")
 	}
-	if c.cachedState != unknown {
-		t.Errorf("cachedState = %d, want unknown", c.cachedState)
+	if own, err := c.isOwnServer(net.ParseIP("10.0.0.5"), net.ParseIP("10.0.0.5")); err != nil || !own {
+		t.Errorf("isOwnServer() = %v, %v, want true without listing local addresses", own, err)
 	}
 }
 
-func TestHetznerConfigurer_configureAddress_OutboundIPError(t *testing.T) {
+func TestHetznerConfigurer_queryAddress_VSwitch(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
-
-	dir := t.TempDir()
-	credPath := writeHetznerCredentialsFile(t, dir, "testuser", "testpass")
+	c, robot := newHetznerTestSetup(t)
+	local := &mockConfigurer{shouldQueryReturn: false}
+	c.local = local
+	robot.activeServerIP = "10.0.0.5"
 
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = credPath
-	c.getOutboundIP = func() (net.IP, error) {
-		return nil, errors.New("no outbound IP")
+	if got := c.queryAddress(); got {
+		t.Errorf("queryAddress() = %v, want false without the VIP on the vSwitch interface", got)
 	}
-	c.runCommand = func(string, ...string) ([]byte, error) {
-		return []byte(`{"failover":{"ip":"192.168.1.10","netmask":"255.255.255.255","server_ip":"10.0.0.1","server_number":12345,"active_server_ip":"10.0.0.5"}}`), nil
+	if robot.requestCount() != 0 {
+		t.Error("expected no API request without the VIP on the vSwitch interface")
 	}
 
-	if got := c.configureAddress(); got {
-		t.Errorf("configureAddress() = %v, want false when outbound IP lookup fails", got)
+	local.shouldQueryReturn = true
+	if got := c.queryAddress(); !got {
+		t.Errorf("queryAddress() = %v, want true", got)
 	}
 }
 
-// ---------------------------------------------------------------------------
-// deconfigureAddress
-// ---------------------------------------------------------------------------
-
-func TestHetznerConfigurer_deconfigureAddress(t *testing.T) {
+// TestHetznerConfigurer_VSwitch_RoutedElsewhere covers the old leader after
+// the new one has routed the failover IP to its own server
+func TestHetznerConfigurer_VSwitch_RoutedElsewhere(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
-
-	c := newTestHetznerConfigurer(t)
-	c.cachedState = configured
+	c, robot := newHetznerTestSetup(t)
+	local := mockLocal(&c.local)
+	robot.activeServerIP = "10.0.0.9"
 
-	if got := c.deconfigureAddress(); !got {
-		t.Errorf("deconfigureAddress() = %v, want true", got)
+	if got := c.queryAddress(); got {
+		t.Fatalf("queryAddress() = %v, want false when failover points elsewhere", got)
 	}
-	if c.cachedState != released {
-		t.Errorf("cachedState = %d, want released", c.cachedState)
+	if !c.queryLocalAddress() {
+		t.Fatal("queryLocalAddress() = false while the address is configured on the vSwitch interface")
+	}
+	runApplyLoop(c, false)
+	if local.deconfigureCount == 0 {
+		t.Error("expected the address to be removed from the vSwitch interface")
 	}
 }
 
 // ---------------------------------------------------------------------------
-// Additional error path tests
+// configureAddress / runAddressConfiguration
 // ---------------------------------------------------------------------------
 
-func TestHetznerConfigurer_curlQueryFailover_ShortLine(t *testing.T) {
+func TestHetznerConfigurer_configureAddress_Success(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
+	c, robot := newHetznerTestSetup(t)
 
-	dir := t.TempDir()
-	path := filepath.Join(dir, "hetzner")
-	// Write a line that's too short (< 4 chars) which should be skipped
-	if err := os.WriteFile(path, []byte("usr\nuser=\"testuser\"\npass=\"testpass\"\n"), 0o600); err != nil {
-		t.Fatalf("failed to write credentials file: %v", err)
+	if got := c.configureAddress(); !got {
+		t.Errorf("configureAddress() = %v, want true on successful failover", got)
 	}
-
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = path
-	c.runCommand = func(string, ...string) ([]byte, error) {
-		return []byte(`{"failover":{"ip":"192.168.1.10","netmask":"255.255.255.255","server_ip":"10.0.0.1","server_number":12345,"active_server_ip":"10.0.0.1"}}`), nil
+	if c.cachedState != configured {
+		t.Errorf("cachedState = %d, want configured", c.cachedState)
 	}
-
-	// Should succeed - short lines are skipped
-	_, err := c.curlQueryFailover(false)
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+	if robot.activeServerIP != "10.0.0.5" {
+		t.Errorf("failover-ip is routed to %s, want 10.0.0.5", robot.activeServerIP)
 	}
 }
 
-func TestHetznerConfigurer_curlQueryFailover_OnlyShortLines(t *testing.T) {
+func TestHetznerConfigurer_configureAddress_APIError(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
+	c, robot := newHetznerTestSetup(t)
+	robot.queued = []fakeRobotResponse{{status: http.StatusNotFound, body: robotErrorJSON(404, "NOT_FOUND")}}
 
-	dir := t.TempDir()
-	path := filepath.Join(dir, "hetzner")
-	// Write only short lines - no valid credentials
-	if err := os.WriteFile(path, []byte("usr\nps\n"), 0o600); err != nil {
-		t.Fatalf("failed to write credentials file: %v", err)
+	if got := c.configureAddress(); got {
+		t.Errorf("configureAddress() = %v, want false when the API fails", got)
 	}
-
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = path
-
-	_, err := c.curlQueryFailover(false)
-	if err == nil {
-		t.Fatal("expected error when no valid credentials found, got nil")
+	if c.cachedState != unknown {
+		t.Errorf("cachedState = %d, want unknown", c.cachedState)
 	}
 }
 
-func TestHetznerConfigurer_curlQueryFailover_MalformedCredentials(t *testing.T) {
+func TestHetznerConfigurer_configureAddress_DifferentIP(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
+	c, robot := newHetznerTestSetup(t)
+	robot.queued = []fakeRobotResponse{{status: http.StatusOK, body: robotFailoverJSON("10.0.0.9")}}
 
-	dir := t.TempDir()
-	path := filepath.Join(dir, "hetzner")
-	// Write credentials that match the prefix but are too short to extract values
-	if err := os.WriteFile(path, []byte("user=\"\npass=\"\n"), 0o600); err != nil {
-		t.Fatalf("failed to write credentials file: %v", err)
+	if got := c.configureAddress(); got {
+		t.Errorf("configureAddress() = %v, want false when API reports different active IP", got)
 	}
-
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = path
-
-	_, err := c.curlQueryFailover(false)
-	if err == nil {
-		t.Fatal("expected error when credentials are empty, got nil")
+	if c.cachedState != unknown {
+		t.Errorf("cachedState = %d, want unknown", c.cachedState)
 	}
 }
 
-func TestHetznerConfigurer_queryAddress_ParseJSONError(t *testing.T) {
+func TestHetznerConfigurer_configureAddress_OutboundIPError(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
-
-	dir := t.TempDir()
-	credPath := writeHetznerCredentialsFile(t, dir, "testuser", "testpass")
-
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = credPath
-	c.lastAPICheck = time.Now().Add(-2 * time.Hour)
-
+	c, robot := newHetznerTestSetup(t)
 	c.getOutboundIP = func() (net.IP, error) {
-		return net.ParseIP("10.0.0.5"), nil
-	}
-	c.runCommand = func(string, ...string) ([]byte, error) {
-		return []byte(`invalid json`), nil
+		return nil, errors.New("no outbound IP")
 	}
 
-	if got := c.queryAddress(); got {
-		t.Errorf("queryAddress() = %v, want false when JSON parsing fails", got)
+	if got := c.configureAddress(); got {
+		t.Errorf("configureAddress() = %v, want false when outbound IP lookup fails", got)
 	}
-	// After the fix, queryAddress should return false early on JSON parse error
-	if c.cachedState != unknown {
-		t.Errorf("cachedState = %d, want unknown after JSON parse error", c.cachedState)
+	if robot.requestCount() != 0 {
+		t.Error("expected no failover to be requested without own IP")
 	}
 }
 
-func TestHetznerConfigurer_queryAddress_BothErrorsOccur(t *testing.T) {
+func TestHetznerConfigurer_configureAddress_JSONParseError(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
-
-	dir := t.TempDir()
-	credPath := writeHetznerCredentialsFile(t, dir, "testuser", "testpass")
-
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = credPath
-	c.lastAPICheck = time.Now().Add(-2 * time.Hour)
-
-	// Both curl and JSON parsing will fail
-	c.runCommand = func(string, ...string) ([]byte, error) {
-		return nil, errors.New("curl failed")
-	}
+	c, robot := newHetznerTestSetup(t)
+	robot.queued = []fakeRobotResponse{{status: http.StatusOK, body: "{invalid json}"}}
 
-	if got := c.queryAddress(); got {
-		t.Errorf("queryAddress() = %v, want false when curl fails", got)
+	if got := c.configureAddress(); got {
+		t.Errorf("configureAddress() = %v, want false when JSON parse fails", got)
 	}
 	if c.cachedState != unknown {
 		t.Errorf("cachedState = %d, want unknown", c.cachedState)
 	}
 }
 
-func TestHetznerConfigurer_configureAddress_JSONParseError(t *testing.T) {
+func TestHetznerConfigurer_configureAddress_FailoverNet(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
+	c, robot := newHetznerTestSetup(t)
+	robot.useFailoverNet(t, c)
 
-	dir := t.TempDir()
-	credPath := writeHetznerCredentialsFile(t, dir, "testuser", "testpass")
-
-	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = credPath
-	c.getOutboundIP = func() (net.IP, error) {
-		return net.ParseIP("10.0.0.5"), nil
+	if got := c.configureAddress(); !got {
+		t.Errorf("configureAddress() = %v, want true on successful failover", got)
 	}
-	c.runCommand = func(string, ...string) ([]byte, error) {
-		return []byte(`{invalid json}`), nil
+	if robot.activeServerIP != "2001:db8:5::" {
+		t.Errorf("failover net is routed to %s, want 2001:db8:5::", robot.activeServerIP)
 	}
-
-	if got := c.configureAddress(); got {
-		t.Errorf("configureAddress() = %v, want false when JSON parse fails", got)
-	}
-	if c.cachedState != unknown {
-		t.Errorf("cachedState = %d, want unknown", c.cachedState)
+	want := fakeRobotRequest{method: http.MethodPost, path: "/failover/2001:db8:1::", user: "testuser", password: "testpass", activeServerIP: "10.0.0.5"}
+	if len(robot.requests) != 1 || robot.requests[0] != want {
+		t.Errorf("requests = %+v, want [%+v]", robot.requests, want)
 	}
 }
 
-func TestHetznerConfigurer_getActiveIPFromJSON_MissingFields(t *testing.T) {
+func TestHetznerConfigurer_configureAddress_VSwitch(t *testing.T) {
 	t.Parallel()
-	setupHetznerTest(t)
+	c, robot := newHetznerTestSetup(t)
+	local := &mockConfigurer{}
+	c.local = local
+	robot.queued = []fakeRobotResponse{{status: http.StatusNotFound, body: robotErrorJSON(404, "NOT_FOUND")}}
 
-	c := newTestHetznerConfigurer(t)
+	if c.configureAddress() {
+		t.Error("configureAddress() should fail when the API fails")
+	}
+	if local.configureCount != 0 {
+		t.Error("expected the VIP not to be added on the vSwitch interface before it is routed")
+	}
 
-	tests := []struct {
-		name     string
-		response string
-	}{
-		{
-			name: "missing active_server_ip",
-			response: `{
-				"failover": {
-					"ip": "192.168.1.10",
-					"netmask": "255.255.255.255",
-					"server_ip": "10.0.0.1",
-					"server_number": 12345
-				}
-			}`,
-		},
-		{
-			name: "active_server_ip is not a string",
-			response: `{
-				"failover": {
-					"ip": "192.168.1.10",
-					"netmask": "255.255.255.255",
-					"server_ip": "10.0.0.1",
-					"server_number": 12345,
-					"active_server_ip": 12345
-				}
-			}`,
-		},
-		{
-			name: "failover is not an object",
-			response: `{
-				"failover": "not an object"
-			}`,
-		},
+	if !c.configureAddress() {
+		t.Error("configureAddress() = false, want true")
+	}
+	if local.configureCount != 1 {
+		t.Errorf("expected the VIP to be added on the vSwitch interface once, got %d", local.configureCount)
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			// This will panic with current implementation due to type assertions
-			// We're testing that the panic is caught or the function handles it
-			defer func() {
-				if r := recover(); r == nil {
-					t.Error("expected panic for type assertion but got none")
-				}
-			}()
-			_, _ = c.getActiveIPFromJSON(tt.response)
-		})
+	local.shouldConfigureFail = true
+	if c.configureAddress() {
+		t.Error("configureAddress() should fail when the VIP can't be added on the vSwitch interface")
 	}
 }
 
-func TestHetznerConfigurer_queryAddress_NilIPFromJSON(t *testing.T) {
+// ---------------------------------------------------------------------------
+// deconfigureAddress
+// ---------------------------------------------------------------------------
+
+func TestHetznerConfigurer_deconfigureAddress(t *testing.T) {
 	t.Parallel()
 	setupHetznerTest(t)
 
-	dir := t.TempDir()
-	credPath := writeHetznerCredentialsFile(t, dir, "testuser", "testpass")
-
 	c := newTestHetznerConfigurer(t)
-	c.credentialsFile = credPath
-	c.lastAPICheck = time.Now().Add(-2 * time.Hour)
+	c.cachedState = configured
 
-	c.getOutboundIP = func() (net.IP, error) {
-		return net.ParseIP("10.0.0.5"), nil
+	if got := c.deconfigureAddress(); !got {
+		t.Errorf("deconfigureAddress() = %v, want true", got)
 	}
-	// Return response that will be parsed but returns nil IP (edge case)
-	c.runCommand = func(string, ...string) ([]byte, error) {
-		return []byte(`{"unexpected": "structure"}`), nil
+	if c.cachedState != released {
+		t.Errorf("cachedState = %d, want released", c.cachedState)
 	}
+}
 
-	if got := c.queryAddress(); got {
-		t.Errorf("queryAddress() = %v, want false when JSON structure is unexpected", got)
+func TestHetznerConfigurer_deconfigureAddress_VSwitch(t *testing.T) {
+	t.Parallel()
+	c, robot := newHetznerTestSetup(t)
+	local := mockLocal(&c.local)
+
+	if got := c.deconfigureAddress(); !got {
+		t.Errorf("deconfigureAddress() = %v, want true", got)
+	}
+	if local.deconfigureCount != 1 {
+		t.Errorf("expected the VIP to be removed from the vSwitch interface, got %d calls", local.deconfigureCount)
+	}
+	if robot.requestCount() != 0 {
+		t.Error("deconfigureAddress() must leave the routing to the next leader")
 	}
 }
 
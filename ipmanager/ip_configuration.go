@@ -13,6 +13,15 @@ type IPConfiguration struct {
 	Iface      net.Interface
 	RetryNum   int
 	RetryAfter int
+
+	ARPCount           int
+	ARPInterval        int //milliseconds
+	ARPMode            string
+	ARPRefreshInterval int //milliseconds
+
+	AddressProbe        bool
+	AddressProbeCount   int
+	AddressProbeTimeout int //milliseconds
 }
 
 // getCIDR returns the CIDR composed from the given address and mask
@@ -27,3 +36,9 @@ func netmaskSize(mask net.IPMask) int {
 	}
 	return ones
 }
+
+// isVIP returns whether ip is exactly the configured address
+func (c *IPConfiguration) isVIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	return ok && addr.Unmap() == c.VIP
+}
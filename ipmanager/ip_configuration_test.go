@@ -144,3 +144,34 @@ func TestNetmaskSize(t *testing.T) {
 		})
 	}
 }
+
+func TestIPConfiguration_isVIP(t *testing.T) {
+	t.Parallel()
+
+	v4 := &IPConfiguration{VIP: netip.MustParseAddr("10.0.0.1")}
+	v6 := &IPConfiguration{VIP: netip.MustParseAddr("2001:db8::1")}
+
+	tests := []struct {
+		name string
+		conf *IPConfiguration
+		ip   net.IP
+		want bool
+	}{
+		{"IPv4 exact", v4, net.ParseIP("10.0.0.1").To4(), true},
+		{"IPv4 in 16 byte form", v4, net.ParseIP("10.0.0.1"), true},
+		{"IPv4 with common prefix", v4, net.ParseIP("10.0.0.11"), false},
+		{"IPv4 other", v4, net.ParseIP("10.0.0.2"), false},
+		{"IPv6 exact", v6, net.ParseIP("2001:db8::1"), true},
+		{"IPv6 with common prefix", v6, net.ParseIP("2001:db8::10"), false},
+		{"nil", v4, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := tt.conf.isVIP(tt.ip); got != tt.want {
+				t.Errorf("isVIP(%v) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
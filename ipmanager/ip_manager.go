@@ -19,11 +19,54 @@ type ipConfigurer interface {
 	getCIDR() string
 }
 
+// addressWatcher is implemented by configurers that are notified about
+// changes of the local addresses and links. The returned channel receives a
+// value whenever the VIP may have been added or removed by somebody else,
+// and is closed when the subscription ends.
+type addressWatcher interface {
+	watchAddress(ctx context.Context) (<-chan struct{}, error)
+}
+
+// localAddressQuerier is implemented by configurers that add the VIP to the
+// interface on top of assigning it at the provider. queryAddress only
+// reports the VIP as up while both are in place, so once the next leader has
+// taken the assignment over, the address left on our interface is only
+// seen through queryLocalAddress.
+type localAddressQuerier interface {
+	queryLocalAddress() bool
+}
+
+// starter is implemented by configurers running sessions of their own,
+// like the BGP speaker. SyncStates starts them before the first check and
+// calls the returned stop after the final deconfigureAddress on shutdown.
+type starter interface {
+	start(ctx context.Context) (stop func())
+}
+
 var log *zap.SugaredLogger
 
+// SetLogger sets the logger of the package. It is shared by all managers
+// and their goroutines, so set it once before creating the first manager.
+func SetLogger(logger *zap.Logger) {
+	log = logger.Sugar()
+}
+
+// watchRetryMin and watchRetryMax bound the wait before subscribing to
+// address changes again after a subscription failed or ended, the wait
+// doubles every time until a change is received
+const (
+	watchRetryMin = time.Second
+	watchRetryMax = 30 * time.Second
+)
+
+// defaultIPv6Mask is used for IPv6 VIPs when no netmask is configured,
+// as that is the prefix length of practically every IPv6 subnet
+const defaultIPv6Mask = 64
+
 // IPManager implements the main functionality of the VIP manager
 type IPManager struct {
 	configurer ipConfigurer
+	hooks      *transitionHooks
 
 	states        <-chan bool
 	shouldSetIPUp atomic.Bool
@@ -38,7 +81,10 @@ func getMask(vip netip.Addr, mask int) net.IPMask {
 		var ip net.IP = vip.AsSlice()
 		return ip.DefaultMask()
 	}
-	return net.CIDRMask(mask, 128) //IPv6
+	if mask > 0 && mask < 129 { //IPv6
+		return net.CIDRMask(mask, 128)
+	}
+	return net.CIDRMask(defaultIPv6Mask, 128)
 }
 
 func getNetIface(iface string) (*net.Interface, error) {
@@ -69,20 +115,53 @@ func NewIPManager(conf *vipconfig.Config, states <-chan bool) (m *IPManager, err
 		Iface:      *netIface,
 		RetryNum:   conf.RetryNum,
 		RetryAfter: conf.RetryAfter,
+
+		ARPCount:           conf.ARPCount,
+		ARPInterval:        conf.ARPInterval,
+		ARPMode:            conf.ARPMode,
+		ARPRefreshInterval: conf.ARPRefreshInterval,
+
+		AddressProbe:        conf.AddressProbe,
+		AddressProbeCount:   conf.AddressProbeCount,
+		AddressProbeTimeout: conf.AddressProbeTimeout,
 	}
 	m = &IPManager{
 		states: states,
 	}
-	log = conf.Logger.Sugar()
 	m.recheckChan = make(chan struct{})
 	switch conf.HostingType {
 	case "hetzner":
-		m.configurer, err = newHetznerConfigurer(ipConf, conf.Verbose)
+		m.configurer, err = newHetznerConfigurer(ipConf, conf)
+	case "hetzner-cloud":
+		m.configurer, err = newHetznerCloudConfigurer(ipConf, conf)
+	case "aws":
+		m.configurer, err = newAWSConfigurer(ipConf, conf)
+	case "gcp":
+		m.configurer, err = newGCPConfigurer(ipConf, conf)
+	case "azure":
+		m.configurer, err = newAzureConfigurer(ipConf, conf)
+	case "openstack":
+		m.configurer, err = newOpenStackConfigurer(ipConf, conf)
+	case "digitalocean":
+		m.configurer, err = newDigitalOceanConfigurer(ipConf, conf)
+	case "ovh":
+		m.configurer, err = newOVHConfigurer(ipConf, conf)
+	case "bgp":
+		m.configurer, err = newBGPConfigurer(ipConf, conf)
+	case "dns":
+		m.configurer, err = newDNSConfigurer(ipConf, conf)
+	case "kubernetes":
+		m.configurer, err = newKubernetesConfigurer(ipConf, conf)
+	case "exec":
+		m.configurer, err = newExecConfigurer(ipConf, conf)
 	case "basic":
 		fallthrough
 	default:
 		m.configurer, err = newBasicConfigurer(ipConf)
 	}
+	if err == nil {
+		m.hooks, err = newTransitionHooks(ipConf, conf)
+	}
 	if err != nil {
 		m = nil
 	}
@@ -91,9 +170,35 @@ func NewIPManager(conf *vipconfig.Config, states <-chan bool) (m *IPManager, err
 
 func (m *IPManager) applyLoop(ctx context.Context) {
 	strUpDown := map[bool]string{true: "up", false: "down"}
+	watcher, _ := m.configurer.(addressWatcher)
+	local, _ := m.configurer.(localAddressQuerier)
+	var changes <-chan struct{}
+	var watchRetry time.Duration
+	var watchAt time.Time
+	// retryWatch schedules the next subscription, backing off to keep a
+	// subscription that keeps failing or ending from spinning the loop
+	retryWatch := func() {
+		watchRetry = min(max(2*watchRetry, watchRetryMin), watchRetryMax)
+		watchAt = time.Now().Add(watchRetry)
+	}
 	for {
+		if watcher != nil && changes == nil && !time.Now().Before(watchAt) {
+			var err error
+			if changes, err = watcher.watchAddress(ctx); err != nil {
+				log.Warnf("Failed to watch for address changes, falling back to periodic checks: %v", err)
+				retryWatch()
+			}
+		}
+		var resubscribe <-chan time.Time
+		if watcher != nil && changes == nil {
+			resubscribe = time.After(time.Until(watchAt))
+		}
 		isIPUp := m.configurer.queryAddress()
 		shouldSetIPUp := m.shouldSetIPUp.Load()
+		if !isIPUp && !shouldSetIPUp && local != nil && local.queryLocalAddress() {
+			log.Infof("IP address %s is assigned elsewhere, but still configured locally", m.configurer.getCIDR())
+			isIPUp = true
+		}
 		log.Infof("IP address %s is %s, must be %s",
 			m.configurer.getCIDR(),
 			strUpDown[isIPUp],
@@ -101,9 +206,9 @@ func (m *IPManager) applyLoop(ctx context.Context) {
 		if isIPUp != shouldSetIPUp {
 			var isOk bool
 			if shouldSetIPUp {
-				isOk = m.configurer.configureAddress()
+				isOk = m.hooks.up(m.configurer.configureAddress)
 			} else {
-				isOk = m.configurer.deconfigureAddress()
+				isOk = m.hooks.down(m.configurer.deconfigureAddress)
 			}
 			if !isOk {
 				log.Error("Failed to configure virtual ip for this machine")
@@ -113,6 +218,15 @@ func (m *IPManager) applyLoop(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-m.recheckChan: // signal to recheck
+		case _, ok := <-changes: // address or link changed underneath us
+			if ok {
+				watchRetry = 0
+			} else {
+				changes = nil
+				retryWatch()
+				log.Warnf("Watching for address changes ended, subscribing again in %s", watchRetry)
+			}
+		case <-resubscribe:
 		case <-time.After(time.Duration(10) * time.Second): // recheck every 10 seconds
 		}
 	}
@@ -120,16 +234,35 @@ func (m *IPManager) applyLoop(ctx context.Context) {
 
 // SyncStates implements states synchronization
 func (m *IPManager) SyncStates(ctx context.Context, states <-chan bool) {
-	go m.applyLoop(ctx)
+	if s, ok := m.configurer.(starter); ok {
+		stop := s.start(ctx)
+		defer stop()
+	}
+	applied := make(chan struct{})
+	go func() {
+		defer close(applied)
+		m.applyLoop(ctx)
+	}()
 	for {
 		select {
 		case newState := <-states:
 			if m.shouldSetIPUp.Load() != newState {
 				m.shouldSetIPUp.Store(newState)
-				m.recheckChan <- struct{}{}
+				select {
+				case m.recheckChan <- struct{}{}:
+				case <-applied:
+				}
 			}
 		case <-ctx.Done():
-			m.configurer.deconfigureAddress()
+			// wait for the apply loop, it must not configure the VIP again
+			// after the final removal
+			<-applied
+			// the hooks only run if we were holding the VIP
+			if m.shouldSetIPUp.Load() {
+				m.hooks.down(m.configurer.deconfigureAddress)
+			} else {
+				m.configurer.deconfigureAddress()
+			}
 			return
 		}
 	}
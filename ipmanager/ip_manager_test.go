@@ -2,6 +2,7 @@ package ipmanager
 
 import (
 	"context"
+	"errors"
 	"net"
 	"net/netip"
 	"strings"
@@ -145,40 +146,14 @@ func TestGetMask_IPv4_OutOfRange(t *testing.T) {
 	}
 }
 
-// ---------------------------------------------------------------------------
-// Mock configurer for testing applyLoop and SyncStates
-// ---------------------------------------------------------------------------
-
-type mockConfigurer struct {
-	queryAddressCount     int
-	configureCount        int
-	deconfigureCount      int
-	shouldQueryFail       bool
-	shouldConfigureFail   bool
-	shouldDeconfigureFail bool
-	shouldQueryReturn     bool
-}
-
-func (m *mockConfigurer) queryAddress() bool {
-	m.queryAddressCount++
-	if m.shouldQueryFail {
-		return false
+func TestGetMask_IPv6_Default(t *testing.T) {
+	t.Parallel()
+	for _, mask := range []int{-1, 0, 129} {
+		m := getMask(netip.MustParseAddr("2001:db8::1"), mask)
+		if ones, bits := m.Size(); ones != 64 || bits != 128 {
+			t.Errorf("getMask(2001:db8::1, %d) = /%d (of %d bits), want /64", mask, ones, bits)
+		}
 	}
-	return m.shouldQueryReturn
-}
-
-func (m *mockConfigurer) configureAddress() bool {
-	m.configureCount++
-	return !m.shouldConfigureFail
-}
-
-func (m *mockConfigurer) deconfigureAddress() bool {
-	m.deconfigureCount++
-	return !m.shouldDeconfigureFail
-}
-
-func (m *mockConfigurer) getCIDR() string {
-	return "192.168.1.100/24"
 }
 
 func TestApplyLoop_DeconfigureWhenNeeded(t *testing.T) {
@@ -186,9 +161,6 @@ func TestApplyLoop_DeconfigureWhenNeeded(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel()
 
-	conf := zap.NewNop()
-	log = conf.Sugar()
-
 	mock := &mockConfigurer{shouldQueryReturn: true}
 	m := &IPManager{
 		configurer:  mock,
@@ -212,9 +184,6 @@ func TestApplyLoop_ConfigureWhenNeeded(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel()
 
-	conf := zap.NewNop()
-	log = conf.Sugar()
-
 	mock := &mockConfigurer{shouldQueryReturn: false}
 	m := &IPManager{
 		configurer:  mock,
@@ -234,9 +203,6 @@ func TestApplyLoop_ConfigureFailure(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
 	defer cancel()
 
-	conf := zap.NewNop()
-	log = conf.Sugar()
-
 	mock := &mockConfigurer{shouldQueryReturn: false, shouldConfigureFail: true}
 	m := &IPManager{
 		configurer:  mock,
@@ -256,9 +222,6 @@ func TestApplyLoop_QueryFails(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
 	defer cancel()
 
-	conf := zap.NewNop()
-	log = conf.Sugar()
-
 	mock := &mockConfigurer{shouldQueryFail: true}
 	m := &IPManager{
 		configurer:  mock,
@@ -279,9 +242,6 @@ func TestApplyLoop_NoChangeNeeded(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
 	defer cancel()
 
-	conf := zap.NewNop()
-	log = conf.Sugar()
-
 	mock := &mockConfigurer{shouldQueryReturn: true}
 	m := &IPManager{
 		configurer:  mock,
@@ -297,6 +257,120 @@ func TestApplyLoop_NoChangeNeeded(t *testing.T) {
 	}
 }
 
+func TestApplyLoop_DeconfigureLeftoverLocalAddress(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// the VIP was assigned to the next leader, but is still on our interface
+	mock := &localConfigurer{local: true}
+	m := &IPManager{
+		configurer:  mock,
+		recheckChan: make(chan struct{}, 1),
+	}
+	m.shouldSetIPUp.Store(false)
+
+	m.applyLoop(ctx)
+
+	if mock.deconfigureCount == 0 {
+		t.Error("expected deconfigureAddress to be called for the leftover local address")
+	}
+}
+
+// watchingConfigurer additionally reports address changes like the Linux
+// BasicConfigurer does
+type watchingConfigurer struct {
+	mockConfigurer
+	subscriptions []chan struct{} // returned in order, the last one repeatedly
+	watchErr      error
+	watchCount    int
+}
+
+func (m *watchingConfigurer) watchAddress(context.Context) (<-chan struct{}, error) {
+	m.watchCount++
+	if m.watchErr != nil {
+		return nil, m.watchErr
+	}
+	return m.subscriptions[min(m.watchCount, len(m.subscriptions))-1], nil
+}
+
+func TestApplyLoop_RecheckOnAddressChange(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+
+	// the VIP is removed by somebody else right after it was checked
+	changes := make(chan struct{}, 1)
+	changes <- struct{}{}
+	mock := &watchingConfigurer{
+		mockConfigurer: mockConfigurer{shouldQueryReturn: true},
+		subscriptions:  []chan struct{}{changes},
+	}
+	m := &IPManager{
+		configurer:  mock,
+		recheckChan: make(chan struct{}, 1),
+	}
+	m.shouldSetIPUp.Store(true)
+
+	m.applyLoop(ctx)
+
+	if mock.queryAddressCount != 2 {
+		t.Errorf("expected an immediate recheck after the address change, queryAddress was called %d times", mock.queryAddressCount)
+	}
+	if mock.watchCount != 1 {
+		t.Errorf("expected a single subscription, got %d", mock.watchCount)
+	}
+}
+
+func TestApplyLoop_ResubscribeWhenWatchEnds(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), watchRetryMin+500*time.Millisecond)
+	defer cancel()
+
+	// every subscription ends right away, the second one is only made after
+	// watchRetryMin and the third one after twice that
+	ended := make(chan struct{})
+	close(ended)
+	mock := &watchingConfigurer{
+		mockConfigurer: mockConfigurer{shouldQueryReturn: true},
+		subscriptions:  []chan struct{}{ended},
+	}
+	m := &IPManager{
+		configurer:  mock,
+		recheckChan: make(chan struct{}, 1),
+	}
+	m.shouldSetIPUp.Store(true)
+
+	start := time.Now()
+	m.applyLoop(ctx)
+
+	if mock.watchCount != 2 {
+		t.Errorf("expected to resubscribe once within %s, got %d subscriptions", time.Since(start), mock.watchCount)
+	}
+}
+
+func TestApplyLoop_WatchFailureFallsBackToPolling(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	mock := &watchingConfigurer{
+		mockConfigurer: mockConfigurer{shouldQueryReturn: false},
+		watchErr:       errors.New("protocol not supported"),
+	}
+	m := &IPManager{
+		configurer:  mock,
+		recheckChan: make(chan struct{}, 1),
+	}
+	m.shouldSetIPUp.Store(true)
+
+	m.applyLoop(ctx)
+
+	if mock.configureCount != 1 {
+		t.Errorf("expected configureAddress to be called once, got %d", mock.configureCount)
+	}
+}
+
 // ---------------------------------------------------------------------------
 // SyncStates
 // ---------------------------------------------------------------------------
@@ -306,9 +380,6 @@ func TestSyncStates_StateChange(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
 	defer cancel()
 
-	conf := zap.NewNop()
-	log = conf.Sugar()
-
 	mock := &mockConfigurer{shouldQueryReturn: false}
 	m := &IPManager{
 		configurer:  mock,
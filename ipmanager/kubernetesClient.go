@@ -0,0 +1,12 @@
+package ipmanager
+
+import (
+	"github.com/cybertec-postgresql/vip-manager/kubernetes"
+)
+
+// newKubernetesClient returns an apiClient for the API server of kube
+func newKubernetesClient(kube *kubernetes.Config) *apiClient {
+	client := newAPIClient(kube.Server, kube.Authorize)
+	client.httpClient.Transport = kube.Transport()
+	return client
+}
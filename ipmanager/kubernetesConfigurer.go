@@ -0,0 +1,364 @@
+package ipmanager
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/cybertec-postgresql/vip-manager/kubernetes"
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+const (
+	// kubernetesServiceNameLabel links an EndpointSlice to its Service
+	kubernetesServiceNameLabel = "kubernetes.io/service-name"
+	// kubernetesManagedByLabel tells the endpoint slice controller to keep
+	// its hands off our EndpointSlice
+	kubernetesManagedByLabel = "endpointslice.kubernetes.io/managed-by"
+	kubernetesManagedBy      = "vip-manager"
+)
+
+// The KubernetesConfigurer points a Kubernetes Service to this node,
+// whenever manager-type `kubernetes` is set. It is meant for clients in a
+// cluster connecting to databases outside of it, or in pods of it.
+// With kubernetes-service, the Service has no selector and this node's
+// address, taken from `ip`, becomes the only endpoint of its EndpointSlice.
+// With kubernetes-pod-label, the label is moved to the pod of this node,
+// so a Service selecting the label points to it.
+// All changes read the object, modify it and write it back with its
+// resourceVersion, and are retried if someone else changed it meanwhile.
+type KubernetesConfigurer struct {
+	*IPConfiguration
+	api       *apiClient
+	namespace string
+	service   string
+	pod       string
+	labelKey  string
+	labelVal  string
+}
+
+type kubernetesObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	OwnerReferences []json.RawMessage `json:"ownerReferences,omitempty"`
+}
+
+type kubernetesService struct {
+	Metadata kubernetesObjectMeta `json:"metadata"`
+	Spec     struct {
+		Selector map[string]string `json:"selector"`
+		Ports    []struct {
+			Name        string          `json:"name"`
+			Protocol    string          `json:"protocol"`
+			AppProtocol *string         `json:"appProtocol"`
+			Port        int32           `json:"port"`
+			TargetPort  json.RawMessage `json:"targetPort"`
+		} `json:"ports"`
+	} `json:"spec"`
+}
+
+type kubernetesEndpointSlice struct {
+	APIVersion  string                   `json:"apiVersion"`
+	Kind        string                   `json:"kind"`
+	Metadata    kubernetesObjectMeta     `json:"metadata"`
+	AddressType string                   `json:"addressType"`
+	Endpoints   []kubernetesEndpoint     `json:"endpoints"`
+	Ports       []kubernetesEndpointPort `json:"ports"`
+}
+
+type kubernetesEndpoint struct {
+	Addresses  []string `json:"addresses"`
+	Conditions struct {
+		Ready *bool `json:"ready,omitempty"`
+	} `json:"conditions"`
+}
+
+type kubernetesEndpointPort struct {
+	Name        string  `json:"name"`
+	Protocol    string  `json:"protocol,omitempty"`
+	AppProtocol *string `json:"appProtocol,omitempty"`
+	Port        int32   `json:"port"`
+}
+
+func newKubernetesConfigurer(config *IPConfiguration, conf *vipconfig.Config) (*KubernetesConfigurer, error) {
+	if (conf.KubernetesService == "") == (conf.KubernetesPodLabel == "") {
+		return nil, errors.New("exactly one of kubernetes-service and kubernetes-pod-label must be set for manager-type kubernetes")
+	}
+	kube, err := kubernetes.LoadConfig(conf.KubernetesKubeconfig, conf.KubernetesContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the Kubernetes credentials: %w", err)
+	}
+	c := &KubernetesConfigurer{
+		IPConfiguration: config,
+		api:             newKubernetesClient(kube),
+		namespace:       cmp.Or(conf.KubernetesNamespace, kube.Namespace, "default"),
+		service:         conf.KubernetesService,
+	}
+	if conf.KubernetesPodLabel != "" {
+		var ok bool
+		c.labelKey, c.labelVal, ok = strings.Cut(conf.KubernetesPodLabel, "=")
+		if !ok || c.labelKey == "" {
+			return nil, fmt.Errorf("kubernetes-pod-label must be key=value, got %q", conf.KubernetesPodLabel)
+		}
+		// the hostname of a pod is its name
+		if c.pod = conf.KubernetesPod; c.pod == "" {
+			if c.pod, err = os.Hostname(); err != nil {
+				return nil, fmt.Errorf("failed to get the pod name, set kubernetes-pod: %w", err)
+			}
+		}
+	}
+	return c, nil
+}
+
+// isKubernetesStatus checks err for the given HTTP status of the API server
+func isKubernetesStatus(err error, status int) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == status
+}
+
+// retryOnConflict runs update again as long as it fails because the object
+// was changed since it was read, at most retry-num times
+func (c *KubernetesConfigurer) retryOnConflict(update func() error) (err error) {
+	for range max(c.RetryNum, 1) {
+		if err = update(); !isKubernetesStatus(err, http.StatusConflict) {
+			return err
+		}
+		log.Infof("Conflicting update, retrying: %s", err)
+	}
+	return err
+}
+
+func (c *KubernetesConfigurer) endpointSlicePath() string {
+	return "/apis/discovery.k8s.io/v1/namespaces/" + c.namespace + "/endpointslices"
+}
+
+func (c *KubernetesConfigurer) podPath() string {
+	return "/api/v1/namespaces/" + c.namespace + "/pods/" + c.pod
+}
+
+// getEndpointSlice returns the EndpointSlice of the Service, nil if it
+// doesn't exist yet
+func (c *KubernetesConfigurer) getEndpointSlice() (*kubernetesEndpointSlice, error) {
+	var slice kubernetesEndpointSlice
+	err := c.api.do(http.MethodGet, c.endpointSlicePath()+"/"+c.service, nil, &slice)
+	if isKubernetesStatus(err, http.StatusNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get EndpointSlice %s/%s: %w", c.namespace, c.service, err)
+	}
+	return &slice, nil
+}
+
+// getServicePorts returns the ports of the Service for its EndpointSlice
+func (c *KubernetesConfigurer) getServicePorts() ([]kubernetesEndpointPort, error) {
+	var service kubernetesService
+	if err := c.api.do(http.MethodGet, "/api/v1/namespaces/"+c.namespace+"/services/"+c.service, nil, &service); err != nil {
+		return nil, fmt.Errorf("failed to get Service %s/%s: %w", c.namespace, c.service, err)
+	}
+	if len(service.Spec.Selector) > 0 {
+		return nil, fmt.Errorf("the Service %s/%s has a selector, its endpoints are managed by Kubernetes", c.namespace, c.service)
+	}
+	ports := make([]kubernetesEndpointPort, 0, len(service.Spec.Ports))
+	for _, p := range service.Spec.Ports {
+		port := kubernetesEndpointPort{Name: p.Name, Protocol: p.Protocol, AppProtocol: p.AppProtocol, Port: p.Port}
+		// named target ports can't be resolved without pods, the port of
+		// the Service is used then
+		var targetPort int32
+		if json.Unmarshal(p.TargetPort, &targetPort) == nil && targetPort > 0 {
+			port.Port = targetPort
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// hasAddress tells if the endpoint has our address
+func (c *KubernetesConfigurer) hasAddress(endpoint kubernetesEndpoint) bool {
+	for _, address := range endpoint.Addresses {
+		if c.isVIP(net.ParseIP(address)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *KubernetesConfigurer) queryEndpointSlice() (bool, error) {
+	slice, err := c.getEndpointSlice()
+	if err != nil || slice == nil {
+		return false, err
+	}
+	// other endpoints would still get a share of the clients
+	if len(slice.Endpoints) != 1 || !c.hasAddress(slice.Endpoints[0]) {
+		return false, nil
+	}
+	ready := slice.Endpoints[0].Conditions.Ready
+	return ready == nil || *ready, nil
+}
+
+func (c *KubernetesConfigurer) configureEndpointSlice() error {
+	ports, err := c.getServicePorts()
+	if err != nil {
+		return err
+	}
+	addressType := "IPv6"
+	if c.VIP.Is4() {
+		addressType = "IPv4"
+	}
+	ready := true
+	endpoint := kubernetesEndpoint{Addresses: []string{c.VIP.String()}}
+	endpoint.Conditions.Ready = &ready
+
+	return c.retryOnConflict(func() error {
+		slice, err := c.getEndpointSlice()
+		if err != nil {
+			return err
+		}
+		method, path := http.MethodPut, c.endpointSlicePath()+"/"+c.service
+		if slice == nil {
+			// creating it fails with a conflict, too, if someone was faster
+			method, path = http.MethodPost, c.endpointSlicePath()
+			slice = &kubernetesEndpointSlice{Metadata: kubernetesObjectMeta{Name: c.service, Namespace: c.namespace}}
+		}
+		slice.APIVersion, slice.Kind = "discovery.k8s.io/v1", "EndpointSlice"
+		if slice.Metadata.Labels == nil {
+			slice.Metadata.Labels = map[string]string{}
+		}
+		slice.Metadata.Labels[kubernetesServiceNameLabel] = c.service
+		slice.Metadata.Labels[kubernetesManagedByLabel] = kubernetesManagedBy
+		slice.AddressType = addressType
+		slice.Endpoints = []kubernetesEndpoint{endpoint}
+		slice.Ports = ports
+		return c.api.do(method, path, slice, nil)
+	})
+}
+
+func (c *KubernetesConfigurer) deconfigureEndpointSlice() error {
+	return c.retryOnConflict(func() error {
+		slice, err := c.getEndpointSlice()
+		if err != nil || slice == nil {
+			return err
+		}
+		endpoints := make([]kubernetesEndpoint, 0, len(slice.Endpoints))
+		for _, endpoint := range slice.Endpoints {
+			if !c.hasAddress(endpoint) {
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+		// the next leader might have replaced us already
+		if len(endpoints) == len(slice.Endpoints) {
+			return nil
+		}
+		slice.Endpoints = endpoints
+		return c.api.do(http.MethodPut, c.endpointSlicePath()+"/"+c.service, slice, nil)
+	})
+}
+
+// getPod returns the pod of this node as generic object, so writing it back
+// keeps all fields we don't know about
+func (c *KubernetesConfigurer) getPod() (map[string]any, map[string]any, error) {
+	var pod map[string]any
+	if err := c.api.do(http.MethodGet, c.podPath(), nil, &pod); err != nil {
+		return nil, nil, fmt.Errorf("failed to get pod %s/%s: %w", c.namespace, c.pod, err)
+	}
+	metadata, ok := pod["metadata"].(map[string]any)
+	if !ok {
+		return nil, nil, fmt.Errorf("pod %s/%s has no metadata", c.namespace, c.pod)
+	}
+	labels, _ := metadata["labels"].(map[string]any)
+	if labels == nil {
+		labels = map[string]any{}
+		metadata["labels"] = labels
+	}
+	return pod, labels, nil
+}
+
+func (c *KubernetesConfigurer) queryPodLabel() (bool, error) {
+	_, labels, err := c.getPod()
+	if err != nil {
+		return false, err
+	}
+	return labels[c.labelKey] == c.labelVal, nil
+}
+
+// updatePodLabel sets the label on our pod, or removes it if set is false
+func (c *KubernetesConfigurer) updatePodLabel(set bool) error {
+	return c.retryOnConflict(func() error {
+		pod, labels, err := c.getPod()
+		if err != nil {
+			return err
+		}
+		if _, ok := labels[c.labelKey]; !ok && !set {
+			return nil
+		}
+		if set {
+			labels[c.labelKey] = c.labelVal
+		} else {
+			delete(labels, c.labelKey)
+		}
+		// pod contains its resourceVersion, so the update fails if it was
+		// changed meanwhile
+		return c.api.do(http.MethodPut, c.podPath(), pod, nil)
+	})
+}
+
+// target describes what we point to this node, for the logs
+func (c *KubernetesConfigurer) target() string {
+	if c.service != "" {
+		return fmt.Sprintf("EndpointSlice %s/%s", c.namespace, c.service)
+	}
+	return fmt.Sprintf("label %s=%s of pod %s/%s", c.labelKey, c.labelVal, c.namespace, c.pod)
+}
+
+func (c *KubernetesConfigurer) queryAddress() bool {
+	var owned bool
+	var err error
+	if c.service != "" {
+		owned, err = c.queryEndpointSlice()
+	} else {
+		owned, err = c.queryPodLabel()
+	}
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	return owned
+}
+
+func (c *KubernetesConfigurer) configureAddress() bool {
+	var err error
+	if c.service != "" {
+		err = c.configureEndpointSlice()
+	} else {
+		err = c.updatePodLabel(true)
+	}
+	if err != nil {
+		log.Errorf("Failed to point %s to %s: %s", c.target(), c.VIP, err)
+		return false
+	}
+	log.Infof("%s was successfully pointed to %s", c.target(), c.VIP)
+	return true
+}
+
+func (c *KubernetesConfigurer) deconfigureAddress() bool {
+	var err error
+	if c.service != "" {
+		err = c.deconfigureEndpointSlice()
+	} else {
+		err = c.updatePodLabel(false)
+	}
+	if err != nil {
+		log.Errorf("Failed to remove %s from %s: %s", c.VIP, c.target(), err)
+		return false
+	}
+	log.Infof("%s was removed from %s", c.VIP, c.target())
+	return true
+}
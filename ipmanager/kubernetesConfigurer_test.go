@@ -0,0 +1,344 @@
+package ipmanager
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/cybertec-postgresql/vip-manager/kubernetes/kubetest"
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// fakeKubernetes is a stand-in for the API server, storing objects by path
+// and rejecting updates carrying an outdated resourceVersion
+type fakeKubernetes struct {
+	*fakeAPI
+	objects   map[string]map[string]any
+	version   int
+	writes    int
+	conflicts int // number of writes that fail as if someone was faster
+}
+
+const (
+	testKubernetesToken     = "test-token"
+	testKubernetesService   = "/api/v1/namespaces/db/services/pg-primary"
+	testKubernetesSlice     = "/apis/discovery.k8s.io/v1/namespaces/db/endpointslices/pg-primary"
+	testKubernetesPod       = "/api/v1/namespaces/db/pods/pg-0"
+	testKubernetesLabel     = "role"
+	testKubernetesLabelVal  = "primary"
+	testKubernetesPodLabel  = testKubernetesLabel + "=" + testKubernetesLabelVal
+	testKubernetesNamespace = "db"
+)
+
+func newFakeKubernetes(t *testing.T) *fakeKubernetes {
+	t.Helper()
+	f := &fakeKubernetes{objects: map[string]map[string]any{}}
+	f.fakeAPI = newFakeTLSAPI(t, f.handle)
+	f.put(testKubernetesService, map[string]any{
+		"metadata": map[string]any{"name": "pg-primary", "namespace": testKubernetesNamespace},
+		"spec": map[string]any{"ports": []any{
+			map[string]any{"name": "postgres", "protocol": "TCP", "port": 5432, "targetPort": 6432},
+			map[string]any{"name": "metrics", "protocol": "TCP", "port": 9187, "targetPort": "metrics"},
+		}},
+	})
+	f.put(testKubernetesPod, map[string]any{
+		"metadata": map[string]any{"name": "pg-0", "namespace": testKubernetesNamespace, "labels": map[string]any{"app": "pg"}},
+		"spec":     map[string]any{"containers": []any{map[string]any{"name": "postgres", "image": "postgres"}}},
+	})
+	return f
+}
+
+// put stores obj at path with a new resourceVersion
+func (f *fakeKubernetes) put(path string, obj map[string]any) {
+	f.version++
+	obj["metadata"].(map[string]any)["resourceVersion"] = strconv.Itoa(f.version)
+	f.objects[path] = obj
+}
+
+func (f *fakeKubernetes) get(path string) map[string]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// round trip, so the caller can't race with the handler
+	var obj map[string]any
+	b, _ := json.Marshal(f.objects[path])
+	_ = json.Unmarshal(b, &obj)
+	return obj
+}
+
+func (f *fakeKubernetes) handle(w http.ResponseWriter, r *http.Request) {
+	status := func(code int, reason string) {
+		w.WriteHeader(code)
+		writeJSON(w, map[string]any{"kind": "Status", "status": "Failure", "reason": reason, "code": code})
+	}
+	if r.Header.Get("Authorization") != "Bearer "+testKubernetesToken {
+		status(http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	path := r.URL.Path
+	var obj map[string]any
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&obj); err != nil {
+			status(http.StatusBadRequest, "BadRequest")
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if existing, ok := f.objects[path]; ok {
+			writeJSON(w, existing)
+		} else {
+			status(http.StatusNotFound, "NotFound")
+		}
+	case http.MethodPost:
+		path += "/" + obj["metadata"].(map[string]any)["name"].(string)
+		if _, ok := f.objects[path]; ok {
+			status(http.StatusConflict, "AlreadyExists")
+			return
+		}
+		f.writes++
+		f.put(path, obj)
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, obj)
+	case http.MethodPut:
+		existing, ok := f.objects[path]
+		if !ok {
+			status(http.StatusNotFound, "NotFound")
+			return
+		}
+		if f.conflicts > 0 {
+			f.conflicts--
+			f.put(path, existing)
+		}
+		if obj["metadata"].(map[string]any)["resourceVersion"] != existing["metadata"].(map[string]any)["resourceVersion"] {
+			status(http.StatusConflict, "Conflict")
+			return
+		}
+		f.writes++
+		f.put(path, obj)
+		writeJSON(w, obj)
+	default:
+		status(http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func newTestKubernetesConfigurer(t *testing.T, f *fakeKubernetes, ip string, conf *vipconfig.Config) *KubernetesConfigurer {
+	t.Helper()
+	conf.KubernetesKubeconfig = kubetest.WriteKubeconfig(t, f.Server, testKubernetesToken)
+	return newTestConfigurer(t, newKubernetesConfigurer, testHetznerIPConfiguration(ip), conf)
+}
+
+func endpointAddresses(slice map[string]any) (addresses []string) {
+	endpoints, _ := slice["endpoints"].([]any)
+	for _, endpoint := range endpoints {
+		for _, address := range endpoint.(map[string]any)["addresses"].([]any) {
+			addresses = append(addresses, address.(string))
+		}
+	}
+	return addresses
+}
+
+// ---------------------------------------------------------------------------
+// newKubernetesConfigurer
+// ---------------------------------------------------------------------------
+
+func TestNewKubernetesConfigurer(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeKubernetes(t)
+	kubeconfig := kubetest.WriteKubeconfig(t, f.Server, testKubernetesToken)
+	tests := []struct {
+		name    string
+		conf    vipconfig.Config
+		wantErr bool
+	}{
+		{"service", vipconfig.Config{KubernetesService: "pg-primary"}, false},
+		{"pod label", vipconfig.Config{KubernetesPodLabel: testKubernetesPodLabel, KubernetesPod: "pg-0"}, false},
+		{"neither", vipconfig.Config{}, true},
+		{"both", vipconfig.Config{KubernetesService: "pg-primary", KubernetesPodLabel: testKubernetesPodLabel}, true},
+		{"label without value", vipconfig.Config{KubernetesPodLabel: "role"}, true},
+		{"plugin", vipconfig.Config{KubernetesService: "pg-primary", KubernetesContext: "plugin"}, true},
+	}
+	for _, tt := range tests {
+		tt.conf.KubernetesKubeconfig = kubeconfig
+		c, err := newKubernetesConfigurer(testHetznerIPConfiguration("10.0.0.11"), &tt.conf)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: newKubernetesConfigurer() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && c.namespace != testKubernetesNamespace {
+			t.Errorf("%s: namespace = %s, want the one of the context", tt.name, c.namespace)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// kubernetes-service
+// ---------------------------------------------------------------------------
+
+func TestKubernetesConfigurer_EndpointSlice(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeKubernetes(t)
+	c := newTestKubernetesConfigurer(t, f, "10.0.0.11", &vipconfig.Config{KubernetesService: "pg-primary"})
+	other := newTestKubernetesConfigurer(t, f, "10.0.0.12", &vipconfig.Config{KubernetesService: "pg-primary"})
+
+	if c.queryAddress() {
+		t.Error("queryAddress() = true without EndpointSlice")
+	}
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	slice := f.get(testKubernetesSlice)
+	if got := endpointAddresses(slice); len(got) != 1 || got[0] != "10.0.0.11" {
+		t.Errorf("EndpointSlice addresses = %v, want [10.0.0.11]", got)
+	}
+	labels := slice["metadata"].(map[string]any)["labels"].(map[string]any)
+	if labels[kubernetesServiceNameLabel] != "pg-primary" || labels[kubernetesManagedByLabel] != kubernetesManagedBy {
+		t.Errorf("EndpointSlice labels = %v", labels)
+	}
+	if slice["addressType"] != "IPv4" {
+		t.Errorf("addressType = %v, want IPv4", slice["addressType"])
+	}
+	ports, _ := json.Marshal(slice["ports"])
+	if want := `[{"name":"postgres","port":6432,"protocol":"TCP"},{"name":"metrics","port":9187,"protocol":"TCP"}]`; string(ports) != want {
+		t.Errorf("EndpointSlice ports = %s, want %s", ports, want)
+	}
+	if !c.queryAddress() || other.queryAddress() {
+		t.Error("expected only the configured node to own the EndpointSlice")
+	}
+
+	// failover, the old leader must not remove the new one
+	if !other.configureAddress() {
+		t.Fatal("configureAddress() of the new leader = false, want true")
+	}
+	if c.queryAddress() || !other.queryAddress() {
+		t.Error("expected the new leader to own the EndpointSlice")
+	}
+	writes := f.writes
+	if !c.deconfigureAddress() {
+		t.Error("deconfigureAddress() = false, want true")
+	}
+	if f.writes != writes {
+		t.Error("deconfigureAddress() must not touch the EndpointSlice of the new leader")
+	}
+	if !other.deconfigureAddress() {
+		t.Error("deconfigureAddress() = false, want true")
+	}
+	if got := endpointAddresses(f.get(testKubernetesSlice)); len(got) != 0 {
+		t.Errorf("EndpointSlice addresses = %v after deconfigureAddress(), want none", got)
+	}
+}
+
+func TestKubernetesConfigurer_EndpointSlice_Conflict(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeKubernetes(t)
+	c := newTestKubernetesConfigurer(t, f, "10.0.0.11", &vipconfig.Config{KubernetesService: "pg-primary"})
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+
+	f.mu.Lock()
+	f.conflicts = 2
+	f.mu.Unlock()
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() should succeed after conflicts within retry-num")
+	}
+	f.mu.Lock()
+	f.conflicts = 3
+	f.mu.Unlock()
+	if c.deconfigureAddress() {
+		t.Error("deconfigureAddress() should fail after retry-num conflicts")
+	}
+}
+
+func TestKubernetesConfigurer_EndpointSlice_IPv6(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeKubernetes(t)
+	c := newTestKubernetesConfigurer(t, f, "2001:db8::11", &vipconfig.Config{KubernetesService: "pg-primary"})
+
+	if !c.configureAddress() || !c.queryAddress() {
+		t.Fatal("expected the EndpointSlice to point to this node")
+	}
+	if got := f.get(testKubernetesSlice)["addressType"]; got != "IPv6" {
+		t.Errorf("addressType = %v, want IPv6", got)
+	}
+}
+
+func TestKubernetesConfigurer_EndpointSlice_Selector(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeKubernetes(t)
+	f.mu.Lock()
+	f.objects[testKubernetesService]["spec"].(map[string]any)["selector"] = map[string]any{"app": "pg"}
+	f.mu.Unlock()
+	c := newTestKubernetesConfigurer(t, f, "10.0.0.11", &vipconfig.Config{KubernetesService: "pg-primary"})
+
+	if c.configureAddress() {
+		t.Error("configureAddress() should refuse a Service with a selector")
+	}
+	if f.get(testKubernetesSlice) != nil {
+		t.Error("no EndpointSlice must be created for a Service with a selector")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// kubernetes-pod-label
+// ---------------------------------------------------------------------------
+
+func TestKubernetesConfigurer_PodLabel(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeKubernetes(t)
+	c := newTestKubernetesConfigurer(t, f, "10.0.0.11", &vipconfig.Config{
+		KubernetesPod:      "pg-0",
+		KubernetesPodLabel: testKubernetesPodLabel,
+	})
+
+	if c.queryAddress() {
+		t.Error("queryAddress() = true without label")
+	}
+	f.mu.Lock()
+	f.conflicts = 1
+	f.mu.Unlock()
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	pod := f.get(testKubernetesPod)
+	labels := pod["metadata"].(map[string]any)["labels"].(map[string]any)
+	if labels[testKubernetesLabel] != testKubernetesLabelVal || labels["app"] != "pg" {
+		t.Errorf("pod labels = %v, want role=primary added", labels)
+	}
+	if pod["spec"] == nil {
+		t.Error("the pod must be written back completely")
+	}
+	if !c.queryAddress() {
+		t.Error("queryAddress() = false after configureAddress()")
+	}
+
+	if !c.deconfigureAddress() {
+		t.Fatal("deconfigureAddress() = false, want true")
+	}
+	labels = f.get(testKubernetesPod)["metadata"].(map[string]any)["labels"].(map[string]any)
+	if _, ok := labels[testKubernetesLabel]; ok || labels["app"] != "pg" {
+		t.Errorf("pod labels = %v, want role removed", labels)
+	}
+	writes := f.writes
+	if !c.deconfigureAddress() || f.writes != writes {
+		t.Error("deconfigureAddress() without label should succeed without writing")
+	}
+}
+
+func TestKubernetesConfigurer_WrongToken(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeKubernetes(t)
+	c := newTestKubernetesConfigurer(t, f, "10.0.0.11", &vipconfig.Config{KubernetesService: "pg-primary"})
+	c.api.authorize = bearerToken("wrong")
+
+	if c.queryAddress() || c.configureAddress() {
+		t.Error("expected failures with a wrong token")
+	}
+}
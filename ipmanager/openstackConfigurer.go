@@ -0,0 +1,434 @@
+package ipmanager
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+	"go.yaml.in/yaml/v3"
+)
+
+// Supported values for openstack-mode
+const (
+	openStackModeAllowedAddressPairs = "allowed-address-pairs"
+	openStackModeFloatingIP          = "floating-ip"
+)
+
+// The OpenStackConfigurer manages the VIP through the Neutron API, whenever
+// manager-type `openstack` is set. Depending on openstack-mode, either the
+// VIP is added to the allowed address pairs of the port of this node, so
+// port security lets its traffic pass, or the VIP is a floating IP that is
+// associated with the port of this node. Afterwards the VIP is added
+// locally like BasicConfigurer does.
+type OpenStackConfigurer struct {
+	*IPConfiguration
+	local    ipConfigurer
+	keystone *apiClient
+	network  *apiClient
+	cloud    *openStackCloud
+	mode     string
+	token    *apiToken
+}
+
+// openStackCloud is an entry of clouds.yaml, see
+// https://docs.openstack.org/openstacksdk/latest/user/config/configuration.html
+type openStackCloud struct {
+	Auth struct {
+		AuthURL                     string `yaml:"auth_url"`
+		Username                    string `yaml:"username"`
+		UserID                      string `yaml:"user_id"`
+		Password                    string `yaml:"password"`
+		UserDomainName              string `yaml:"user_domain_name"`
+		UserDomainID                string `yaml:"user_domain_id"`
+		ProjectName                 string `yaml:"project_name"`
+		ProjectID                   string `yaml:"project_id"`
+		ProjectDomainName           string `yaml:"project_domain_name"`
+		ProjectDomainID             string `yaml:"project_domain_id"`
+		ApplicationCredentialID     string `yaml:"application_credential_id"`
+		ApplicationCredentialSecret string `yaml:"application_credential_secret"`
+	} `yaml:"auth"`
+	RegionName string `yaml:"region_name"`
+	Interface  string `yaml:"interface"`
+}
+
+type openStackAddressPair struct {
+	IPAddress  string `json:"ip_address"`
+	MACAddress string `json:"mac_address,omitempty"`
+}
+
+type openStackPort struct {
+	ID        string `json:"id"`
+	NetworkID string `json:"network_id"`
+	FixedIPs  []struct {
+		IPAddress string `json:"ip_address"`
+	} `json:"fixed_ips"`
+	AllowedAddressPairs []openStackAddressPair `json:"allowed_address_pairs"`
+}
+
+type openStackFloatingIP struct {
+	ID                string  `json:"id"`
+	FloatingIPAddress string  `json:"floating_ip_address"`
+	PortID            *string `json:"port_id"`
+}
+
+// openStackCloudsFiles are the standard locations of clouds.yaml
+func openStackCloudsFiles() []string {
+	files := []string{"clouds.yaml"}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".config", "openstack", "clouds.yaml"))
+	}
+	return append(files, "/etc/openstack/clouds.yaml")
+}
+
+// loadOpenStackCloud reads the cloud called name from clouds.yaml, either
+// the given file or the first one found in the standard locations
+func loadOpenStackCloud(file, name string) (*openStackCloud, error) {
+	files := openStackCloudsFiles()
+	if file != "" {
+		files = []string{file}
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if errors.Is(err, os.ErrNotExist) && file == "" {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", f, err)
+		}
+		var clouds struct {
+			Clouds map[string]*openStackCloud `yaml:"clouds"`
+		}
+		if err = yaml.Unmarshal(b, &clouds); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", f, err)
+		}
+		cloud, ok := clouds.Clouds[name]
+		if !ok {
+			return nil, fmt.Errorf("there is no cloud %q in %s", name, f)
+		}
+		return cloud, nil
+	}
+	return nil, fmt.Errorf("no clouds.yaml found in %s", strings.Join(files, ", "))
+}
+
+func newOpenStackConfigurer(config *IPConfiguration, conf *vipconfig.Config) (*OpenStackConfigurer, error) {
+	mode := cmp.Or(conf.OpenStackMode, openStackModeAllowedAddressPairs)
+	if mode != openStackModeAllowedAddressPairs && mode != openStackModeFloatingIP {
+		return nil, fmt.Errorf("unsupported openstack-mode %q, supported values: allowed-address-pairs, floating-ip", mode)
+	}
+
+	cloud := &openStackCloud{}
+	if conf.OpenStackApplicationCredentialID != "" {
+		secret, err := readSecret(conf.OpenStackApplicationCredentialSecret, "", "OS_APPLICATION_CREDENTIAL_SECRET")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the application credential secret: %w", err)
+		}
+		cloud.Auth.AuthURL = cmp.Or(conf.OpenStackAuthURL, os.Getenv("OS_AUTH_URL"))
+		cloud.Auth.ApplicationCredentialID = conf.OpenStackApplicationCredentialID
+		cloud.Auth.ApplicationCredentialSecret = secret
+	} else {
+		name := cmp.Or(conf.OpenStackCloud, os.Getenv("OS_CLOUD"))
+		if name == "" {
+			return nil, errors.New("either openstack-cloud or openstack-application-credential-id must be set")
+		}
+		var err error
+		if cloud, err = loadOpenStackCloud(conf.OpenStackCloudsFile, name); err != nil {
+			return nil, err
+		}
+	}
+	if cloud.Auth.AuthURL == "" {
+		return nil, errors.New("no Keystone auth_url configured")
+	}
+	cloud.RegionName = cmp.Or(conf.OpenStackRegion, cloud.RegionName)
+
+	local, err := newBasicConfigurer(config)
+	if err != nil {
+		return nil, err
+	}
+	authURL := strings.TrimRight(cloud.Auth.AuthURL, "/")
+	if !strings.HasSuffix(authURL, "/v3") {
+		authURL += "/v3"
+	}
+	c := &OpenStackConfigurer{
+		IPConfiguration: config,
+		local:           local,
+		keystone:        newAPIClient(authURL, nil),
+		cloud:           cloud,
+		mode:            mode,
+	}
+	c.token = &apiToken{fetch: c.fetchToken}
+	return c, nil
+}
+
+// authRequest returns the body of a Keystone v3 token request for either
+// the application credential or the user and project of the cloud
+func (c *OpenStackConfigurer) authRequest() map[string]any {
+	auth := c.cloud.Auth
+	if auth.ApplicationCredentialID != "" {
+		return map[string]any{"auth": map[string]any{"identity": map[string]any{
+			"methods": []string{"application_credential"},
+			"application_credential": map[string]string{
+				"id":     auth.ApplicationCredentialID,
+				"secret": auth.ApplicationCredentialSecret,
+			},
+		}}}
+	}
+
+	domain := func(id, name string) map[string]string {
+		if id != "" {
+			return map[string]string{"id": id}
+		}
+		return map[string]string{"name": cmp.Or(name, "Default")}
+	}
+	user := map[string]any{"password": auth.Password}
+	if auth.UserID != "" {
+		user["id"] = auth.UserID
+	} else {
+		user["name"] = auth.Username
+		user["domain"] = domain(auth.UserDomainID, auth.UserDomainName)
+	}
+	request := map[string]any{"identity": map[string]any{
+		"methods":  []string{"password"},
+		"password": map[string]any{"user": user},
+	}}
+	if auth.ProjectID != "" {
+		request["scope"] = map[string]any{"project": map[string]string{"id": auth.ProjectID}}
+	} else if auth.ProjectName != "" {
+		request["scope"] = map[string]any{"project": map[string]any{
+			"name":   auth.ProjectName,
+			"domain": domain(auth.ProjectDomainID, auth.ProjectDomainName),
+		}}
+	}
+	return map[string]any{"auth": request}
+}
+
+// authenticate makes sure we have a token and know the Neutron endpoint
+func (c *OpenStackConfigurer) authenticate() error {
+	_, err := c.token.get()
+	return err
+}
+
+// fetchToken gets a token from Keystone and looks up the Neutron endpoint
+// in the service catalog that comes with it
+func (c *OpenStackConfigurer) fetchToken() (string, time.Time, error) {
+	var resp struct {
+		Token struct {
+			ExpiresAt time.Time `json:"expires_at"`
+			Catalog   []struct {
+				Type      string `json:"type"`
+				Endpoints []struct {
+					Interface string `json:"interface"`
+					RegionID  string `json:"region_id"`
+					URL       string `json:"url"`
+				} `json:"endpoints"`
+			} `json:"catalog"`
+		} `json:"token"`
+	}
+	header, err := c.keystone.doHeader(http.MethodPost, "/auth/tokens", c.authRequest(), &resp)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to authenticate with Keystone: %w", err)
+	}
+	token := header.Get("X-Subject-Token")
+	if token == "" {
+		return "", time.Time{}, errors.New("no token in the Keystone response")
+	}
+	if c.network != nil {
+		return token, resp.Token.ExpiresAt, nil
+	}
+	iface := strings.TrimSuffix(cmp.Or(c.cloud.Interface, "public"), "URL")
+	for _, service := range resp.Token.Catalog {
+		if service.Type != "network" {
+			continue
+		}
+		for _, endpoint := range service.Endpoints {
+			if endpoint.Interface != iface || (c.cloud.RegionName != "" && endpoint.RegionID != c.cloud.RegionName) {
+				continue
+			}
+			baseURL := strings.TrimRight(endpoint.URL, "/")
+			if !strings.HasSuffix(baseURL, "/v2.0") {
+				baseURL += "/v2.0"
+			}
+			c.network = newAPIClient(baseURL, c.authorizeNetwork)
+			log.Infof("Using the %s network endpoint %s", iface, baseURL)
+			return token, resp.Token.ExpiresAt, nil
+		}
+	}
+	return "", time.Time{}, fmt.Errorf("no %s network endpoint in region %q in the service catalog", iface, c.cloud.RegionName)
+}
+
+func (c *OpenStackConfigurer) authorizeNetwork(req *http.Request) error {
+	token, err := c.token.get()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", token)
+	return nil
+}
+
+// getPort returns the port of our interface, found by its MAC address
+func (c *OpenStackConfigurer) getPort() (*openStackPort, error) {
+	var resp struct {
+		Ports []openStackPort `json:"ports"`
+	}
+	mac := c.Iface.HardwareAddr.String()
+	if err := c.network.do(http.MethodGet, "/ports?mac_address="+url.QueryEscape(mac), nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to query the port with MAC %s: %w", mac, err)
+	}
+	if len(resp.Ports) != 1 {
+		return nil, fmt.Errorf("expected one port with MAC %s, found %d", mac, len(resp.Ports))
+	}
+	return &resp.Ports[0], nil
+}
+
+// hasVIP returns whether the VIP is one of the address pairs, which can be
+// given as plain address or as CIDR
+func (c *OpenStackConfigurer) hasVIP(pair openStackAddressPair) bool {
+	if prefix, err := netip.ParsePrefix(pair.IPAddress); err == nil {
+		return prefix.Addr() == c.VIP && prefix.IsSingleIP()
+	}
+	addr, err := netip.ParseAddr(pair.IPAddress)
+	return err == nil && addr == c.VIP
+}
+
+func (c *OpenStackConfigurer) setAddressPairs(portID string, pairs []openStackAddressPair) error {
+	// an empty list removes all pairs, null is rejected
+	if pairs == nil {
+		pairs = []openStackAddressPair{}
+	}
+	return c.network.do(http.MethodPut, "/ports/"+portID, map[string]any{
+		"port": map[string]any{"allowed_address_pairs": pairs},
+	}, nil)
+}
+
+// moveAddressPair removes the VIP from the allowed address pairs of all other
+// ports in the network, so the old leader can no longer use it, and adds it
+// to ours
+func (c *OpenStackConfigurer) moveAddressPair(own *openStackPort) error {
+	var resp struct {
+		Ports []openStackPort `json:"ports"`
+	}
+	if err := c.network.do(http.MethodGet, "/ports?network_id="+url.QueryEscape(own.NetworkID), nil, &resp); err != nil {
+		return fmt.Errorf("failed to list the ports of network %s: %w", own.NetworkID, err)
+	}
+	for _, port := range resp.Ports {
+		if port.ID == own.ID || !slices.ContainsFunc(port.AllowedAddressPairs, c.hasVIP) {
+			continue
+		}
+		log.Infof("Removing %s from the allowed address pairs of port %s", c.VIP, port.ID)
+		if err := c.setAddressPairs(port.ID, slices.DeleteFunc(port.AllowedAddressPairs, c.hasVIP)); err != nil {
+			return fmt.Errorf("failed to update port %s: %w", port.ID, err)
+		}
+	}
+	if slices.ContainsFunc(own.AllowedAddressPairs, c.hasVIP) {
+		return nil
+	}
+	pairs := append(slices.Clone(own.AllowedAddressPairs), openStackAddressPair{IPAddress: c.VIP.String()})
+	if err := c.setAddressPairs(own.ID, pairs); err != nil {
+		return fmt.Errorf("failed to update port %s: %w", own.ID, err)
+	}
+	return nil
+}
+
+func (c *OpenStackConfigurer) getFloatingIP() (*openStackFloatingIP, error) {
+	var resp struct {
+		FloatingIPs []openStackFloatingIP `json:"floatingips"`
+	}
+	if err := c.network.do(http.MethodGet, "/floatingips?floating_ip_address="+url.QueryEscape(c.VIP.String()), nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to query floating IP %s: %w", c.VIP, err)
+	}
+	if len(resp.FloatingIPs) == 0 {
+		return nil, fmt.Errorf("there is no floating IP %s in this project", c.VIP)
+	}
+	return &resp.FloatingIPs[0], nil
+}
+
+// moveFloatingIP associates the floating IP with the first fixed IP of our
+// port of the same address family
+func (c *OpenStackConfigurer) moveFloatingIP(own *openStackPort) error {
+	floatingIP, err := c.getFloatingIP()
+	if err != nil {
+		return err
+	}
+	if floatingIP.PortID != nil && *floatingIP.PortID == own.ID {
+		return nil
+	}
+	var fixedIP string
+	for _, ip := range own.FixedIPs {
+		if addr, err := netip.ParseAddr(ip.IPAddress); err == nil && addr.Is4() == c.VIP.Is4() {
+			fixedIP = ip.IPAddress
+			break
+		}
+	}
+	if fixedIP == "" {
+		return fmt.Errorf("port %s has no fixed IP to associate %s with", own.ID, c.VIP)
+	}
+	return c.network.do(http.MethodPut, "/floatingips/"+floatingIP.ID, map[string]any{
+		"floatingip": map[string]string{"port_id": own.ID, "fixed_ip_address": fixedIP},
+	}, nil)
+}
+
+func (c *OpenStackConfigurer) queryAddress() bool {
+	if !c.local.queryAddress() {
+		return false
+	}
+	if err := c.authenticate(); err != nil {
+		log.Error(err)
+		return false
+	}
+	own, err := c.getPort()
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	if c.mode == openStackModeFloatingIP {
+		floatingIP, err := c.getFloatingIP()
+		if err != nil {
+			log.Error(err)
+			return false
+		}
+		return floatingIP.PortID != nil && *floatingIP.PortID == own.ID
+	}
+	return slices.ContainsFunc(own.AllowedAddressPairs, c.hasVIP)
+}
+
+func (c *OpenStackConfigurer) queryLocalAddress() bool {
+	return c.local.queryAddress()
+}
+
+func (c *OpenStackConfigurer) configureAddress() bool {
+	if err := c.authenticate(); err != nil {
+		log.Error(err)
+		return false
+	}
+	own, err := c.getPort()
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	if c.mode == openStackModeFloatingIP {
+		err = c.moveFloatingIP(own)
+	} else {
+		err = c.moveAddressPair(own)
+	}
+	if err != nil {
+		log.Errorf("Failed to move %s to port %s: %s", c.VIP, own.ID, err)
+		return false
+	}
+	log.Infof("%s was successfully moved to port %s", c.VIP, own.ID)
+	return c.local.configureAddress()
+}
+
+func (c *OpenStackConfigurer) deconfigureAddress() bool {
+	// The address pair stays on our port, the next leader removes it before
+	// adding it to its own, and the floating IP is associated with the next
+	// port directly. Neither needs anything from us.
+	return c.local.deconfigureAddress()
+}
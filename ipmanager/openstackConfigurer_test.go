@@ -0,0 +1,404 @@
+package ipmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// fakeOpenStack is a stand-in for Keystone and Neutron with a network of
+// two nodes
+type fakeOpenStack struct {
+	*fakeAPI
+	ports       []*openStackPort
+	floatingIPs []*openStackFloatingIP
+	authBodies  []string
+	puts        []string
+}
+
+func newFakeOpenStack(t *testing.T) *fakeOpenStack {
+	t.Helper()
+	f := &fakeOpenStack{ports: []*openStackPort{
+		testOpenStackPort("port-own", "10.0.0.5"),
+		testOpenStackPort("port-other", "10.0.0.6"),
+	}}
+	f.fakeAPI = newFakeAPI(t, f.handle)
+	return f
+}
+
+func testOpenStackPort(id, fixedIP string, pairs ...string) *openStackPort {
+	port := &openStackPort{ID: id, NetworkID: "net-1"}
+	port.FixedIPs = append(port.FixedIPs, struct {
+		IPAddress string `json:"ip_address"`
+	}{fixedIP})
+	for _, ip := range pairs {
+		port.AllowedAddressPairs = append(port.AllowedAddressPairs, openStackAddressPair{IPAddress: ip, MACAddress: "fa:16:3e:00:00:01"})
+	}
+	return port
+}
+
+func (f *fakeOpenStack) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/identity/v3/auth/tokens" && r.Method == http.MethodPost {
+		b, _ := io.ReadAll(r.Body)
+		f.authBodies = append(f.authBodies, string(b))
+		w.Header().Set("X-Subject-Token", "os-token")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, map[string]any{"token": map[string]any{
+			"expires_at": time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			"catalog": []any{
+				map[string]any{"type": "identity", "endpoints": []any{
+					map[string]string{"interface": "public", "region_id": "RegionOne", "url": f.URL + "/identity"},
+				}},
+				map[string]any{"type": "network", "endpoints": []any{
+					map[string]string{"interface": "internal", "region_id": "RegionOne", "url": "http://internal.invalid:9696"},
+					map[string]string{"interface": "public", "region_id": "RegionTwo", "url": "http://region-two.invalid:9696"},
+					map[string]string{"interface": "public", "region_id": "RegionOne", "url": f.URL + "/network/"},
+				}},
+			},
+		}})
+		return
+	}
+	if r.Header.Get("X-Auth-Token") != "os-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch path := strings.TrimPrefix(r.URL.Path, "/network/v2.0"); {
+	case path == "/ports" && r.URL.Query().Has("mac_address"):
+		ports := []*openStackPort{}
+		if r.URL.Query().Get("mac_address") == "00:11:22:33:44:55" {
+			ports = append(ports, f.ports[0])
+		}
+		writeJSON(w, map[string]any{"ports": ports})
+	case path == "/ports":
+		writeJSON(w, map[string]any{"ports": f.ports})
+	case strings.HasPrefix(path, "/ports/") && r.Method == http.MethodPut:
+		var body struct {
+			Port struct {
+				AllowedAddressPairs []openStackAddressPair `json:"allowed_address_pairs"`
+			} `json:"port"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		id := strings.TrimPrefix(path, "/ports/")
+		for _, port := range f.ports {
+			if port.ID == id && body.Port.AllowedAddressPairs != nil {
+				port.AllowedAddressPairs = body.Port.AllowedAddressPairs
+				f.puts = append(f.puts, id)
+				writeJSON(w, map[string]any{"port": port})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	case path == "/floatingips":
+		fips := []*openStackFloatingIP{}
+		for _, fip := range f.floatingIPs {
+			if fip.FloatingIPAddress == r.URL.Query().Get("floating_ip_address") {
+				fips = append(fips, fip)
+			}
+		}
+		writeJSON(w, map[string]any{"floatingips": fips})
+	case strings.HasPrefix(path, "/floatingips/") && r.Method == http.MethodPut:
+		var body struct {
+			FloatingIP struct {
+				PortID         string `json:"port_id"`
+				FixedIPAddress string `json:"fixed_ip_address"`
+			} `json:"floatingip"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		id := strings.TrimPrefix(path, "/floatingips/")
+		for _, fip := range f.floatingIPs {
+			if fip.ID == id && body.FloatingIP.FixedIPAddress == "10.0.0.5" {
+				fip.PortID = &body.FloatingIP.PortID
+				f.puts = append(f.puts, id)
+				writeJSON(w, map[string]any{"floatingip": fip})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeOpenStack) pairs(id string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ips []string
+	for _, port := range f.ports {
+		if port.ID == id {
+			for _, pair := range port.AllowedAddressPairs {
+				ips = append(ips, pair.IPAddress)
+			}
+		}
+	}
+	return ips
+}
+
+// writeCloudsYAML writes a clouds.yaml with a password cloud named test
+func writeCloudsYAML(t *testing.T, f *fakeOpenStack) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "clouds.yaml")
+	content := fmt.Sprintf(`clouds:
+  test:
+    auth:
+      auth_url: %s/identity
+      username: vip-manager
+      password: secret
+      project_name: databases
+      user_domain_name: Default
+      project_domain_name: Default
+    region_name: RegionOne
+    interface: public
+`, f.URL)
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func newTestOpenStackConfigurer(t *testing.T, f *fakeOpenStack, vip, mode string) (*OpenStackConfigurer, *mockConfigurer) {
+	t.Helper()
+	c := newTestConfigurer(t, newOpenStackConfigurer, testHetznerIPConfiguration(vip), &vipconfig.Config{
+		OpenStackMode:       mode,
+		OpenStackCloud:      "test",
+		OpenStackCloudsFile: writeCloudsYAML(t, f),
+	})
+	return c, mockLocal(&c.local)
+}
+
+// ---------------------------------------------------------------------------
+// newOpenStackConfigurer / authentication
+// ---------------------------------------------------------------------------
+
+func TestNewOpenStackConfigurer_Errors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		conf vipconfig.Config
+	}{
+		{"unknown mode", vipconfig.Config{OpenStackMode: "port-forwarding", OpenStackCloud: "test"}},
+		{"missing clouds.yaml", vipconfig.Config{OpenStackCloud: "test", OpenStackCloudsFile: "/nonexistent/clouds.yaml"}},
+		{"application credential without auth url", vipconfig.Config{
+			OpenStackApplicationCredentialID: "id", OpenStackApplicationCredentialSecret: "secret"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if _, err := newOpenStackConfigurer(testHetznerIPConfiguration("10.0.0.10"), &tt.conf); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestLoadOpenStackCloud_Unknown(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeOpenStack(t)
+	if _, err := loadOpenStackCloud(writeCloudsYAML(t, f), "production"); err == nil {
+		t.Error("expected an error for a cloud missing in clouds.yaml")
+	}
+}
+
+func TestOpenStackConfigurer_authenticate_Password(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeOpenStack(t)
+	c, _ := newTestOpenStackConfigurer(t, f, "10.0.0.10", "")
+
+	if err := c.authenticate(); err != nil {
+		t.Fatalf("authenticate() error = %v", err)
+	}
+	if c.network.baseURL != f.URL+"/network/v2.0" {
+		t.Errorf("network endpoint = %s, want the public one of RegionOne", c.network.baseURL)
+	}
+	for _, want := range []string{`"methods":["password"]`, `"name":"vip-manager"`, `"project":{"domain":{"name":"Default"},"name":"databases"}`} {
+		if !strings.Contains(f.authBodies[0], want) {
+			t.Errorf("token request %s does not contain %s", f.authBodies[0], want)
+		}
+	}
+	if err := c.authenticate(); err != nil || len(f.authBodies) != 1 {
+		t.Errorf("expected the token to be reused, got %d token requests, %v", len(f.authBodies), err)
+	}
+}
+
+func TestOpenStackConfigurer_authenticate_ApplicationCredential(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeOpenStack(t)
+	c, err := newOpenStackConfigurer(testHetznerIPConfiguration("10.0.0.10"), &vipconfig.Config{
+		OpenStackAuthURL:                     f.URL + "/identity/v3/",
+		OpenStackApplicationCredentialID:     "app-id",
+		OpenStackApplicationCredentialSecret: "app-secret",
+	})
+	if err != nil {
+		t.Fatalf("newOpenStackConfigurer() error = %v", err)
+	}
+
+	if err = c.authenticate(); err != nil {
+		t.Fatalf("authenticate() error = %v", err)
+	}
+	want := `{"auth":{"identity":{"application_credential":{"id":"app-id","secret":"app-secret"},"methods":["application_credential"]}}}`
+	if f.authBodies[0] != want {
+		t.Errorf("token request = %s, want %s", f.authBodies[0], want)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// allowed address pairs
+// ---------------------------------------------------------------------------
+
+func TestOpenStackConfigurer_AllowedAddressPairs(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeOpenStack(t)
+	f.ports[1] = testOpenStackPort("port-other", "10.0.0.6", "10.0.0.10/32", "10.0.0.11")
+	c, local := newTestOpenStackConfigurer(t, f, "10.0.0.10", "")
+
+	if c.queryAddress() {
+		t.Fatal("queryAddress() = true while the VIP belongs to the other port")
+	}
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if got := f.pairs("port-other"); !slices.Equal(got, []string{"10.0.0.11"}) {
+		t.Errorf("allowed address pairs of the other port = %v", got)
+	}
+	if got := f.pairs("port-own"); !slices.Equal(got, []string{"10.0.0.10"}) {
+		t.Errorf("allowed address pairs of our port = %v", got)
+	}
+	if local.configureCount != 1 {
+		t.Errorf("expected the address to be added locally once, got %d", local.configureCount)
+	}
+	if !c.queryAddress() {
+		t.Error("queryAddress() = false after the VIP was moved")
+	}
+
+	f.puts = nil
+	if !c.configureAddress() || len(f.puts) != 0 {
+		t.Errorf("configuring again should not change any port, got %v", f.puts)
+	}
+}
+
+// TestOpenStackConfigurer_MovedElsewhere covers the old leader after the new
+// one has taken the address pair and the floating IP over
+func TestOpenStackConfigurer_MovedElsewhere(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range []string{"", "floating-ip"} {
+		f := newFakeOpenStack(t)
+		f.ports[1] = testOpenStackPort("port-other", "10.0.0.6", "10.0.0.10")
+		other := "port-other"
+		f.floatingIPs = []*openStackFloatingIP{{ID: "fip-1", FloatingIPAddress: "10.0.0.10", PortID: &other}}
+		c, local := newTestOpenStackConfigurer(t, f, "10.0.0.10", mode)
+
+		if c.queryAddress() {
+			t.Fatalf("mode %q: queryAddress() = true while the VIP belongs to the other port", mode)
+		}
+		if !c.queryLocalAddress() {
+			t.Fatalf("mode %q: queryLocalAddress() = false while the address is configured locally", mode)
+		}
+		runApplyLoop(c, false)
+		if local.deconfigureCount == 0 {
+			t.Errorf("mode %q: expected the address to be removed locally", mode)
+		}
+		if len(f.puts) != 0 {
+			t.Errorf("mode %q: the other port must be left alone, got %v", mode, f.puts)
+		}
+	}
+}
+
+func TestOpenStackConfigurer_queryAddress_NotLocal(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeOpenStack(t)
+	f.ports[0] = testOpenStackPort("port-own", "10.0.0.5", "10.0.0.10")
+	c, local := newTestOpenStackConfigurer(t, f, "10.0.0.10", "")
+	local.shouldQueryReturn = false
+
+	if c.queryAddress() {
+		t.Error("queryAddress() must be false while the address is not configured locally")
+	}
+}
+
+func TestOpenStackConfigurer_configureAddress_UnknownPort(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeOpenStack(t)
+	c, local := newTestOpenStackConfigurer(t, f, "10.0.0.10", "")
+	c.Iface.HardwareAddr = []byte{0x02, 0, 0, 0, 0, 0x99}
+
+	if c.configureAddress() {
+		t.Error("configureAddress() should fail without a port for the interface")
+	}
+	if local.configureCount != 0 {
+		t.Error("the address must not be added locally")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// floating IPs
+// ---------------------------------------------------------------------------
+
+func TestOpenStackConfigurer_FloatingIP(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeOpenStack(t)
+	other := "port-other"
+	f.floatingIPs = []*openStackFloatingIP{{ID: "fip-1", FloatingIPAddress: "203.0.113.10", PortID: &other}}
+	c, local := newTestOpenStackConfigurer(t, f, "203.0.113.10", "floating-ip")
+
+	if c.queryAddress() {
+		t.Fatal("queryAddress() = true while the floating IP belongs to the other port")
+	}
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if *f.floatingIPs[0].PortID != "port-own" {
+		t.Errorf("floating IP is associated with %s, want port-own", *f.floatingIPs[0].PortID)
+	}
+	if local.configureCount != 1 {
+		t.Errorf("expected the address to be added locally once, got %d", local.configureCount)
+	}
+	if !c.queryAddress() {
+		t.Error("queryAddress() = false after the floating IP was moved")
+	}
+}
+
+func TestOpenStackConfigurer_FloatingIP_Missing(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeOpenStack(t)
+	c, _ := newTestOpenStackConfigurer(t, f, "203.0.113.10", "floating-ip")
+
+	if c.configureAddress() {
+		t.Error("configureAddress() should fail without the floating IP")
+	}
+}
+
+func TestOpenStackConfigurer_deconfigureAddress(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeOpenStack(t)
+	c, local := newTestOpenStackConfigurer(t, f, "10.0.0.10", "")
+
+	if !c.deconfigureAddress() {
+		t.Error("deconfigureAddress() = false, want true")
+	}
+	if local.deconfigureCount != 1 {
+		t.Error("expected the address to be removed locally")
+	}
+	if len(f.puts) != 0 {
+		t.Errorf("deconfigureAddress() must leave the VIP to the next leader, got %v", f.puts)
+	}
+}
@@ -0,0 +1,245 @@
+package ipmanager
+
+import (
+	"bufio"
+	"cmp"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+const (
+	defaultOVHEndpoint = "https://eu.api.ovh.com/1.0"
+
+	// ovhTaskTimeout limits how long we wait for the move of an IP to finish
+	ovhTaskTimeout = 5 * time.Minute
+)
+
+// The OVHConfigurer moves an additional IP (formerly failover IP) to this
+// dedicated server through the OVHcloud API, whenever manager-type `ovh` is
+// set. OVHcloud routes the IP block to the server it was moved to without
+// announcing anything to the servers, which therefore all keep the address
+// permanently configured on their public interface.
+type OVHConfigurer struct {
+	*IPConfiguration
+	api         *apiClient
+	credentials ovhCredentials
+	serviceName string
+	ipBlock     string
+
+	// timeDelta is the difference between the clock of the API and ours,
+	// the timestamp of signed requests must match the API clock
+	timeDelta  time.Duration
+	timeSynced bool
+}
+
+type ovhCredentials struct {
+	ApplicationKey    string
+	ApplicationSecret string
+	ConsumerKey       string
+}
+
+type ovhTask struct {
+	TaskID  int64  `json:"taskId"`
+	Status  string `json:"status"`
+	Comment string `json:"comment"`
+}
+
+// readOVHCredentials reads the keys from a file in the format of ovh.conf,
+// as used by the official OVHcloud API clients. Sections are ignored.
+func readOVHCredentials(path string) (creds ovhCredentials, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return creds, fmt.Errorf("can't open credentials file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "[") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+		switch strings.TrimSpace(key) {
+		case "application_key":
+			creds.ApplicationKey = value
+		case "application_secret":
+			creds.ApplicationSecret = value
+		case "consumer_key":
+			creds.ConsumerKey = value
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return creds, fmt.Errorf("failed to read credentials file: %w", err)
+	}
+	if creds.ApplicationKey == "" || creds.ApplicationSecret == "" || creds.ConsumerKey == "" {
+		return creds, errors.New("application_key, application_secret and consumer_key must be set in the credentials file")
+	}
+	return creds, nil
+}
+
+func newOVHConfigurer(config *IPConfiguration, conf *vipconfig.Config) (*OVHConfigurer, error) {
+	// The service name rarely matches the hostname, moving the IP block
+	// to whatever server has that name would be worse than not starting.
+	if conf.OVHServiceName == "" {
+		return nil, errors.New("ovh-service-name must be set for manager-type ovh")
+	}
+	creds, err := readOVHCredentials(cmp.Or(conf.OVHCredentialsFile, "/etc/ovh.conf"))
+	if err != nil {
+		return nil, err
+	}
+	ipBlock := netip.PrefixFrom(config.VIP, config.VIP.BitLen())
+	if conf.OVHIPBlock != "" {
+		if ipBlock, err = netip.ParsePrefix(conf.OVHIPBlock); err != nil {
+			return nil, fmt.Errorf("invalid ovh-ip-block: %w", err)
+		}
+		if !ipBlock.Contains(config.VIP) {
+			return nil, fmt.Errorf("ovh-ip-block %s does not contain %s", ipBlock, config.VIP)
+		}
+	}
+	c := &OVHConfigurer{
+		IPConfiguration: config,
+		credentials:     creds,
+		serviceName:     conf.OVHServiceName,
+		ipBlock:         ipBlock.Masked().String(),
+	}
+	c.api = newAPIClient(cmp.Or(conf.OVHEndpoint, defaultOVHEndpoint), c.sign)
+	return c, nil
+}
+
+// syncTime determines the difference between the clock of the API and ours
+func (c *OVHConfigurer) syncTime() error {
+	if c.timeSynced {
+		return nil
+	}
+	str, err := newAPIClient(c.api.baseURL, nil).getText("/auth/time")
+	if err != nil {
+		return fmt.Errorf("failed to query the API time: %w", err)
+	}
+	serverTime, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return fmt.Errorf("unexpected API time %q: %w", str, err)
+	}
+	c.timeDelta = time.Until(time.Unix(serverTime, 0))
+	c.timeSynced = true
+	return nil
+}
+
+// sign adds the OVHcloud authentication headers, the signature covers the
+// method, URL, body and timestamp of the request, see
+// https://help.ovhcloud.com/csm/en-api-getting-started-ovhcloud-api
+func (c *OVHConfigurer) sign(req *http.Request) error {
+	if err := c.syncTime(); err != nil {
+		return err
+	}
+	var body []byte
+	if req.GetBody != nil {
+		r, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		if body, err = io.ReadAll(r); err != nil {
+			return err
+		}
+	}
+	timestamp := strconv.FormatInt(time.Now().Add(c.timeDelta).Unix(), 10)
+	sum := sha1.Sum([]byte(strings.Join([]string{
+		c.credentials.ApplicationSecret,
+		c.credentials.ConsumerKey,
+		req.Method,
+		req.URL.String(),
+		string(body),
+		timestamp,
+	}, "+")))
+
+	req.Header.Set("X-Ovh-Application", c.credentials.ApplicationKey)
+	req.Header.Set("X-Ovh-Consumer", c.credentials.ConsumerKey)
+	req.Header.Set("X-Ovh-Timestamp", timestamp)
+	req.Header.Set("X-Ovh-Signature", "$1$"+hex.EncodeToString(sum[:]))
+	return nil
+}
+
+func (c *OVHConfigurer) ipPath() string {
+	return "/ip/" + url.PathEscape(c.ipBlock)
+}
+
+// getRoutedTo returns the service name of the server the IP block is routed
+// to, empty if it isn't routed anywhere
+func (c *OVHConfigurer) getRoutedTo() (string, error) {
+	var resp struct {
+		RoutedTo *struct {
+			ServiceName string `json:"serviceName"`
+		} `json:"routedTo"`
+	}
+	if err := c.api.do(http.MethodGet, c.ipPath(), nil, &resp); err != nil {
+		return "", fmt.Errorf("failed to query %s: %w", c.ipBlock, err)
+	}
+	if resp.RoutedTo == nil {
+		return "", nil
+	}
+	return resp.RoutedTo.ServiceName, nil
+}
+
+// waitForTask polls the task until it is no longer pending
+func (c *OVHConfigurer) waitForTask(task ovhTask) error {
+	deadline := time.Now().Add(ovhTaskTimeout)
+	for task.Status == "init" || task.Status == "todo" || task.Status == "doing" {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("task %d did not finish within %s", task.TaskID, ovhTaskTimeout)
+		}
+		time.Sleep(time.Duration(max(c.RetryAfter, 1)) * time.Millisecond)
+		if err := c.api.do(http.MethodGet, fmt.Sprintf("%s/task/%d", c.ipPath(), task.TaskID), nil, &task); err != nil {
+			return fmt.Errorf("failed to query task %d: %w", task.TaskID, err)
+		}
+	}
+	if task.Status != "done" {
+		return fmt.Errorf("task %d finished with status %q: %s", task.TaskID, task.Status, task.Comment)
+	}
+	return nil
+}
+
+func (c *OVHConfigurer) queryAddress() bool {
+	routedTo, err := c.getRoutedTo()
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	log.Debugf("%s is routed to %q", c.ipBlock, routedTo)
+	return routedTo == c.serviceName
+}
+
+func (c *OVHConfigurer) configureAddress() bool {
+	var task ovhTask
+	err := c.api.do(http.MethodPost, c.ipPath()+"/move", map[string]string{"to": c.serviceName}, &task)
+	if err == nil {
+		err = c.waitForTask(task)
+	}
+	if err != nil {
+		log.Errorf("Failed to move %s to %s: %s", c.ipBlock, c.serviceName, err)
+		return false
+	}
+	log.Infof("%s was successfully moved to %s", c.ipBlock, c.serviceName)
+	return true
+}
+
+func (c *OVHConfigurer) deconfigureAddress() bool {
+	// An additional IP is always routed to some service, and its move
+	// takes it from ours when the next leader asks for it.
+	return true
+}
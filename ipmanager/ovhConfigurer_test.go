@@ -0,0 +1,284 @@
+package ipmanager
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// fakeOVH is a stand-in for the OVHcloud API, checking the signature of
+// every request. Its clock is an hour ahead, tasks are done after being
+// polled once.
+type fakeOVH struct {
+	*fakeAPI
+	routedTo  string
+	tasks     map[int64]string
+	failTasks bool
+}
+
+const ovhTestBlock = "/1.0/ip/192.0.2.8%2F29"
+
+func newFakeOVH(t *testing.T) *fakeOVH {
+	t.Helper()
+	f := &fakeOVH{routedTo: "ns2.ip-198-51-100.eu", tasks: map[int64]string{}}
+	f.fakeAPI = newFakeAPI(t, f.handle)
+	return f
+}
+
+func (f *fakeOVH) now() time.Time {
+	return time.Now().Add(time.Hour)
+}
+
+func (f *fakeOVH) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/1.0/auth/time" {
+		fmt.Fprint(w, f.now().Unix())
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	if msg := f.checkSignature(r, body); msg != "" {
+		w.WriteHeader(http.StatusForbidden)
+		writeJSON(w, map[string]string{"message": msg})
+		return
+	}
+
+	switch path := r.URL.EscapedPath(); {
+	case path == ovhTestBlock && r.Method == http.MethodGet:
+		ip := map[string]any{"ip": "192.0.2.8/29", "routedTo": nil}
+		if f.routedTo != "" {
+			ip["routedTo"] = map[string]string{"serviceName": f.routedTo}
+		}
+		writeJSON(w, ip)
+	case path == ovhTestBlock+"/move" && r.Method == http.MethodPost:
+		var move struct {
+			To string `json:"to"`
+		}
+		_ = json.Unmarshal(body, &move)
+		id := int64(len(f.tasks) + 1)
+		f.tasks[id] = "todo"
+		if !f.failTasks {
+			f.routedTo = move.To
+		}
+		writeJSON(w, map[string]any{"taskId": id, "status": "todo", "function": "genericMoveFloatingIp"})
+	case strings.HasPrefix(path, ovhTestBlock+"/task/"):
+		id, _ := strconv.ParseInt(strings.TrimPrefix(path, ovhTestBlock+"/task/"), 10, 64)
+		f.tasks[id] = "done"
+		if f.failTasks {
+			f.tasks[id] = "ovhError"
+		}
+		writeJSON(w, map[string]any{"taskId": id, "status": f.tasks[id], "comment": "moved"})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// checkSignature returns why the request isn't properly signed, if it isn't
+func (f *fakeOVH) checkSignature(r *http.Request, body []byte) string {
+	if r.Header.Get("X-Ovh-Application") != "app-key" || r.Header.Get("X-Ovh-Consumer") != "consumer-key" {
+		return "Invalid application key"
+	}
+	timestamp, _ := strconv.ParseInt(r.Header.Get("X-Ovh-Timestamp"), 10, 64)
+	if d := f.now().Unix() - timestamp; d < -5 || d > 5 {
+		return "Query out of time"
+	}
+	sum := sha1.Sum([]byte(strings.Join([]string{
+		"app-secret", "consumer-key", r.Method, "http://" + r.Host + r.URL.RequestURI(), string(body), r.Header.Get("X-Ovh-Timestamp"),
+	}, "+")))
+	if r.Header.Get("X-Ovh-Signature") != "$1$"+hex.EncodeToString(sum[:]) {
+		return "Invalid signature"
+	}
+	return ""
+}
+
+func writeOVHCredentials(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ovh.conf")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testOVHCredentials = `[default]
+; the endpoint is taken from ovh-endpoint
+endpoint=ovh-eu
+
+[ovh-eu]
+application_key=app-key
+application_secret="app-secret"
+consumer_key=consumer-key
+`
+
+func newTestOVHConfigurer(t *testing.T, f *fakeOVH) *OVHConfigurer {
+	t.Helper()
+	return newTestConfigurer(t, newOVHConfigurer, testHetznerIPConfiguration("192.0.2.10"), &vipconfig.Config{
+		OVHCredentialsFile: writeOVHCredentials(t, testOVHCredentials),
+		OVHEndpoint:        f.URL + "/1.0",
+		OVHServiceName:     "ns1.ip-198-51-100.eu",
+		OVHIPBlock:         "192.0.2.8/29",
+	})
+}
+
+// ---------------------------------------------------------------------------
+// newOVHConfigurer
+// ---------------------------------------------------------------------------
+
+func TestReadOVHCredentials(t *testing.T) {
+	t.Parallel()
+
+	creds, err := readOVHCredentials(writeOVHCredentials(t, testOVHCredentials))
+	if err != nil {
+		t.Fatalf("readOVHCredentials() error = %v", err)
+	}
+	want := ovhCredentials{ApplicationKey: "app-key", ApplicationSecret: "app-secret", ConsumerKey: "consumer-key"}
+	if creds != want {
+		t.Errorf("readOVHCredentials() = %+v, want %+v", creds, want)
+	}
+
+	if _, err = readOVHCredentials(writeOVHCredentials(t, "application_key=app-key\n")); err == nil {
+		t.Error("expected an error for incomplete credentials")
+	}
+	if _, err = readOVHCredentials(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestNewOVHConfigurer_IPBlock(t *testing.T) {
+	t.Parallel()
+
+	credentials := writeOVHCredentials(t, testOVHCredentials)
+	tests := []struct {
+		ipBlock string
+		want    string
+		wantErr bool
+	}{
+		{"", "192.0.2.10/32", false},
+		{"192.0.2.8/29", "192.0.2.8/29", false},
+		{"192.0.2.10/29", "192.0.2.8/29", false},
+		{"198.51.100.0/29", "", true},
+		{"invalid", "", true},
+	}
+	for _, tt := range tests {
+		c, err := newOVHConfigurer(testHetznerIPConfiguration("192.0.2.10"), &vipconfig.Config{
+			OVHCredentialsFile: credentials,
+			OVHServiceName:     "ns1.ip-198-51-100.eu",
+			OVHIPBlock:         tt.ipBlock,
+		})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newOVHConfigurer(%q) error = %v, wantErr %v", tt.ipBlock, err, tt.wantErr)
+			continue
+		}
+		if err == nil && c.ipBlock != tt.want {
+			t.Errorf("newOVHConfigurer(%q) ipBlock = %s, want %s", tt.ipBlock, c.ipBlock, tt.want)
+		}
+	}
+}
+
+func TestNewOVHConfigurer_NoServiceName(t *testing.T) {
+	t.Parallel()
+
+	_, err := newOVHConfigurer(testHetznerIPConfiguration("192.0.2.10"), &vipconfig.Config{
+		OVHCredentialsFile: writeOVHCredentials(t, testOVHCredentials),
+	})
+	if err == nil {
+		t.Error("expected an error without ovh-service-name")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// queryAddress / configureAddress / deconfigureAddress
+// ---------------------------------------------------------------------------
+
+func TestOVHConfigurer_queryAddress(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeOVH(t)
+	c := newTestOVHConfigurer(t, f)
+
+	for _, tt := range []struct {
+		routedTo string
+		want     bool
+	}{
+		{"ns2.ip-198-51-100.eu", false},
+		{"ns1.ip-198-51-100.eu", true},
+		{"", false},
+	} {
+		f.mu.Lock()
+		f.routedTo = tt.routedTo
+		f.mu.Unlock()
+		if got := c.queryAddress(); got != tt.want {
+			t.Errorf("queryAddress() routed to %q = %v, want %v", tt.routedTo, got, tt.want)
+		}
+	}
+	if !c.timeSynced || c.timeDelta < 59*time.Minute {
+		t.Errorf("expected the clock difference to the API to be taken into account, got %s", c.timeDelta)
+	}
+}
+
+func TestOVHConfigurer_configureAddress(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeOVH(t)
+	c := newTestOVHConfigurer(t, f)
+
+	if !c.configureAddress() {
+		t.Fatal("configureAddress() = false, want true")
+	}
+	if f.routedTo != "ns1.ip-198-51-100.eu" {
+		t.Errorf("IP block is routed to %s, want ns1.ip-198-51-100.eu", f.routedTo)
+	}
+	if f.tasks[1] != "done" {
+		t.Errorf("expected the task to be polled until done, got %q", f.tasks[1])
+	}
+	if !c.queryAddress() {
+		t.Error("queryAddress() = false after the move")
+	}
+}
+
+func TestOVHConfigurer_configureAddress_TaskFails(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeOVH(t)
+	f.failTasks = true
+	c := newTestOVHConfigurer(t, f)
+
+	if c.configureAddress() {
+		t.Error("configureAddress() should fail when the task fails")
+	}
+}
+
+func TestOVHConfigurer_WrongSecret(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeOVH(t)
+	c := newTestOVHConfigurer(t, f)
+	c.credentials.ApplicationSecret = "wrong"
+
+	if c.queryAddress() || c.configureAddress() {
+		t.Error("expected failures with a wrong application secret")
+	}
+}
+
+func TestOVHConfigurer_deconfigureAddress(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeOVH(t)
+	c := newTestOVHConfigurer(t, f)
+
+	if !c.deconfigureAddress() {
+		t.Error("deconfigureAddress() = false, want true")
+	}
+	if len(f.tasks) != 0 {
+		t.Error("deconfigureAddress() must leave the IP to the next leader")
+	}
+}
@@ -0,0 +1,91 @@
+package ipmanager
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// transitionHooks are user supplied commands run around configureAddress
+// and deconfigureAddress, whatever the manager-type, e.g. to reload a
+// connection pooler or notify monitoring. They get the environment of the
+// exec configurer, VIP_ACTION being the name of the hook, and post hooks
+// additionally learn in VIP_RESULT if the change succeeded.
+type transitionHooks struct {
+	preUp     string
+	postUp    string
+	preDown   string
+	postDown  string
+	preUpVeto bool
+	timeout   time.Duration
+	env       []string
+}
+
+func newTransitionHooks(config *IPConfiguration, conf *vipconfig.Config) (*transitionHooks, error) {
+	h := &transitionHooks{
+		preUp:     conf.PreUp,
+		postUp:    conf.PostUp,
+		preDown:   conf.PreDown,
+		postDown:  conf.PostDown,
+		preUpVeto: conf.PreUpVeto,
+		timeout:   time.Duration(conf.HookTimeout) * time.Millisecond,
+		env:       commandEnv(config, conf),
+	}
+	if h.preUp+h.postUp+h.preDown+h.postDown != "" && h.timeout <= 0 {
+		return nil, errors.New("hook-timeout must be positive")
+	}
+	return h, nil
+}
+
+// run runs the hook, if set, and tells if it succeeded
+func (h *transitionHooks) run(name, line string, env ...string) bool {
+	if line == "" {
+		return true
+	}
+	code, err := runCommand(name, line, slices.Concat(h.env, []string{"VIP_ACTION=" + name}, env), h.timeout, log.Infof)
+	switch {
+	case err != nil:
+		log.Error(err)
+		return false
+	case code != 0:
+		log.Errorf("%s exited with code %d", name, code)
+		return false
+	}
+	return true
+}
+
+// up runs configure between pre-up and post-up. A failing pre-up only
+// prevents the change with pre-up-veto, the next check tries again then.
+func (h *transitionHooks) up(configure func() bool) bool {
+	if h == nil {
+		return configure()
+	}
+	if !h.run("pre-up", h.preUp) && h.preUpVeto {
+		log.Warn("pre-up failed, the VIP is not configured because of pre-up-veto")
+		return false
+	}
+	ok := configure()
+	h.run("post-up", h.postUp, "VIP_RESULT="+hookResult(ok))
+	return ok
+}
+
+// down runs deconfigure between pre-down and post-down. Losing the
+// leadership can't be vetoed, so the result of pre-down is only logged.
+func (h *transitionHooks) down(deconfigure func() bool) bool {
+	if h == nil {
+		return deconfigure()
+	}
+	h.run("pre-down", h.preDown)
+	ok := deconfigure()
+	h.run("post-down", h.postDown, "VIP_RESULT="+hookResult(ok))
+	return ok
+}
+
+func hookResult(ok bool) string {
+	if ok {
+		return "success"
+	}
+	return "failure"
+}
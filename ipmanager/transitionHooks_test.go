@@ -0,0 +1,167 @@
+package ipmanager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// testHooksConfig returns hooks appending their name and result to a file
+func testHooksConfig(file string) *vipconfig.Config {
+	hook := fmt.Sprintf(`echo "$VIP_ACTION $VIP_IP $VIP_RESULT" >> %q`, file)
+	return &vipconfig.Config{
+		PreUp:       hook,
+		PostUp:      hook,
+		PreDown:     hook,
+		PostDown:    hook,
+		HookTimeout: 5000,
+	}
+}
+
+func newTestTransitionHooks(t *testing.T, conf *vipconfig.Config) *transitionHooks {
+	t.Helper()
+
+	h, err := newTransitionHooks(testHetznerIPConfiguration("10.0.0.100"), conf)
+	if err != nil {
+		t.Fatalf("newTransitionHooks() error = %v", err)
+	}
+	return h
+}
+
+// readHookLog returns the lines written by the hooks
+func readHookLog(t *testing.T, file string) []string {
+	t.Helper()
+	b, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+// ---------------------------------------------------------------------------
+// newTransitionHooks
+// ---------------------------------------------------------------------------
+
+func TestNewTransitionHooks(t *testing.T) {
+	t.Parallel()
+
+	if _, err := newTransitionHooks(testHetznerIPConfiguration("10.0.0.100"), &vipconfig.Config{}); err != nil {
+		t.Errorf("newTransitionHooks() without hooks error = %v", err)
+	}
+	if _, err := newTransitionHooks(testHetznerIPConfiguration("10.0.0.100"), &vipconfig.Config{PostUp: "true"}); err == nil {
+		t.Error("expected an error for hooks without timeout")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// up / down
+// ---------------------------------------------------------------------------
+
+func TestTransitionHooks(t *testing.T) {
+	t.Parallel()
+	skipWithoutShell(t)
+
+	file := filepath.Join(t.TempDir(), "hooks.log")
+	h := newTestTransitionHooks(t, testHooksConfig(file))
+
+	var calls []string
+	if !h.up(func() bool { calls = append(calls, "configure"); return true }) {
+		t.Error("up() = false, want true")
+	}
+	if h.down(func() bool { calls = append(calls, "deconfigure"); return false }) {
+		t.Error("down() = true, want the result of deconfigure")
+	}
+	if len(calls) != 2 {
+		t.Errorf("expected configure and deconfigure to be called once, got %v", calls)
+	}
+	want := []string{
+		"pre-up 10.0.0.100 ",
+		"post-up 10.0.0.100 success",
+		"pre-down 10.0.0.100 ",
+		"post-down 10.0.0.100 failure",
+	}
+	if got := readHookLog(t, file); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("hooks ran as %q, want %q", got, want)
+	}
+}
+
+func TestTransitionHooks_PreUpFails(t *testing.T) {
+	t.Parallel()
+	skipWithoutShell(t)
+
+	conf := testHooksConfig(filepath.Join(t.TempDir(), "hooks.log"))
+	conf.PreUp = "exit 1"
+	h := newTestTransitionHooks(t, conf)
+
+	configured := 0
+	configure := func() bool { configured++; return true }
+	if !h.up(configure) || configured != 1 {
+		t.Error("a failing pre-up must not prevent the change without pre-up-veto")
+	}
+
+	h.preUpVeto = true
+	if h.up(configure) || configured != 1 {
+		t.Error("a failing pre-up must prevent the change with pre-up-veto")
+	}
+}
+
+func TestTransitionHooks_PreDownFails(t *testing.T) {
+	t.Parallel()
+	skipWithoutShell(t)
+
+	conf := testHooksConfig(filepath.Join(t.TempDir(), "hooks.log"))
+	conf.PreDown = "exit 1"
+	conf.PreUpVeto = true
+	h := newTestTransitionHooks(t, conf)
+
+	deconfigured := false
+	if !h.down(func() bool { deconfigured = true; return true }) || !deconfigured {
+		t.Error("a failing pre-down must not prevent the change")
+	}
+}
+
+func TestTransitionHooks_Nil(t *testing.T) {
+	t.Parallel()
+
+	var h *transitionHooks
+	if !h.up(func() bool { return true }) || h.down(func() bool { return false }) {
+		t.Error("without hooks, the result of the change must be returned")
+	}
+}
+
+func TestApplyLoop_PreUpVeto(t *testing.T) {
+	t.Parallel()
+	skipWithoutShell(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+
+	file := filepath.Join(t.TempDir(), "hooks.log")
+	conf := testHooksConfig(file)
+	conf.PreUp = "exit 1"
+	conf.PreUpVeto = true
+	mock := &mockConfigurer{shouldQueryReturn: false}
+	m := &IPManager{
+		configurer:  mock,
+		hooks:       newTestTransitionHooks(t, conf),
+		recheckChan: make(chan struct{}, 1),
+	}
+	m.shouldSetIPUp.Store(true)
+
+	m.applyLoop(ctx)
+
+	if mock.configureCount != 0 {
+		t.Error("configureAddress must not be called after pre-up vetoed")
+	}
+	if got := readHookLog(t, file); got != nil {
+		t.Errorf("post-up must not run after pre-up vetoed, got %q", got)
+	}
+}
@@ -0,0 +1,249 @@
+// Package kubernetes loads the credentials to talk to the API server of a
+// Kubernetes cluster, from a kubeconfig file or the service account of the
+// pod vip-manager runs in
+package kubernetes
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// serviceAccountDir is where the credentials of the service account are
+// mounted into every pod
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Config holds what is needed to talk to the API server, either taken from
+// a kubeconfig file or from the service account of the pod
+type Config struct {
+	Server    string
+	Namespace string
+	TLS       *tls.Config
+	Token     string
+	// TokenFile is read for every request, projected service account
+	// tokens are rotated while we are running
+	TokenFile string
+}
+
+// kubeconfig is the subset of a kubeconfig file we support, see
+// https://kubernetes.io/docs/concepts/configuration/organize-cluster-access-kubeconfig/
+type kubeconfig struct {
+	CurrentContext string              `yaml:"current-context"`
+	Clusters       []kubeconfigCluster `yaml:"clusters"`
+	Users          []kubeconfigUser    `yaml:"users"`
+	Contexts       []kubeconfigContext `yaml:"contexts"`
+}
+
+type kubeconfigCluster struct {
+	Name    string `yaml:"name"`
+	Cluster struct {
+		Server                   string `yaml:"server"`
+		CertificateAuthority     string `yaml:"certificate-authority"`
+		CertificateAuthorityData string `yaml:"certificate-authority-data"`
+		InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		TLSServerName            string `yaml:"tls-server-name"`
+	} `yaml:"cluster"`
+}
+
+type kubeconfigUser struct {
+	Name string `yaml:"name"`
+	User struct {
+		Token                 string     `yaml:"token"`
+		TokenFile             string     `yaml:"tokenFile"`
+		ClientCertificate     string     `yaml:"client-certificate"`
+		ClientCertificateData string     `yaml:"client-certificate-data"`
+		ClientKey             string     `yaml:"client-key"`
+		ClientKeyData         string     `yaml:"client-key-data"`
+		Exec                  *yaml.Node `yaml:"exec"`
+		AuthProvider          *yaml.Node `yaml:"auth-provider"`
+	} `yaml:"user"`
+}
+
+type kubeconfigContext struct {
+	Name    string `yaml:"name"`
+	Context struct {
+		Cluster   string `yaml:"cluster"`
+		User      string `yaml:"user"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"context"`
+}
+
+// LoadConfig uses the given kubeconfig file if set, else the service
+// account when running in a pod, else the kubeconfig of $KUBECONFIG or
+// ~/.kube/config. context selects a context of the kubeconfig file,
+// defaulting to its current-context.
+func LoadConfig(file, context string) (*Config, error) {
+	if file == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return loadInClusterConfig(serviceAccountDir)
+	}
+	if file == "" {
+		file = filepath.SplitList(os.Getenv("KUBECONFIG"))[0]
+	}
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("no kubeconfig found: %w", err)
+		}
+		file = filepath.Join(home, ".kube", "config")
+	}
+	return loadKubeconfig(file, context)
+}
+
+// loadInClusterConfig uses the service account mounted to dir
+func loadInClusterConfig(dir string) (*Config, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set in a pod")
+	}
+	ca, err := os.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the CA of the service account: %w", err)
+	}
+	tlsClientConfig, err := tlsConfig(ca, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := os.ReadFile(filepath.Join(dir, "namespace"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the namespace of the service account: %w", err)
+	}
+	return &Config{
+		Server:    "https://" + net.JoinHostPort(host, port),
+		Namespace: strings.TrimSpace(string(namespace)),
+		TLS:       tlsClientConfig,
+		TokenFile: filepath.Join(dir, "token"),
+	}, nil
+}
+
+// loadKubeconfig reads the cluster and user of context from file
+func loadKubeconfig(file, context string) (*Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	var kc kubeconfig
+	if err = yaml.Unmarshal(b, &kc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	context = cmp.Or(context, kc.CurrentContext)
+	idx := slices.IndexFunc(kc.Contexts, func(c kubeconfigContext) bool { return c.Name == context })
+	if idx < 0 {
+		return nil, fmt.Errorf("there is no context %q in %s", context, file)
+	}
+	ctx := kc.Contexts[idx].Context
+	clusterIdx := slices.IndexFunc(kc.Clusters, func(c kubeconfigCluster) bool { return c.Name == ctx.Cluster })
+	if clusterIdx < 0 {
+		return nil, fmt.Errorf("there is no cluster %q in %s", ctx.Cluster, file)
+	}
+	cluster := kc.Clusters[clusterIdx].Cluster
+	config := &Config{
+		Server:    strings.TrimRight(cluster.Server, "/"),
+		Namespace: ctx.Namespace,
+	}
+	if config.Server == "" {
+		return nil, fmt.Errorf("cluster %q in %s has no server", ctx.Cluster, file)
+	}
+
+	// relative paths are relative to the kubeconfig file
+	dir := filepath.Dir(file)
+	readData := func(data, path string) ([]byte, error) {
+		if data != "" {
+			return base64.StdEncoding.DecodeString(data)
+		}
+		if path == "" {
+			return nil, nil
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		return os.ReadFile(path)
+	}
+	ca, err := readData(cluster.CertificateAuthorityData, cluster.CertificateAuthority)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the CA of cluster %q: %w", ctx.Cluster, err)
+	}
+
+	var cert, key []byte
+	if userIdx := slices.IndexFunc(kc.Users, func(u kubeconfigUser) bool { return u.Name == ctx.User }); userIdx >= 0 {
+		user := kc.Users[userIdx].User
+		if user.Exec != nil || user.AuthProvider != nil {
+			return nil, fmt.Errorf("user %q in %s uses a credential plugin, which is not supported, use a token or client certificate", ctx.User, file)
+		}
+		config.Token = user.Token
+		if user.TokenFile != "" && user.Token == "" {
+			config.TokenFile = user.TokenFile
+			if !filepath.IsAbs(config.TokenFile) {
+				config.TokenFile = filepath.Join(dir, config.TokenFile)
+			}
+		}
+		if cert, err = readData(user.ClientCertificateData, user.ClientCertificate); err != nil {
+			return nil, fmt.Errorf("failed to read the client certificate of user %q: %w", ctx.User, err)
+		}
+		if key, err = readData(user.ClientKeyData, user.ClientKey); err != nil {
+			return nil, fmt.Errorf("failed to read the client key of user %q: %w", ctx.User, err)
+		}
+	} else if ctx.User != "" {
+		return nil, fmt.Errorf("there is no user %q in %s", ctx.User, file)
+	}
+
+	if config.TLS, err = tlsConfig(ca, cert, key); err != nil {
+		return nil, err
+	}
+	config.TLS.InsecureSkipVerify = cluster.InsecureSkipTLSVerify
+	config.TLS.ServerName = cluster.TLSServerName
+	return config, nil
+}
+
+// tlsConfig trusts ca, if given, instead of the system roots and
+// presents the client certificate, if given
+func tlsConfig(ca, cert, key []byte) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(ca) > 0 {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in the CA of the cluster")
+		}
+	}
+	if len(cert) > 0 || len(key) > 0 {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config, nil
+}
+
+// Authorize adds the bearer token, if any, to req
+func (c *Config) Authorize(req *http.Request) error {
+	token := c.Token
+	if c.TokenFile != "" {
+		b, err := os.ReadFile(c.TokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// Transport returns an HTTP transport using the TLS config of the cluster
+func (c *Config) Transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = c.TLS
+	return transport
+}
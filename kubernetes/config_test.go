@@ -0,0 +1,149 @@
+package kubernetes
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cybertec-postgresql/vip-manager/kubernetes/kubetest"
+)
+
+const testToken = "test-token"
+
+// newTestServer returns an API server answering with the Authorization
+// header it received
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func serverCA(s *httptest.Server) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+}
+
+// get requests the test server with config and returns what it answered
+func get(t *testing.T, config *Config, url string) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = config.Authorize(req); err != nil {
+		t.Fatalf("Authorize() error = %v", err)
+	}
+	resp, err := (&http.Client{Transport: config.Transport()}).Do(req)
+	if err != nil {
+		t.Fatalf("request to the API server failed: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// ---------------------------------------------------------------------------
+// loadKubeconfig
+// ---------------------------------------------------------------------------
+
+func TestLoadKubeconfig(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServer(t)
+	path := kubetest.WriteKubeconfig(t, s, testToken)
+
+	config, err := loadKubeconfig(path, "")
+	if err != nil {
+		t.Fatalf("loadKubeconfig() error = %v", err)
+	}
+	if config.Server != s.URL || config.Namespace != "db" {
+		t.Errorf("loadKubeconfig() server, namespace = %s, %s, want %s, db", config.Server, config.Namespace, s.URL)
+	}
+	if config.TokenFile != filepath.Join(filepath.Dir(path), "token") {
+		t.Errorf("expected the token file relative to the kubeconfig, got %s", config.TokenFile)
+	}
+	if got := get(t, config, s.URL); got != "Bearer "+testToken {
+		t.Errorf("the API server got Authorization %q", got)
+	}
+
+	if _, err = loadKubeconfig(path, "plugin"); err == nil || !strings.Contains(err.Error(), "credential plugin") {
+		t.Errorf("expected an error for a credential plugin, got %v", err)
+	}
+	if _, err = loadKubeconfig(path, "nouser"); err == nil {
+		t.Error("expected an error for a missing user")
+	}
+	if _, err = loadKubeconfig(path, "missing"); err == nil {
+		t.Error("expected an error for a missing context")
+	}
+	if _, err = loadKubeconfig(filepath.Join(t.TempDir(), "missing"), ""); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestLoadConfig_Kubeconfig(t *testing.T) {
+	s := newTestServer(t)
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBECONFIG", kubetest.WriteKubeconfig(t, s, testToken))
+
+	config, err := LoadConfig("", "")
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if config.Server != s.URL {
+		t.Errorf("LoadConfig() server = %s, want the one of $KUBECONFIG", config.Server)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// loadInClusterConfig
+// ---------------------------------------------------------------------------
+
+func TestLoadInClusterConfig(t *testing.T) {
+	s := newTestServer(t)
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"ca.crt":    string(serverCA(s)),
+		"namespace": "db\n",
+		"token":     testToken,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("KUBERNETES_SERVICE_HOST", "10.96.0.1")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "443")
+
+	config, err := loadInClusterConfig(dir)
+	if err != nil {
+		t.Fatalf("loadInClusterConfig() error = %v", err)
+	}
+	if config.Server != "https://10.96.0.1:443" || config.Namespace != "db" {
+		t.Errorf("loadInClusterConfig() server, namespace = %s, %s", config.Server, config.Namespace)
+	}
+
+	// the token is read for every request, it is rotated by the kubelet
+	if got := get(t, config, s.URL); got != "Bearer "+testToken {
+		t.Errorf("the API server got Authorization %q", got)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "token"), []byte("rotated"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, config, s.URL); got != "Bearer rotated" {
+		t.Errorf("expected the rotated token to be used, got %q", got)
+	}
+
+	t.Setenv("KUBERNETES_SERVICE_PORT", "")
+	if _, err = loadInClusterConfig(dir); err == nil {
+		t.Error("expected an error outside of a pod")
+	}
+}
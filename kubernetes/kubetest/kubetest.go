@@ -0,0 +1,61 @@
+// Package kubetest provides what the tests of the packages talking to the
+// API server need to point them to a fake one
+package kubetest
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// WriteKubeconfig writes a kubeconfig trusting the TLS server s and returns
+// its path. The current context db uses namespace db and authenticates with
+// token, which is read from the file token next to the kubeconfig. The
+// context plugin uses a credential plugin and nouser a missing user.
+func WriteKubeconfig(t testing.TB, s *httptest.Server, token string) string {
+	t.Helper()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "token"), []byte(token+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	content := `apiVersion: v1
+kind: Config
+current-context: db
+clusters:
+- name: test
+  cluster:
+    server: ` + s.URL + `/
+    certificate-authority-data: ` + base64.StdEncoding.EncodeToString(ca) + `
+users:
+- name: vip-manager
+  user:
+    tokenFile: token
+- name: plugin
+  user:
+    exec:
+      command: kubectl-login
+contexts:
+- name: db
+  context:
+    cluster: test
+    user: vip-manager
+    namespace: db
+- name: plugin
+  context:
+    cluster: test
+    user: plugin
+- name: nouser
+  context:
+    cluster: test
+    user: missing
+`
+	path := filepath.Join(dir, "kubeconfig")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
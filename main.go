@@ -37,17 +37,6 @@ func main() {
 	log := conf.Logger.Sugar()
 	defer func() { _ = conf.Logger.Sync() }()
 
-	lc, err := checker.NewLeaderChecker(conf)
-	if err != nil {
-		log.Fatalf("Failed to initialize leader checker: %s", err)
-	}
-
-	states := make(chan bool)
-	manager, err := ipmanager.NewIPManager(conf, states)
-	if err != nil {
-		log.Fatalf("Problems with generating the virtual ip manager: %s", err)
-	}
-
 	mainCtx, cancel := context.WithCancel(context.Background())
 
 	go func() {
@@ -58,21 +47,84 @@ func main() {
 		cancel()
 	}()
 
+	ipmanager.SetLogger(conf.Logger)
+
+	// The DCS settings are the same for every virtual IP, so the VIPs
+	// following the same trigger key share one leader checker, whose
+	// state is fanned out to their managers.
+	type trigger struct{ key, value string }
+	checkers := map[trigger]checker.LeaderChecker{}
+	followers := map[trigger][]chan bool{}
+
 	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		err := lc.GetChangeNotificationStream(mainCtx, states)
-		if err != nil && err != context.Canceled {
-			log.Fatal("Leader checker returned the following error: %s", zap.Error(err))
+	for _, vipConf := range conf.VIPConfigs() {
+		t := trigger{vipConf.TriggerKey, vipConf.TriggerValue}
+		if _, ok := checkers[t]; !ok {
+			lc, err := checker.NewLeaderChecker(vipConf)
+			if err != nil {
+				log.Fatalf("Failed to initialize leader checker for %s: %s", vipConf.TriggerKey, err)
+			}
+			checkers[t] = lc
 		}
-		wg.Done()
-	}()
 
-	wg.Add(1)
-	go func() {
-		manager.SyncStates(mainCtx, states)
-		wg.Done()
-	}()
+		// the latest state is all a manager needs, see fanOut
+		states := make(chan bool, 1)
+		manager, err := ipmanager.NewIPManager(vipConf, states)
+		if err != nil {
+			log.Fatalf("Problems with generating the virtual ip manager for %s: %s", vipConf.IP, err)
+		}
+		followers[t] = append(followers[t], states)
+
+		wg.Add(1)
+		go func() {
+			manager.SyncStates(mainCtx, states)
+			wg.Done()
+		}()
+	}
+
+	for t, lc := range checkers {
+		states := make(chan bool)
+		wg.Add(1)
+		go func() {
+			fanOut(mainCtx, states, followers[t])
+			wg.Done()
+		}()
+
+		wg.Add(1)
+		go func() {
+			err := lc.GetChangeNotificationStream(mainCtx, states)
+			if err != nil && err != context.Canceled {
+				log.Fatal("Leader checker returned the following error: %s", zap.Error(err))
+			}
+			wg.Done()
+		}()
+	}
 
 	wg.Wait()
 }
+
+// fanOut passes every state received from in on to all of out until ctx is
+// done. A manager still busy with an earlier state must not hold up the
+// others, so a state it didn't pick up yet is replaced by the newer one.
+func fanOut(ctx context.Context, in <-chan bool, out []chan bool) {
+	for {
+		select {
+		case state := <-in:
+			for _, ch := range out {
+				select {
+				case ch <- state:
+				default:
+					// we are the only sender, so after taking the stale
+					// state out there is room for the new one
+					select {
+					case <-ch:
+					default:
+					}
+					ch <- state
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
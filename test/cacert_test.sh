@@ -70,7 +70,7 @@ echo $! > .ncatPid
 etcdctl --cacert test/certs/etcd_server_ca.crt del service/pgcluster/leader || true
 
 touch .failed
-./vip-manager --etcd-ca-file test/certs/etcd_server_ca.crt --dcs-endpoints https://127.0.0.1:2379 --interface $dev --ip $vip --netmask 32 --trigger-key service/pgcluster/leader --trigger-value $HOSTNAME &> vip-manager.log &
+./vip-manager --dcs-type etcd3 --etcd-ca-file test/certs/etcd_server_ca.crt --dcs-endpoints https://127.0.0.1:2379 --interface $dev --ip $vip --netmask 32 --trigger-key service/pgcluster/leader --trigger-value $HOSTNAME &> vip-manager.log &
 echo $! > .vipPid
 sleep 2
 
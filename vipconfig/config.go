@@ -1,9 +1,11 @@
 package vipconfig
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"sort"
 	"strings"
 
@@ -35,16 +37,186 @@ type Config struct {
 
 	ConsulToken string `mapstructure:"consul-token"`
 
+	PatroniUser     string `mapstructure:"patroni-user"`
+	PatroniPassword string `mapstructure:"patroni-password"`
+	PatroniCAFile   string `mapstructure:"patroni-ca-file"`
+	PatroniCertFile string `mapstructure:"patroni-cert-file"`
+	PatroniKeyFile  string `mapstructure:"patroni-key-file"`
+	PatroniJSON     bool   `mapstructure:"patroni-json"`
+	PatroniRole     string `mapstructure:"patroni-role"`
+	PatroniCluster  bool   `mapstructure:"patroni-cluster"`
+
+	ZooKeeperUser     string `mapstructure:"zookeeper-user"`
+	ZooKeeperPassword string `mapstructure:"zookeeper-password"`
+	ZooKeeperCAFile   string `mapstructure:"zookeeper-ca-file"`
+	ZooKeeperCertFile string `mapstructure:"zookeeper-cert-file"`
+	ZooKeeperKeyFile  string `mapstructure:"zookeeper-key-file"`
+
 	Interval int `mapstructure:"interval"` //milliseconds
 
 	RetryAfter int `mapstructure:"retry-after"` //milliseconds
 	RetryNum   int `mapstructure:"retry-num"`
 
+	ARPCount           int    `mapstructure:"arp-count"`
+	ARPInterval        int    `mapstructure:"arp-interval"` //milliseconds
+	ARPMode            string `mapstructure:"arp-mode"`
+	ARPRefreshInterval int    `mapstructure:"arp-refresh-interval"` //milliseconds
+
+	AddressProbe        bool `mapstructure:"address-probe"`
+	AddressProbeCount   int  `mapstructure:"address-probe-count"`
+	AddressProbeTimeout int  `mapstructure:"address-probe-timeout"` //milliseconds
+
+	PreUp       string `mapstructure:"pre-up"`
+	PostUp      string `mapstructure:"post-up"`
+	PreDown     string `mapstructure:"pre-down"`
+	PostDown    string `mapstructure:"post-down"`
+	PreUpVeto   bool   `mapstructure:"pre-up-veto"`
+	HookTimeout int    `mapstructure:"hook-timeout"` //milliseconds
+
+	HetznerRobotEndpoint    string `mapstructure:"hetzner-robot-endpoint"`
+	HetznerFailoverNet      string `mapstructure:"hetzner-failover-net"`
+	HetznerVSwitchInterface string `mapstructure:"hetzner-vswitch-interface"`
+
+	HetznerCloudToken            string `mapstructure:"hetzner-cloud-token"`
+	HetznerCloudTokenFile        string `mapstructure:"hetzner-cloud-token-file"`
+	HetznerCloudNetwork          int    `mapstructure:"hetzner-cloud-network"`
+	HetznerCloudEndpoint         string `mapstructure:"hetzner-cloud-endpoint"`
+	HetznerCloudMetadataEndpoint string `mapstructure:"hetzner-cloud-metadata-endpoint"`
+
+	AWSRegion                string `mapstructure:"aws-region"`
+	AWSElasticIPAllocationID string `mapstructure:"aws-eip-allocation-id"`
+	AWSEC2Endpoint           string `mapstructure:"aws-ec2-endpoint"`
+	AWSIMDSEndpoint          string `mapstructure:"aws-imds-endpoint"`
+
+	GCPMode             string `mapstructure:"gcp-mode"`
+	GCPNetworkInterface string `mapstructure:"gcp-network-interface"`
+	GCPRouteName        string `mapstructure:"gcp-route-name"`
+	GCPComputeEndpoint  string `mapstructure:"gcp-compute-endpoint"`
+	GCPMetadataEndpoint string `mapstructure:"gcp-metadata-endpoint"`
+
+	AzureClientID            string `mapstructure:"azure-client-id"`
+	AzureIPConfigurationName string `mapstructure:"azure-ip-configuration-name"`
+	AzureARMEndpoint         string `mapstructure:"azure-arm-endpoint"`
+	AzureIMDSEndpoint        string `mapstructure:"azure-imds-endpoint"`
+
+	OpenStackMode                        string `mapstructure:"openstack-mode"`
+	OpenStackCloud                       string `mapstructure:"openstack-cloud"`
+	OpenStackCloudsFile                  string `mapstructure:"openstack-clouds-file"`
+	OpenStackAuthURL                     string `mapstructure:"openstack-auth-url"`
+	OpenStackApplicationCredentialID     string `mapstructure:"openstack-application-credential-id"`
+	OpenStackApplicationCredentialSecret string `mapstructure:"openstack-application-credential-secret"`
+	OpenStackRegion                      string `mapstructure:"openstack-region"`
+
+	DigitalOceanTokenFile        string `mapstructure:"digitalocean-token-file"`
+	DigitalOceanEndpoint         string `mapstructure:"digitalocean-endpoint"`
+	DigitalOceanMetadataEndpoint string `mapstructure:"digitalocean-metadata-endpoint"`
+
+	OVHCredentialsFile string `mapstructure:"ovh-credentials-file"`
+	OVHEndpoint        string `mapstructure:"ovh-endpoint"`
+	OVHServiceName     string `mapstructure:"ovh-service-name"`
+	OVHIPBlock         string `mapstructure:"ovh-ip-block"`
+
+	BGPLocalAS     int      `mapstructure:"bgp-local-as"`
+	BGPPeerAS      int      `mapstructure:"bgp-peer-as"`
+	BGPRouterID    string   `mapstructure:"bgp-router-id"`
+	BGPNeighbors   []string `mapstructure:"bgp-neighbors"`
+	BGPHoldTime    int      `mapstructure:"bgp-hold-time"` //seconds
+	BGPNextHop     string   `mapstructure:"bgp-next-hop"`
+	BGPMED         int      `mapstructure:"bgp-med"`
+	BGPCommunities []string `mapstructure:"bgp-communities"`
+
+	DNSServer         string `mapstructure:"dns-server"`
+	DNSZone           string `mapstructure:"dns-zone"`
+	DNSName           string `mapstructure:"dns-name"`
+	DNSTTL            int    `mapstructure:"dns-ttl"` //seconds
+	DNSTSIGKeyName    string `mapstructure:"dns-tsig-key-name"`
+	DNSTSIGAlgorithm  string `mapstructure:"dns-tsig-algorithm"`
+	DNSTSIGSecret     string `mapstructure:"dns-tsig-secret"`
+	DNSTSIGSecretFile string `mapstructure:"dns-tsig-secret-file"`
+
+	KubernetesKubeconfig string `mapstructure:"kubernetes-kubeconfig"`
+	KubernetesContext    string `mapstructure:"kubernetes-context"`
+	KubernetesNamespace  string `mapstructure:"kubernetes-namespace"`
+	KubernetesService    string `mapstructure:"kubernetes-service"`
+	KubernetesPod        string `mapstructure:"kubernetes-pod"`
+	KubernetesPodLabel   string `mapstructure:"kubernetes-pod-label"`
+
+	ExecUp      string `mapstructure:"exec-up"`
+	ExecDown    string `mapstructure:"exec-down"`
+	ExecStatus  string `mapstructure:"exec-status"`
+	ExecTimeout int    `mapstructure:"exec-timeout"` //milliseconds
+
 	Verbose bool `mapstructure:"verbose"`
 
+	VIPs []VIPConfig `mapstructure:"vips"`
+
 	Logger *zap.Logger
 }
 
+// VIPConfig describes one entry of the vips list, used to manage several
+// virtual IPs from a single vip-manager process. Settings left empty
+// are taken from the top level of the configuration.
+type VIPConfig struct {
+	IP    string `mapstructure:"ip"`
+	Mask  int    `mapstructure:"netmask"`
+	Iface string `mapstructure:"interface"`
+
+	HostingType string `mapstructure:"manager-type"`
+
+	TriggerKey   string `mapstructure:"trigger-key"`
+	TriggerValue string `mapstructure:"trigger-value"`
+}
+
+// VIPConfigs returns one Config per virtual IP to manage. Without a vips
+// list this is the Config itself, otherwise every entry is applied on top
+// of a copy of the global settings.
+func (conf *Config) VIPConfigs() []*Config {
+	if len(conf.VIPs) == 0 {
+		return []*Config{conf}
+	}
+	confs := make([]*Config, 0, len(conf.VIPs))
+	for _, vip := range conf.VIPs {
+		c := *conf
+		c.VIPs = nil
+		c.IP = vip.IP
+		c.Mask = cmp.Or(vip.Mask, conf.Mask)
+		c.Iface = cmp.Or(vip.Iface, conf.Iface)
+		c.HostingType = cmp.Or(vip.HostingType, conf.HostingType)
+		c.TriggerKey = cmp.Or(vip.TriggerKey, conf.TriggerKey)
+		c.TriggerValue = cmp.Or(vip.TriggerValue, conf.TriggerValue)
+		confs = append(confs, &c)
+	}
+	return confs
+}
+
+// checkVIPs makes sure that every entry of the vips list, combined with
+// the global settings, describes a complete virtual IP
+func (conf *Config) checkVIPs() error {
+	success := true
+	seen := map[string]bool{}
+	for i, c := range conf.VIPConfigs() {
+		for _, setting := range [][2]string{
+			{"ip", c.IP},
+			{"interface", c.Iface},
+			{"trigger-key", c.TriggerKey},
+		} {
+			if setting[1] == "" {
+				fmt.Printf("Setting %s is mandatory for entry %d of vips", setting[0], i)
+				success = false
+			}
+		}
+		if c.IP != "" && seen[c.IP] {
+			fmt.Printf("Address %s is listed more than once in vips", c.IP)
+			success = false
+		}
+		seen[c.IP] = true
+	}
+	if !success {
+		return errors.New("one or more vips entries are incomplete")
+	}
+	return nil
+}
+
 func defineFlags() *pflag.FlagSet {
 	// When adding new flags here, consider adding them to the Config struct above
 	// and then make sure to insert them into the conf instance in NewConfig down below.
@@ -54,15 +226,15 @@ func defineFlags() *pflag.FlagSet {
 	flags.Bool("version", false, "Show the version number.")
 
 	flags.String("ip", "", "Virtual IP address to configure.")
-	flags.String("netmask", "", "The netmask used for the IP address. Defaults to -1 which assigns ipv4 default mask.")
+	flags.String("netmask", "", "The netmask used for the IP address. Defaults to -1 which assigns ipv4 default mask, or /64 for ipv6.")
 	flags.String("interface", "", "Network interface to configure on .")
 
 	flags.String("trigger-key", "", "Key in the DCS to monitor, e.g. \"/service/batman/leader\".")
 	flags.String("trigger-value", "", "Value to monitor for.")
 
-	flags.String("dcs-type", "etcd", "Type of endpoint used for key storage. Supported values: etcd, consul, patroni.")
+	flags.String("dcs-type", "etcd", "Type of endpoint used for key storage. Supported values: etcd (v2 API), etcd3, consul, patroni, zookeeper, kubernetes.")
 	// note: can't put a default value into dcs-endpoints as that would mess with applying default localhost when using consul
-	flags.String("dcs-endpoints", "", "DCS endpoint(s), separate multiple endpoints using commas. (default \"http://127.0.0.1:2379\", \"http://127.0.0.1:8500\" or \"http://127.0.0.1:8008/\" depending on dcs-type.)")
+	flags.String("dcs-endpoints", "", "DCS endpoint(s), separate multiple endpoints using commas. (default \"http://127.0.0.1:2379\", \"http://127.0.0.1:8500\", \"http://127.0.0.1:8008/\" or \"127.0.0.1:2181\" depending on dcs-type.)")
 	flags.String("etcd-user", "", "Username for etcd DCS endpoints.")
 	flags.String("etcd-password", "", "Password for etcd DCS endpoints.")
 	flags.String("etcd-ca-file", "", "Trusted CA certificate for the etcd server.")
@@ -71,12 +243,116 @@ func defineFlags() *pflag.FlagSet {
 
 	flags.String("consul-token", "", "Token for consul DCS endpoints.")
 
+	flags.String("patroni-user", "", "Username for basic authentication with the Patroni REST API.")
+	flags.String("patroni-password", "", "Password for basic authentication with the Patroni REST API.")
+	flags.String("patroni-ca-file", "", "Trusted CA certificate for the Patroni REST API. Defaults to etcd-ca-file.")
+	flags.String("patroni-cert-file", "", "Client certificate used for authentication with the Patroni REST API.")
+	flags.String("patroni-key-file", "", "Private key matching patroni-cert-file.")
+	flags.Bool("patroni-json", false, "Check the JSON status document returned for trigger-key (e.g. /patroni) instead of the status code, trigger-value is the member name then.")
+	flags.Bool("patroni-cluster", false, "Ask every endpoint in dcs-endpoints for the leader (trigger-key /cluster) and hold the VIP while a majority agrees it is the member named in trigger-value.")
+	flags.String("patroni-role", "primary", "Role the member must have to hold the VIP with patroni-json, e.g. primary or standby_leader.")
+
+	flags.String("zookeeper-user", "", "Username for digest authentication with zookeeper DCS endpoints.")
+	flags.String("zookeeper-password", "", "Password for digest authentication with zookeeper DCS endpoints.")
+	flags.String("zookeeper-ca-file", "", "Trusted CA certificate for the zookeeper server, enables TLS.")
+	flags.String("zookeeper-cert-file", "", "Client certificate used for authentication with zookeeper.")
+	flags.String("zookeeper-key-file", "", "Private key matching zookeeper-cert-file.")
+
 	flags.Int("interval", 1000, "DCS scan interval in milliseconds.")
-	flags.String("manager-type", "basic", "Type of VIP-management to be used. Supported values: basic, hetzner.")
+	flags.String("manager-type", "basic", "Type of VIP-management to be used. Supported values: basic, hetzner, hetzner-cloud, aws, gcp, azure, openstack, digitalocean, ovh, bgp, dns, kubernetes, exec.")
 
 	flags.Int("retry-after", 250, "Time to wait before retrying interactions with outside components in milliseconds.")
 	flags.Int("retry-num", 3, "Number of times interactions with outside components are retried.")
 
+	flags.Int("arp-count", 1, "Number of gratuitous ARP (or IPv6 neighbor advertisement) announcements sent after the VIP was added.")
+	flags.Int("arp-interval", 1000, "Time between two announcements in milliseconds.")
+	flags.String("arp-mode", "reply", "Type of gratuitous ARP packets to send. Supported values: request, reply, both.")
+	flags.Int("arp-refresh-interval", 0, "Repeat the announcements in this interval (in milliseconds) while the VIP is held. 0 disables the refresh.")
+
+	flags.Bool("address-probe", false, "Probe for other hosts using the VIP (ARP probe or IPv6 DAD) before adding it.")
+	flags.Int("address-probe-count", 3, "Number of probes sent before the VIP is considered unused.")
+	flags.Int("address-probe-timeout", 500, "Time to wait for an answer after each probe in milliseconds.")
+
+	flags.String("pre-up", "", "Command run before the VIP is configured.")
+	flags.String("post-up", "", "Command run after the VIP was configured.")
+	flags.String("pre-down", "", "Command run before the VIP is deconfigured.")
+	flags.String("post-down", "", "Command run after the VIP was deconfigured.")
+	flags.Bool("pre-up-veto", false, "Don't configure the VIP if pre-up fails.")
+	flags.Int("hook-timeout", 10000, "Time after which the hook commands are killed (in milliseconds).")
+
+	flags.String("hetzner-robot-endpoint", "https://robot-ws.your-server.de", "URL of the Hetzner Robot webservice, used by manager-type=hetzner.")
+	flags.String("hetzner-failover-net", "", "Failover net containing the VIP, e.g. 2001:db8::/64. Defaults to the VIP itself for IPv4 and its /64 for IPv6.")
+	flags.String("hetzner-vswitch-interface", "", "VLAN interface of a vSwitch to add the VIP on after it was routed to this server.")
+
+	flags.String("hetzner-cloud-token", "", "Hetzner Cloud API token. Defaults to the content of hetzner-cloud-token-file or the HCLOUD_TOKEN environment variable.")
+	flags.String("hetzner-cloud-token-file", "", "File containing the Hetzner Cloud API token.")
+	flags.Int("hetzner-cloud-network", 0, "ID of the Hetzner Cloud network to manage the VIP as alias IP in. If not set, the VIP is a Floating IP.")
+	flags.String("hetzner-cloud-endpoint", "https://api.hetzner.cloud/v1", "URL of the Hetzner Cloud API.")
+	flags.String("hetzner-cloud-metadata-endpoint", "http://169.254.169.254/hetzner/v1/metadata", "URL of the Hetzner Cloud metadata service.")
+
+	flags.String("aws-region", "", "AWS region of this instance. Defaults to the region reported by the instance metadata service.")
+	flags.String("aws-eip-allocation-id", "", "Allocation ID of an Elastic IP to associate with the VIP, used by manager-type=aws.")
+	flags.String("aws-ec2-endpoint", "", "URL of the EC2 API. Defaults to the regional endpoint.")
+	flags.String("aws-imds-endpoint", "http://169.254.169.254", "URL of the EC2 instance metadata service.")
+
+	flags.String("gcp-mode", "alias", "How manager-type=gcp moves the VIP. Supported values: alias, route.")
+	flags.String("gcp-network-interface", "nic0", "Name of the network interface of the instance that gets the alias IP range.")
+	flags.String("gcp-route-name", "", "Name of the route to the VIP. Defaults to vip-manager-<ip>.")
+	flags.String("gcp-compute-endpoint", "https://compute.googleapis.com/compute/v1", "URL of the Compute Engine API.")
+	flags.String("gcp-metadata-endpoint", "http://metadata.google.internal/computeMetadata/v1", "URL of the GCE metadata server.")
+
+	flags.String("azure-client-id", "", "Client ID of the user-assigned managed identity to use. Defaults to the system-assigned identity.")
+	flags.String("azure-ip-configuration-name", "vip-manager", "Name of the IP configuration holding the VIP on the network interface.")
+	flags.String("azure-arm-endpoint", "https://management.azure.com", "URL of the Azure Resource Manager API.")
+	flags.String("azure-imds-endpoint", "http://169.254.169.254/metadata", "URL of the Azure instance metadata service.")
+
+	flags.String("openstack-mode", "allowed-address-pairs", "How manager-type=openstack moves the VIP. Supported values: allowed-address-pairs, floating-ip.")
+	flags.String("openstack-cloud", "", "Name of the cloud in clouds.yaml. Defaults to the OS_CLOUD environment variable.")
+	flags.String("openstack-clouds-file", "", "Path of clouds.yaml. Defaults to the standard locations.")
+	flags.String("openstack-auth-url", "", "Keystone URL, used with application credentials instead of clouds.yaml.")
+	flags.String("openstack-application-credential-id", "", "ID of the application credential, used instead of clouds.yaml.")
+	flags.String("openstack-application-credential-secret", "", "Secret of the application credential. Defaults to the OS_APPLICATION_CREDENTIAL_SECRET environment variable.")
+	flags.String("openstack-region", "", "Region of the network endpoint. Defaults to region_name of the cloud in clouds.yaml.")
+
+	flags.String("digitalocean-token-file", "", "File containing the DigitalOcean API token. Defaults to the DIGITALOCEAN_TOKEN environment variable.")
+	flags.String("digitalocean-endpoint", "https://api.digitalocean.com/v2", "URL of the DigitalOcean API.")
+	flags.String("digitalocean-metadata-endpoint", "http://169.254.169.254/metadata/v1", "URL of the droplet metadata service.")
+
+	flags.String("ovh-credentials-file", "/etc/ovh.conf", "File containing the application key, application secret and consumer key for the OVHcloud API.")
+	flags.String("ovh-endpoint", "https://eu.api.ovh.com/1.0", "URL of the OVHcloud API.")
+	flags.String("ovh-service-name", "", "Service name of this dedicated server, e.g. ns3000000.ip-1-2-3.eu. Mandatory for manager-type ovh.")
+	flags.String("ovh-ip-block", "", "The additional IP block to move, e.g. 192.0.2.8/29. Defaults to the VIP.")
+
+	flags.Int("bgp-local-as", 0, "AS number of this machine, used by manager-type=bgp.")
+	flags.Int("bgp-peer-as", 0, "AS number of the BGP neighbors. Defaults to bgp-local-as.")
+	flags.String("bgp-router-id", "", "BGP router ID. Defaults to the local IPv4 address of each session.")
+	flags.String("bgp-neighbors", "", "BGP neighbors to announce the VIP to, separate multiple neighbors using commas, e.g. 10.0.0.1,[2001:db8::1]:179.")
+	flags.Int("bgp-hold-time", 90, "BGP hold time in seconds, 0 disables keepalives.")
+	flags.String("bgp-next-hop", "", "Next hop of the announced route. Defaults to the local address of each session.")
+	flags.Int("bgp-med", 0, "Multi-exit discriminator of the announced route.")
+	flags.String("bgp-communities", "", "Communities attached to the announced route, separate multiple communities using commas, e.g. 65000:100,no-export.")
+
+	flags.String("dns-server", "", "Primary DNS server accepting dynamic updates for dns-name, used by manager-type=dns.")
+	flags.String("dns-zone", "", "Zone containing dns-name. Defaults to the parent domain of dns-name.")
+	flags.String("dns-name", "", "Name whose A or AAAA record is pointed to this node.")
+	flags.Int("dns-ttl", 30, "TTL of the record in seconds.")
+	flags.String("dns-tsig-key-name", "", "Name of the TSIG key to sign the updates with.")
+	flags.String("dns-tsig-algorithm", "hmac-sha256", "Algorithm of the TSIG key. Supported values: hmac-sha1, hmac-sha224, hmac-sha256, hmac-sha384, hmac-sha512.")
+	flags.String("dns-tsig-secret", "", "Base64 encoded secret of the TSIG key. Defaults to the content of dns-tsig-secret-file.")
+	flags.String("dns-tsig-secret-file", "", "File containing the base64 encoded secret of the TSIG key.")
+
+	flags.String("kubernetes-kubeconfig", "", "Kubeconfig file used by manager-type=kubernetes and dcs-type=kubernetes. Defaults to the service account when running in a pod, else to $KUBECONFIG or ~/.kube/config.")
+	flags.String("kubernetes-context", "", "Context of the kubeconfig file. Defaults to its current context.")
+	flags.String("kubernetes-namespace", "", "Namespace of the Service, pod or leader object. Defaults to the namespace of the context or service account.")
+	flags.String("kubernetes-service", "", "Selector-less Service whose EndpointSlice is pointed to ip.")
+	flags.String("kubernetes-pod", "", "Pod of this node to set kubernetes-pod-label on. Defaults to the hostname.")
+	flags.String("kubernetes-pod-label", "", "Label set on the pod of the leader, as key=value.")
+
+	flags.String("exec-up", "", "Command configuring the VIP, used by manager-type=exec.")
+	flags.String("exec-down", "", "Command deconfiguring the VIP.")
+	flags.String("exec-status", "", "Command telling whether the VIP is configured, with exit code 0 if it is and 1 if it isn't.")
+	flags.Int("exec-timeout", 10000, "Time after which the exec commands are killed (in milliseconds).")
+
 	flags.Bool("verbose", false, "Be verbose. Currently only implemented for manager-type=hetzner .")
 
 	flags.SortFlags = false
@@ -87,9 +363,22 @@ func setDefaults(v *viper.Viper) {
 	defaults := map[string]any{
 		"manager-type": "basic",
 		"dcs-type":     "etcd",
+		"patroni-role": "primary",
 		"interval":     1000,
 		"retry-after":  250,
 		"retry-num":    3,
+		"arp-count":    1,
+		"arp-interval": 1000,
+		"arp-mode":     "reply",
+
+		"address-probe-count":   3,
+		"address-probe-timeout": 500,
+
+		"hook-timeout": 10000,
+
+		"bgp-hold-time": 90,
+		"dns-ttl":       30,
+		"exec-timeout":  10000,
 	}
 
 	for k, val := range defaults {
@@ -98,8 +387,9 @@ func setDefaults(v *viper.Viper) {
 		}
 	}
 
-	// apply defaults for endpoints
-	if !v.IsSet("dcs-endpoints") {
+	// apply defaults for endpoints, kubernetes reaches the API server
+	// through the service account or kubeconfig instead
+	if !v.IsSet("dcs-endpoints") && v.GetString("dcs-type") != "kubernetes" {
 		fmt.Println("No dcs-endpoints specified, trying to use localhost with standard ports!")
 		switch v.GetString("dcs-type") {
 		case "consul":
@@ -108,18 +398,29 @@ func setDefaults(v *viper.Viper) {
 			v.Set("dcs-endpoints", []string{"http://127.0.0.1:2379"})
 		case "patroni":
 			v.Set("dcs-endpoints", []string{"http://127.0.0.1:8008/"})
+		case "zookeeper":
+			v.Set("dcs-endpoints", []string{"127.0.0.1:2181"})
 		}
 	}
 
-	// set trigger-key to '/leader' if DCS type is patroni and nothing is specified
+	// set trigger-key to '/leader', '/patroni' for the status document or
+	// '/cluster' for the cluster document, if DCS type is patroni and
+	// nothing is specified
 	if v.GetString("trigger-key") == "" && v.GetString("dcs-type") == "patroni" {
-		v.Set("trigger-key", "/leader")
+		switch {
+		case v.GetBool("patroni-json"):
+			v.Set("trigger-key", "/patroni")
+		case v.GetBool("patroni-cluster"):
+			v.Set("trigger-key", "/cluster")
+		default:
+			v.Set("trigger-key", "/leader")
+		}
 	}
 
 	// set trigger-value to default value if nothing is specified
 	if triggerValue := v.GetString("trigger-value"); triggerValue == "" {
 		var err error
-		if v.GetString("dcs-type") == "patroni" {
+		if v.GetString("dcs-type") == "patroni" && !v.GetBool("patroni-json") && !v.GetBool("patroni-cluster") {
 			triggerValue = "200"
 		} else {
 			triggerValue, err = os.Hostname()
@@ -155,6 +456,17 @@ func checkMandatory(v *viper.Viper) error {
 		"trigger-value",
 		"dcs-endpoints",
 	}
+	if v.IsSet("vips") {
+		// the per-VIP settings are checked for every entry once the
+		// config is decoded, see checkVIPs
+		mandatory = []string{
+			"trigger-value",
+			"dcs-endpoints",
+		}
+	}
+	if v.GetString("dcs-type") == "kubernetes" {
+		mandatory = slices.DeleteFunc(mandatory, func(name string) bool { return name == "dcs-endpoints" })
+	}
 	success := true
 	for _, name := range mandatory {
 		success = checkSetting(v, name) && success
@@ -178,9 +490,15 @@ func checkImpliedSetting(v *viper.Viper, implied string, reason string) bool {
 func checkImpliedMandatory(v *viper.Viper) error {
 	mandatory := map[string]string{
 		// "implied" : "reason"
-		"etcd-user":     "etcd-password",
-		"etcd-key-file": "etcd-cert-file",
-		"etcd-ca-file":  "etcd-cert-file",
+		"etcd-user":          "etcd-password",
+		"etcd-key-file":      "etcd-cert-file",
+		"etcd-ca-file":       "etcd-cert-file",
+		"patroni-user":       "patroni-password",
+		"patroni-key-file":   "patroni-cert-file",
+		"patroni-ca-file":    "patroni-cert-file",
+		"zookeeper-user":     "zookeeper-password",
+		"zookeeper-key-file": "zookeeper-cert-file",
+		"zookeeper-ca-file":  "zookeeper-cert-file",
 	}
 	success := true
 	for k, reason := range mandatory {
@@ -198,9 +516,7 @@ func printSettings(v *viper.Viper) {
 	for k, val := range v.AllSettings() {
 		if val != "" {
 			switch k {
-			case "etcd-password":
-				fallthrough
-			case "consul-token":
+			case "etcd-password", "consul-token", "patroni-password", "zookeeper-password", "hetzner-cloud-token", "openstack-application-credential-secret", "dns-tsig-secret":
 				s = append(s, fmt.Sprintf("\t%s : *****\n", k))
 			default:
 				s = append(s, fmt.Sprintf("\t%s : %v\n", k, val))
@@ -265,8 +581,10 @@ func newConfig(args []string) (*Config, error) {
 	}
 
 	// convert string of csv to String Slice
-	if endpointsString := v.GetString("dcs-endpoints"); endpointsString != "" && strings.Contains(endpointsString, ",") {
-		v.Set("dcs-endpoints", strings.Split(endpointsString, ","))
+	for _, key := range []string{"dcs-endpoints", "bgp-neighbors", "bgp-communities"} {
+		if csv := v.GetString(key); csv != "" && strings.Contains(csv, ",") {
+			v.Set(key, strings.Split(csv, ","))
+		}
 	}
 	setDefaults(v)
 	if err = checkMandatory(v); err != nil {
@@ -277,6 +595,9 @@ func newConfig(args []string) (*Config, error) {
 	if err = v.Unmarshal(conf); err != nil {
 		zap.L().Fatal("unable to decode viper config into config struct, %v", zap.Error(err))
 	}
+	if err = conf.checkVIPs(); err != nil {
+		return nil, err
+	}
 
 	conf.initLogger()
 	printSettings(v)
@@ -198,6 +198,17 @@ func TestSetDefaults_EndpointsDefaultPatroni(t *testing.T) {
 	}
 }
 
+func TestSetDefaults_EndpointsDefaultZooKeeper(t *testing.T) {
+	v := viper.New()
+	v.Set("dcs-type", "zookeeper")
+	v.Set("trigger-value", "host1")
+	setDefaults(v)
+	endpoints := v.GetStringSlice("dcs-endpoints")
+	if len(endpoints) == 0 || endpoints[0] != "127.0.0.1:2181" {
+		t.Errorf("expected zookeeper default endpoint, got %v", endpoints)
+	}
+}
+
 func TestSetDefaults_PatroniTriggerKeyDefault(t *testing.T) {
 	v := viper.New()
 	v.Set("dcs-type", "patroni")
@@ -217,6 +228,37 @@ func TestSetDefaults_PatroniTriggerValueDefault(t *testing.T) {
 	}
 }
 
+func TestSetDefaults_PatroniJSONDefaults(t *testing.T) {
+	v := viper.New()
+	v.Set("dcs-type", "patroni")
+	v.Set("patroni-json", true)
+	setDefaults(v)
+	if got := v.GetString("trigger-key"); got != "/patroni" {
+		t.Errorf("expected trigger-key=/patroni for patroni-json, got %q", got)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skip("cannot determine hostname")
+	}
+	if got := v.GetString("trigger-value"); got != hostname {
+		t.Errorf("expected trigger-value=%q (hostname) for patroni-json, got %q", hostname, got)
+	}
+	if got := v.GetString("patroni-role"); got != "primary" {
+		t.Errorf("expected patroni-role=primary, got %q", got)
+	}
+}
+
+func TestSetDefaults_PatroniClusterTriggerKeyDefault(t *testing.T) {
+	v := viper.New()
+	v.Set("dcs-type", "patroni")
+	v.Set("patroni-cluster", true)
+	v.Set("trigger-value", "host1")
+	setDefaults(v)
+	if got := v.GetString("trigger-key"); got != "/cluster" {
+		t.Errorf("expected trigger-key=/cluster for patroni-cluster, got %q", got)
+	}
+}
+
 func TestSetDefaults_TriggerValueFallsBackToHostname(t *testing.T) {
 	v := viper.New()
 	// dcs-type will default to etcd; no trigger-value set
@@ -506,6 +548,34 @@ func TestNewConfig_FlagOverridesFile(t *testing.T) {
 	}
 }
 
+// TestNewConfig_KubernetesDCS loads the example of the README, which has no
+// dcs-endpoints as they aren't used for dcs-type kubernetes
+func TestNewConfig_KubernetesDCS(t *testing.T) {
+	content := `
+ip: 10.0.0.1
+netmask: 24
+interface: eth0
+dcs-type: kubernetes
+trigger-key: configmaps/pgcluster-leader
+trigger-value: pgcluster-0 # defaults to the hostname, which is the name of the pod
+kubernetes-namespace: db
+`
+	path := filepath.Join(t.TempDir(), "vip-manager.yml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := newConfig([]string{fmt.Sprintf("--config=%s", path)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if conf.EndpointType != "kubernetes" || conf.TriggerKey != "configmaps/pgcluster-leader" || conf.KubernetesNamespace != "db" {
+		t.Errorf("got dcs-type %q, trigger-key %q, namespace %q", conf.EndpointType, conf.TriggerKey, conf.KubernetesNamespace)
+	}
+	if len(conf.Endpoints) != 0 {
+		t.Errorf("expected no dcs-endpoints, got %v", conf.Endpoints)
+	}
+}
+
 func TestNewConfig_MissingMandatory(t *testing.T) {
 	// no config file, no flags → mandatory settings missing
 	_, err := newConfig([]string{})
@@ -535,6 +605,26 @@ func TestNewConfig_CSVEndpoints(t *testing.T) {
 	}
 }
 
+func TestNewConfig_BGPLists(t *testing.T) {
+	path := minimalConfigFile(t, "bgp-communities:\n  - 65000:100\n  - no-export")
+	conf, err := newConfig([]string{
+		fmt.Sprintf("--config=%s", path),
+		"--bgp-neighbors=10.0.0.254,[2001:db8::1]:179",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(conf.BGPNeighbors) != 2 || conf.BGPNeighbors[1] != "[2001:db8::1]:179" {
+		t.Errorf("BGPNeighbors: got %v", conf.BGPNeighbors)
+	}
+	if len(conf.BGPCommunities) != 2 || conf.BGPCommunities[1] != "no-export" {
+		t.Errorf("BGPCommunities: got %v", conf.BGPCommunities)
+	}
+	if conf.BGPHoldTime != 90 {
+		t.Errorf("BGPHoldTime: got %d, want 90", conf.BGPHoldTime)
+	}
+}
+
 func TestNewConfig_EnvVarOverride(t *testing.T) {
 	path := minimalConfigFile(t)
 	t.Setenv("VIP_TRIGGER_VALUE", "from-env")
@@ -578,3 +668,123 @@ func TestNewConfig_CreatesConfig(t *testing.T) {
 		t.Errorf("IP: got %q, want 10.0.0.1", conf.IP)
 	}
 }
+
+// ---------------------------------------------------------------------------
+// vips
+// ---------------------------------------------------------------------------
+
+// vipsConfigFile writes a config YAML with a vips list to a temp file and returns its path.
+func vipsConfigFile(t *testing.T, vips string) string {
+	t.Helper()
+	content := `
+netmask: 24
+interface: eth0
+trigger-value: host1
+dcs-type: etcd
+dcs-endpoints:
+  - http://127.0.0.1:2379
+vips:
+` + vips
+	path := filepath.Join(t.TempDir(), "vip-manager.yml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVIPConfigs_WithoutList(t *testing.T) {
+	conf := &Config{IP: "10.0.0.1", Iface: "eth0"}
+	confs := conf.VIPConfigs()
+	if len(confs) != 1 || confs[0] != conf {
+		t.Errorf("expected the config itself, got %v", confs)
+	}
+}
+
+func TestVIPConfigs_InheritsGlobalSettings(t *testing.T) {
+	conf := &Config{
+		Mask:         24,
+		Iface:        "eth0",
+		HostingType:  "basic",
+		TriggerValue: "host1",
+		Endpoints:    []string{"http://127.0.0.1:2379"},
+		VIPs: []VIPConfig{
+			{IP: "10.0.0.1", TriggerKey: "/service/a/leader"},
+			{IP: "10.0.1.1", Mask: 16, Iface: "eth1", HostingType: "hetzner", TriggerKey: "/service/b/leader", TriggerValue: "host2"},
+		},
+	}
+	confs := conf.VIPConfigs()
+	if len(confs) != 2 {
+		t.Fatalf("expected 2 configs, got %d", len(confs))
+	}
+
+	first := confs[0]
+	if first.IP != "10.0.0.1" || first.Mask != 24 || first.Iface != "eth0" ||
+		first.HostingType != "basic" || first.TriggerKey != "/service/a/leader" || first.TriggerValue != "host1" {
+		t.Errorf("unexpected first config: %+v", first)
+	}
+	second := confs[1]
+	if second.IP != "10.0.1.1" || second.Mask != 16 || second.Iface != "eth1" ||
+		second.HostingType != "hetzner" || second.TriggerKey != "/service/b/leader" || second.TriggerValue != "host2" {
+		t.Errorf("unexpected second config: %+v", second)
+	}
+	for _, c := range confs {
+		if c.VIPs != nil {
+			t.Error("per-VIP configs should not carry the vips list")
+		}
+		if len(c.Endpoints) != 1 {
+			t.Error("per-VIP configs should keep the global DCS settings")
+		}
+	}
+	if conf.IP != "" || conf.Iface != "eth0" {
+		t.Error("VIPConfigs must not modify the global config")
+	}
+}
+
+func TestNewConfig_VIPList(t *testing.T) {
+	path := vipsConfigFile(t, `
+  - ip: 10.0.0.1
+    trigger-key: /service/a/leader
+  - ip: 10.0.1.1
+    netmask: 16
+    interface: eth1
+    trigger-key: /service/b/leader
+    trigger-value: host2
+`)
+	conf, err := newConfig([]string{fmt.Sprintf("--config=%s", path)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(conf.VIPs) != 2 {
+		t.Fatalf("expected 2 vips, got %d", len(conf.VIPs))
+	}
+	confs := conf.VIPConfigs()
+	if confs[0].IP != "10.0.0.1" || confs[0].Iface != "eth0" || confs[0].TriggerValue != "host1" {
+		t.Errorf("unexpected first config: %+v", confs[0])
+	}
+	if confs[1].IP != "10.0.1.1" || confs[1].Mask != 16 || confs[1].TriggerValue != "host2" {
+		t.Errorf("unexpected second config: %+v", confs[1])
+	}
+}
+
+func TestNewConfig_VIPListIncompleteEntry(t *testing.T) {
+	path := vipsConfigFile(t, `
+  - ip: 10.0.0.1
+`)
+	_, err := newConfig([]string{fmt.Sprintf("--config=%s", path)})
+	if err == nil {
+		t.Error("expected error for vips entry without trigger-key")
+	}
+}
+
+func TestNewConfig_VIPListDuplicateAddress(t *testing.T) {
+	path := vipsConfigFile(t, `
+  - ip: 10.0.0.1
+    trigger-key: /service/a/leader
+  - ip: 10.0.0.1
+    trigger-key: /service/b/leader
+`)
+	_, err := newConfig([]string{fmt.Sprintf("--config=%s", path)})
+	if err == nil {
+		t.Error("expected error for an address listed twice")
+	}
+}